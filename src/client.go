@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"etha-tunnel/client/forwarding/clienttcptunforward"
+	"etha-tunnel/client/forwarding/clientudptunforward"
 	"etha-tunnel/client/forwarding/ipconfiguration"
+	"etha-tunnel/handshake/ChaCha20"
 	"etha-tunnel/handshake/ChaCha20/handshakeHandlers"
 	"etha-tunnel/inputcommands"
 	"etha-tunnel/network"
+	"etha-tunnel/network/obfuscation"
+	"etha-tunnel/network/proxy"
+	"etha-tunnel/network/websocket"
 	"etha-tunnel/settings/client"
+	"fmt"
 	"log"
 	"net"
 	"sync"
@@ -29,19 +36,28 @@ func main() {
 	// Start a goroutine to listen for user input
 	go inputcommands.ListenForCommand(cancel)
 
-	// Client configuration (enabling TUN/TCP forwarding)
-	ipconfiguration.Unconfigure()
-	defer ipconfiguration.Unconfigure()
-	if err := ipconfiguration.Configure(); err != nil {
-		log.Fatalf("Failed to configure client: %v", err)
-	}
-
 	// Read client configuration
 	conf, err := (&client.Conf{}).Read()
 	if err != nil {
 		log.Fatalf("Failed to read configuration: %v", err)
 	}
 
+	// A new client enrolls with an invite code, the server returns the rest of its configuration in the handshake.
+	// The invite names the server and the interface is named by default, so it is done before the interface is configured.
+	if conf.InviteCode != "" {
+		err = conf.PrepareEnrollment()
+		if err != nil {
+			log.Fatalf("Failed to enroll with invite code: %v", err)
+		}
+	}
+
+	// Client configuration (enabling TUN/TCP forwarding)
+	ipconfiguration.Unconfigure(conf)
+	defer ipconfiguration.Unconfigure(conf)
+	if err := ipconfiguration.Configure(conf); err != nil {
+		log.Fatalf("Failed to configure client: %v", err)
+	}
+
 	// Open the TUN interface
 	tunFile, err := network.OpenTunByName(conf.IfName)
 	if err != nil {
@@ -49,19 +65,25 @@ func main() {
 	}
 	defer tunFile.Close()
 
+	// A ticket issued in a session resumes the next one after a reconnect
+	var ticket *ChaCha20.ResumptionTicket
 	for {
-		conn, connectionError := establishConnection(*conf, ctx)
+		conn, session, serverHello, connectionError := establishConnection(conf, ticket, ctx)
 		if connectionError != nil {
 			log.Fatalf("failed establish connection: %s", connectionError)
 		}
 
-		log.Printf("Connected to server at %s", conf.ServerTCPAddress)
-		session, err := handshakeHandlers.OnConnectedToServer(conn, conf)
+		log.Printf("Connected to server at %s (%s)", conf.ServerAddress(), conf.Transport)
+		if conf.Proxy != "" {
+			log.Printf("Connected through proxy %s", conf.DialAddress())
+		}
+
+		// Tunnel addresses are assigned by the server
+		err = ipconfiguration.AssignAddresses(conf.IfName, serverHello.IPv4, serverHello.IPv6)
 		if err != nil {
 			conn.Close()
-			ipconfiguration.Unconfigure()
-			log.Printf("registration failed: %s\n", err)
-			log.Fatalf("connection is aborted")
+			ipconfiguration.Unconfigure(conf)
+			log.Fatalf("failed to assign tunnel addresses: %s", err)
 		}
 
 		// Create a child context for managing data forwarding goroutines
@@ -76,17 +98,31 @@ func main() {
 			connCancel()
 		}()
 
-		// TUN -> TCP
-		go func() {
-			defer wg.Done()
-			clienttcptunforward.ToTCP(conn, tunFile, session, ctx)
-		}()
+		if conf.Transport == client.UDPTransport {
+			// TUN -> UDP
+			go func() {
+				defer wg.Done()
+				clientudptunforward.ToUDP(conn, tunFile, session, ctx)
+			}()
 
-		// TCP -> TUN
-		go func() {
-			defer wg.Done()
-			clienttcptunforward.ToTun(conn, tunFile, session, ctx)
-		}()
+			// UDP -> TUN
+			go func() {
+				defer wg.Done()
+				clientudptunforward.ToTun(conn, tunFile, session, ctx)
+			}()
+		} else {
+			// TUN -> TCP
+			go func() {
+				defer wg.Done()
+				clienttcptunforward.ToTCP(conn, tunFile, session, ctx)
+			}()
+
+			// TCP -> TUN
+			go func() {
+				defer wg.Done()
+				clienttcptunforward.ToTun(conn, tunFile, session, ctx)
+			}()
+		}
 
 		// Wait for goroutines to finish
 		wg.Wait()
@@ -100,33 +136,32 @@ func main() {
 			log.Println("Connection lost, attempting to reconnect...")
 		}
 
+		ticket = session.ResumptionTicket()
+
 		// Close the connection (if not already closed)
 		conn.Close()
 	}
 }
 
-func establishConnection(conf client.Conf, ctx context.Context) (net.Conn, error) {
+// establishConnection connects to the server and performs the handshake, a failed attempt is retried with backoff
+func establishConnection(conf *client.Conf, ticket *ChaCha20.ResumptionTicket, ctx context.Context) (net.Conn, *ChaCha20.Session, *ChaCha20.ServerHello, error) {
 	reconnectAttempts := 0
 	backoff := initialBackoff
 
 	for {
-		dialer := &net.Dialer{}
-		dialCtx, dialCancel := context.WithTimeout(ctx, connectionTimeout)
-		conn, err := dialer.DialContext(dialCtx, "tcp", conf.ServerTCPAddress)
-		dialCancel()
-
+		conn, session, serverHello, err := connectToServer(conf, ticket, ctx)
 		if err != nil {
 			log.Printf("Failed to connect to server: %v", err)
 			reconnectAttempts++
 			if reconnectAttempts > maxReconnectAttempts {
-				ipconfiguration.Unconfigure()
+				ipconfiguration.Unconfigure(conf)
 				log.Fatalf("Exceeded maximum reconnect attempts (%d)", maxReconnectAttempts)
 			}
 			log.Printf("Retrying to connect in %v...", backoff)
 			select {
 			case <-ctx.Done():
 				log.Println("Client is shutting down.")
-				return nil, err
+				return nil, nil, nil, err
 			case <-time.After(backoff):
 			}
 			backoff *= 2
@@ -136,6 +171,105 @@ func establishConnection(conf client.Conf, ctx context.Context) (net.Conn, error
 			continue
 		}
 
-		return conn, nil
+		return conn, session, serverHello, nil
 	}
 }
+
+// connectToServer dials the server and performs the handshake on the new connection
+func connectToServer(conf *client.Conf, ticket *ChaCha20.ResumptionTicket, ctx context.Context) (net.Conn, *ChaCha20.Session, *ChaCha20.ServerHello, error) {
+	dialCtx, dialCancel := context.WithTimeout(ctx, connectionTimeout)
+	conn, err := dialServer(dialCtx, *conf)
+	if err == nil && conf.Transport == client.WebSocketTransport {
+		conn, err = upgradeToWebSocket(conn, *conf)
+	}
+	if err == nil && conf.ObfuscationKey != nil {
+		conn, err = obfuscate(conn, *conf)
+	}
+	dialCancel()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Handshake datagrams sent over UDP may get lost, so the handshake must not wait forever,
+	// a handshake that timed out is started again on a new connection
+	_ = conn.SetDeadline(time.Now().Add(connectionTimeout))
+	session, serverHello, err := handshakeHandlers.OnConnectedToServer(conn, conf, ticket)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, fmt.Errorf("registration failed: %s", err)
+	}
+
+	return conn, session, serverHello, nil
+}
+
+// dialServer connects to the server over the configured transport, through the proxy if one is set, wrapped in TLS if it is enabled
+func dialServer(ctx context.Context, conf client.Conf) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if conf.Proxy == "" {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, conf.Network(), conf.ServerAddress())
+	} else {
+		conn, err = dialThroughProxy(ctx, conf)
+	}
+	if err != nil || !conf.TLS {
+		return conn, err
+	}
+
+	tlsConfig, err := conf.TLSConfig()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// dialThroughProxy connects to the server address through the HTTP CONNECT or SOCKS5 proxy of the conf
+func dialThroughProxy(ctx context.Context, conf client.Conf) (net.Conn, error) {
+	proxyURL, err := proxy.Parse(conf.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy.Dial(ctx, proxyURL, conf.ServerAddress())
+}
+
+// upgradeToWebSocket wraps the connection in a WebSocket, so the handshake and the tunnel frames pass HTTP-only networks
+func upgradeToWebSocket(conn net.Conn, conf client.Conf) (net.Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(connectionTimeout))
+	wsConn, err := websocket.Dial(conn, conf.ServerAddress(), conf.WebSocketPath)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return wsConn, nil
+}
+
+// obfuscate opens the obfuscation layer on the connection, so the handshake and the tunnel frames look like random bytes
+func obfuscate(conn net.Conn, conf client.Conf) (net.Conn, error) {
+	padding, err := obfuscation.ParsePaddingPolicy(conf.ObfuscationPadding)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(connectionTimeout))
+	obfuscatedConn, err := obfuscation.Client(conn, conf.ObfuscationKey, padding)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return obfuscatedConn, nil
+}
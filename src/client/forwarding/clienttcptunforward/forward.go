@@ -33,16 +33,18 @@ func ToTCP(conn net.Conn, tunFile *os.File, session *ChaCha20.Session, ctx conte
 				continue
 			}
 
-			encryptedPacket, err := session.Encrypt(buf[:n])
-			if err != nil {
-				log.Printf("failed to encrypt packet: %v", err)
-				continue
+			// Keys are renewed in-band once the session has carried enough data or is old enough
+			if session.NeedsRekey() {
+				rekeyInit, err := session.InitiateRekey()
+				if err != nil {
+					log.Printf("failed to initiate rekey: %v", err)
+				} else if err = writeFrame(conn, session, rekeyInit); err != nil {
+					log.Printf("failed to write to server: %v", err)
+					return
+				}
 			}
 
-			length := uint32(len(encryptedPacket))
-			lengthBuf := make([]byte, 4)
-			binary.BigEndian.PutUint32(lengthBuf, length)
-			_, err = conn.Write(append(lengthBuf, encryptedPacket...))
+			err = writeFrame(conn, session, buf[:n])
 			if err != nil {
 				log.Printf("failed to write to server: %v", err)
 				return
@@ -91,6 +93,22 @@ func ToTun(conn net.Conn, tunFile *os.File, session *ChaCha20.Session, ctx conte
 				return
 			}
 
+			if ChaCha20.IsControlFrame(decrypted) {
+				reply, err := session.HandleControlFrame(decrypted)
+				if err != nil {
+					log.Printf("failed to handle server control frame: %v", err)
+					return
+				}
+				if reply != nil {
+					err = writeFrame(conn, session, reply)
+					if err != nil {
+						log.Printf("failed to write to server: %v", err)
+						return
+					}
+				}
+				continue
+			}
+
 			// Write the decrypted packet to the TUN interface
 			_, err = tunFile.Write(decrypted)
 			if err != nil {
@@ -100,3 +118,13 @@ func ToTun(conn net.Conn, tunFile *os.File, session *ChaCha20.Session, ctx conte
 		}
 	}
 }
+
+// writeFrame encrypts a frame and writes it with a length prefix, frames from both forwarding directions are serialized by the session
+func writeFrame(conn net.Conn, session *ChaCha20.Session, plaintext []byte) error {
+	return session.EncryptAndWrite(plaintext, func(ciphertext []byte) error {
+		lengthBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(lengthBuf, uint32(len(ciphertext)))
+		_, err := conn.Write(append(lengthBuf, ciphertext...))
+		return err
+	})
+}
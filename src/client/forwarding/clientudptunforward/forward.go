@@ -0,0 +1,114 @@
+package clientudptunforward
+
+import (
+	"context"
+	"etha-tunnel/handshake/ChaCha20"
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+const (
+	maxPacketLengthBytes = 65535
+)
+
+// ToUDP forwards packets from TUN to UDP, each packet as a standalone datagram
+func ToUDP(conn net.Conn, tunFile *os.File, session *ChaCha20.Session, ctx context.Context) {
+	buf := make([]byte, maxPacketLengthBytes)
+	for {
+		select {
+		case <-ctx.Done(): // Stop-signal
+			return
+		default:
+			n, err := tunFile.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					fmt.Printf("context ended with error: %s\n", err)
+					return
+				}
+				log.Printf("failed to read from TUN: %v", err)
+				continue
+			}
+
+			// Keys are renewed in-band once the session has carried enough data or is old enough,
+			// a lost init frame is sent again after a timeout
+			if session.NeedsRekey() {
+				rekeyInit, err := session.InitiateRekey()
+				if err != nil {
+					log.Printf("failed to initiate rekey: %v", err)
+				} else if err = writeDatagram(conn, session, rekeyInit); err != nil {
+					log.Printf("failed to write to server: %v", err)
+					return
+				}
+			}
+
+			err = writeDatagram(conn, session, buf[:n])
+			if err != nil {
+				log.Printf("failed to write to server: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// ToTun forwards datagrams from UDP to TUN
+func ToTun(conn net.Conn, tunFile *os.File, session *ChaCha20.Session, ctx context.Context) {
+	buf := make([]byte, maxPacketLengthBytes)
+	for {
+		select {
+		case <-ctx.Done(): // Stop-signal
+			return
+		default:
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					fmt.Printf("context ended with error: %s\n", err)
+					return
+				}
+				log.Printf("failed to read from server: %v", err)
+				return
+			}
+
+			// Lost, reordered and forged datagrams are expected on UDP, so a failed datagram is skipped
+			decrypted, err := session.DecryptDatagram(buf[:n])
+			if err != nil {
+				log.Printf("failed to decrypt server datagram: %v", err)
+				continue
+			}
+
+			if ChaCha20.IsControlFrame(decrypted) {
+				reply, err := session.HandleControlFrame(decrypted)
+				if err != nil {
+					log.Printf("failed to handle server control frame: %v", err)
+					continue
+				}
+				if reply != nil {
+					err = writeDatagram(conn, session, reply)
+					if err != nil {
+						log.Printf("failed to write to server: %v", err)
+						return
+					}
+				}
+				continue
+			}
+
+			// Write the decrypted packet to the TUN interface
+			_, err = tunFile.Write(decrypted)
+			if err != nil {
+				log.Printf("failed to write to TUN: %v", err)
+				return
+			}
+		}
+	}
+}
+
+func writeDatagram(conn net.Conn, session *ChaCha20.Session, plaintext []byte) error {
+	datagram, err := session.EncryptDatagram(plaintext)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(datagram)
+	return err
+}
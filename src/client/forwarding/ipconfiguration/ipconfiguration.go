@@ -10,12 +10,8 @@ import (
 	"strings"
 )
 
-func Configure() error {
-	conf, err := (&client.Conf{}).Read()
-	if err != nil {
-		log.Fatalf("failed to read configuration: %v", err)
-	}
-
+// Configure creates the TUN interface of the conf and routes all traffic through it, except the route to the server
+func Configure(conf *client.Conf) error {
 	// Delete existing link if any
 	_, _ = ip.LinkDel(conf.IfName)
 
@@ -25,18 +21,11 @@ func Configure() error {
 	}
 	fmt.Printf("created TUN interface: %v\n", name)
 
-	// Assign IP address to the TUN interface
-	_, err = ip.LinkAddrAdd(conf.IfName, conf.IfIP)
+	// The route to the server, or to the proxy the client connects through, stays outside the tunnel
+	serverIP, err := routedIP(conf)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("assigned IP %s to interface %s\n", conf.IfIP, conf.IfName)
-
-	// Parse server IP
-	serverIP, _, err := net.SplitHostPort(conf.ServerTCPAddress)
-	if err != nil {
-		return fmt.Errorf("failed to parse server address: %v", err)
-	}
 
 	// Get routing information
 	routeInfo, err := ip.RouteGet(serverIP)
@@ -75,15 +64,37 @@ func Configure() error {
 	return nil
 }
 
-func Unconfigure() {
-	conf, err := (&client.Conf{}).Read()
+// AssignAddresses assigns the tunnel addresses received from the server to the TUN interface,
+// replacing the ones assigned on previous connection
+func AssignAddresses(ifName string, ipv4 string, ipv6 string) error {
+	_, err := ip.LinkAddrFlush(ifName)
 	if err != nil {
-		log.Fatalf("failed to read configuration: %v", err)
+		return err
 	}
 
-	hostIp, devName := strings.Split(conf.ServerTCPAddress, ":")[0], conf.IfName
+	for _, address := range []string{ipv4, ipv6} {
+		if address == "" {
+			continue
+		}
+
+		_, err = ip.LinkAddrAdd(ifName, address)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("assigned IP %s to interface %s\n", address, ifName)
+	}
+
+	return nil
+}
+
+// Unconfigure deletes the route to the server and the TUN interface of the conf
+func Unconfigure(conf *client.Conf) {
+	devName := conf.IfName
 	// Delete the route to the host IP
-	if err := ip.RouteDel(hostIp); err != nil {
+	hostIp, err := routedIP(conf)
+	if err != nil {
+		log.Printf("failed to delete route: %s", err)
+	} else if err := ip.RouteDel(hostIp); err != nil {
 		log.Printf("failed to delete route: %s", err)
 	}
 
@@ -92,3 +103,22 @@ func Unconfigure() {
 		log.Printf("failed to delete interface: %s", err)
 	}
 }
+
+// routedIP returns the IP the client connects to directly, a proxy may be given by its host name
+func routedIP(conf *client.Conf) (string, error) {
+	host, _, err := net.SplitHostPort(conf.DialAddress())
+	if err != nil {
+		return "", fmt.Errorf("failed to parse server address: %v", err)
+	}
+
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+
+	return addr.IP.String(), nil
+}
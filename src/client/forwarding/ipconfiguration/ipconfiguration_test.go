@@ -0,0 +1,54 @@
+package ipconfiguration
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"etha-tunnel/settings/client"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoutedIP_InviteOnlyConf(t *testing.T) {
+	root := t.TempDir()
+	confDir := filepath.Join(root, "src", "settings", "client")
+	err := os.MkdirAll(confDir, 0700)
+	if err != nil {
+		t.Fatalf("failed to create settings directory: %s", err)
+	}
+	t.Chdir(filepath.Join(root, "src"))
+
+	serverKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	code, err := (&client.Invite{
+		ServerTCPAddress: "192.0.2.1:8080",
+		Ed25519PublicKey: serverKey,
+		Id:               bytes.Repeat([]byte{1}, 8),
+		Secret:           bytes.Repeat([]byte{2}, 32),
+	}).Encode()
+	if err != nil {
+		t.Fatalf("failed to encode invite: %s", err)
+	}
+	err = os.WriteFile(filepath.Join(confDir, "conf.json"), []byte(`{"InviteCode": "`+code+`"}`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write conf: %s", err)
+	}
+
+	conf, err := (&client.Conf{}).Read()
+	if err != nil {
+		t.Fatalf("failed to read invite-only conf: %s", err)
+	}
+	err = conf.PrepareEnrollment()
+	if err != nil {
+		t.Fatalf("failed to prepare enrollment: %s", err)
+	}
+
+	// The interface is configured from the conf the invite filled in
+	if conf.IfName == "" {
+		t.Errorf("expected the interface to be named")
+	}
+	serverIP, err := routedIP(conf)
+	if err != nil || serverIP != "192.0.2.1" {
+		t.Errorf("expected the route to the invite server, got %q, %v", serverIP, err)
+	}
+}
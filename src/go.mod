@@ -1,6 +1,6 @@
 module etha-tunnel
 
-go 1.22.2
+go 1.24
 
 require golang.org/x/sys v0.25.0
 
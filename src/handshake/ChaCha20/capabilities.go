@@ -0,0 +1,81 @@
+package ChaCha20
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Capability is an optional protocol feature, the client offers the ones it supports and the server selects among them
+type Capability uint16
+
+const (
+	// CapabilityRekey allows the client to renew the session keys in-band
+	CapabilityRekey Capability = 1
+	// CapabilityHybridKEM combines X25519 with ML-KEM-768 in the handshake
+	CapabilityHybridKEM Capability = 2
+	// CapabilityResumption makes the server issue resumption tickets
+	CapabilityResumption Capability = 3
+	// CapabilityServerKeys makes the server announce its current and upcoming signing keys in-band
+	CapabilityServerKeys Capability = 4
+)
+
+// SupportedCapabilities are the capabilities this build implements
+var SupportedCapabilities = []Capability{CapabilityRekey, CapabilityHybridKEM, CapabilityResumption, CapabilityServerKeys}
+
+const maxCapabilities = 255
+
+// NegotiateCapabilities returns the offered capabilities this build supports as well
+func NegotiateCapabilities(offered []Capability) []Capability {
+	selected := make([]Capability, 0, len(offered))
+	for _, capability := range offered {
+		if HasCapability(SupportedCapabilities, capability) && !HasCapability(selected, capability) {
+			selected = append(selected, capability)
+		}
+	}
+
+	return selected
+}
+
+// HasCapability reports whether capabilities contain capability
+func HasCapability(capabilities []Capability, capability Capability) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+func encodeCapabilities(capabilities []Capability) ([]byte, error) {
+	if len(capabilities) > maxCapabilities {
+		return nil, fmt.Errorf("too many capabilities: %d", len(capabilities))
+	}
+
+	arr := make([]byte, 1, 1+2*len(capabilities))
+	arr[0] = uint8(len(capabilities))
+	for _, capability := range capabilities {
+		arr = binary.BigEndian.AppendUint16(arr, uint16(capability))
+	}
+
+	return arr, nil
+}
+
+// decodeCapabilities returns the capabilities and the number of bytes they were encoded in
+func decodeCapabilities(data []byte) ([]Capability, int, error) {
+	if len(data) < 1 {
+		return nil, 0, fmt.Errorf("missing capabilities")
+	}
+
+	count := int(data[0])
+	if len(data) < 1+2*count {
+		return nil, 0, fmt.Errorf("invalid capabilities length")
+	}
+
+	capabilities := make([]Capability, count)
+	for i := range capabilities {
+		capabilities[i] = Capability(binary.BigEndian.Uint16(data[1+2*i:]))
+	}
+
+	return capabilities, 1 + 2*count, nil
+}
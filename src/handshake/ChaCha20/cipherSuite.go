@@ -0,0 +1,145 @@
+package ChaCha20
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite is the AEAD the session traffic is encrypted with, every suite takes a 32 bytes key
+type CipherSuite uint16
+
+const (
+	CipherSuiteChaCha20Poly1305  CipherSuite = 1
+	CipherSuiteXChaCha20Poly1305 CipherSuite = 2
+	CipherSuiteAES256GCM         CipherSuite = 3
+)
+
+// SupportedCipherSuites are the suites this build implements, in the order the client prefers them
+var SupportedCipherSuites = []CipherSuite{CipherSuiteChaCha20Poly1305, CipherSuiteAES256GCM, CipherSuiteXChaCha20Poly1305}
+
+// DefaultCipherSuite is used with peers that do not negotiate cipher suites
+const DefaultCipherSuite = CipherSuiteChaCha20Poly1305
+
+var cipherSuiteNames = map[CipherSuite]string{
+	CipherSuiteChaCha20Poly1305:  "ChaCha20-Poly1305",
+	CipherSuiteXChaCha20Poly1305: "XChaCha20-Poly1305",
+	CipherSuiteAES256GCM:         "AES-256-GCM",
+}
+
+func (c CipherSuite) String() string {
+	if name, ok := cipherSuiteNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown cipher suite %d", uint16(c))
+}
+
+// NewAEAD creates the AEAD of the suite
+func (c CipherSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherSuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case CipherSuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	case CipherSuiteAES256GCM:
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid AES-256 key length: %d", len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite: %d", uint16(c))
+	}
+}
+
+// ParseCipherSuites parses suite names in the order of preference, an empty list allows every supported suite
+func ParseCipherSuites(names []string) ([]CipherSuite, error) {
+	if len(names) == 0 {
+		return SupportedCipherSuites, nil
+	}
+
+	suites := make([]CipherSuite, 0, len(names))
+	for _, name := range names {
+		suite, ok := cipherSuiteByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite: %s", name)
+		}
+		suites = append(suites, suite)
+	}
+
+	return suites, nil
+}
+
+// SelectCipherSuite returns the first of the allowed suites, in the server's order of preference, the client offers
+func SelectCipherSuite(allowed []CipherSuite, offered []CipherSuite) (CipherSuite, error) {
+	for _, suite := range allowed {
+		for _, offeredSuite := range offered {
+			if suite == offeredSuite {
+				return suite, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("no cipher suite in common, offered %v", offered)
+}
+
+func cipherSuiteByName(name string) (CipherSuite, bool) {
+	for suite, suiteName := range cipherSuiteNames {
+		if suiteName == name {
+			return suite, true
+		}
+	}
+
+	return 0, false
+}
+
+// aeadNonce widens the 12 bytes counter nonce to the nonce size of the AEAD, the counter takes the trailing bytes
+func aeadNonce(aead cipher.AEAD, nonce *[12]byte) []byte {
+	if aead.NonceSize() == len(nonce) {
+		return nonce[:]
+	}
+
+	wide := make([]byte, aead.NonceSize())
+	copy(wide[aead.NonceSize()-len(nonce):], nonce[:])
+	return wide
+}
+
+func encodeCipherSuites(suites []CipherSuite) ([]byte, error) {
+	if len(suites) > 255 {
+		return nil, fmt.Errorf("too many cipher suites: %d", len(suites))
+	}
+
+	arr := make([]byte, 1, 1+2*len(suites))
+	arr[0] = uint8(len(suites))
+	for _, suite := range suites {
+		arr = binary.BigEndian.AppendUint16(arr, uint16(suite))
+	}
+
+	return arr, nil
+}
+
+// decodeCipherSuites decodes the optional trailing cipher suites and returns their encoded length,
+// peers without suite negotiation use the default one
+func decodeCipherSuites(data []byte) ([]CipherSuite, int, error) {
+	if len(data) == 0 {
+		return []CipherSuite{DefaultCipherSuite}, 0, nil
+	}
+
+	count := int(data[0])
+	if len(data) < 1+2*count {
+		return nil, 0, fmt.Errorf("invalid cipher suites length")
+	}
+
+	suites := make([]CipherSuite, count)
+	for i := range suites {
+		suites[i] = CipherSuite(binary.BigEndian.Uint16(data[1+2*i:]))
+	}
+
+	return suites, 1 + 2*count, nil
+}
@@ -0,0 +1,64 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCipherSuites_SessionRoundTrip(t *testing.T) {
+	clientToServerKey := bytes.Repeat([]byte{1}, 32)
+	serverToClientKey := bytes.Repeat([]byte{2}, 32)
+	packet := []byte{0x45, 0, 0, 1}
+
+	for _, suite := range SupportedCipherSuites {
+		t.Run(suite.String(), func(t *testing.T) {
+			client, err := NewSession(suite, clientToServerKey, serverToClientKey, false)
+			if err != nil {
+				t.Fatalf("failed to create client session: %s", err)
+			}
+			server, err := NewSession(suite, serverToClientKey, clientToServerKey, true)
+			if err != nil {
+				t.Fatalf("failed to create server session: %s", err)
+			}
+
+			ciphertext, _ := client.Encrypt(packet)
+			plaintext, err := server.Decrypt(ciphertext)
+			if err != nil || !bytes.Equal(plaintext, packet) {
+				t.Errorf("failed to decrypt packet: %v", err)
+			}
+
+			datagram, _ := server.EncryptDatagram(packet)
+			plaintext, err = client.DecryptDatagram(datagram)
+			if err != nil || !bytes.Equal(plaintext, packet) {
+				t.Errorf("failed to decrypt datagram: %v", err)
+			}
+		})
+	}
+}
+
+func TestSelectCipherSuite_FollowsServerPreference(t *testing.T) {
+	allowed, err := ParseCipherSuites([]string{"AES-256-GCM", "ChaCha20-Poly1305"})
+	if err != nil {
+		t.Fatalf("failed to parse cipher suites: %s", err)
+	}
+
+	suite, err := SelectCipherSuite(allowed, []CipherSuite{CipherSuiteChaCha20Poly1305, CipherSuiteAES256GCM})
+	if err != nil || suite != CipherSuiteAES256GCM {
+		t.Errorf("expected AES-256-GCM, got %s (%v)", suite, err)
+	}
+
+	if _, err = SelectCipherSuite(allowed, []CipherSuite{CipherSuiteXChaCha20Poly1305}); err == nil {
+		t.Errorf("expected no cipher suite in common")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	if _, err := ParseCipherSuites([]string{"DES"}); err == nil {
+		t.Errorf("expected unknown cipher suite to be rejected")
+	}
+
+	suites, err := ParseCipherSuites(nil)
+	if err != nil || len(suites) != len(SupportedCipherSuites) {
+		t.Errorf("expected every supported cipher suite to be allowed by default, got %v", suites)
+	}
+}
@@ -3,26 +3,33 @@ package ChaCha20
 import "fmt"
 
 type ClientSignature struct {
-	ClientSignature []byte
+	ClientSignature    []byte
+	PresharedKeyBinder []byte // proves the client holds the same pre-shared key as the server
 }
 
 func (s *ClientSignature) Read(data []byte) (*ClientSignature, error) {
-	if len(data) < 64 {
+	if len(data) < 64+presharedKeyBinderLength {
 		return nil, fmt.Errorf("invalid data")
 	}
 
 	s.ClientSignature = data[:64]
+	s.PresharedKeyBinder = data[64 : 64+presharedKeyBinderLength]
 
 	return s, nil
 }
 
-func (m *ClientSignature) Write(signature *[]byte) (*[]byte, error) {
+func (m *ClientSignature) Write(signature *[]byte, binder []byte) (*[]byte, error) {
 	if len(*signature) != 64 {
 		return nil, fmt.Errorf("invalid signature")
 	}
 
-	arr := make([]byte, len(*signature))
+	if len(binder) != presharedKeyBinderLength {
+		return nil, fmt.Errorf("invalid pre-shared key binder")
+	}
+
+	arr := make([]byte, len(*signature)+len(binder))
 	copy(arr, *signature)
+	copy(arr[len(*signature):], binder)
 
 	return &arr, nil
 }
@@ -0,0 +1,77 @@
+package ChaCha20
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// EnrollmentFrame is the control frame the server returns the configuration of a newly enrolled client in
+const EnrollmentFrame byte = 0x06
+
+const (
+	// InviteIdLength is the length of the id an invite is looked up by
+	InviteIdLength = 8
+	// InviteSecretLength is the length of the secret proving the client holds the invite
+	InviteSecretLength = 32
+	// inviteFieldLength is the invite id followed by the binder
+	inviteFieldLength = InviteIdLength + sha256.Size
+)
+
+// InviteBinder proves the client holds the invite secret without sending it. It covers the client keys,
+// so an observer of the client hello cannot redeem the invite for a key of its own.
+func InviteBinder(secret []byte, edPublicKey []byte, curvePublicKey []byte, clientNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("invite"))
+	mac.Write(edPublicKey)
+	mac.Write(curvePublicKey)
+	mac.Write(clientNonce)
+	return mac.Sum(nil)
+}
+
+// WriteEnrollmentFrame encodes the client configuration into a control frame, it is sent once per enrollment
+func WriteEnrollmentFrame(conf []byte) ([]byte, error) {
+	if len(conf) > MaxHandshakeBodyLength {
+		return nil, fmt.Errorf("enrolled configuration is too long: %d", len(conf))
+	}
+
+	return append([]byte{EnrollmentFrame}, conf...), nil
+}
+
+func (s *Session) onEnrollment(conf []byte) error {
+	// Only the server enrolls clients
+	if s.isServer {
+		return fmt.Errorf("unexpected enrollment frame")
+	}
+
+	if s.OnEnrollment != nil {
+		s.OnEnrollment(append([]byte(nil), conf...))
+	}
+
+	return nil
+}
+
+// encodeInvite encodes the optional trailing invite field of the client hello, empty if the client is already enrolled
+func encodeInvite(inviteId []byte, binder []byte) ([]byte, error) {
+	if len(inviteId) == 0 && len(binder) == 0 {
+		return nil, nil
+	}
+
+	if len(inviteId) != InviteIdLength || len(binder) != sha256.Size {
+		return nil, fmt.Errorf("invalid invite")
+	}
+
+	return append(append(make([]byte, 0, inviteFieldLength), inviteId...), binder...), nil
+}
+
+// decodeInvite decodes the optional trailing invite field of the client hello
+func decodeInvite(data []byte) ([]byte, []byte, error) {
+	switch len(data) {
+	case 0:
+		return nil, nil, nil
+	case inviteFieldLength:
+		return data[:InviteIdLength], data[InviteIdLength:], nil
+	default:
+		return nil, nil, fmt.Errorf("invalid invite length")
+	}
+}
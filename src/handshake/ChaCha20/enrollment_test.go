@@ -0,0 +1,69 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"testing"
+)
+
+func TestClientHello_InviteRoundTrip(t *testing.T) {
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	curvePublic := make([]byte, 32)
+	nonce := make([]byte, 32)
+	inviteId := bytes.Repeat([]byte{1}, InviteIdLength)
+	secret := bytes.Repeat([]byte{2}, InviteSecretLength)
+	binder := InviteBinder(secret, edPublic, curvePublic, nonce)
+
+	data, err := (&ClientHello{
+		EdPublicKey:    edPublic,
+		CurvePublicKey: curvePublic,
+		ClientNonce:    nonce,
+		Capabilities:   SupportedCapabilities,
+		CipherSuites:   SupportedCipherSuites,
+		InviteId:       inviteId,
+		InviteBinder:   binder,
+	}).Write()
+	if err != nil {
+		t.Fatalf("failed to write client hello: %s", err)
+	}
+
+	clientHello, err := (&ClientHello{}).Read(*data)
+	if err != nil {
+		t.Fatalf("failed to read client hello: %s", err)
+	}
+	if !bytes.Equal(clientHello.InviteId, inviteId) || !bytes.Equal(clientHello.InviteBinder, binder) {
+		t.Errorf("expected the invite to survive the round trip, got %v %v", clientHello.InviteId, clientHello.InviteBinder)
+	}
+
+	// The binder is bound to the client key, another key cannot redeem the invite with it
+	otherPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	if hmac.Equal(InviteBinder(secret, otherPublic, curvePublic, nonce), binder) {
+		t.Errorf("expected the binder to depend on the client key")
+	}
+}
+
+func TestSession_EnrollmentFrame(t *testing.T) {
+	client, server := newSessionPair(t)
+	var received []byte
+	client.OnEnrollment = func(conf []byte) {
+		received = conf
+	}
+
+	frame, err := WriteEnrollmentFrame([]byte(`{"PresharedKey":"AA=="}`))
+	if err != nil {
+		t.Fatalf("failed to write enrollment frame: %s", err)
+	}
+
+	if _, err = client.HandleControlFrame(frame); err != nil {
+		t.Fatalf("failed to handle enrollment frame: %s", err)
+	}
+	if string(received) != `{"PresharedKey":"AA=="}` {
+		t.Errorf("unexpected enrolled configuration: %s", received)
+	}
+
+	if _, err = server.HandleControlFrame(frame); err == nil {
+		t.Errorf("expected server to reject the enrollment frame")
+	}
+}
@@ -0,0 +1,17 @@
+package ChaCha20
+
+import (
+	"crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Fingerprint returns the SHA256 fingerprint of a server key, in the notation ssh-keygen -l prints for the same key,
+// so an operator can compare it out of band
+func Fingerprint(publicKey ed25519.PublicKey) string {
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "invalid key"
+	}
+
+	return ssh.FingerprintSHA256(sshPublicKey)
+}
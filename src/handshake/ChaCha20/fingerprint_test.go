@@ -0,0 +1,22 @@
+package ChaCha20
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func TestFingerprint_MatchesSSH(t *testing.T) {
+	// ssh-keygen -l prints the SHA256 of the key in SSH wire format
+	publicKey := ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))
+	wire := append([]byte{0, 0, 0, 11}, "ssh-ed25519"...)
+	wire = append(wire, 0, 0, 0, 32)
+	wire = append(wire, publicKey...)
+	sum := sha256.Sum256(wire)
+
+	expected := "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+	if fingerprint := Fingerprint(publicKey); fingerprint != expected {
+		t.Errorf("expected %s, got %s", expected, fingerprint)
+	}
+}
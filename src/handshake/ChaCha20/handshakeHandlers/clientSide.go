@@ -1,25 +1,50 @@
 package handshakeHandlers
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"etha-tunnel/handshake/ChaCha20"
 	"etha-tunnel/settings/client"
 	"fmt"
-	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/ed25519"
-	"golang.org/x/crypto/hkdf"
 	"io"
+	"log"
 	"net"
-	"strings"
+	"time"
 )
 
-func OnConnectedToServer(conn net.Conn, conf *client.Conf) (*ChaCha20.Session, error) {
-	edPub, ed, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate ed25519 key pair: %s", err)
+// OnConnectedToServer performs the handshake, the returned server hello holds the tunnel addresses assigned by the server.
+// A session is resumed from the ticket of a previous session if it has one, with a full handshake if the server rejects it.
+func OnConnectedToServer(conn net.Conn, conf *client.Conf, ticket *ChaCha20.ResumptionTicket) (*ChaCha20.Session, *ChaCha20.ServerHello, error) {
+	if len(conf.ClientEd25519PrivateKey) != ed25519.PrivateKeySize {
+		return nil, nil, fmt.Errorf("client ed25519 private key is missing in client configuration")
+	}
+
+	// The server refuses a client whose access has expired, so it is not asked at all
+	if !conf.NotAfter.IsZero() && !time.Now().Before(conf.NotAfter) {
+		return nil, nil, fmt.Errorf("client configuration expired at %s", conf.NotAfter.Format(time.RFC3339))
+	}
+
+	// An invite is redeemed with the signed handshake, the Noise one needs the client to be known already
+	if conf.Handshake == client.NoiseHandshake && conf.InviteCode == "" {
+		return noiseClientSession(conn, conf)
+	}
+
+	if ticket != nil && time.Now().Before(ticket.ExpiresAt) {
+		session, serverHello, err := resumeClientSession(conn, conf, ticket)
+		if err == nil {
+			return session, serverHello, nil
+		}
+		if !errors.Is(err, errResumptionRejected) {
+			return nil, nil, err
+		}
+		log.Printf("session resumption rejected by server, performing full handshake")
 	}
+	ed := conf.ClientEd25519PrivateKey
+	edPub := ed.Public().(ed25519.PublicKey)
 
 	var curvePrivate [32]byte
 	_, _ = io.ReadFull(rand.Reader, curvePrivate[:])
@@ -27,67 +52,373 @@ func OnConnectedToServer(conn net.Conn, conf *client.Conf) (*ChaCha20.Session, e
 	nonce := make([]byte, 32)
 	_, _ = io.ReadFull(rand.Reader, nonce)
 
-	rm, err := (&ChaCha20.ClientHello{}).Write(4, strings.Split(conf.IfIP, "/")[0], edPub, &curvePublic, &nonce)
+	// ML-KEM key is offered for a hybrid handshake, a server without hybrid support ignores it
+	kemKey, err := ChaCha20.GenerateKEMKey()
 	if err != nil {
-		return nil, fmt.Errorf("failed to serialize registration message")
+		return nil, nil, fmt.Errorf("failed to generate KEM key: %s", err)
 	}
+	kemEncapsulationKey := kemKey.EncapsulationKey().Bytes()
 
-	_, err = conn.Write(*rm)
+	clientConf, err := (&client.Conf{}).Read()
 	if err != nil {
-		return nil, fmt.Errorf("failed to notice server on local address: %v", err)
+		return nil, nil, fmt.Errorf("failed to read client configuration: %s", err)
+	}
+	// The server signs with one of the pinned keys, so it can rotate its key while older clients keep working
+	pinnedServerKeys := clientConf.PinnedServerKeys(time.Now())
+	var knownHosts *client.KnownHosts
+	if clientConf.TrustOnFirstUse {
+		knownHosts, err = (&client.KnownHosts{}).Read()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read known hosts: %s", err)
+		}
+		if key, ok := knownHosts.Find(clientConf.ServerHost()); ok {
+			pinnedServerKeys = append(pinnedServerKeys, key)
+		}
+	}
+	if len(pinnedServerKeys) == 0 && !clientConf.TrustOnFirstUse {
+		return nil, nil, fmt.Errorf("no valid server public key in client configuration")
+	}
+
+	// A new client presents its invite, proving it holds the invite secret for its own keys
+	var inviteId, inviteBinder []byte
+	if conf.InviteCode != "" {
+		invite, inviteErr := client.DecodeInvite(conf.InviteCode)
+		if inviteErr != nil {
+			return nil, nil, inviteErr
+		}
+		inviteId = invite.Id
+		inviteBinder = ChaCha20.InviteBinder(invite.Secret, edPub, curvePublic, nonce)
 	}
 
-	//Mocked server hello
-	sHBuf := make([]byte, 128)
-	_, err = conn.Read(sHBuf)
+	clientHello := &ChaCha20.ClientHello{
+		EdPublicKey:         edPub,
+		CurvePublicKey:      curvePublic,
+		ClientNonce:         nonce,
+		Capabilities:        ChaCha20.SupportedCapabilities,
+		KEMEncapsulationKey: kemEncapsulationKey,
+		CipherSuites:        ChaCha20.SupportedCipherSuites,
+		ServerKeyIds:        ChaCha20.ServerKeyIds(pinnedServerKeys),
+		InviteId:            inviteId,
+		InviteBinder:        inviteBinder,
+	}
+
+	// Every handshake message from the first client hello on is bound into the transcript
+	transcript := ChaCha20.NewTranscript()
+	messageType, sHBuf, err := sendClientHello(conn, transcript, clientHello)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read server-hello message")
+		return nil, nil, err
+	}
+
+	// A server under load asks to repeat the client hello with a cookie, proving the client receives at its address
+	if messageType == ChaCha20.CookieReplyMessage {
+		transcript.Add(messageType, sHBuf)
+		clientHello.Cookie = sHBuf
+		messageType, sHBuf, err = sendClientHello(conn, transcript, clientHello)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if messageType != ChaCha20.ServerHelloMessage {
+		return nil, nil, fmt.Errorf("failed to read server-hello message: unexpected message type %d", messageType)
 	}
 
 	serverHello, err := (&ChaCha20.ServerHello{}).Read(sHBuf)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read server-hello message")
+		return nil, nil, fmt.Errorf("failed to read server-hello message: %s", err)
 	}
 
-	clientConf, err := (&client.Conf{}).Read()
+	clientHelloTranscript := transcript.Sum()
+	serverDataToVerify, err := ChaCha20.ServerHelloDataToSign(clientHelloTranscript, serverHello.CurvePublicKey, serverHello.ServerNonce, serverHello.IPv4, serverHello.IPv6, serverHello.Capabilities, serverHello.KEMCiphertext, serverHello.CipherSuite)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read server-hello message: %s", err)
+	}
+	// Without a pinned key, the key the server names is trusted on first use once it proves to hold it
+	firstUse := len(pinnedServerKeys) == 0
+	if firstUse {
+		if len(serverHello.SigningPublicKey) == 0 {
+			return nil, nil, fmt.Errorf("server does not name its key, it cannot be trusted on first use")
+		}
+		pinnedServerKeys = []ed25519.PublicKey{serverHello.SigningPublicKey}
+	}
+	if !verifyServerSignature(pinnedServerKeys, serverHello, serverDataToVerify) {
+		if clientConf.TrustOnFirstUse && len(serverHello.SigningPublicKey) > 0 {
+			return nil, nil, fmt.Errorf("server key of %s has changed to %s, it may be impersonated. If the change is expected, remove the host from known_hosts.json",
+				clientConf.ServerHost(), ChaCha20.Fingerprint(serverHello.SigningPublicKey))
+		}
+		return nil, nil, fmt.Errorf("server failed signature check")
+	}
+
+	curveSharedSecret, _ := curve25519.X25519(curvePrivate[:], serverHello.CurvePublicKey)
+	var kemSharedKey []byte
+	if ChaCha20.HasCapability(serverHello.Capabilities, ChaCha20.CapabilityHybridKEM) {
+		kemSharedKey, err = kemKey.Decapsulate(serverHello.KEMCiphertext)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decapsulate KEM ciphertext: %s", err)
+		}
+	}
+	sharedSecret := ChaCha20.HybridSharedSecret(curveSharedSecret, kemSharedKey)
+	salt := ChaCha20.HandshakeSalt(clientHelloTranscript, serverHello.ServerNonce)
+
+	// The server is authenticated at this point, so a wrong binder means the pre-shared keys differ
+	serverBinder := ChaCha20.PresharedKeyBinder(sharedSecret, conf.PresharedKey, salt, true)
+	if !hmac.Equal(serverBinder, serverHello.PresharedKeyBinder) {
+		return nil, nil, ChaCha20.ErrPresharedKeyMismatch
+	}
+
+	if firstUse {
+		err = trustServerKey(knownHosts, clientConf.ServerHost(), serverHello.SigningPublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	transcript.Add(ChaCha20.ServerHelloMessage, sHBuf)
+	clientSignature := ed25519.Sign(ed, ChaCha20.ClientSignatureData(transcript.Sum()))
+	clientBinder := ChaCha20.PresharedKeyBinder(sharedSecret, conf.PresharedKey, salt, false)
+	cS, err := (&ChaCha20.ClientSignature{}).Write(&clientSignature, clientBinder)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client signature message: %s", err)
+	}
+
+	err = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.ClientSignatureMessage, *cS)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send client signature message: %s", err)
+	}
+	transcript.Add(ChaCha20.ClientSignatureMessage, *cS)
+
+	// Session keys are salted with the complete transcript, so a session over a tampered handshake fails on its first packet
+	handshakeTranscript := transcript.Sum()
+	serverToClientKey, clientToServerKey := ChaCha20.DeriveSessionKeys(sharedSecret, conf.PresharedKey, handshakeTranscript)
+
+	clientSession, err := ChaCha20.NewSession(serverHello.CipherSuite, clientToServerKey, serverToClientKey, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client session: %s\n", err)
+	}
+
+	clientSession.SetSessionId(ChaCha20.DeriveSessionId(sharedSecret, handshakeTranscript))
+	clientSession.SetRekeySecret(ChaCha20.DeriveRekeySecret(sharedSecret, conf.PresharedKey, handshakeTranscript))
+	applyCapabilities(clientSession, conf, serverHello.Capabilities)
+	if conf.InviteCode != "" {
+		clientSession.OnEnrollment = func(enrolled []byte) {
+			completeEnrollment(conf, enrolled)
+		}
+	}
+	if ChaCha20.HasCapability(serverHello.Capabilities, ChaCha20.CapabilityResumption) {
+		clientSession.SetResumptionSecret(ChaCha20.DeriveResumptionSecret(sharedSecret, conf.PresharedKey, handshakeTranscript), serverHello.Capabilities)
+	}
+
+	return clientSession, serverHello, nil
+}
+
+// errResumptionRejected is returned when the server rejected the ticket and a full handshake is to follow
+var errResumptionRejected = errors.New("session resumption rejected")
+
+// resumeClientSession resumes a session from a ticket in a single round trip,
+// the server proves it opened the ticket with a binder keyed by the resumption secret
+func resumeClientSession(conn net.Conn, conf *client.Conf, ticket *ChaCha20.ResumptionTicket) (*ChaCha20.Session, *ChaCha20.ServerHello, error) {
+	var curvePrivate [32]byte
+	_, _ = io.ReadFull(rand.Reader, curvePrivate[:])
+	curvePublic, _ := curve25519.X25519(curvePrivate[:], curve25519.Basepoint)
+	nonce := make([]byte, 32)
+	_, _ = io.ReadFull(rand.Reader, nonce)
+
+	binder := ChaCha20.ResumeHelloBinder(ticket.Secret, ticket.Ticket, curvePublic, nonce)
+	resumeHello, err := (&ChaCha20.ResumeHello{}).Write(ticket.Ticket, curvePublic, nonce, binder)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to serialize resume hello: %s", err)
+	}
+
+	messageType, body, err := sendFirstMessage(conn, ChaCha20.ResumeHelloMessage, resumeHello)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resume session: %w", err)
+	}
+	if messageType == ChaCha20.ResumeRejectMessage {
+		return nil, nil, errResumptionRejected
+	}
+	if messageType != ChaCha20.ResumeAcceptMessage {
+		return nil, nil, fmt.Errorf("failed to read resume reply: unexpected message type %d", messageType)
+	}
+
+	resumeAccept, err := (&ChaCha20.ResumeAccept{}).Read(body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read client configuration: %s", err)
+		return nil, nil, fmt.Errorf("failed to read resume accept: %s", err)
 	}
-	serverEdPub := clientConf.Ed25519PublicKey
-	if !ed25519.Verify(serverEdPub, append(append(serverHello.CurvePublicKey, serverHello.ServerNonce...), nonce...), serverHello.ServerSignature) {
-		return nil, fmt.Errorf("server failed signature check")
+
+	expectedBinder, err := ChaCha20.ResumeAcceptBinder(ticket.Secret, binder, resumeAccept.CurvePublicKey, resumeAccept.ServerNonce, resumeAccept.IPv4, resumeAccept.IPv6)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read resume accept: %s", err)
+	}
+	if !hmac.Equal(expectedBinder, resumeAccept.Binder) {
+		return nil, nil, fmt.Errorf("server failed resume binder check")
+	}
+
+	curveSharedSecret, err := curve25519.X25519(curvePrivate[:], resumeAccept.CurvePublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid server curve public key: %s", err)
+	}
+
+	// Like a full handshake, the resumed session is bound to the transcript of the resume hello and accept
+	transcript := ChaCha20.NewTranscript()
+	transcript.Add(ChaCha20.ResumeHelloMessage, resumeHello)
+	transcript.Add(ChaCha20.ResumeAcceptMessage, body)
+	resumeTranscript := transcript.Sum()
+
+	serverToClientKey, clientToServerKey := ChaCha20.DeriveSessionKeys(curveSharedSecret, ticket.Secret, resumeTranscript)
+	clientSession, err := ChaCha20.NewSession(ticket.CipherSuite, clientToServerKey, serverToClientKey, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client session: %s\n", err)
+	}
+
+	clientSession.SetSessionId(ChaCha20.DeriveSessionId(append(curveSharedSecret, ticket.Secret...), resumeTranscript))
+	clientSession.SetRekeySecret(ChaCha20.DeriveRekeySecret(curveSharedSecret, ticket.Secret, resumeTranscript))
+	applyCapabilities(clientSession, conf, ticket.Capabilities)
+	clientSession.SetResumptionSecret(ChaCha20.DeriveResumptionSecret(curveSharedSecret, ticket.Secret, resumeTranscript), ticket.Capabilities)
+
+	// The resumed session keeps what was negotiated in the full handshake
+	serverHello := &ChaCha20.ServerHello{
+		IPv4:         resumeAccept.IPv4,
+		IPv6:         resumeAccept.IPv6,
+		Capabilities: ticket.Capabilities,
+		CipherSuite:  ticket.CipherSuite,
+	}
+
+	return clientSession, serverHello, nil
+}
+
+// applyCapabilities configures the session for the negotiated capabilities
+func applyCapabilities(session *ChaCha20.Session, conf *client.Conf, capabilities []ChaCha20.Capability) {
+	// The client is the one to initiate rekeys, the server only answers them
+	if ChaCha20.HasCapability(capabilities, ChaCha20.CapabilityRekey) {
+		session.RekeyAfterBytes = conf.RekeyAfterBytesThreshold()
+		session.RekeyAfterTime = conf.RekeyAfterTimeThreshold()
+	}
+
+	if ChaCha20.HasCapability(capabilities, ChaCha20.CapabilityServerKeys) {
+		session.OnServerKeys = pinServerKeys
+	}
+}
+
+// verifyServerSignature checks the server hello is signed with a pinned key.
+// A server naming no signing key has a single one, so each pinned key is tried.
+func verifyServerSignature(pinnedServerKeys []ed25519.PublicKey, serverHello *ChaCha20.ServerHello, data []byte) bool {
+	for _, key := range pinnedServerKeys {
+		if len(serverHello.SigningPublicKey) > 0 && !key.Equal(serverHello.SigningPublicKey) {
+			continue
+		}
+		if ed25519.Verify(key, data, serverHello.ServerSignature) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// completeEnrollment takes over the configuration the server returned for the invite, both in memory
+// for the next handshake and in the client configuration
+func completeEnrollment(conf *client.Conf, enrolled []byte) {
+	var enrolledConf client.Conf
+	err := json.Unmarshal(enrolled, &enrolledConf)
+	if err != nil {
+		log.Printf("failed to read enrolled configuration: %s", err)
+		return
+	}
+	conf.CompleteEnrollment(&enrolledConf)
+
+	storedConf, err := (&client.Conf{}).Read()
+	if err != nil {
+		log.Printf("failed to read client configuration: %s", err)
+		return
 	}
+	storedConf.CompleteEnrollment(&enrolledConf)
 
-	clientDataToSign := append(append(curvePublic, nonce...), serverHello.ServerNonce...)
-	clientSignature := ed25519.Sign(ed, clientDataToSign)
-	cS, err := (&ChaCha20.ClientSignature{}).Write(&clientSignature)
+	err = storedConf.RewriteConf()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client signature message: %s", err)
+		log.Printf("failed to store enrolled configuration: %s", err)
+		return
 	}
+	log.Printf("client is enrolled")
+}
+
+// trustServerKey records the key of a server seen for the first time in the known hosts
+func trustServerKey(knownHosts *client.KnownHosts, host string, publicKey ed25519.PublicKey) error {
+	knownHosts.Trust(host, publicKey)
+	err := knownHosts.Rewrite()
+	if err != nil {
+		return fmt.Errorf("failed to record server key in known hosts: %s", err)
+	}
+
+	log.Printf("server %s is not known yet, trusting its key on first use: %s", host, ChaCha20.Fingerprint(publicKey))
+	return nil
+}
+
+// pinServerKeys pins the signing keys the server announced in the client configuration
+func pinServerKeys(keys []ChaCha20.AnnouncedServerKey) {
+	conf, err := (&client.Conf{}).Read()
+	if err != nil {
+		log.Printf("failed to read client configuration: %s", err)
+		return
+	}
+
+	announced := make([]client.ServerKey, len(keys))
+	for i, key := range keys {
+		announced[i] = client.ServerKey{Ed25519PublicKey: key.PublicKey, NotAfter: key.NotAfter}
+	}
+
+	if !conf.PinServerKeys(announced, time.Now()) {
+		return
+	}
+
+	err = conf.RewriteConf()
+	if err != nil {
+		log.Printf("failed to pin announced server keys: %s", err)
+		return
+	}
+	log.Printf("pinned server keys are updated")
+}
 
-	_, err = conn.Write(*cS)
+// sendFirstMessage sends the first message of a handshake whose body has no cookie field and returns the server reply.
+// A server under load answers with a cookie, which is echoed before the message is repeated unchanged.
+func sendFirstMessage(conn net.Conn, messageType byte, body []byte) (byte, []byte, error) {
+	err := ChaCha20.WriteHandshakeMessage(conn, messageType, body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send client signature message: %s", err)
+		return 0, nil, err
 	}
 
-	sharedSecret, _ := curve25519.X25519(curvePrivate[:], serverHello.CurvePublicKey)
-	salt := sha256.Sum256(append(serverHello.ServerNonce, nonce...))
-	infoSC := []byte("server-to-client") // server-key info
-	infoCS := []byte("client-to-server") // client-key info
-	serverToClientHKDF := hkdf.New(sha256.New, sharedSecret, salt[:], infoSC)
-	clientToServerHKDF := hkdf.New(sha256.New, sharedSecret, salt[:], infoCS)
-	keySize := chacha20poly1305.KeySize
-	serverToClientKey := make([]byte, keySize)
-	_, _ = io.ReadFull(serverToClientHKDF, serverToClientKey)
-	clientToServerKey := make([]byte, keySize)
-	_, _ = io.ReadFull(clientToServerHKDF, clientToServerKey)
+	replyType, reply, err := ChaCha20.ReadAnyHandshakeMessage(conn)
+	if err != nil || replyType != ChaCha20.CookieReplyMessage {
+		return replyType, reply, err
+	}
 
-	clientSession, err := ChaCha20.NewSession(clientToServerKey, serverToClientKey, false)
+	err = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.CookieEchoMessage, reply)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = ChaCha20.WriteHandshakeMessage(conn, messageType, body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client session: %s\n", err)
+		return 0, nil, err
 	}
 
-	clientSession.SessionId = sha256.Sum256(append(sharedSecret, salt[:]...))
+	return ChaCha20.ReadAnyHandshakeMessage(conn)
+}
+
+// sendClientHello sends the client hello and returns the type and body of the server reply
+func sendClientHello(conn net.Conn, transcript *ChaCha20.Transcript, clientHello *ChaCha20.ClientHello) (byte, []byte, error) {
+	rm, err := clientHello.Write()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to serialize registration message")
+	}
+
+	err = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.ClientHelloMessage, *rm)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to notice server on local address: %v", err)
+	}
+	transcript.Add(ChaCha20.ClientHelloMessage, *rm)
+
+	messageType, body, err := ChaCha20.ReadAnyHandshakeMessage(conn)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read server-hello message: %w", err)
+	}
 
-	return clientSession, nil
+	return messageType, body, nil
 }
@@ -0,0 +1,80 @@
+package handshakeHandlers
+
+import (
+	"errors"
+	"etha-tunnel/handshake/ChaCha20"
+	"etha-tunnel/settings/client"
+	"fmt"
+	"net"
+	"time"
+)
+
+// noiseClientSession performs the client side of the Noise IK handshake in a single round trip.
+// The pinned server key is the Noise static key of the server, so the server needs no signature to be authenticated.
+func noiseClientSession(conn net.Conn, conf *client.Conf) (*ChaCha20.Session, *ChaCha20.ServerHello, error) {
+	// The initiation is addressed to a single key, the server accepts it for any of its valid keys
+	serverKey, ok := conf.NewestServerKey(time.Now())
+	if !ok {
+		return nil, nil, fmt.Errorf("the noise handshake needs a pinned server public key in client configuration")
+	}
+	serverStatic, err := ChaCha20.X25519PublicKey(serverKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initiator, err := ChaCha20.NewNoiseInitiator(ChaCha20.X25519PrivateKey(conf.ClientEd25519PrivateKey), serverStatic, conf.PresharedKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start noise handshake: %s", err)
+	}
+
+	payload, err := (&ChaCha20.NoiseInitiationPayload{}).Write(time.Now(), ChaCha20.NoiseCapabilities)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write noise initiation: %s", err)
+	}
+	initiation, err := initiator.WriteInitiation(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write noise initiation: %s", err)
+	}
+
+	messageType, response, err := sendFirstMessage(conn, ChaCha20.NoiseInitiationMessage, initiation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send noise initiation: %w", err)
+	}
+	if messageType != ChaCha20.NoiseResponseMessage {
+		return nil, nil, fmt.Errorf("failed to read noise response: unexpected message type %d", messageType)
+	}
+
+	// Only the holder of the server static key can answer, so a response that fails to decrypt
+	// comes from an impersonator or from a server holding another pre-shared key
+	responsePayloadBuf, err := initiator.ReadResponse(response)
+	if errors.Is(err, ChaCha20.ErrNoiseDecryption) {
+		return nil, nil, fmt.Errorf("server failed noise handshake, it holds another key or pre-shared key")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read noise response: %s", err)
+	}
+	responsePayload, err := (&ChaCha20.NoiseResponsePayload{}).Read(responsePayloadBuf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read noise response: %s", err)
+	}
+
+	clientToServerKey, serverToClientKey := initiator.Split()
+	clientSession, err := ChaCha20.NewSession(ChaCha20.CipherSuiteChaCha20Poly1305, clientToServerKey, serverToClientKey, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client session: %s\n", err)
+	}
+	var sessionId [32]byte
+	copy(sessionId[:], initiator.HandshakeHash())
+	clientSession.SetSessionId(sessionId)
+	clientSession.SetRekeySecret(initiator.RekeySecret())
+	applyCapabilities(clientSession, conf, responsePayload.Capabilities)
+
+	serverHello := &ChaCha20.ServerHello{
+		IPv4:         responsePayload.IPv4,
+		IPv6:         responsePayload.IPv6,
+		Capabilities: responsePayload.Capabilities,
+		CipherSuite:  ChaCha20.CipherSuiteChaCha20Poly1305,
+	}
+
+	return clientSession, serverHello, nil
+}
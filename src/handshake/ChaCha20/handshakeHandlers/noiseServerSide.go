@@ -0,0 +1,164 @@
+package handshakeHandlers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"etha-tunnel/handshake/ChaCha20"
+	"etha-tunnel/server/ipam"
+	"etha-tunnel/settings/server"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// noiseTimestamps holds the timestamp of the last accepted Noise initiation of every client, so a replayed one is refused
+var noiseTimestamps struct {
+	sync.Mutex
+	last map[string]time.Time // string(client ed25519 public key) to timestamp map
+}
+
+// noiseServerSession performs the server side of the Noise IK handshake. The client addresses one of the server
+// signing keys as the Noise static key, and names its own key only inside the encrypted initiation.
+func noiseServerSession(conn net.Conn, buf []byte, pool *ipam.Pool) (*ChaCha20.Session, *ipam.Assignment, [][]byte, error) {
+	conf, err := (&server.Conf{}).Read()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read server conf: %s", err)
+	}
+
+	responder, payloadBuf, err := readNoiseInitiation(conf, buf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	edPublicKey, err := findNoisePeer(conf, responder.RemoteStatic())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	peer, err := conf.AuthorizePeer(edPublicKey, time.Now())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	payload, err := (&ChaCha20.NoiseInitiationPayload{}).Read(payloadBuf)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid noise initiation: %s", err)
+	}
+	if !acceptNoiseTimestamp(edPublicKey, payload.Timestamp) {
+		return nil, nil, nil, fmt.Errorf("replayed noise initiation")
+	}
+
+	// The Noise protocol fixes the cipher, so the server must allow it
+	allowedSuites, err := ChaCha20.ParseCipherSuites(conf.CipherSuites)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid cipher suites in server conf: %s", err)
+	}
+	cipherSuite, err := ChaCha20.SelectCipherSuite(allowedSuites, []ChaCha20.CipherSuite{ChaCha20.CipherSuiteChaCha20Poly1305})
+	if err != nil {
+		_ = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.HandshakeErrorMessage, []byte(err.Error()))
+		return nil, nil, nil, err
+	}
+
+	assignment, err := pool.Acquire(edPublicKey, conf.Peers)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to assign tunnel address: %s", err)
+	}
+	handshakeSucceeded := false
+	defer func() {
+		if !handshakeSucceeded {
+			pool.Release(assignment)
+		}
+	}()
+
+	var capabilities []ChaCha20.Capability
+	for _, capability := range ChaCha20.NegotiateCapabilities(payload.Capabilities) {
+		if ChaCha20.HasCapability(ChaCha20.NoiseCapabilities, capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+
+	responsePayload, err := (&ChaCha20.NoiseResponsePayload{}).Write(assignment.IPv4, assignment.IPv6, capabilities)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to write noise response: %s", err)
+	}
+	// The pre-shared key of the client is mixed in last, a client holding another one cannot read the response
+	responder.SetPresharedKey(peer.PresharedKey)
+	response, err := responder.WriteResponse(responsePayload)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to write noise response: %s", err)
+	}
+
+	err = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.NoiseResponseMessage, response)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to send noise response: %s", err)
+	}
+
+	clientToServerKey, serverToClientKey := responder.Split()
+	serverSession, err := ChaCha20.NewSession(cipherSuite, serverToClientKey, clientToServerKey, true)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create server session: %s", err)
+	}
+	var sessionId [32]byte
+	copy(sessionId[:], responder.HandshakeHash())
+	serverSession.SetSessionId(sessionId)
+	// The handshake hash is public, so the rekeys are keyed with a secret out of the pre-shared key mixing chain
+	serverSession.SetRekeySecret(responder.RekeySecret())
+
+	var controlFrames [][]byte
+	if ChaCha20.HasCapability(capabilities, ChaCha20.CapabilityServerKeys) {
+		controlFrames = appendFrame(controlFrames, announceServerKeys(conf))
+	}
+
+	handshakeSucceeded = true
+	return serverSession, assignment, controlFrames, nil
+}
+
+// readNoiseInitiation finds the server key the initiation is addressed to by decrypting it with each valid key.
+// Keys held by an external signer cannot compute a Diffie-Hellman exchange, so they are skipped.
+func readNoiseInitiation(conf *server.Conf, buf []byte) (*ChaCha20.NoiseHandshake, []byte, error) {
+	now := time.Now()
+	for _, key := range conf.AllSigningKeys() {
+		if !key.ValidAt(now) || len(key.Ed25519PrivateKey) != ed25519.PrivateKeySize {
+			continue
+		}
+
+		responder, err := ChaCha20.NewNoiseResponder(ChaCha20.X25519PrivateKey(key.Ed25519PrivateKey))
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, err := responder.ReadInitiation(buf)
+		if err == nil {
+			return responder, payload, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("noise initiation is not addressed to a server key")
+}
+
+// findNoisePeer returns the ed25519 key of the peer whose Noise static key the client presented
+func findNoisePeer(conf *server.Conf, staticKey []byte) (ed25519.PublicKey, error) {
+	for _, peer := range conf.Peers {
+		peerStatic, err := ChaCha20.X25519PublicKey(peer.Ed25519PublicKey)
+		if err == nil && bytes.Equal(peerStatic, staticKey) {
+			return peer.Ed25519PublicKey, nil
+		}
+	}
+
+	return nil, server.ErrUnknownPeer
+}
+
+// acceptNoiseTimestamp reports whether the initiation is newer than the last accepted one of the client
+func acceptNoiseTimestamp(edPublicKey ed25519.PublicKey, timestamp time.Time) bool {
+	noiseTimestamps.Lock()
+	defer noiseTimestamps.Unlock()
+
+	if last, ok := noiseTimestamps.last[string(edPublicKey)]; ok && !timestamp.After(last) {
+		return false
+	}
+	if noiseTimestamps.last == nil {
+		noiseTimestamps.last = make(map[string]time.Time)
+	}
+	noiseTimestamps.last[string(edPublicKey)] = timestamp
+
+	return true
+}
@@ -1,36 +1,142 @@
 package handshakeHandlers
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"etha-tunnel/handshake/ChaCha20"
+	"etha-tunnel/server/confgen"
+	"etha-tunnel/server/handshakeguard"
+	"etha-tunnel/server/ipam"
+	"etha-tunnel/server/resumption"
 	"etha-tunnel/settings/server"
 	"fmt"
-	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
-	"golang.org/x/crypto/hkdf"
 	"io"
 	"log"
 	"net"
+	"slices"
+	"time"
 )
 
-func OnClientConnected(conn net.Conn) (*ChaCha20.Session, *string, error) {
+// handshakePhaseTimeout bounds every step of the handshake, so a stalled client cannot hold a goroutine open
+const handshakePhaseTimeout = 5 * time.Second
+
+// OnClientConnected performs the signed or the Noise handshake, or resumes a session from a ticket. The returned control frames are
+// the first ones of the session, they hand the client a resumption ticket and announce the server signing keys.
+// The caller marks the handshake as in progress with the guard, including the transport handshake before it.
+func OnClientConnected(conn net.Conn, pool *ipam.Pool, guard *handshakeguard.Guard, tickets *resumption.Tickets) (*ChaCha20.Session, *ipam.Assignment, [][]byte, error) {
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakePhaseTimeout))
+	messageType, buf, err := readClientMessage(conn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Every handshake message from the first client hello on is bound into the transcript
+	transcript := ChaCha20.NewTranscript()
+
+	// Under load, no work is done for a first message of any kind until the client proved it receives at its address
+	if guard.UnderLoad() {
+		buf, err = requireCookie(conn, guard, messageType, buf, transcript)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// The Noise handshake takes a single round trip, the signed one is used otherwise
+	if messageType == ChaCha20.NoiseInitiationMessage {
+		return noiseServerSession(conn, buf, pool)
+	}
+
+	// A failed resumption is rejected and the client goes on with a full handshake on the same connection
+	if messageType == ChaCha20.ResumeHelloMessage {
+		session, assignment, controlFrames, resumeErr := resumeServerSession(conn, buf, pool, tickets)
+		if resumeErr == nil {
+			return session, assignment, controlFrames, nil
+		}
+		log.Printf("session resumption rejected for %s: %s", conn.RemoteAddr(), resumeErr)
+
+		err = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.ResumeRejectMessage, nil)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to send resume reject: %s", err)
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(handshakePhaseTimeout))
+		messageType, buf, err = readClientMessage(conn)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	clientHello, err := parseClientHello(messageType, buf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	transcript.Add(messageType, buf)
+
 	conf, err := (&server.Conf{}).Read()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read server conf: %s", err)
+		return nil, nil, nil, fmt.Errorf("failed to read server conf: %s", err)
 	}
 
-	buf := make([]byte, 39+2+32+32+32) // 39(max ip) + 2(length headers) + 32 (ed25519 pub key) + 32 (curve pub key)
-	_, err = conn.Read(buf)
+	// Only clients listed in server peers are allowed to connect, unless revoked or expired, or new ones holding an invite
+	peer, err := conf.AuthorizePeer(clientHello.EdPublicKey, time.Now())
+	var invite *server.Invite
+	if errors.Is(err, server.ErrUnknownPeer) {
+		var inviteErr error
+		invite, inviteErr = findInvite(clientHello)
+		if inviteErr != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %s", err, inviteErr)
+		}
+		// The client is enrolled once the handshake succeeds, until then it goes without a pre-shared key
+		conf.Peers = append(conf.Peers, server.Peer{Ed25519PublicKey: clientHello.EdPublicKey})
+		peer = &conf.Peers[len(conf.Peers)-1]
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Assign tunnel addresses, they are handed back to the pool if the handshake fails
+	assignment, err := pool.Acquire(clientHello.EdPublicKey, conf.Peers)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read from client: %v\n", err)
+		return nil, nil, nil, fmt.Errorf("failed to assign tunnel address: %s", err)
 	}
+	handshakeSucceeded := false
+	defer func() {
+		if !handshakeSucceeded {
+			pool.Release(assignment)
+		}
+	}()
 
-	//Read client hello
-	clientHello, err := (&ChaCha20.ClientHello{}).Read(buf)
+	signingKey, err := selectSigningKey(conf, clientHello)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Select the capabilities both sides support, resumption only if the server issues tickets
+	capabilities := ChaCha20.NegotiateCapabilities(clientHello.Capabilities)
+	if !tickets.Enabled() {
+		capabilities = withoutCapability(capabilities, ChaCha20.CapabilityResumption)
+	}
+
+	// Select the cipher suite in the server's order of preference
+	allowedSuites, err := ChaCha20.ParseCipherSuites(conf.CipherSuites)
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid client hello: %s", err)
+		return nil, nil, nil, fmt.Errorf("invalid cipher suites in server conf: %s", err)
+	}
+	cipherSuite, err := ChaCha20.SelectCipherSuite(allowedSuites, clientHello.CipherSuites)
+	if err != nil {
+		_ = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.HandshakeErrorMessage, []byte(err.Error()))
+		return nil, nil, nil, err
 	}
 
 	// Generate server hello response
@@ -39,58 +145,418 @@ func OnClientConnected(conn net.Conn) (*ChaCha20.Session, *string, error) {
 	curvePublic, _ := curve25519.X25519(curvePrivate[:], curve25519.Basepoint)
 	serverNonce := make([]byte, 32)
 	_, _ = io.ReadFull(rand.Reader, serverNonce)
-	serverDataToSign := append(append(curvePublic, serverNonce...), clientHello.ClientNonce...)
-	privateEd := conf.Ed25519PrivateKey
-	serverSignature := ed25519.Sign(privateEd, serverDataToSign)
-	serverHello, err := (&ChaCha20.ServerHello{}).Write(&serverSignature, &serverNonce, &curvePublic)
+	// In a hybrid handshake an ML-KEM shared key is encapsulated to the client next to the X25519 exchange
+	var kemSharedKey, kemCiphertext []byte
+	if ChaCha20.HasCapability(capabilities, ChaCha20.CapabilityHybridKEM) {
+		kemSharedKey, kemCiphertext, err = ChaCha20.EncapsulateKEM(clientHello.KEMEncapsulationKey)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to encapsulate KEM shared key: %s", err)
+		}
+	}
+	clientHelloTranscript := transcript.Sum()
+	serverDataToSign, err := ChaCha20.ServerHelloDataToSign(clientHelloTranscript, curvePublic, serverNonce, assignment.IPv4, assignment.IPv6, capabilities, kemCiphertext, cipherSuite)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create server hello signature data: %s", err)
+	}
+	signer, err := signingKey.Signer()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serverSignature, err := signer.Sign(rand.Reader, serverDataToSign, crypto.Hash(0))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to sign server hello: %s", err)
+	}
+
+	// Generate shared secret and salt
+	curveSharedSecret, _ := curve25519.X25519(curvePrivate[:], clientHello.CurvePublicKey)
+	sharedSecret := ChaCha20.HybridSharedSecret(curveSharedSecret, kemSharedKey)
+	salt := ChaCha20.HandshakeSalt(clientHelloTranscript, serverNonce)
+
+	serverBinder := ChaCha20.PresharedKeyBinder(sharedSecret, peer.PresharedKey, salt, true)
+	serverHello, err := (&ChaCha20.ServerHello{
+		ServerSignature:    serverSignature,
+		ServerNonce:        serverNonce,
+		CurvePublicKey:     curvePublic,
+		IPv4:               assignment.IPv4,
+		IPv6:               assignment.IPv6,
+		Capabilities:       capabilities,
+		PresharedKeyBinder: serverBinder,
+		KEMCiphertext:      kemCiphertext,
+		CipherSuite:        cipherSuite,
+		SigningPublicKey:   signingKey.Ed25519PublicKey,
+	}).Write()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to write server hello: %s\n", err)
+		return nil, nil, nil, fmt.Errorf("failed to write server hello: %s\n", err)
 	}
 
 	// Send server hello
-	_, err = conn.Write(*serverHello)
-	clientSignatureBuf := make([]byte, 64)
+	err = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.ServerHelloMessage, *serverHello)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to send server hello: %s", err)
+	}
+	transcript.Add(ChaCha20.ServerHelloMessage, *serverHello)
+	serverHelloTranscript := transcript.Sum()
 
 	// Read client signature
-	_, err = conn.Read(clientSignatureBuf)
+	_ = conn.SetDeadline(time.Now().Add(handshakePhaseTimeout))
+	clientSignatureBuf, err := ChaCha20.ReadHandshakeMessage(conn, ChaCha20.ClientSignatureMessage)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read client signature: %s\n", err)
+		return nil, nil, nil, fmt.Errorf("failed to read client signature: %s\n", err)
 	}
 	clientSignature, err := (&ChaCha20.ClientSignature{}).Read(clientSignatureBuf)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read client signature: %s", err)
+		return nil, nil, nil, fmt.Errorf("failed to read client signature: %s", err)
 	}
+	transcript.Add(ChaCha20.ClientSignatureMessage, clientSignatureBuf)
 
-	// Verify client signature
-	if !ed25519.Verify(clientHello.EdPublicKey, append(append(clientHello.CurvePublicKey, clientHello.ClientNonce...), serverNonce...), clientSignature.ClientSignature) {
-		return nil, nil, fmt.Errorf("client signature verification failed: %s\n", err)
+	// Verify client signature, it covers the transcript up to the server hello
+	if !ed25519.Verify(clientHello.EdPublicKey, ChaCha20.ClientSignatureData(serverHelloTranscript), clientSignature.ClientSignature) {
+		return nil, nil, nil, fmt.Errorf("client signature verification failed")
 	}
 
-	// Generate shared secret and salt
-	sharedSecret, _ := curve25519.X25519(curvePrivate[:], clientHello.CurvePublicKey)
-	salt := sha256.Sum256(append(serverNonce, clientHello.ClientNonce...))
-
-	infoSC := []byte("server-to-client") // server-key info
-	infoCS := []byte("client-to-server") // client-key info
-
-	// Generate HKDF for both encryption directions
-	serverToClientHKDF := hkdf.New(sha256.New, sharedSecret, salt[:], infoSC)
-	clientToServerHKDF := hkdf.New(sha256.New, sharedSecret, salt[:], infoCS)
-	keySize := chacha20poly1305.KeySize
+	// The client is authenticated at this point, so a wrong binder means the pre-shared keys differ
+	clientBinder := ChaCha20.PresharedKeyBinder(sharedSecret, peer.PresharedKey, salt, false)
+	if !hmac.Equal(clientBinder, clientSignature.PresharedKeyBinder) {
+		return nil, nil, nil, ChaCha20.ErrPresharedKeyMismatch
+	}
 
-	// Generate keys for both encryption directions
-	serverToClientKey := make([]byte, keySize)
-	_, _ = io.ReadFull(serverToClientHKDF, serverToClientKey)
-	clientToServerKey := make([]byte, keySize)
-	_, _ = io.ReadFull(clientToServerHKDF, clientToServerKey)
+	// Generate keys for both encryption directions, salted with the complete transcript
+	handshakeTranscript := transcript.Sum()
+	serverToClientKey, clientToServerKey := ChaCha20.DeriveSessionKeys(sharedSecret, peer.PresharedKey, handshakeTranscript)
 
 	// Generate server session
-	serverSession, err := ChaCha20.NewSession(serverToClientKey, clientToServerKey, true)
+	serverSession, err := ChaCha20.NewSession(cipherSuite, serverToClientKey, clientToServerKey, true)
 	if err != nil {
 		log.Fatalf("failed to create server session: %s\n", err)
 	}
 
-	serverSession.SessionId = sha256.Sum256(append(sharedSecret, salt[:]...))
+	serverSession.SetSessionId(ChaCha20.DeriveSessionId(sharedSecret, handshakeTranscript))
+	serverSession.SetRekeySecret(ChaCha20.DeriveRekeySecret(sharedSecret, peer.PresharedKey, handshakeTranscript))
+
+	var controlFrames [][]byte
+	if invite != nil {
+		enrollmentFrame, enrollErr := enrollClient(invite, clientHello.EdPublicKey)
+		if enrollErr != nil {
+			return nil, nil, nil, enrollErr
+		}
+		controlFrames = append(controlFrames, enrollmentFrame)
+	}
+	if ChaCha20.HasCapability(capabilities, ChaCha20.CapabilityResumption) {
+		resumptionSecret := ChaCha20.DeriveResumptionSecret(sharedSecret, peer.PresharedKey, handshakeTranscript)
+		controlFrames = appendFrame(controlFrames, issueTicket(tickets, clientHello.EdPublicKey, resumptionSecret, cipherSuite, capabilities))
+	}
+	if ChaCha20.HasCapability(capabilities, ChaCha20.CapabilityServerKeys) {
+		controlFrames = appendFrame(controlFrames, announceServerKeys(conf))
+	}
+
+	handshakeSucceeded = true
+	return serverSession, assignment, controlFrames, nil
+}
+
+// resumeServerSession restores a session from a ticket in a single round trip. A fresh X25519 exchange is mixed
+// with the resumption secret, so the resumed session keys stay forward secret as well.
+func resumeServerSession(conn net.Conn, buf []byte, pool *ipam.Pool, tickets *resumption.Tickets) (*ChaCha20.Session, *ipam.Assignment, [][]byte, error) {
+	resumeHello, err := (&ChaCha20.ResumeHello{}).Read(buf)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid resume hello: %s", err)
+	}
+
+	// Opening a forged ticket fails before any public key operation is done
+	state, err := tickets.Open(resumeHello.Ticket)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	binder := ChaCha20.ResumeHelloBinder(state.Secret, resumeHello.Ticket, resumeHello.CurvePublicKey, resumeHello.ClientNonce)
+	if !hmac.Equal(binder, resumeHello.Binder) {
+		return nil, nil, nil, fmt.Errorf("invalid resume hello binder")
+	}
+
+	// A replayed resume hello would take over the addresses of the session it resumed, so a ticket is used once
+	err = tickets.Redeem(resumeHello.Ticket, state)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conf, err := (&server.Conf{}).Read()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read server conf: %s", err)
+	}
+
+	// A ticket does not outlive the removal, revocation or expiry of its client
+	if _, err = conf.AuthorizePeer(state.Ed25519PublicKey, time.Now()); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Neither does the cipher suite it was issued for
+	allowedSuites, err := ChaCha20.ParseCipherSuites(conf.CipherSuites)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid cipher suites in server conf: %s", err)
+	}
+	if _, err = ChaCha20.SelectCipherSuite(allowedSuites, []ChaCha20.CipherSuite{state.CipherSuite}); err != nil {
+		return nil, nil, nil, err
+	}
+
+	assignment, err := pool.Acquire(state.Ed25519PublicKey, conf.Peers)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to assign tunnel address: %s", err)
+	}
+	resumeSucceeded := false
+	defer func() {
+		if !resumeSucceeded {
+			pool.Release(assignment)
+		}
+	}()
+
+	var curvePrivate [32]byte
+	_, _ = io.ReadFull(rand.Reader, curvePrivate[:])
+	curvePublic, _ := curve25519.X25519(curvePrivate[:], curve25519.Basepoint)
+	serverNonce := make([]byte, 32)
+	_, _ = io.ReadFull(rand.Reader, serverNonce)
+
+	curveSharedSecret, err := curve25519.X25519(curvePrivate[:], resumeHello.CurvePublicKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid curve public key: %s", err)
+	}
+
+	acceptBinder, err := ChaCha20.ResumeAcceptBinder(state.Secret, resumeHello.Binder, curvePublic, serverNonce, assignment.IPv4, assignment.IPv6)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	resumeAccept, err := (&ChaCha20.ResumeAccept{}).Write(curvePublic, serverNonce, assignment.IPv4, assignment.IPv6, acceptBinder)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to write resume accept: %s", err)
+	}
+
+	// Like a full handshake, the resumed session is bound to the transcript of the resume hello and accept
+	transcript := ChaCha20.NewTranscript()
+	transcript.Add(ChaCha20.ResumeHelloMessage, buf)
+	transcript.Add(ChaCha20.ResumeAcceptMessage, resumeAccept)
+	resumeTranscript := transcript.Sum()
+
+	serverToClientKey, clientToServerKey := ChaCha20.DeriveSessionKeys(curveSharedSecret, state.Secret, resumeTranscript)
+	serverSession, err := ChaCha20.NewSession(state.CipherSuite, serverToClientKey, clientToServerKey, true)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create server session: %s", err)
+	}
+	serverSession.SetSessionId(ChaCha20.DeriveSessionId(append(curveSharedSecret, state.Secret...), resumeTranscript))
+	serverSession.SetRekeySecret(ChaCha20.DeriveRekeySecret(curveSharedSecret, state.Secret, resumeTranscript))
+
+	err = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.ResumeAcceptMessage, resumeAccept)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to send resume accept: %s", err)
+	}
+
+	// Every resumption hands out a fresh ticket, so a ticket is not needed more than once
+	resumptionSecret := ChaCha20.DeriveResumptionSecret(curveSharedSecret, state.Secret, resumeTranscript)
+	controlFrames := appendFrame(nil, issueTicket(tickets, state.Ed25519PublicKey, resumptionSecret, state.CipherSuite, state.Capabilities))
+	if ChaCha20.HasCapability(state.Capabilities, ChaCha20.CapabilityServerKeys) {
+		controlFrames = appendFrame(controlFrames, announceServerKeys(conf))
+	}
+
+	resumeSucceeded = true
+	return serverSession, assignment, controlFrames, nil
+}
+
+// issueTicket returns the control frame handing a new ticket to the client, nil if it could not be issued
+func issueTicket(tickets *resumption.Tickets, edPublicKey ed25519.PublicKey, secret []byte, cipherSuite ChaCha20.CipherSuite, capabilities []ChaCha20.Capability) []byte {
+	ticket, err := tickets.Issue(resumption.State{
+		Ed25519PublicKey: edPublicKey,
+		Secret:           secret,
+		CipherSuite:      cipherSuite,
+		Capabilities:     capabilities,
+	})
+	if err != nil {
+		log.Printf("failed to issue resumption ticket: %s", err)
+		return nil
+	}
+
+	frame, err := ChaCha20.WriteNewTicketFrame(ticket, tickets.Lifetime())
+	if err != nil {
+		log.Printf("failed to issue resumption ticket: %s", err)
+		return nil
+	}
+
+	return frame
+}
+
+// announceServerKeys returns the control frame announcing the current and upcoming server signing keys, nil on failure
+func announceServerKeys(conf *server.Conf) []byte {
+	var keys []ChaCha20.AnnouncedServerKey
+	for _, key := range conf.UpcomingSigningKeys(time.Now()) {
+		keys = append(keys, ChaCha20.AnnouncedServerKey{PublicKey: key.Ed25519PublicKey, NotAfter: key.NotAfter})
+	}
+
+	frame, err := ChaCha20.WriteServerKeysFrame(keys)
+	if err != nil {
+		log.Printf("failed to announce server keys: %s", err)
+		return nil
+	}
+
+	return frame
+}
+
+// findInvite looks up the invite a new client presents and checks the client holds its secret
+func findInvite(clientHello *ChaCha20.ClientHello) (*server.Invite, error) {
+	if len(clientHello.InviteId) == 0 {
+		return nil, fmt.Errorf("no invite")
+	}
+
+	invite, err := server.FindInvite(hex.EncodeToString(clientHello.InviteId), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	binder := ChaCha20.InviteBinder(invite.Secret, clientHello.EdPublicKey, clientHello.CurvePublicKey, clientHello.ClientNonce)
+	if !hmac.Equal(binder, clientHello.InviteBinder) {
+		return nil, fmt.Errorf("invalid invite binder")
+	}
+
+	return invite, nil
+}
+
+// enrollClient registers the client key as a peer, redeems the invite and returns the control frame
+// handing the client its configuration. An invite redeemed by a concurrent handshake fails this one.
+func enrollClient(invite *server.Invite, edPublicKey ed25519.PublicKey) ([]byte, error) {
+	conf, err := confgen.Enroll(edPublicKey, invite.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll client: %s", err)
+	}
+
+	marshalled, err := json.Marshal(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll client: %s", err)
+	}
+
+	frame, err := ChaCha20.WriteEnrollmentFrame(marshalled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll client: %s", err)
+	}
+
+	log.Printf("client %s enrolled with invite %s", base64.StdEncoding.EncodeToString(edPublicKey), invite.Id)
+	return frame, nil
+}
+
+// selectSigningKey picks the server key the handshake is signed with out of the ones the client pins
+func selectSigningKey(conf *server.Conf, clientHello *ChaCha20.ClientHello) (*server.SigningKey, error) {
+	return conf.SelectSigningKey(time.Now(), func(publicKey ed25519.PublicKey) bool {
+		keyId := ChaCha20.ServerKeyId(publicKey)
+		return slices.ContainsFunc(clientHello.ServerKeyIds, func(id []byte) bool {
+			return bytes.Equal(id, keyId)
+		})
+	})
+}
+
+func appendFrame(frames [][]byte, frame []byte) [][]byte {
+	if frame == nil {
+		return frames
+	}
+
+	return append(frames, frame)
+}
+
+func withoutCapability(capabilities []ChaCha20.Capability, capability ChaCha20.Capability) []ChaCha20.Capability {
+	filtered := make([]ChaCha20.Capability, 0, len(capabilities))
+	for _, c := range capabilities {
+		if c != capability {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// requireCookie makes a client prove it receives at its address before any work is done for its first message.
+// A client hello carries the cookie in a field, one without it is repeated with the cookie and the exchange is bound
+// into the transcript. Other first messages have no cookie field, the client echoes the cookie and repeats them unchanged.
+// The first message that passed is returned.
+func requireCookie(conn net.Conn, guard *handshakeguard.Guard, messageType byte, buf []byte, transcript *ChaCha20.Transcript) ([]byte, error) {
+	sourceIP := handshakeguard.SourceIP(conn.RemoteAddr())
+	if sourceIP == nil {
+		return nil, fmt.Errorf("unknown source address: %s", conn.RemoteAddr())
+	}
+
+	var clientHello *ChaCha20.ClientHello
+	if messageType == ChaCha20.ClientHelloMessage {
+		var err error
+		clientHello, err = parseClientHello(messageType, buf)
+		if err != nil {
+			return nil, err
+		}
+		if guard.VerifyCookie(sourceIP, clientHello.Cookie) {
+			return buf, nil
+		}
+		if len(clientHello.Cookie) > 0 {
+			return nil, fmt.Errorf("invalid cookie")
+		}
+	}
+
+	cookie := guard.Cookie(sourceIP)
+	err := ChaCha20.WriteHandshakeMessage(conn, ChaCha20.CookieReplyMessage, cookie)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send cookie reply: %s", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakePhaseTimeout))
+
+	if clientHello != nil {
+		transcript.Add(messageType, buf)
+		transcript.Add(ChaCha20.CookieReplyMessage, cookie)
+
+		repeatedType, repeated, err := readClientMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		clientHello, err = parseClientHello(repeatedType, repeated)
+		if err != nil {
+			return nil, err
+		}
+		if !guard.VerifyCookie(sourceIP, clientHello.Cookie) {
+			return nil, fmt.Errorf("invalid cookie")
+		}
+		return repeated, nil
+	}
+
+	echo, err := ChaCha20.ReadHandshakeMessage(conn, ChaCha20.CookieEchoMessage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cookie echo: %s", err)
+	}
+	if !guard.VerifyCookie(sourceIP, echo) {
+		return nil, fmt.Errorf("invalid cookie")
+	}
+
+	repeatedType, repeated, err := readClientMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if repeatedType != messageType {
+		return nil, fmt.Errorf("unexpected handshake message type after cookie echo: %d, expected %d", repeatedType, messageType)
+	}
+
+	return repeated, nil
+}
+
+// readClientMessage reads a handshake message from the client
+func readClientMessage(conn net.Conn) (byte, []byte, error) {
+	messageType, buf, err := ChaCha20.ReadAnyHandshakeMessage(conn)
+	if err != nil {
+		// A client speaking another protocol version is told so, rather than failing on a signature later
+		if errors.Is(err, ChaCha20.ErrUnsupportedVersion) {
+			_ = ChaCha20.WriteHandshakeMessage(conn, ChaCha20.HandshakeErrorMessage, []byte(err.Error()))
+		}
+		return 0, nil, fmt.Errorf("failed to read from client: %v\n", err)
+	}
+
+	return messageType, buf, nil
+}
+
+func parseClientHello(messageType byte, buf []byte) (*ChaCha20.ClientHello, error) {
+	if messageType != ChaCha20.ClientHelloMessage {
+		return nil, fmt.Errorf("unexpected handshake message type: %d, expected %d", messageType, ChaCha20.ClientHelloMessage)
+	}
+
+	clientHello, err := (&ChaCha20.ClientHello{}).Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client hello: %s", err)
+	}
 
-	return serverSession, &clientHello.IpAddress, nil
+	return clientHello, nil
 }
@@ -0,0 +1,147 @@
+package ChaCha20
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ProtocolVersion is the version of the handshake and data protocol, peers speaking another version are rejected.
+// Version 1 was the unframed handshake, version 2 signed the handshake fields rather than the transcript.
+const ProtocolVersion = 3
+
+// Handshake message types
+const (
+	ClientHelloMessage     byte = 0x01
+	ServerHelloMessage     byte = 0x02
+	ClientSignatureMessage byte = 0x03
+	HandshakeErrorMessage  byte = 0x04 // carries a human-readable reason the peer is rejected for
+	CookieReplyMessage     byte = 0x05 // the server is under load, the client must repeat its first message with this cookie
+	ResumeHelloMessage     byte = 0x06 // the client resumes a session from a ticket
+	ResumeAcceptMessage    byte = 0x07 // the server accepted the ticket
+	ResumeRejectMessage    byte = 0x08 // the server rejected the ticket, the client goes on with a full handshake
+	CookieEchoMessage      byte = 0x0b // the client echoes the cookie before repeating a first message that has no cookie field
+)
+
+const (
+	// handshakeHeaderLength is 1 (message type) + 1 (protocol version) + 2 (body length)
+	handshakeHeaderLength = 1 + 1 + 2
+	// MaxHandshakeBodyLength limits a handshake message body, so a peer cannot make the other side allocate much
+	MaxHandshakeBodyLength = 4096
+)
+
+// ErrUnsupportedVersion is returned when the peer speaks another protocol version
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// HandshakeRejectedError is returned when the peer rejected the handshake with an error message
+type HandshakeRejectedError struct {
+	Reason string
+}
+
+func (e *HandshakeRejectedError) Error() string {
+	return fmt.Sprintf("handshake rejected by peer: %s", e.Reason)
+}
+
+// IsClientHandshakeStart reports whether the first bytes of a connection are the header of a message a client starts
+// a handshake with. The protocol version is not checked, so a client speaking another version is still told about it.
+func IsClientHandshakeStart(header []byte) bool {
+	if len(header) < handshakeHeaderLength {
+		return false
+	}
+
+	switch header[0] {
+	case ClientHelloMessage, ResumeHelloMessage, NoiseInitiationMessage:
+	default:
+		return false
+	}
+
+	return binary.BigEndian.Uint16(header[2:4]) <= MaxHandshakeBodyLength
+}
+
+// WriteHandshakeMessage writes a typed and length-prefixed handshake message in a single write,
+// so it is sent as one datagram over UDP
+func WriteHandshakeMessage(conn io.Writer, messageType byte, body []byte) error {
+	if len(body) > MaxHandshakeBodyLength {
+		return fmt.Errorf("handshake message is too long: %d", len(body))
+	}
+
+	message := make([]byte, 0, handshakeHeaderLength+len(body))
+	message = append(message, handshakeHeader(messageType, len(body))...)
+	message = append(message, body...)
+
+	_, err := conn.Write(message)
+	return err
+}
+
+func handshakeHeader(messageType byte, bodyLength int) []byte {
+	header := make([]byte, handshakeHeaderLength)
+	header[0] = messageType
+	header[1] = ProtocolVersion
+	binary.BigEndian.PutUint16(header[2:], uint16(bodyLength))
+	return header
+}
+
+// ReadHandshakeMessage reads a handshake message of the expected type and returns its body
+func ReadHandshakeMessage(conn net.Conn, expectedType byte) ([]byte, error) {
+	messageType, body, err := ReadAnyHandshakeMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if messageType != expectedType {
+		return nil, fmt.Errorf("unexpected handshake message type: %d, expected %d", messageType, expectedType)
+	}
+
+	return body, nil
+}
+
+// ReadAnyHandshakeMessage reads a handshake message and returns its type and body.
+// Stream connections are read exactly up to the end of the message, datagram connections one datagram at a time.
+func ReadAnyHandshakeMessage(conn net.Conn) (byte, []byte, error) {
+	var header, body []byte
+	if conn.RemoteAddr().Network() == "udp" {
+		datagram := make([]byte, handshakeHeaderLength+MaxHandshakeBodyLength)
+		n, err := conn.Read(datagram)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < handshakeHeaderLength {
+			return 0, nil, fmt.Errorf("handshake message is too short")
+		}
+		header, body = datagram[:handshakeHeaderLength], datagram[handshakeHeaderLength:n]
+	} else {
+		header = make([]byte, handshakeHeaderLength)
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	messageType, version := header[0], header[1]
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if length > MaxHandshakeBodyLength {
+		return 0, nil, fmt.Errorf("handshake message is too long: %d", length)
+	}
+
+	if body == nil {
+		body = make([]byte, length)
+		_, err := io.ReadFull(conn, body)
+		if err != nil {
+			return 0, nil, err
+		}
+	} else if len(body) != length {
+		return 0, nil, fmt.Errorf("handshake message length mismatch: %d, expected %d", len(body), length)
+	}
+
+	// Error messages are understood regardless of the version, so a peer can tell why it is rejected
+	if messageType == HandshakeErrorMessage {
+		return 0, nil, &HandshakeRejectedError{Reason: string(body)}
+	}
+	if version != ProtocolVersion {
+		return 0, nil, fmt.Errorf("%w: %d, expected %d", ErrUnsupportedVersion, version, ProtocolVersion)
+	}
+
+	return messageType, body, nil
+}
@@ -0,0 +1,124 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// writeInChunks writes data one byte at a time, so the reader sees partial reads
+func writeInChunks(conn net.Conn, data []byte) {
+	for i := range data {
+		_, _ = conn.Write(data[i : i+1])
+	}
+}
+
+func TestHandshakeMessage_PartialReads(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	body := []byte("client hello body")
+	var message bytes.Buffer
+	_ = WriteHandshakeMessage(&message, ClientHelloMessage, body)
+	go writeInChunks(client, message.Bytes())
+
+	received, err := ReadHandshakeMessage(server, ClientHelloMessage)
+	if err != nil {
+		t.Fatalf("failed to read handshake message: %s", err)
+	}
+	if !bytes.Equal(received, body) {
+		t.Errorf("expected %q, got %q", body, received)
+	}
+}
+
+func TestHandshakeMessage_RejectsOtherVersion(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{ClientHelloMessage, ProtocolVersion + 1, 0, 1, 0})
+	}()
+
+	_, err := ReadHandshakeMessage(server, ClientHelloMessage)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected unsupported version error, got %v", err)
+	}
+}
+
+func TestHandshakeMessage_ReturnsRejectionReason(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_ = WriteHandshakeMessage(server, HandshakeErrorMessage, []byte("go away"))
+	}()
+
+	_, err := ReadHandshakeMessage(client, ServerHelloMessage)
+	var rejected *HandshakeRejectedError
+	if !errors.As(err, &rejected) || rejected.Reason != "go away" {
+		t.Errorf("expected rejection with reason, got %v", err)
+	}
+}
+
+func TestHandshakeMessage_RejectsUnexpectedType(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_ = WriteHandshakeMessage(client, ClientSignatureMessage, []byte{1})
+	}()
+
+	if _, err := ReadHandshakeMessage(server, ClientHelloMessage); err == nil {
+		t.Errorf("expected unexpected message type to be rejected")
+	}
+}
+
+func TestServerHello_CapabilitiesRoundTrip(t *testing.T) {
+	signature := make([]byte, 64)
+	nonce := make([]byte, 32)
+	curvePublic := make([]byte, 32)
+	signingKey := bytes.Repeat([]byte{9}, 32)
+
+	data, err := (&ServerHello{
+		ServerSignature:    signature,
+		ServerNonce:        nonce,
+		CurvePublicKey:     curvePublic,
+		IPv4:               "10.0.0.2/24",
+		Capabilities:       []Capability{CapabilityRekey},
+		PresharedKeyBinder: make([]byte, presharedKeyBinderLength),
+		CipherSuite:        CipherSuiteAES256GCM,
+		SigningPublicKey:   signingKey,
+	}).Write()
+	if err != nil {
+		t.Fatalf("failed to write server hello: %s", err)
+	}
+
+	serverHello, err := (&ServerHello{}).Read(*data)
+	if err != nil {
+		t.Fatalf("failed to read server hello: %s", err)
+	}
+	if serverHello.IPv4 != "10.0.0.2/24" || serverHello.IPv6 != "" {
+		t.Errorf("unexpected addresses: %q %q", serverHello.IPv4, serverHello.IPv6)
+	}
+	if !HasCapability(serverHello.Capabilities, CapabilityRekey) {
+		t.Errorf("expected rekey capability, got %v", serverHello.Capabilities)
+	}
+	if serverHello.CipherSuite != CipherSuiteAES256GCM {
+		t.Errorf("expected AES-256-GCM, got %s", serverHello.CipherSuite)
+	}
+	if !bytes.Equal(serverHello.SigningPublicKey, signingKey) {
+		t.Errorf("expected signing key to round trip, got %v", serverHello.SigningPublicKey)
+	}
+}
+
+func TestNegotiateCapabilities_DropsUnknown(t *testing.T) {
+	selected := NegotiateCapabilities([]Capability{CapabilityRekey, 0xffff, CapabilityRekey})
+	if len(selected) != 1 || selected[0] != CapabilityRekey {
+		t.Errorf("expected only the rekey capability, got %v", selected)
+	}
+}
@@ -0,0 +1,59 @@
+package ChaCha20
+
+import (
+	"crypto/mlkem"
+	"encoding/binary"
+	"fmt"
+)
+
+// ML-KEM-768 is combined with X25519, so the session keys stay secret as long as either of them is unbroken
+const (
+	KEMEncapsulationKeyLength = mlkem.EncapsulationKeySize768
+	KEMCiphertextLength       = mlkem.CiphertextSize768
+)
+
+// GenerateKEMKey generates the client ML-KEM-768 key pair of a hybrid handshake
+func GenerateKEMKey() (*mlkem.DecapsulationKey768, error) {
+	return mlkem.GenerateKey768()
+}
+
+// EncapsulateKEM returns the ML-KEM-768 shared key and the ciphertext the client decapsulates it from
+func EncapsulateKEM(encapsulationKey []byte) ([]byte, []byte, error) {
+	key, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid KEM encapsulation key: %w", err)
+	}
+
+	sharedKey, ciphertext := key.Encapsulate()
+	return sharedKey, ciphertext, nil
+}
+
+// HybridSharedSecret concatenates the X25519 and the optional ML-KEM shared secrets into the HKDF input
+func HybridSharedSecret(curveSharedSecret []byte, kemSharedKey []byte) []byte {
+	sharedSecret := make([]byte, 0, len(curveSharedSecret)+len(kemSharedKey))
+	sharedSecret = append(sharedSecret, curveSharedSecret...)
+	sharedSecret = append(sharedSecret, kemSharedKey...)
+	return sharedSecret
+}
+
+// encodeKEMField encodes a KEM key or ciphertext with a 2 bytes length prefix, an absent one as zero length
+func encodeKEMField(field []byte) []byte {
+	arr := make([]byte, 2, 2+len(field))
+	binary.BigEndian.PutUint16(arr, uint16(len(field)))
+	return append(arr, field...)
+}
+
+// decodeKEMField decodes an optional KEM field and returns the number of bytes it was encoded in,
+// messages of peers without hybrid support end before it
+func decodeKEMField(data []byte) ([]byte, int, error) {
+	if len(data) == 0 {
+		return nil, 0, nil
+	}
+
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return nil, 0, fmt.Errorf("invalid KEM field length")
+	}
+
+	length := int(binary.BigEndian.Uint16(data))
+	return data[2 : 2+length], 2 + length, nil
+}
@@ -0,0 +1,92 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestHybridKEM_SharedKeysMatch(t *testing.T) {
+	kemKey, err := GenerateKEMKey()
+	if err != nil {
+		t.Fatalf("failed to generate KEM key: %s", err)
+	}
+
+	serverSharedKey, ciphertext, err := EncapsulateKEM(kemKey.EncapsulationKey().Bytes())
+	if err != nil {
+		t.Fatalf("failed to encapsulate: %s", err)
+	}
+	if len(ciphertext) != KEMCiphertextLength {
+		t.Fatalf("unexpected ciphertext length: %d", len(ciphertext))
+	}
+
+	clientSharedKey, err := kemKey.Decapsulate(ciphertext)
+	if err != nil {
+		t.Fatalf("failed to decapsulate: %s", err)
+	}
+	if !bytes.Equal(serverSharedKey, clientSharedKey) {
+		t.Errorf("expected both sides to share the same KEM key")
+	}
+}
+
+func TestClientHello_KEMEncapsulationKeyRoundTrip(t *testing.T) {
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	curvePublic := make([]byte, 32)
+	nonce := make([]byte, 32)
+	kemKey, _ := GenerateKEMKey()
+	encapsulationKey := kemKey.EncapsulationKey().Bytes()
+
+	data, err := (&ClientHello{
+		EdPublicKey:         edPublic,
+		CurvePublicKey:      curvePublic,
+		ClientNonce:         nonce,
+		Capabilities:        SupportedCapabilities,
+		Cookie:              []byte{7},
+		KEMEncapsulationKey: encapsulationKey,
+		CipherSuites:        SupportedCipherSuites,
+	}).Write()
+	if err != nil {
+		t.Fatalf("failed to write client hello: %s", err)
+	}
+
+	clientHello, err := (&ClientHello{}).Read(*data)
+	if err != nil {
+		t.Fatalf("failed to read client hello: %s", err)
+	}
+	if !bytes.Equal(clientHello.KEMEncapsulationKey, encapsulationKey) {
+		t.Errorf("expected KEM encapsulation key to survive the round trip")
+	}
+	if !bytes.Equal(clientHello.Cookie, []byte{7}) {
+		t.Errorf("expected cookie to survive the round trip, got %v", clientHello.Cookie)
+	}
+}
+
+func TestClientHello_WithoutKEMFieldFromOlderPeer(t *testing.T) {
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	curvePublic := make([]byte, 32)
+	nonce := make([]byte, 32)
+
+	data, _ := (&ClientHello{
+		EdPublicKey:    edPublic,
+		CurvePublicKey: curvePublic,
+		ClientNonce:    nonce,
+		Capabilities:   []Capability{CapabilityRekey},
+	}).Write()
+	// Older peers end the message right after the cookie, without the KEM field, cipher suites and server key ids
+	olderPeerHello := (*data)[:len(*data)-2-1-1]
+
+	clientHello, err := (&ClientHello{}).Read(olderPeerHello)
+	if err != nil {
+		t.Fatalf("failed to read client hello of an older peer: %s", err)
+	}
+	if len(clientHello.KEMEncapsulationKey) != 0 {
+		t.Errorf("expected no KEM encapsulation key")
+	}
+	if HasCapability(NegotiateCapabilities(clientHello.Capabilities), CapabilityHybridKEM) {
+		t.Errorf("expected hybrid mode not to be negotiated with an older peer")
+	}
+	if len(clientHello.CipherSuites) != 1 || clientHello.CipherSuites[0] != DefaultCipherSuite {
+		t.Errorf("expected an older peer to use the default cipher suite, got %v", clientHello.CipherSuites)
+	}
+}
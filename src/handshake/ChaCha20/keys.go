@@ -0,0 +1,71 @@
+package ChaCha20
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+const (
+	// PresharedKeyLength is the length of the optional symmetric key shared by a client and the server
+	PresharedKeyLength       = 32
+	presharedKeyBinderLength = sha256.Size
+)
+
+// ErrPresharedKeyMismatch is returned when the peers are authenticated, but hold different pre-shared keys
+var ErrPresharedKeyMismatch = errors.New("pre-shared key mismatch")
+
+// DeriveSessionKeys derives the keys of both directions from the X25519 shared secret.
+// The optional pre-shared key is mixed into the HKDF input, so the keys stay secret even if the curve is broken.
+func DeriveSessionKeys(sharedSecret []byte, presharedKey []byte, salt []byte) (serverToClientKey []byte, clientToServerKey []byte) {
+	ikm := keyMaterial(sharedSecret, presharedKey)
+
+	serverToClientKey = make([]byte, chacha20poly1305.KeySize)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("server-to-client")), serverToClientKey)
+	clientToServerKey = make([]byte, chacha20poly1305.KeySize)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("client-to-server")), clientToServerKey)
+
+	return serverToClientKey, clientToServerKey
+}
+
+// PresharedKeyBinder proves the sender derived its keys with the same pre-shared key.
+// It is checked after the signature, so a mismatch is told apart from an impersonation attempt.
+func PresharedKeyBinder(sharedSecret []byte, presharedKey []byte, salt []byte, isServerToClient bool) []byte {
+	binderKey := make([]byte, sha256.Size)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, keyMaterial(sharedSecret, presharedKey), salt, []byte("psk-binder")), binderKey)
+
+	direction := []byte("client-to-server")
+	if isServerToClient {
+		direction = []byte("server-to-client")
+	}
+
+	mac := hmac.New(sha256.New, binderKey)
+	mac.Write(direction)
+	return mac.Sum(nil)
+}
+
+// DeriveResumptionSecret derives the secret a later session is resumed from, it never encrypts traffic itself.
+// Like the session keys, it depends on the pre-shared key, so a resumed session keeps its protection.
+func DeriveResumptionSecret(sharedSecret []byte, presharedKey []byte, salt []byte) []byte {
+	secret := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, keyMaterial(sharedSecret, presharedKey), salt, []byte("resumption")), secret)
+	return secret
+}
+
+// DeriveRekeySecret derives the root secret the in-band rekeys of a session are keyed with, so the pre-shared key
+// keeps protecting the session keys after a rekey
+func DeriveRekeySecret(sharedSecret []byte, presharedKey []byte, salt []byte) []byte {
+	secret := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, keyMaterial(sharedSecret, presharedKey), salt, []byte("rekey")), secret)
+	return secret
+}
+
+func keyMaterial(sharedSecret []byte, presharedKey []byte) []byte {
+	ikm := make([]byte, 0, len(sharedSecret)+len(presharedKey))
+	ikm = append(ikm, sharedSecret...)
+	ikm = append(ikm, presharedKey...)
+	return ikm
+}
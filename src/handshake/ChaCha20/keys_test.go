@@ -0,0 +1,40 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"testing"
+)
+
+func TestDeriveSessionKeys_MixesPresharedKey(t *testing.T) {
+	sharedSecret := bytes.Repeat([]byte{1}, 32)
+	salt := bytes.Repeat([]byte{2}, 32)
+	presharedKey := bytes.Repeat([]byte{3}, PresharedKeyLength)
+
+	withoutS2C, withoutC2S := DeriveSessionKeys(sharedSecret, nil, salt)
+	withS2C, withC2S := DeriveSessionKeys(sharedSecret, presharedKey, salt)
+
+	if bytes.Equal(withoutS2C, withS2C) || bytes.Equal(withoutC2S, withC2S) {
+		t.Errorf("expected pre-shared key to change the session keys")
+	}
+	if bytes.Equal(withS2C, withC2S) {
+		t.Errorf("expected keys of both directions to differ")
+	}
+}
+
+func TestPresharedKeyBinder_DetectsMismatch(t *testing.T) {
+	sharedSecret := bytes.Repeat([]byte{1}, 32)
+	salt := bytes.Repeat([]byte{2}, 32)
+	presharedKey := bytes.Repeat([]byte{3}, PresharedKeyLength)
+
+	serverBinder := PresharedKeyBinder(sharedSecret, presharedKey, salt, true)
+	if !hmac.Equal(serverBinder, PresharedKeyBinder(sharedSecret, presharedKey, salt, true)) {
+		t.Errorf("expected binders of the same pre-shared key to match")
+	}
+	if hmac.Equal(serverBinder, PresharedKeyBinder(sharedSecret, nil, salt, true)) {
+		t.Errorf("expected binder without pre-shared key to differ")
+	}
+	if hmac.Equal(serverBinder, PresharedKeyBinder(sharedSecret, presharedKey, salt, false)) {
+		t.Errorf("expected binders of both directions to differ")
+	}
+}
@@ -0,0 +1,495 @@
+package ChaCha20
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"hash"
+	"io"
+	"math/big"
+)
+
+// The Noise handshake is an alternative to the signed handshake, it follows the Noise Protocol Framework
+// (https://noiseprotocol.org/noise.html) with the IK pattern and a pre-shared key mixed in after the second message:
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se, psk
+//
+// The client knows the server static key up front, so the handshake takes a single round trip,
+// and sends its own static key encrypted, so a passive observer cannot tell which client connects.
+const (
+	NoiseInitiationMessage byte = 0x09 // client -> server: first Noise message
+	NoiseResponseMessage   byte = 0x0a // server -> client: second Noise message
+)
+
+const (
+	noiseKeyLength = 32
+	noiseTagLength = chacha20poly1305.Overhead
+)
+
+// NoiseProtocol is a Noise protocol of the IK pattern: its name, hash function and the prologue of the application
+type NoiseProtocol struct {
+	Name     string
+	Prologue []byte
+	Hash     func() hash.Hash
+	// WithPresharedKey mixes a pre-shared key in after the second message, the psk2 modifier of the name
+	WithPresharedKey bool
+}
+
+// TunGoNoise is the Noise protocol of the TunGo Noise handshake, a peer without a pre-shared key uses one of all zeros.
+// The prologue sets it apart from other applications of the same protocol.
+var TunGoNoise = NoiseProtocol{
+	Name:             "Noise_IKpsk2_25519_ChaChaPoly_SHA256",
+	Prologue:         []byte("TunGo Noise"),
+	Hash:             sha256.New,
+	WithPresharedKey: true,
+}
+
+// ErrNoiseDecryption is returned when a Noise handshake message fails to decrypt, the peers hold other keys
+var ErrNoiseDecryption = errors.New("noise handshake message decryption failed")
+
+// noiseCipherState encrypts with a key and a counter nonce, as long as it has no key it passes data through
+type noiseCipherState struct {
+	key   []byte
+	nonce uint64
+}
+
+// noiseNonce encodes the counter as Noise does for ChaChaPoly: 32 zero bits and the counter in little-endian
+func noiseNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func (c *noiseCipherState) encrypt(ad []byte, plaintext []byte) ([]byte, error) {
+	if c.key == nil {
+		return plaintext, nil
+	}
+
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nil, noiseNonce(c.nonce), plaintext, ad)
+	c.nonce++
+
+	return ciphertext, nil
+}
+
+func (c *noiseCipherState) decrypt(ad []byte, ciphertext []byte) ([]byte, error) {
+	if c.key == nil {
+		return ciphertext, nil
+	}
+
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, noiseNonce(c.nonce), ciphertext, ad)
+	if err != nil {
+		return nil, ErrNoiseDecryption
+	}
+	c.nonce++
+
+	return plaintext, nil
+}
+
+// noiseSymmetricState holds the chaining key and the handshake hash of a Noise handshake
+type noiseSymmetricState struct {
+	cipher        noiseCipherState
+	hash          func() hash.Hash
+	chainingKey   []byte
+	handshakeHash []byte
+}
+
+func newNoiseSymmetricState(protocol NoiseProtocol) *noiseSymmetricState {
+	h := make([]byte, noiseKeyLength)
+	if len(protocol.Name) <= noiseKeyLength {
+		copy(h, protocol.Name)
+	} else {
+		digest := protocol.Hash()
+		digest.Write([]byte(protocol.Name))
+		h = digest.Sum(nil)
+	}
+
+	return &noiseSymmetricState{hash: protocol.Hash, chainingKey: h, handshakeHash: h}
+}
+
+func (s *noiseSymmetricState) mixHash(data []byte) {
+	h := s.hash()
+	h.Write(s.handshakeHash)
+	h.Write(data)
+	s.handshakeHash = h.Sum(nil)
+}
+
+func (s *noiseSymmetricState) mixKey(inputKeyMaterial []byte) {
+	outputs := noiseHKDF(s.hash, s.chainingKey, inputKeyMaterial, 2)
+	s.chainingKey = outputs[0]
+	s.cipher = noiseCipherState{key: outputs[1]}
+}
+
+func (s *noiseSymmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
+	outputs := noiseHKDF(s.hash, s.chainingKey, inputKeyMaterial, 3)
+	s.chainingKey = outputs[0]
+	s.mixHash(outputs[1])
+	s.cipher = noiseCipherState{key: outputs[2]}
+}
+
+func (s *noiseSymmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.cipher.encrypt(s.handshakeHash, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+
+	return ciphertext, nil
+}
+
+func (s *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.cipher.decrypt(s.handshakeHash, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// noiseHKDF is the HKDF of the Noise specification, it returns up to three outputs of the hash length
+func noiseHKDF(hash func() hash.Hash, chainingKey []byte, inputKeyMaterial []byte, outputs int) [][]byte {
+	extract := hmac.New(hash, chainingKey)
+	extract.Write(inputKeyMaterial)
+	tempKey := extract.Sum(nil)
+
+	result := make([][]byte, 0, outputs)
+	var previous []byte
+	for i := 1; i <= outputs; i++ {
+		expand := hmac.New(hash, tempKey)
+		expand.Write(previous)
+		expand.Write([]byte{byte(i)})
+		previous = expand.Sum(nil)
+		result = append(result, previous)
+	}
+
+	return result
+}
+
+// NoiseHandshake is one side of a Noise IK handshake. The initiator writes the initiation and reads the response,
+// the responder reads the initiation, sets the pre-shared key of the initiator it names and writes the response.
+type NoiseHandshake struct {
+	symmetric       *noiseSymmetricState
+	staticPrivate   []byte
+	staticPublic    []byte
+	ephemeral       []byte
+	remoteStatic    []byte
+	remoteEphemeral []byte
+	presharedKey    []byte
+	withPSK         bool
+	// generateEphemeral returns a fresh ephemeral private key, the test vectors replace it
+	generateEphemeral func() ([]byte, error)
+}
+
+// NewNoiseInitiator starts the TunGo Noise handshake of a client, which knows the static key of the server up front
+func NewNoiseInitiator(staticPrivate []byte, responderStatic []byte, presharedKey []byte) (*NoiseHandshake, error) {
+	handshake, err := TunGoNoise.NewInitiator(staticPrivate, responderStatic)
+	if err != nil {
+		return nil, err
+	}
+	handshake.SetPresharedKey(presharedKey)
+
+	return handshake, nil
+}
+
+// NewNoiseResponder starts the TunGo Noise handshake of a server with the static key the client is expected to address
+func NewNoiseResponder(staticPrivate []byte) (*NoiseHandshake, error) {
+	return TunGoNoise.NewResponder(staticPrivate)
+}
+
+// NewInitiator starts the handshake of the side knowing the responder static key up front
+func (p NoiseProtocol) NewInitiator(staticPrivate []byte, responderStatic []byte) (*NoiseHandshake, error) {
+	if len(responderStatic) != noiseKeyLength {
+		return nil, fmt.Errorf("invalid responder static key")
+	}
+
+	handshake, err := newNoiseHandshake(p, staticPrivate)
+	if err != nil {
+		return nil, err
+	}
+	// The responder static key is a pre-message, both sides hash it before the first message
+	handshake.remoteStatic = responderStatic
+	handshake.symmetric.mixHash(responderStatic)
+
+	return handshake, nil
+}
+
+// NewResponder starts the handshake of the side whose static key the initiator addresses
+func (p NoiseProtocol) NewResponder(staticPrivate []byte) (*NoiseHandshake, error) {
+	handshake, err := newNoiseHandshake(p, staticPrivate)
+	if err != nil {
+		return nil, err
+	}
+	handshake.symmetric.mixHash(handshake.staticPublic)
+
+	return handshake, nil
+}
+
+func newNoiseHandshake(protocol NoiseProtocol, staticPrivate []byte) (*NoiseHandshake, error) {
+	if len(staticPrivate) != noiseKeyLength {
+		return nil, fmt.Errorf("invalid static private key")
+	}
+	staticPublic, err := curve25519.X25519(staticPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	symmetric := newNoiseSymmetricState(protocol)
+	symmetric.mixHash(protocol.Prologue)
+
+	return &NoiseHandshake{
+		symmetric:         symmetric,
+		staticPrivate:     staticPrivate,
+		staticPublic:      staticPublic,
+		withPSK:           protocol.WithPresharedKey,
+		generateEphemeral: generateNoiseEphemeral,
+	}, nil
+}
+
+func generateNoiseEphemeral() ([]byte, error) {
+	private := make([]byte, noiseKeyLength)
+	_, err := io.ReadFull(rand.Reader, private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+
+	return private, nil
+}
+
+// SetPresharedKey sets the pre-shared key mixed into the response, an empty key is taken as all zeros
+func (n *NoiseHandshake) SetPresharedKey(presharedKey []byte) {
+	if len(presharedKey) == 0 {
+		presharedKey = make([]byte, PresharedKeyLength)
+	}
+	n.presharedKey = presharedKey
+}
+
+// RemoteStatic returns the static public key of the peer, on the responder once the initiation is read
+func (n *NoiseHandshake) RemoteStatic() []byte {
+	return n.remoteStatic
+}
+
+// HandshakeHash returns the handshake hash, once the handshake is complete it identifies the session
+func (n *NoiseHandshake) HandshakeHash() []byte {
+	return n.symmetric.handshakeHash
+}
+
+// WriteInitiation writes the first message: -> e, es, s, ss and the encrypted payload
+func (n *NoiseHandshake) WriteInitiation(payload []byte) ([]byte, error) {
+	message, err := n.writeEphemeral(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = n.mixDH(n.ephemeral, n.remoteStatic); err != nil {
+		return nil, err
+	}
+
+	encryptedStatic, err := n.symmetric.encryptAndHash(n.staticPublic)
+	if err != nil {
+		return nil, err
+	}
+	message = append(message, encryptedStatic...)
+
+	if err = n.mixDH(n.staticPrivate, n.remoteStatic); err != nil {
+		return nil, err
+	}
+
+	return n.appendPayload(message, payload)
+}
+
+// ReadInitiation reads the first message and returns its payload, the initiator static key is known afterwards
+func (n *NoiseHandshake) ReadInitiation(message []byte) ([]byte, error) {
+	if len(message) < noiseKeyLength+noiseKeyLength+noiseTagLength+noiseTagLength {
+		return nil, fmt.Errorf("noise initiation is too short")
+	}
+
+	rest := n.readEphemeral(message)
+
+	if err := n.mixDH(n.staticPrivate, n.remoteEphemeral); err != nil {
+		return nil, err
+	}
+
+	remoteStatic, err := n.symmetric.decryptAndHash(rest[:noiseKeyLength+noiseTagLength])
+	if err != nil {
+		return nil, err
+	}
+	n.remoteStatic = remoteStatic
+
+	if err = n.mixDH(n.staticPrivate, n.remoteStatic); err != nil {
+		return nil, err
+	}
+
+	return n.symmetric.decryptAndHash(rest[noiseKeyLength+noiseTagLength:])
+}
+
+// WriteResponse writes the second message: <- e, ee, se, psk and the encrypted payload
+func (n *NoiseHandshake) WriteResponse(payload []byte) ([]byte, error) {
+	message, err := n.writeEphemeral(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = n.mixDH(n.ephemeral, n.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if err = n.mixDH(n.ephemeral, n.remoteStatic); err != nil {
+		return nil, err
+	}
+	n.mixPresharedKey()
+
+	return n.appendPayload(message, payload)
+}
+
+// ReadResponse reads the second message and returns its payload, the handshake is complete afterwards
+func (n *NoiseHandshake) ReadResponse(message []byte) ([]byte, error) {
+	if len(message) < noiseKeyLength+noiseTagLength {
+		return nil, fmt.Errorf("noise response is too short")
+	}
+
+	rest := n.readEphemeral(message)
+
+	if err := n.mixDH(n.ephemeral, n.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if err := n.mixDH(n.staticPrivate, n.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	n.mixPresharedKey()
+
+	return n.symmetric.decryptAndHash(rest)
+}
+
+// RekeySecret returns the root secret of the in-band rekeys once the handshake is complete. It follows the transport
+// keys out of the final chaining key, so it depends on the pre-shared key like they do.
+func (n *NoiseHandshake) RekeySecret() []byte {
+	outputs := noiseHKDF(n.symmetric.hash, n.symmetric.chainingKey, nil, 3)
+	return outputs[2]
+}
+
+// Split returns the transport keys of both directions once the handshake is complete
+func (n *NoiseHandshake) Split() (initiatorToResponderKey []byte, responderToInitiatorKey []byte) {
+	outputs := noiseHKDF(n.symmetric.hash, n.symmetric.chainingKey, nil, 2)
+	return outputs[0], outputs[1]
+}
+
+func (n *NoiseHandshake) writeEphemeral(message []byte) ([]byte, error) {
+	ephemeral, err := n.generateEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	n.ephemeral = ephemeral
+
+	n.symmetric.mixHash(ephemeralPublic)
+	// With a pre-shared key, the ephemeral key is mixed into the keys as well
+	if n.withPSK {
+		n.symmetric.mixKey(ephemeralPublic)
+	}
+
+	return append(message, ephemeralPublic...), nil
+}
+
+func (n *NoiseHandshake) readEphemeral(message []byte) []byte {
+	n.remoteEphemeral = message[:noiseKeyLength]
+
+	n.symmetric.mixHash(n.remoteEphemeral)
+	if n.withPSK {
+		n.symmetric.mixKey(n.remoteEphemeral)
+	}
+
+	return message[noiseKeyLength:]
+}
+
+func (n *NoiseHandshake) mixDH(private []byte, public []byte) error {
+	sharedSecret, err := curve25519.X25519(private, public)
+	if err != nil {
+		return fmt.Errorf("invalid noise public key: %w", err)
+	}
+
+	n.symmetric.mixKey(sharedSecret)
+	return nil
+}
+
+func (n *NoiseHandshake) mixPresharedKey() {
+	if n.withPSK {
+		n.symmetric.mixKeyAndHash(n.presharedKey)
+	}
+}
+
+func (n *NoiseHandshake) appendPayload(message []byte, payload []byte) ([]byte, error) {
+	encryptedPayload, err := n.symmetric.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(message, encryptedPayload...), nil
+}
+
+// curve25519Prime is the field prime 2^255 - 19 both Ed25519 and X25519 keys live in
+var curve25519Prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// X25519PrivateKey converts an Ed25519 private key to the X25519 private key of the same scalar,
+// so the Ed25519 keys of the server and the clients double as their Noise static keys
+func X25519PrivateKey(privateKey ed25519.PrivateKey) []byte {
+	digest := sha512.Sum512(privateKey.Seed())
+	scalar := digest[:32]
+	scalar[0] &= 248
+	scalar[31] &= 127
+	scalar[31] |= 64
+
+	return scalar
+}
+
+// X25519PublicKey converts an Ed25519 public key to the X25519 public key matching X25519PrivateKey,
+// with the birational map u = (1 + y) / (1 - y) from the Edwards to the Montgomery curve
+func X25519PublicKey(publicKey ed25519.PublicKey) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+
+	// The point is encoded as y in little-endian, with the sign of x in the top bit
+	encoded := make([]byte, ed25519.PublicKeySize)
+	for i := range encoded {
+		encoded[i] = publicKey[len(publicKey)-1-i]
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519Prime)
+	if denominator.Sign() == 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, curve25519Prime))
+	u.Mod(u, curve25519Prime)
+
+	montgomery := make([]byte, noiseKeyLength)
+	u.FillBytes(montgomery)
+	for i, j := 0, len(montgomery)-1; i < j; i, j = i+1, j-1 {
+		montgomery[i], montgomery[j] = montgomery[j], montgomery[i]
+	}
+
+	return montgomery, nil
+}
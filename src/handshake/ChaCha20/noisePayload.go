@@ -0,0 +1,87 @@
+package ChaCha20
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// NoiseCapabilities are the capabilities available with the Noise handshake. The hybrid KEM and resumption
+// are bound to the signed handshake, so they are not offered.
+var NoiseCapabilities = []Capability{CapabilityRekey, CapabilityServerKeys}
+
+// noiseTimestampLength is the length of the initiation timestamp, unix nanoseconds in big-endian
+const noiseTimestampLength = 8
+
+// NoiseInitiationPayload is the encrypted payload of the Noise initiation. The timestamp grows with every
+// handshake of a client, so the server refuses a replayed initiation.
+type NoiseInitiationPayload struct {
+	Timestamp    time.Time
+	Capabilities []Capability // capabilities offered by the client
+}
+
+func (p *NoiseInitiationPayload) Read(data []byte) (*NoiseInitiationPayload, error) {
+	if len(data) < noiseTimestampLength {
+		return nil, fmt.Errorf("invalid noise initiation payload")
+	}
+	p.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(data[:noiseTimestampLength])))
+
+	capabilities, _, err := decodeCapabilities(data[noiseTimestampLength:])
+	if err != nil {
+		return nil, err
+	}
+	p.Capabilities = capabilities
+
+	return p, nil
+}
+
+func (p *NoiseInitiationPayload) Write(timestamp time.Time, capabilities []Capability) ([]byte, error) {
+	encodedCapabilities, err := encodeCapabilities(capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	arr := make([]byte, 0, noiseTimestampLength+len(encodedCapabilities))
+	arr = binary.BigEndian.AppendUint64(arr, uint64(timestamp.UnixNano()))
+	arr = append(arr, encodedCapabilities...)
+
+	return arr, nil
+}
+
+// NoiseResponsePayload is the encrypted payload of the Noise response, it carries what a server hello does
+// in the signed handshake: the tunnel addresses and the selected capabilities
+type NoiseResponsePayload struct {
+	IPv4         string
+	IPv6         string
+	Capabilities []Capability
+}
+
+func (p *NoiseResponsePayload) Read(data []byte) (*NoiseResponsePayload, error) {
+	ipv4, ipv6, addressesLength, err := decodeAddresses(data)
+	if err != nil {
+		return nil, err
+	}
+	p.IPv4, p.IPv6 = ipv4, ipv6
+
+	capabilities, _, err := decodeCapabilities(data[addressesLength:])
+	if err != nil {
+		return nil, err
+	}
+	p.Capabilities = capabilities
+
+	return p, nil
+}
+
+func (p *NoiseResponsePayload) Write(ipv4 string, ipv6 string, capabilities []Capability) ([]byte, error) {
+	addresses, err := encodeAddresses(ipv4, ipv6)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedCapabilities, err := encodeCapabilities(capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(addresses, encodedCapabilities...), nil
+}
@@ -0,0 +1,229 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+	"hash"
+	"testing"
+	"time"
+)
+
+// noiseVector is a test vector of the Noise specification test suite (cacophony format): the static and ephemeral
+// private keys of both sides, the handshake messages and a transport message in each direction
+type noiseVector struct {
+	protocol           NoiseProtocol
+	presharedKey       string
+	initiatorStatic    string
+	responderStatic    string
+	initiatorEphemeral string
+	responderEphemeral string
+	messages           [4]struct{ payload, ciphertext string }
+}
+
+var noiseVectors = []noiseVector{
+	{
+		protocol:           NoiseProtocol{Name: "Noise_IK_25519_ChaChaPoly_SHA256", Hash: sha256.New},
+		initiatorStatic:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		responderStatic:    "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		initiatorEphemeral: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		responderEphemeral: "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60",
+		messages: [4]struct{ payload, ciphertext string }{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662544f8445e5dc2467b1e32653192d05dee85c4781bf0dd8d33ceebb5905a7a069f09e0d3f2cad1c842930a762eb75e528270337527f958f92050deefa1892482d74328fee90d08201bba3cc"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466cb4a35db52355821787bb891112ba10f4d3dfe08b27d634db8af"},
+			{"79656c6c6f777375626d6172696e65", "226ca869f2777611f37350a7ab446f650c0cfe2855b7f020ce658bcf100f2d"},
+			{"7375626d6172696e6579656c6c6f77", "90d84d69cd44829283b05d684879b53b8d714e51619b601438a1ae67caacd9"},
+		},
+	},
+	{
+		protocol:           NoiseProtocol{Name: "Noise_IKpsk2_25519_ChaChaPoly_SHA256", Hash: sha256.New, WithPresharedKey: true},
+		presharedKey:       "2176657279736563726574766572797365637265747665727973656372657421",
+		initiatorStatic:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		responderStatic:    "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		initiatorEphemeral: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		responderEphemeral: "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60",
+		messages: [4]struct{ payload, ciphertext string }{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662545bdb2d5031ac09dcb167ccedf2898899c56e3e963e1e707a4df1bed7f3f9594b80af8aa87faa8e0f7b1b9c32a49360cdd218fc428fc8457cdf1952ae4c8d5ba601f8bf9547bc4e3b5083"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466b86d10d43f68d1d0667499f113d9a91c468559a52225e8f34d8c"},
+			{"79656c6c6f777375626d6172696e65", "abbc8826715c00752948d22874560b57dc102dbf6c3dd853037efdd9499ad0"},
+			{"7375626d6172696e6579656c6c6f77", "f80bad7ea7c64490f8123d2728a176c3afb97a59f197c7b1be246b7cd3eb1d"},
+		},
+	},
+	{
+		// The protocol of WireGuard, which hashes with BLAKE2s
+		protocol:           NoiseProtocol{Name: "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s", Hash: newBLAKE2s, WithPresharedKey: true},
+		presharedKey:       "2176657279736563726574766572797365637265747665727973656372657421",
+		initiatorStatic:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		responderStatic:    "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		initiatorEphemeral: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		responderEphemeral: "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60",
+		messages: [4]struct{ payload, ciphertext string }{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254d06f15f78ad0914d9715147bb5a5004b27345a838bab4aa8bc5f144afc2cf4cca972105ba526e8c92b759e028200e7666a3d77b86f9aa87dcfe685e771e38b97d3c5996368c663051641"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466168e6913e78d7a2b04b2f3d5529e73e953bafe6c7ce2b1005367"},
+			{"79656c6c6f777375626d6172696e65", "6013ea114b4c4884afb82bf029f72f924bd8a32c487a15a1cef4855ba234be"},
+			{"7375626d6172696e6579656c6c6f77", "8a2e7119635e41a35b7e64e0adac5483b66b1a9827895124ea07d58440b654"},
+		},
+	},
+}
+
+func newBLAKE2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %s", s, err)
+	}
+	return decoded
+}
+
+func fixedEphemeral(key []byte) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return key, nil
+	}
+}
+
+func TestNoiseHandshake_SpecificationVectors(t *testing.T) {
+	for _, vector := range noiseVectors {
+		t.Run(vector.protocol.Name, func(t *testing.T) {
+			responderStatic := mustDecodeHex(t, vector.responderStatic)
+			responderStaticPublic, _ := curve25519.X25519(responderStatic, curve25519.Basepoint)
+
+			initiator, err := vector.protocol.NewInitiator(mustDecodeHex(t, vector.initiatorStatic), responderStaticPublic)
+			if err != nil {
+				t.Fatalf("failed to create initiator: %s", err)
+			}
+			initiator.generateEphemeral = fixedEphemeral(mustDecodeHex(t, vector.initiatorEphemeral))
+			initiator.presharedKey = mustDecodeHex(t, vector.presharedKey)
+
+			responder, err := vector.protocol.NewResponder(responderStatic)
+			if err != nil {
+				t.Fatalf("failed to create responder: %s", err)
+			}
+			responder.generateEphemeral = fixedEphemeral(mustDecodeHex(t, vector.responderEphemeral))
+			responder.presharedKey = mustDecodeHex(t, vector.presharedKey)
+
+			initiation, err := initiator.WriteInitiation(mustDecodeHex(t, vector.messages[0].payload))
+			if err != nil {
+				t.Fatalf("failed to write initiation: %s", err)
+			}
+			if !bytes.Equal(initiation, mustDecodeHex(t, vector.messages[0].ciphertext)) {
+				t.Fatalf("initiation does not match the vector: %x", initiation)
+			}
+			payload, err := responder.ReadInitiation(initiation)
+			if err != nil || !bytes.Equal(payload, mustDecodeHex(t, vector.messages[0].payload)) {
+				t.Fatalf("failed to read initiation: %s", err)
+			}
+
+			response, err := responder.WriteResponse(mustDecodeHex(t, vector.messages[1].payload))
+			if err != nil {
+				t.Fatalf("failed to write response: %s", err)
+			}
+			if !bytes.Equal(response, mustDecodeHex(t, vector.messages[1].ciphertext)) {
+				t.Fatalf("response does not match the vector: %x", response)
+			}
+			payload, err = initiator.ReadResponse(response)
+			if err != nil || !bytes.Equal(payload, mustDecodeHex(t, vector.messages[1].payload)) {
+				t.Fatalf("failed to read response: %s", err)
+			}
+
+			// The transport messages of the vector check the split keys of both sides
+			initiatorToResponder, responderToInitiator := initiator.Split()
+			responderSend, _ := responder.Split()
+			if !bytes.Equal(initiatorToResponder, responderSend) {
+				t.Fatalf("expected both sides to split the same keys")
+			}
+			if !bytes.Equal(initiator.RekeySecret(), responder.RekeySecret()) || bytes.Equal(initiator.RekeySecret(), responderSend) {
+				t.Fatalf("expected both sides to derive the same rekey secret apart from the transport keys")
+			}
+			transport, _ := (&noiseCipherState{key: initiatorToResponder}).encrypt(nil, mustDecodeHex(t, vector.messages[2].payload))
+			if !bytes.Equal(transport, mustDecodeHex(t, vector.messages[2].ciphertext)) {
+				t.Errorf("initiator transport message does not match the vector: %x", transport)
+			}
+			transport, _ = (&noiseCipherState{key: responderToInitiator}).encrypt(nil, mustDecodeHex(t, vector.messages[3].payload))
+			if !bytes.Equal(transport, mustDecodeHex(t, vector.messages[3].ciphertext)) {
+				t.Errorf("responder transport message does not match the vector: %x", transport)
+			}
+		})
+	}
+}
+
+func TestNoiseHandshake_PresharedKeyMismatch(t *testing.T) {
+	_, serverPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	_, clientPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	serverStatic, _ := X25519PublicKey(serverPrivate.Public().(ed25519.PublicKey))
+
+	initiator, err := NewNoiseInitiator(X25519PrivateKey(clientPrivate), serverStatic, bytes.Repeat([]byte{1}, PresharedKeyLength))
+	if err != nil {
+		t.Fatalf("failed to create initiator: %s", err)
+	}
+	responder, err := NewNoiseResponder(X25519PrivateKey(serverPrivate))
+	if err != nil {
+		t.Fatalf("failed to create responder: %s", err)
+	}
+
+	initiation, _ := initiator.WriteInitiation([]byte("hello"))
+	if _, err = responder.ReadInitiation(initiation); err != nil {
+		t.Fatalf("failed to read initiation: %s", err)
+	}
+	clientStatic, _ := X25519PublicKey(clientPrivate.Public().(ed25519.PublicKey))
+	if !bytes.Equal(responder.RemoteStatic(), clientStatic) {
+		t.Errorf("expected the responder to learn the client static key")
+	}
+
+	// The responder has no pre-shared key for the client, so the initiator cannot read its response
+	response, _ := responder.WriteResponse(nil)
+	if _, err = initiator.ReadResponse(response); !errors.Is(err, ErrNoiseDecryption) {
+		t.Errorf("expected a decryption error, got %v", err)
+	}
+}
+
+func TestX25519Keys_MatchEd25519KeyPair(t *testing.T) {
+	for range 8 {
+		public, private, _ := ed25519.GenerateKey(rand.Reader)
+
+		converted, err := X25519PublicKey(public)
+		if err != nil {
+			t.Fatalf("failed to convert public key: %s", err)
+		}
+		derived, _ := curve25519.X25519(X25519PrivateKey(private), curve25519.Basepoint)
+		if !bytes.Equal(converted, derived) {
+			t.Fatalf("expected the converted public key to match the converted private key")
+		}
+	}
+}
+
+func TestNoisePayloads_RoundTrip(t *testing.T) {
+	timestamp := time.Unix(0, 1234567890)
+	data, err := (&NoiseInitiationPayload{}).Write(timestamp, NoiseCapabilities)
+	if err != nil {
+		t.Fatalf("failed to write initiation payload: %s", err)
+	}
+	initiation, err := (&NoiseInitiationPayload{}).Read(data)
+	if err != nil {
+		t.Fatalf("failed to read initiation payload: %s", err)
+	}
+	if !initiation.Timestamp.Equal(timestamp) || !HasCapability(initiation.Capabilities, CapabilityServerKeys) {
+		t.Errorf("unexpected initiation payload: %+v", initiation)
+	}
+
+	data, err = (&NoiseResponsePayload{}).Write("10.0.0.2/24", "fd00::2/64", []Capability{CapabilityRekey})
+	if err != nil {
+		t.Fatalf("failed to write response payload: %s", err)
+	}
+	response, err := (&NoiseResponsePayload{}).Read(data)
+	if err != nil {
+		t.Fatalf("failed to read response payload: %s", err)
+	}
+	if response.IPv4 != "10.0.0.2/24" || response.IPv6 != "fd00::2/64" || !HasCapability(response.Capabilities, CapabilityRekey) {
+		t.Errorf("unexpected response payload: %+v", response)
+	}
+}
@@ -0,0 +1,289 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"time"
+)
+
+// Control frames travel inside the encrypted channel next to the tunneled packets.
+// A tunneled IP packet always starts with version 4 or 6, so a zero high nibble marks a control frame.
+const (
+	RekeyInitFrame    byte = 0x01 // initiator -> responder: fresh curve public key
+	RekeyAckFrame     byte = 0x02 // responder -> initiator: fresh curve public key, still under the old key
+	RekeyConfirmFrame byte = 0x03 // initiator -> responder: first frame under the new key
+)
+
+const (
+	rekeyFrameLength = 1 + 32
+	// rekeyRetryTimeout is how long the initiator waits for an ack before resending the init frame
+	rekeyRetryTimeout = 5 * time.Second
+	// rekeyOverlap is how long packets under the replaced receive key are still accepted
+	rekeyOverlap = 30 * time.Second
+)
+
+type rekeyState struct {
+	// secret is mixed into the keys of every rekey and ratcheted forward by it, it comes from the handshake keys
+	secret []byte
+	// Initiator side
+	curvePrivate []byte
+	curvePublic  []byte
+	startedAt    time.Time
+	// Responder side, a repeated init frame is answered with the same ack
+	lastInitPublic []byte
+	lastAck        []byte
+}
+
+// SetRekeySecret keeps the rekey root secret derived in the handshake, next to the pre-shared key it was mixed with
+func (s *Session) SetRekeySecret(secret []byte) {
+	s.rekeyMutex.Lock()
+	defer s.rekeyMutex.Unlock()
+
+	s.rekey.secret = secret
+}
+
+// IsControlFrame reports whether a decrypted plaintext is a control frame rather than a tunneled packet
+func IsControlFrame(plaintext []byte) bool {
+	return len(plaintext) > 0 && plaintext[0]>>4 == 0
+}
+
+// NeedsRekey reports whether the initiator should send a rekey init frame
+func (s *Session) NeedsRekey() bool {
+	s.rekeyMutex.Lock()
+	defer s.rekeyMutex.Unlock()
+
+	if s.rekey.curvePrivate != nil {
+		return time.Since(s.rekey.startedAt) >= rekeyRetryTimeout
+	}
+
+	if s.RekeyAfterBytes > 0 && s.trafficBytes.Load() >= s.RekeyAfterBytes {
+		return true
+	}
+
+	return s.RekeyAfterTime > 0 && time.Since(time.Unix(0, s.keyCreatedAt.Load())) >= s.RekeyAfterTime
+}
+
+// InitiateRekey returns the rekey init frame. A retry reuses the ephemeral key of the pending rekey,
+// so an ack to any of the sent init frames completes it.
+func (s *Session) InitiateRekey() ([]byte, error) {
+	s.rekeyMutex.Lock()
+	defer s.rekeyMutex.Unlock()
+
+	if s.rekey.curvePrivate == nil {
+		curvePrivate := make([]byte, 32)
+		_, err := io.ReadFull(rand.Reader, curvePrivate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate rekey curve private key: %w", err)
+		}
+		curvePublic, err := curve25519.X25519(curvePrivate, curve25519.Basepoint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate rekey curve public key: %w", err)
+		}
+		s.rekey.curvePrivate = curvePrivate
+		s.rekey.curvePublic = curvePublic
+	}
+	s.rekey.startedAt = time.Now()
+
+	return append([]byte{RekeyInitFrame}, s.rekey.curvePublic...), nil
+}
+
+// HandleControlFrame processes a decrypted control frame and returns the frame to send back, if any
+func (s *Session) HandleControlFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 1 {
+		return nil, fmt.Errorf("empty control frame")
+	}
+
+	switch frame[0] {
+	case RekeyInitFrame:
+		if len(frame) < rekeyFrameLength {
+			return nil, fmt.Errorf("invalid rekey init frame")
+		}
+		return s.onRekeyInit(frame[1:rekeyFrameLength])
+	case RekeyAckFrame:
+		if len(frame) < rekeyFrameLength {
+			return nil, fmt.Errorf("invalid rekey ack frame")
+		}
+		return s.onRekeyAck(frame[1:rekeyFrameLength])
+	case RekeyConfirmFrame:
+		// The new keys were confirmed by decrypting this frame
+		return nil, nil
+	case NewTicketFrame:
+		return nil, s.onNewTicket(frame[1:])
+	case ServerKeysFrame:
+		return nil, s.onServerKeys(frame[1:])
+	case EnrollmentFrame:
+		return nil, s.onEnrollment(frame[1:])
+	default:
+		return nil, fmt.Errorf("unknown control frame: %d", frame[0])
+	}
+}
+
+// onRekeyInit switches the receive key right away, while the send key is switched
+// only once a frame under the new receive key proves the initiator has it too
+func (s *Session) onRekeyInit(initiatorPublic []byte) ([]byte, error) {
+	s.rekeyMutex.Lock()
+	defer s.rekeyMutex.Unlock()
+
+	if s.rekey.lastAck != nil && bytes.Equal(s.rekey.lastInitPublic, initiatorPublic) {
+		return s.rekey.lastAck, nil
+	}
+
+	curvePrivate := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, curvePrivate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate rekey curve private key: %w", err)
+	}
+	curvePublic, err := curve25519.X25519(curvePrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate rekey curve public key: %w", err)
+	}
+
+	sendKey, recvKey, err := s.deriveRekeyKeys(curvePrivate, initiatorPublic, initiatorPublic, curvePublic)
+	if err != nil {
+		return nil, err
+	}
+	sendCipher, recvCipher, err := newCiphers(s.suite, sendKey, recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recvNonceMutex.Lock()
+	// An unconfirmed rekey is superseded, the key in use before it stays the previous one
+	if s.pendingSend == nil {
+		s.previousRecv = &previousRecvKey{
+			cipher:       s.recvCipher,
+			nonce:        s.RecvNonce,
+			replayWindow: s.replayWindow,
+		}
+	}
+	s.recvCipher = recvCipher
+	s.RecvNonce = [12]byte{}
+	s.replayWindow = ReplayWindow{}
+	s.pendingSend = sendCipher
+	s.recvNonceMutex.Unlock()
+
+	s.rekey.lastInitPublic = append([]byte(nil), initiatorPublic...)
+	s.rekey.lastAck = append([]byte{RekeyAckFrame}, curvePublic...)
+
+	return s.rekey.lastAck, nil
+}
+
+// onRekeyAck switches both keys and returns the confirm frame, which is the first one under the new send key
+func (s *Session) onRekeyAck(responderPublic []byte) ([]byte, error) {
+	s.rekeyMutex.Lock()
+	defer s.rekeyMutex.Unlock()
+
+	// A repeated ack of an already completed rekey
+	if s.rekey.curvePrivate == nil {
+		return nil, nil
+	}
+
+	sendKey, recvKey, err := s.deriveRekeyKeys(s.rekey.curvePrivate, responderPublic, s.rekey.curvePublic, responderPublic)
+	if err != nil {
+		return nil, err
+	}
+	sendCipher, recvCipher, err := newCiphers(s.suite, sendKey, recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recvNonceMutex.Lock()
+	s.previousRecv = &previousRecvKey{
+		cipher:       s.recvCipher,
+		nonce:        s.RecvNonce,
+		replayWindow: s.replayWindow,
+		expiresAt:    time.Now().Add(rekeyOverlap),
+	}
+	s.recvCipher = recvCipher
+	s.RecvNonce = [12]byte{}
+	s.replayWindow = ReplayWindow{}
+	s.recvNonceMutex.Unlock()
+
+	s.sendNonceMutex.Lock()
+	s.switchSendCipher(sendCipher)
+	s.sendNonceMutex.Unlock()
+
+	s.rekey.curvePrivate = nil
+	s.rekey.curvePublic = nil
+
+	return []byte{RekeyConfirmFrame}, nil
+}
+
+// onCurrentKeyUsed is called with the receive lock held once a frame is decrypted under the current receive key
+func (s *Session) onCurrentKeyUsed(plaintextLength int) {
+	s.trafficBytes.Add(uint64(plaintextLength))
+
+	if s.pendingSend == nil {
+		return
+	}
+
+	// The initiator has switched to the new keys, so the responder switches its send key as well
+	s.sendNonceMutex.Lock()
+	s.switchSendCipher(s.pendingSend)
+	s.sendNonceMutex.Unlock()
+	s.pendingSend = nil
+	if s.previousRecv != nil {
+		s.previousRecv.expiresAt = time.Now().Add(rekeyOverlap)
+	}
+}
+
+// activePreviousRecv returns the previous receive key unless its overlap is over, the receive lock must be held
+func (s *Session) activePreviousRecv() *previousRecvKey {
+	if s.previousRecv == nil {
+		return nil
+	}
+
+	if !s.previousRecv.expiresAt.IsZero() && time.Now().After(s.previousRecv.expiresAt) {
+		s.previousRecv = nil
+		return nil
+	}
+
+	return s.previousRecv
+}
+
+// switchSendCipher installs a new send key, the send lock must be held
+func (s *Session) switchSendCipher(sendCipher cipher.AEAD) {
+	s.sendCipher = sendCipher
+	s.SendNonce = [12]byte{}
+	s.trafficBytes.Store(0)
+	s.keyCreatedAt.Store(time.Now().UnixNano())
+}
+
+// deriveRekeyKeys derives the new send and receive keys the same way the handshake does, from the fresh shared secret
+// and the rekey secret, salted with the session id and both public keys of the rekey exchange. The rekey secret is
+// ratcheted forward, so every rekey depends on the pre-shared key and on all the exchanges before it.
+// The rekey lock must be held.
+func (s *Session) deriveRekeyKeys(curvePrivate, peerPublic, initiatorPublic, responderPublic []byte) ([]byte, []byte, error) {
+	sharedSecret, err := curve25519.X25519(curvePrivate, peerPublic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid rekey curve public key: %w", err)
+	}
+
+	saltData := make([]byte, 0, len(s.SessionId)+len(initiatorPublic)+len(responderPublic))
+	saltData = append(saltData, s.SessionId[:]...)
+	saltData = append(saltData, initiatorPublic...)
+	saltData = append(saltData, responderPublic...)
+	salt := sha256.Sum256(saltData)
+
+	ikm := keyMaterial(sharedSecret, s.rekey.secret)
+	serverToClientKey := make([]byte, chacha20poly1305.KeySize)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, ikm, salt[:], []byte("server-to-client")), serverToClientKey)
+	clientToServerKey := make([]byte, chacha20poly1305.KeySize)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, ikm, salt[:], []byte("client-to-server")), clientToServerKey)
+	nextSecret := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, ikm, salt[:], []byte("rekey")), nextSecret)
+	s.rekey.secret = nextSecret
+
+	if s.isServer {
+		return serverToClientKey, clientToServerKey, nil
+	}
+
+	return clientToServerKey, serverToClientKey, nil
+}
@@ -0,0 +1,197 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"golang.org/x/crypto/curve25519"
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T) (*Session, *Session) {
+	clientToServerKey := bytes.Repeat([]byte{1}, 32)
+	serverToClientKey := bytes.Repeat([]byte{2}, 32)
+
+	client, err := NewSession(CipherSuiteChaCha20Poly1305, clientToServerKey, serverToClientKey, false)
+	if err != nil {
+		t.Fatalf("failed to create client session: %s", err)
+	}
+	server, err := NewSession(CipherSuiteChaCha20Poly1305, serverToClientKey, clientToServerKey, true)
+	if err != nil {
+		t.Fatalf("failed to create server session: %s", err)
+	}
+	rekeySecret := bytes.Repeat([]byte{3}, 32)
+	client.SetRekeySecret(rekeySecret)
+	server.SetRekeySecret(rekeySecret)
+
+	return client, server
+}
+
+func TestSession_RekeyDependsOnPresharedKey(t *testing.T) {
+	sharedSecret := bytes.Repeat([]byte{4}, 32)
+	transcriptHash := bytes.Repeat([]byte{5}, 32)
+	curvePrivate := bytes.Repeat([]byte{6}, 32)
+	curvePublic, _ := curve25519.X25519(curvePrivate, curve25519.Basepoint)
+	peerPublic, _ := curve25519.X25519(bytes.Repeat([]byte{7}, 32), curve25519.Basepoint)
+
+	rekeyedSendKeys := func(presharedKey []byte) ([]byte, []byte) {
+		session, _ := newSessionPair(t)
+		session.SetRekeySecret(DeriveRekeySecret(sharedSecret, presharedKey, transcriptHash))
+		first, _, err := session.deriveRekeyKeys(curvePrivate, peerPublic, curvePublic, peerPublic)
+		if err != nil {
+			t.Fatalf("failed to derive rekey keys: %s", err)
+		}
+		second, _, _ := session.deriveRekeyKeys(curvePrivate, peerPublic, curvePublic, peerPublic)
+		return first, second
+	}
+
+	first, second := rekeyedSendKeys(bytes.Repeat([]byte{8}, 32))
+	otherFirst, _ := rekeyedSendKeys(bytes.Repeat([]byte{9}, 32))
+	if bytes.Equal(first, otherFirst) {
+		t.Errorf("expected sessions with different pre-shared keys to derive different rekeyed keys")
+	}
+	// The same exchange repeated later derives other keys, as the rekey secret is ratcheted forward
+	if bytes.Equal(first, second) {
+		t.Errorf("expected the rekey secret to be ratcheted forward")
+	}
+}
+
+func mustEncrypt(t *testing.T, s *Session, plaintext []byte) []byte {
+	ciphertext, err := s.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	return ciphertext
+}
+
+func mustDecrypt(t *testing.T, s *Session, ciphertext []byte, expected []byte) {
+	plaintext, err := s.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(plaintext, expected) {
+		t.Fatalf("expected %v, got %v", expected, plaintext)
+	}
+}
+
+func TestSession_RekeyOverStream(t *testing.T) {
+	client, server := newSessionPair(t)
+	oldPacket := []byte{0x45, 1}
+	newPacket := []byte{0x45, 2}
+
+	rekeyInit, err := client.InitiateRekey()
+	if err != nil {
+		t.Fatalf("failed to initiate rekey: %s", err)
+	}
+	mustDecrypt(t, server, mustEncrypt(t, client, rekeyInit), rekeyInit)
+	rekeyAck, err := server.HandleControlFrame(rekeyInit)
+	if err != nil {
+		t.Fatalf("failed to handle rekey init: %s", err)
+	}
+
+	// Packets sent under the old keys while the ack is in flight
+	clientInFlight := mustEncrypt(t, client, oldPacket)
+	encryptedAck := mustEncrypt(t, server, rekeyAck)
+	serverInFlight := mustEncrypt(t, server, oldPacket)
+
+	mustDecrypt(t, client, encryptedAck, rekeyAck)
+	rekeyConfirm, err := client.HandleControlFrame(rekeyAck)
+	if err != nil {
+		t.Fatalf("failed to handle rekey ack: %s", err)
+	}
+	encryptedConfirm := mustEncrypt(t, client, rekeyConfirm)
+
+	mustDecrypt(t, server, clientInFlight, oldPacket)
+	mustDecrypt(t, server, encryptedConfirm, rekeyConfirm)
+	mustDecrypt(t, client, serverInFlight, oldPacket)
+
+	// Both sides have switched to the new keys
+	mustDecrypt(t, server, mustEncrypt(t, client, newPacket), newPacket)
+	mustDecrypt(t, client, mustEncrypt(t, server, newPacket), newPacket)
+	if server.SendNonce != [12]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1} {
+		t.Errorf("expected server send nonce to restart with the new key, got %v", server.SendNonce)
+	}
+}
+
+func TestSession_RekeyDatagramOverlap(t *testing.T) {
+	client, server := newSessionPair(t)
+	packet := []byte{0x60, 1}
+
+	oldDatagram, _ := client.EncryptDatagram(packet)
+
+	rekeyInit, _ := client.InitiateRekey()
+	rekeyAck, err := server.HandleControlFrame(rekeyInit)
+	if err != nil {
+		t.Fatalf("failed to handle rekey init: %s", err)
+	}
+	if _, err = client.HandleControlFrame(rekeyAck); err != nil {
+		t.Fatalf("failed to handle rekey ack: %s", err)
+	}
+
+	newDatagram, _ := client.EncryptDatagram(packet)
+
+	// The datagram under the new key overtakes the one under the old key
+	if _, err = server.DecryptDatagram(newDatagram); err != nil {
+		t.Fatalf("failed to decrypt datagram under the new key: %s", err)
+	}
+	if _, err = server.DecryptDatagram(oldDatagram); err != nil {
+		t.Fatalf("failed to decrypt datagram under the old key: %s", err)
+	}
+	if _, err = server.DecryptDatagram(oldDatagram); err == nil {
+		t.Errorf("expected replayed datagram under the old key to be rejected")
+	}
+
+	// Once the overlap is over the old key is dropped
+	server.recvNonceMutex.Lock()
+	server.previousRecv.expiresAt = time.Now().Add(-time.Second)
+	server.recvNonceMutex.Unlock()
+	if _, err = server.DecryptDatagram(oldDatagram); err == nil {
+		t.Errorf("expected datagram under the expired key to be rejected")
+	}
+}
+
+func TestSession_RepeatedRekeyInitGetsSameAck(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	rekeyInit, _ := client.InitiateRekey()
+	firstAck, _ := server.HandleControlFrame(rekeyInit)
+
+	retriedInit, _ := client.InitiateRekey()
+	if !bytes.Equal(rekeyInit, retriedInit) {
+		t.Fatalf("expected retried rekey init to reuse the pending key")
+	}
+	secondAck, _ := server.HandleControlFrame(retriedInit)
+	if !bytes.Equal(firstAck, secondAck) {
+		t.Errorf("expected repeated rekey init to be answered with the same ack")
+	}
+}
+
+func TestSession_NeedsRekey(t *testing.T) {
+	client, _ := newSessionPair(t)
+	if client.NeedsRekey() {
+		t.Errorf("expected no rekey with thresholds disabled")
+	}
+
+	client.RekeyAfterBytes = 4
+	_, _ = client.Encrypt([]byte{0x45, 0, 0})
+	if client.NeedsRekey() {
+		t.Errorf("expected no rekey below the traffic threshold")
+	}
+	_, _ = client.Encrypt([]byte{0x45, 0, 0})
+	if !client.NeedsRekey() {
+		t.Errorf("expected rekey above the traffic threshold")
+	}
+
+	_, _ = client.InitiateRekey()
+	if client.NeedsRekey() {
+		t.Errorf("expected no rekey while one is pending")
+	}
+}
+
+func TestIsControlFrame(t *testing.T) {
+	if !IsControlFrame([]byte{RekeyInitFrame}) {
+		t.Errorf("expected rekey init to be a control frame")
+	}
+	if IsControlFrame([]byte{0x45}) || IsControlFrame([]byte{0x60}) {
+		t.Errorf("expected IP packets not to be control frames")
+	}
+}
@@ -0,0 +1,53 @@
+package ChaCha20
+
+const (
+	replayWindowWords = 32
+	replayWindowBits  = replayWindowWords * 64
+	// replayWindowSize is the number of counters behind the highest accepted one that can still be accepted.
+	// One word of the bitmap is always kept as a spare, so the window slides word by word (RFC 6479).
+	replayWindowSize = replayWindowBits - 64
+)
+
+// ReplayWindow is a sliding anti-replay window over explicit datagram counters.
+// It is not safe for concurrent use, callers are expected to hold the receive mutex of the session.
+type ReplayWindow struct {
+	last     uint64 // highest accepted counter
+	accepted bool   // false until the first counter is accepted
+	bitmap   [replayWindowWords]uint64
+}
+
+// Check reports whether counter is neither a replay nor too old to fit in the window.
+// Check does not change the window, call Accept once the datagram is authenticated.
+func (w *ReplayWindow) Check(counter uint64) bool {
+	if !w.accepted || counter > w.last {
+		return true
+	}
+
+	if w.last-counter >= replayWindowSize {
+		return false
+	}
+
+	word := (counter / 64) % replayWindowWords
+	return w.bitmap[word]&(1<<(counter%64)) == 0
+}
+
+// Accept marks counter as received, sliding the window forward if needed.
+func (w *ReplayWindow) Accept(counter uint64) {
+	if !w.accepted || counter > w.last {
+		if w.accepted {
+			currentWord := w.last / 64
+			diff := counter/64 - currentWord
+			if diff > replayWindowWords {
+				diff = replayWindowWords
+			}
+			for i := uint64(1); i <= diff; i++ {
+				w.bitmap[(currentWord+i)%replayWindowWords] = 0
+			}
+		}
+		w.last = counter
+		w.accepted = true
+	}
+
+	word := (counter / 64) % replayWindowWords
+	w.bitmap[word] |= 1 << (counter % 64)
+}
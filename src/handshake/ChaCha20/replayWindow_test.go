@@ -0,0 +1,151 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReplayWindow_AcceptsOutOfOrder(t *testing.T) {
+	var w ReplayWindow
+
+	for _, counter := range []uint64{0, 2, 1, 5, 3, 4} {
+		if !w.Check(counter) {
+			t.Fatalf("expected counter %d to be accepted", counter)
+		}
+		w.Accept(counter)
+	}
+}
+
+func TestReplayWindow_RejectsReplay(t *testing.T) {
+	var w ReplayWindow
+
+	w.Accept(0)
+	w.Accept(10)
+
+	if w.Check(0) {
+		t.Errorf("expected replayed counter 0 to be rejected")
+	}
+
+	if w.Check(10) {
+		t.Errorf("expected replayed counter 10 to be rejected")
+	}
+
+	if !w.Check(5) {
+		t.Errorf("expected counter 5 to be accepted")
+	}
+}
+
+func TestReplayWindow_RejectsTooOld(t *testing.T) {
+	var w ReplayWindow
+
+	w.Accept(replayWindowSize + 100)
+
+	if w.Check(99) {
+		t.Errorf("expected counter outside of the window to be rejected")
+	}
+
+	if !w.Check(101) {
+		t.Errorf("expected counter inside of the window to be accepted")
+	}
+}
+
+func TestReplayWindow_SlidesForward(t *testing.T) {
+	var w ReplayWindow
+
+	w.Accept(1)
+	w.Accept(1 + replayWindowBits)
+
+	// The word of counter 1 is reused by the window, so the bit must have been cleared
+	if !w.Check(1 + replayWindowBits - 64) {
+		t.Errorf("expected counter reusing a cleared word to be accepted")
+	}
+}
+
+func TestSession_DatagramRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	client, err := NewSession(CipherSuiteChaCha20Poly1305, key, key, false)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	server, err := NewSession(CipherSuiteChaCha20Poly1305, key, key, true)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+
+	first, _ := client.EncryptDatagram([]byte("first"))
+	second, _ := client.EncryptDatagram([]byte("second"))
+
+	plaintext, err := server.DecryptDatagram(second)
+	if err != nil || string(plaintext) != "second" {
+		t.Fatalf("failed to decrypt reordered datagram: %v", err)
+	}
+
+	plaintext, err = server.DecryptDatagram(first)
+	if err != nil || string(plaintext) != "first" {
+		t.Fatalf("failed to decrypt late datagram: %v", err)
+	}
+
+	if _, err = server.DecryptDatagram(first); err == nil {
+		t.Errorf("expected replayed datagram to be rejected")
+	}
+}
+
+func TestSession_Authenticates(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	client, _ := NewSession(CipherSuiteChaCha20Poly1305, key, key, false)
+	server, _ := NewSession(CipherSuiteChaCha20Poly1305, key, key, true)
+	other, _ := NewSession(CipherSuiteChaCha20Poly1305, bytes.Repeat([]byte{2}, 32), key, false)
+
+	datagram, _ := client.EncryptDatagram([]byte("packet"))
+	if !server.Authenticates(datagram) {
+		t.Fatalf("expected datagram of the session to be authenticated")
+	}
+
+	// The counter is not accepted by the check, so the datagram still decrypts once
+	if _, err := server.DecryptDatagram(datagram); err != nil {
+		t.Fatalf("failed to decrypt checked datagram: %v", err)
+	}
+	if server.Authenticates(datagram) {
+		t.Errorf("expected replayed datagram not to be authenticated")
+	}
+
+	forged, _ := other.EncryptDatagram([]byte("packet"))
+	if server.Authenticates(forged) {
+		t.Errorf("expected datagram of another session not to be authenticated")
+	}
+}
+
+func TestSession_DatagramReceiverIndex(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	client, _ := NewSession(CipherSuiteChaCha20Poly1305, key, key, false)
+	server, _ := NewSession(CipherSuiteChaCha20Poly1305, key, key, true)
+	other, _ := NewSession(CipherSuiteChaCha20Poly1305, key, key, true)
+	client.SetSessionId([32]byte{1})
+	server.SetSessionId([32]byte{1})
+	other.SetSessionId([32]byte{2})
+
+	datagram, _ := client.EncryptDatagram([]byte("packet"))
+	index, ok := DatagramReceiverIndex(datagram)
+	if !ok || index != server.ReceiverIndex() {
+		t.Fatalf("expected datagram to carry the receiver index of the session")
+	}
+	if other.ReceiverIndex() == server.ReceiverIndex() {
+		t.Fatalf("expected sessions with different ids to have different receiver indexes")
+	}
+
+	// A datagram addressed to another session is rejected without being decrypted
+	if other.Authenticates(datagram) {
+		t.Errorf("expected datagram of another session not to be authenticated")
+	}
+	if _, err := other.DecryptDatagram(datagram); err == nil {
+		t.Errorf("expected datagram of another session to be rejected")
+	}
+
+	if _, err := server.DecryptDatagram(datagram); err != nil {
+		t.Fatalf("failed to decrypt datagram: %v", err)
+	}
+
+	if _, ok = DatagramReceiverIndex(datagram[:DatagramReceiverIndexLength]); ok {
+		t.Errorf("expected datagram without a counter to have no receiver index")
+	}
+}
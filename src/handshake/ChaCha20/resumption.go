@@ -0,0 +1,216 @@
+package ChaCha20
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+	"time"
+)
+
+// NewTicketFrame is the control frame the server hands a resumption ticket to the client in
+const NewTicketFrame byte = 0x04
+
+const (
+	maxTicketLength = 1024
+	// resumeBodyFixedLength is 32 (curve pub key) + 32 (nonce) + 32 (binder)
+	resumeBodyFixedLength = 32 + 32 + sha256.Size
+)
+
+// ResumptionTicket is what a client keeps to resume its session on reconnect with a single round trip
+type ResumptionTicket struct {
+	Ticket       []byte // opaque to the client, sealed with a server ticket key
+	Secret       []byte // resumption secret the ticket was issued for
+	ExpiresAt    time.Time
+	CipherSuite  CipherSuite
+	Capabilities []Capability
+}
+
+// resumptionState is the client side of the next resumption, guarded by its own mutex
+type resumptionState struct {
+	mu           sync.Mutex
+	secret       []byte
+	capabilities []Capability
+	ticket       *ResumptionTicket
+}
+
+// SetResumptionSecret keeps the resumption secret of the handshake, so a ticket issued for it can be used later
+func (s *Session) SetResumptionSecret(secret []byte, capabilities []Capability) {
+	s.resumption.mu.Lock()
+	defer s.resumption.mu.Unlock()
+
+	s.resumption.secret = secret
+	s.resumption.capabilities = capabilities
+}
+
+// ResumptionTicket returns the last ticket the server issued in this session, nil if none
+func (s *Session) ResumptionTicket() *ResumptionTicket {
+	s.resumption.mu.Lock()
+	defer s.resumption.mu.Unlock()
+
+	return s.resumption.ticket
+}
+
+// WriteNewTicketFrame encodes a ticket valid for lifetime into a control frame
+func WriteNewTicketFrame(ticket []byte, lifetime time.Duration) ([]byte, error) {
+	if len(ticket) > maxTicketLength {
+		return nil, fmt.Errorf("ticket is too long: %d", len(ticket))
+	}
+
+	frame := make([]byte, 1+4, 1+4+len(ticket))
+	frame[0] = NewTicketFrame
+	binary.BigEndian.PutUint32(frame[1:], uint32(lifetime/time.Second))
+	return append(frame, ticket...), nil
+}
+
+func (s *Session) onNewTicket(frame []byte) error {
+	if len(frame) < 4 || len(frame)-4 > maxTicketLength {
+		return fmt.Errorf("invalid new ticket frame")
+	}
+
+	s.resumption.mu.Lock()
+	defer s.resumption.mu.Unlock()
+
+	if s.resumption.secret == nil {
+		return fmt.Errorf("unexpected new ticket frame")
+	}
+
+	lifetime := time.Duration(binary.BigEndian.Uint32(frame)) * time.Second
+	s.resumption.ticket = &ResumptionTicket{
+		Ticket:       append([]byte(nil), frame[4:]...),
+		Secret:       s.resumption.secret,
+		ExpiresAt:    time.Now().Add(lifetime),
+		CipherSuite:  s.suite,
+		Capabilities: s.resumption.capabilities,
+	}
+
+	return nil
+}
+
+// ResumeHello asks to resume a session from a ticket, a fresh X25519 exchange keeps resumed sessions forward secret
+type ResumeHello struct {
+	Ticket         []byte
+	CurvePublicKey []byte
+	ClientNonce    []byte
+	Binder         []byte // proves the client knows the resumption secret of the ticket
+}
+
+func (m *ResumeHello) Read(data []byte) (*ResumeHello, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("invalid message")
+	}
+
+	ticketLength := int(binary.BigEndian.Uint16(data))
+	if ticketLength > maxTicketLength || len(data) < 2+ticketLength+resumeBodyFixedLength {
+		return nil, fmt.Errorf("invalid ticket length")
+	}
+
+	m.Ticket = data[2 : 2+ticketLength]
+	offset := 2 + ticketLength
+	m.CurvePublicKey = data[offset : offset+32]
+	m.ClientNonce = data[offset+32 : offset+64]
+	m.Binder = data[offset+64 : offset+resumeBodyFixedLength]
+
+	return m, nil
+}
+
+func (m *ResumeHello) Write(ticket []byte, curvePublic []byte, nonce []byte, binder []byte) ([]byte, error) {
+	if len(ticket) > maxTicketLength {
+		return nil, fmt.Errorf("invalid ticket")
+	}
+
+	if len(curvePublic) != 32 || len(nonce) != 32 || len(binder) != sha256.Size {
+		return nil, fmt.Errorf("invalid resume hello")
+	}
+
+	arr := make([]byte, 2, 2+len(ticket)+resumeBodyFixedLength)
+	binary.BigEndian.PutUint16(arr, uint16(len(ticket)))
+	arr = append(arr, ticket...)
+	arr = append(arr, curvePublic...)
+	arr = append(arr, nonce...)
+	arr = append(arr, binder...)
+
+	return arr, nil
+}
+
+// ResumeAccept completes a resumption, carrying the tunnel addresses the same way ServerHello does
+type ResumeAccept struct {
+	CurvePublicKey []byte
+	ServerNonce    []byte
+	IPv4           string
+	IPv6           string
+	Binder         []byte // proves the server opened the ticket
+}
+
+func (m *ResumeAccept) Read(data []byte) (*ResumeAccept, error) {
+	if len(data) < 32+32+2 {
+		return nil, fmt.Errorf("invalid message")
+	}
+
+	m.CurvePublicKey = data[:32]
+	m.ServerNonce = data[32:64]
+
+	ipv4Length := int(data[64])
+	if len(data) < 64+1+ipv4Length+1 {
+		return nil, fmt.Errorf("invalid IPv4 address length")
+	}
+	m.IPv4 = string(data[65 : 65+ipv4Length])
+
+	ipv6Offset := 65 + ipv4Length
+	ipv6Length := int(data[ipv6Offset])
+	if len(data) < ipv6Offset+1+ipv6Length+sha256.Size {
+		return nil, fmt.Errorf("invalid IPv6 address length")
+	}
+	m.IPv6 = string(data[ipv6Offset+1 : ipv6Offset+1+ipv6Length])
+	m.Binder = data[ipv6Offset+1+ipv6Length : ipv6Offset+1+ipv6Length+sha256.Size]
+
+	return m, nil
+}
+
+func (m *ResumeAccept) Write(curvePublic []byte, nonce []byte, ipv4 string, ipv6 string, binder []byte) ([]byte, error) {
+	if len(curvePublic) != 32 || len(nonce) != 32 || len(binder) != sha256.Size {
+		return nil, fmt.Errorf("invalid resume accept")
+	}
+
+	addresses, err := encodeAddresses(ipv4, ipv6)
+	if err != nil {
+		return nil, err
+	}
+
+	arr := make([]byte, 0, 64+len(addresses)+len(binder))
+	arr = append(arr, curvePublic...)
+	arr = append(arr, nonce...)
+	arr = append(arr, addresses...)
+	arr = append(arr, binder...)
+
+	return arr, nil
+}
+
+// ResumeHelloBinder authenticates the client hello of a resumption with the resumption secret
+func ResumeHelloBinder(secret []byte, ticket []byte, curvePublic []byte, clientNonce []byte) []byte {
+	return resumptionMAC(secret, []byte("client-to-server"), ticket, curvePublic, clientNonce)
+}
+
+// ResumeAcceptBinder authenticates the server reply of a resumption, bound to the client hello through its binder
+func ResumeAcceptBinder(secret []byte, clientBinder []byte, curvePublic []byte, serverNonce []byte, ipv4 string, ipv6 string) ([]byte, error) {
+	addresses, err := encodeAddresses(ipv4, ipv6)
+	if err != nil {
+		return nil, err
+	}
+
+	return resumptionMAC(secret, []byte("server-to-client"), clientBinder, curvePublic, serverNonce, addresses), nil
+}
+
+func resumptionMAC(secret []byte, parts ...[]byte) []byte {
+	binderKey := make([]byte, sha256.Size)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("resumption-binder")), binderKey)
+
+	mac := hmac.New(sha256.New, binderKey)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,71 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSession_NewTicketFrame(t *testing.T) {
+	client, _ := newSessionPair(t)
+	frame, err := WriteNewTicketFrame([]byte("ticket"), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to write new ticket frame: %s", err)
+	}
+
+	if _, err = client.HandleControlFrame(frame); err == nil {
+		t.Errorf("expected ticket without a resumption secret to be rejected")
+	}
+
+	secret := bytes.Repeat([]byte{3}, 32)
+	client.SetResumptionSecret(secret, []Capability{CapabilityResumption})
+	if _, err = client.HandleControlFrame(frame); err != nil {
+		t.Fatalf("failed to handle new ticket frame: %s", err)
+	}
+
+	ticket := client.ResumptionTicket()
+	if ticket == nil || !bytes.Equal(ticket.Ticket, []byte("ticket")) || !bytes.Equal(ticket.Secret, secret) {
+		t.Fatalf("unexpected ticket: %+v", ticket)
+	}
+	if time.Until(ticket.ExpiresAt) <= 59*time.Minute {
+		t.Errorf("unexpected ticket expiry: %s", ticket.ExpiresAt)
+	}
+}
+
+func TestResumeMessages_RoundTrip(t *testing.T) {
+	secret := bytes.Repeat([]byte{4}, 32)
+	curvePublic := bytes.Repeat([]byte{5}, 32)
+	nonce := bytes.Repeat([]byte{6}, 32)
+
+	helloBinder := ResumeHelloBinder(secret, []byte("ticket"), curvePublic, nonce)
+	data, err := (&ResumeHello{}).Write([]byte("ticket"), curvePublic, nonce, helloBinder)
+	if err != nil {
+		t.Fatalf("failed to write resume hello: %s", err)
+	}
+	resumeHello, err := (&ResumeHello{}).Read(data)
+	if err != nil {
+		t.Fatalf("failed to read resume hello: %s", err)
+	}
+	if !bytes.Equal(resumeHello.Ticket, []byte("ticket")) || !bytes.Equal(resumeHello.Binder, helloBinder) {
+		t.Errorf("unexpected resume hello: %+v", resumeHello)
+	}
+
+	acceptBinder, _ := ResumeAcceptBinder(secret, helloBinder, curvePublic, nonce, "10.0.0.2/24", "fd00::2/64")
+	data, err = (&ResumeAccept{}).Write(curvePublic, nonce, "10.0.0.2/24", "fd00::2/64", acceptBinder)
+	if err != nil {
+		t.Fatalf("failed to write resume accept: %s", err)
+	}
+	resumeAccept, err := (&ResumeAccept{}).Read(data)
+	if err != nil {
+		t.Fatalf("failed to read resume accept: %s", err)
+	}
+	if resumeAccept.IPv4 != "10.0.0.2/24" || resumeAccept.IPv6 != "fd00::2/64" || !bytes.Equal(resumeAccept.Binder, acceptBinder) {
+		t.Errorf("unexpected resume accept: %+v", resumeAccept)
+	}
+
+	// The binder of the accept depends on the assigned addresses
+	otherBinder, _ := ResumeAcceptBinder(secret, helloBinder, curvePublic, nonce, "10.0.0.3/24", "fd00::2/64")
+	if bytes.Equal(otherBinder, acceptBinder) {
+		t.Errorf("expected binder to cover the addresses")
+	}
+}
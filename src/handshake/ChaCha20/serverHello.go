@@ -1,40 +1,213 @@
 package ChaCha20
 
-import "fmt"
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// serverHelloFixedLength is 64 (signature) + 32 (nonce) + 32 (curve pub key),
+// followed by the addresses, capabilities, pre-shared key binder, KEM ciphertext, cipher suite and signing key
+const serverHelloFixedLength = 64 + 32 + 32
 
 type ServerHello struct {
-	ServerSignature []byte
-	ServerNonce     []byte
-	CurvePublicKey  []byte
+	ServerSignature    []byte
+	ServerNonce        []byte
+	CurvePublicKey     []byte
+	IPv4               string       // Tunnel IPv4 address of the client in CIDR notation, empty if not assigned
+	IPv6               string       // Tunnel IPv6 address of the client in CIDR notation, empty if not assigned
+	Capabilities       []Capability // capabilities selected by the server out of the ones offered by the client
+	PresharedKeyBinder []byte       // proves the server holds the same pre-shared key as the client
+	KEMCiphertext      []byte       // ML-KEM-768 ciphertext of a hybrid handshake, empty otherwise
+	CipherSuite        CipherSuite  // cipher suite selected by the server
+	// SigningPublicKey is the server key the signature is made with, empty if the server has a single key
+	SigningPublicKey ed25519.PublicKey
 }
 
 func (s *ServerHello) Read(data []byte) (*ServerHello, error) {
-	if len(data) < 128 {
+	if len(data) < serverHelloFixedLength+2 {
 		return nil, fmt.Errorf("invalid data")
 	}
 
 	s.ServerSignature = data[:64]
 	s.ServerNonce = data[64 : 64+32]
-	s.CurvePublicKey = data[64+32 : 128]
+	s.CurvePublicKey = data[64+32 : serverHelloFixedLength]
+
+	ipv4Length := int(data[serverHelloFixedLength])
+	if len(data) < serverHelloFixedLength+1+ipv4Length+1 {
+		return nil, fmt.Errorf("invalid IPv4 address length")
+	}
+	s.IPv4 = string(data[serverHelloFixedLength+1 : serverHelloFixedLength+1+ipv4Length])
+
+	ipv6Offset := serverHelloFixedLength + 1 + ipv4Length
+	ipv6Length := int(data[ipv6Offset])
+	if len(data) < ipv6Offset+1+ipv6Length {
+		return nil, fmt.Errorf("invalid IPv6 address length")
+	}
+	s.IPv6 = string(data[ipv6Offset+1 : ipv6Offset+1+ipv6Length])
+
+	capabilitiesOffset := ipv6Offset + 1 + ipv6Length
+	capabilities, capabilitiesLength, err := decodeCapabilities(data[capabilitiesOffset:])
+	if err != nil {
+		return nil, err
+	}
+	s.Capabilities = capabilities
+
+	binderOffset := capabilitiesOffset + capabilitiesLength
+	if len(data) < binderOffset+presharedKeyBinderLength {
+		return nil, fmt.Errorf("invalid pre-shared key binder")
+	}
+	s.PresharedKeyBinder = data[binderOffset : binderOffset+presharedKeyBinderLength]
+
+	kemOffset := binderOffset + presharedKeyBinderLength
+	kemCiphertext, kemLength, err := decodeKEMField(data[kemOffset:])
+	if err != nil {
+		return nil, err
+	}
+	s.KEMCiphertext = kemCiphertext
+
+	suiteOffset := kemOffset + kemLength
+	cipherSuites, suiteLength, err := decodeCipherSuites(data[suiteOffset:])
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherSuites) != 1 {
+		return nil, fmt.Errorf("invalid cipher suite")
+	}
+	s.CipherSuite = cipherSuites[0]
+
+	signingKeyOffset := suiteOffset + suiteLength
+	switch len(data) - signingKeyOffset {
+	case 0:
+	case ed25519.PublicKeySize:
+		s.SigningPublicKey = data[signingKeyOffset:]
+	default:
+		return nil, fmt.Errorf("invalid signing public key")
+	}
 
 	return s, nil
 }
 
-func (m *ServerHello) Write(signature *[]byte, nonce *[]byte, curvePublicKey *[]byte) (*[]byte, error) {
-	if len(*signature) != 64 {
+// Write encodes the server hello from its fields
+func (m *ServerHello) Write() (*[]byte, error) {
+	if len(m.ServerSignature) != 64 {
 		return nil, fmt.Errorf("invalid signature")
 	}
-	if len(*nonce) != 32 {
+	if len(m.ServerNonce) != 32 {
 		return nil, fmt.Errorf("invalid nonce")
 	}
 
-	if len(*curvePublicKey) != 32 {
+	if len(m.CurvePublicKey) != 32 {
 		return nil, fmt.Errorf("invalid curve public key")
 	}
-	arr := make([]byte, len(*signature)+len(*nonce)+len(*curvePublicKey))
-	copy(arr, *signature)
-	copy(arr[len(*signature):], *nonce)
-	copy(arr[len(*signature)+len(*nonce):], *curvePublicKey)
+
+	if len(m.PresharedKeyBinder) != presharedKeyBinderLength {
+		return nil, fmt.Errorf("invalid pre-shared key binder")
+	}
+
+	if len(m.KEMCiphertext) != 0 && len(m.KEMCiphertext) != KEMCiphertextLength {
+		return nil, fmt.Errorf("invalid KEM ciphertext")
+	}
+
+	if len(m.SigningPublicKey) != 0 && len(m.SigningPublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signing public key")
+	}
+
+	addresses, err := encodeAddresses(m.IPv4, m.IPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedCapabilities, err := encodeCapabilities(m.Capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedCipherSuite, err := encodeCipherSuites([]CipherSuite{m.CipherSuite})
+	if err != nil {
+		return nil, err
+	}
+
+	arr := make([]byte, 0, serverHelloFixedLength+len(addresses)+len(encodedCapabilities)+len(m.PresharedKeyBinder)+2+len(m.KEMCiphertext)+len(encodedCipherSuite)+len(m.SigningPublicKey))
+	arr = append(arr, m.ServerSignature...)
+	arr = append(arr, m.ServerNonce...)
+	arr = append(arr, m.CurvePublicKey...)
+	arr = append(arr, addresses...)
+	arr = append(arr, encodedCapabilities...)
+	arr = append(arr, m.PresharedKeyBinder...)
+	arr = append(arr, encodeKEMField(m.KEMCiphertext)...)
+	arr = append(arr, encodedCipherSuite...)
+	arr = append(arr, m.SigningPublicKey...)
 
 	return &arr, nil
 }
+
+// ServerHelloDataToSign returns the data covered by the server signature: the transcript up to the client hello
+// the server answers, so no client hello field can be altered, and every server hello field but the binder,
+// so neither the assigned addresses nor the negotiated capabilities and cipher suite can be altered either.
+func ServerHelloDataToSign(transcriptHash []byte, curvePublicKey []byte, serverNonce []byte, ipv4 string, ipv6 string, selected []Capability, kemCiphertext []byte, selectedSuite CipherSuite) ([]byte, error) {
+	addresses, err := encodeAddresses(ipv4, ipv6)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedSelected, err := encodeCapabilities(selected)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedSelectedSuite, err := encodeCipherSuites([]CipherSuite{selectedSuite})
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, len("server-signature")+len(transcriptHash)+len(curvePublicKey)+len(serverNonce)+len(addresses)+len(encodedSelected)+2+len(kemCiphertext)+len(encodedSelectedSuite))
+	data = append(data, "server-signature"...)
+	data = append(data, transcriptHash...)
+	data = append(data, curvePublicKey...)
+	data = append(data, serverNonce...)
+	data = append(data, addresses...)
+	data = append(data, encodedSelected...)
+	data = append(data, encodeKEMField(kemCiphertext)...)
+	data = append(data, encodedSelectedSuite...)
+
+	return data, nil
+}
+
+func encodeAddresses(ipv4 string, ipv6 string) ([]byte, error) {
+	if len(ipv4) > 18 {
+		return nil, fmt.Errorf("invalid IPv4 address")
+	}
+
+	if len(ipv6) > 43 {
+		return nil, fmt.Errorf("invalid IPv6 address")
+	}
+
+	arr := make([]byte, 0, 2+len(ipv4)+len(ipv6))
+	arr = append(arr, uint8(len(ipv4)))
+	arr = append(arr, ipv4...)
+	arr = append(arr, uint8(len(ipv6)))
+	arr = append(arr, ipv6...)
+
+	return arr, nil
+}
+
+// decodeAddresses reads the addresses encoded by encodeAddresses and returns the number of bytes read
+func decodeAddresses(data []byte) (string, string, int, error) {
+	if len(data) < 1 {
+		return "", "", 0, fmt.Errorf("invalid IPv4 address length")
+	}
+	ipv4Length := int(data[0])
+	if len(data) < 1+ipv4Length+1 {
+		return "", "", 0, fmt.Errorf("invalid IPv4 address length")
+	}
+	ipv4 := string(data[1 : 1+ipv4Length])
+
+	ipv6Offset := 1 + ipv4Length
+	ipv6Length := int(data[ipv6Offset])
+	if len(data) < ipv6Offset+1+ipv6Length {
+		return "", "", 0, fmt.Errorf("invalid IPv6 address length")
+	}
+	ipv6 := string(data[ipv6Offset+1 : ipv6Offset+1+ipv6Length])
+
+	return ipv4, ipv6, ipv6Offset + 1 + ipv6Length, nil
+}
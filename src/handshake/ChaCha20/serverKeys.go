@@ -0,0 +1,129 @@
+package ChaCha20
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// ServerKeysFrame is the control frame the server announces its current and upcoming signing keys in
+const ServerKeysFrame byte = 0x05
+
+const (
+	// serverKeyIdLength is the length of the id a pinned server key is hinted with in the client hello
+	serverKeyIdLength = 8
+	// announcedKeyLength is 32 (public key) + 8 (not after, unix seconds, zero if open)
+	announcedKeyLength = ed25519.PublicKeySize + 8
+)
+
+// AnnouncedServerKey is a server signing key announced in-band, so clients pin it before the current key expires
+type AnnouncedServerKey struct {
+	PublicKey ed25519.PublicKey
+	NotAfter  time.Time // zero if the key does not expire
+}
+
+// ServerKeyId identifies a server signing key without sending all of it
+func ServerKeyId(publicKey ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(publicKey)
+	return sum[:serverKeyIdLength]
+}
+
+// ServerKeyIds returns the ids of the pinned server keys a client hello carries
+func ServerKeyIds(keys []ed25519.PublicKey) [][]byte {
+	ids := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, ServerKeyId(key))
+	}
+	return ids
+}
+
+// WriteServerKeysFrame encodes announced keys into a control frame.
+// The frame travels inside the session the server authenticated, so it needs no signature of its own.
+func WriteServerKeysFrame(keys []AnnouncedServerKey) ([]byte, error) {
+	if len(keys) > 255 {
+		return nil, fmt.Errorf("too many server keys: %d", len(keys))
+	}
+
+	frame := make([]byte, 2, 2+len(keys)*announcedKeyLength)
+	frame[0] = ServerKeysFrame
+	frame[1] = uint8(len(keys))
+	for _, key := range keys {
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid server key")
+		}
+		var notAfter int64
+		if !key.NotAfter.IsZero() {
+			notAfter = key.NotAfter.Unix()
+		}
+		frame = append(frame, key.PublicKey...)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(notAfter))
+	}
+
+	return frame, nil
+}
+
+func (s *Session) onServerKeys(frame []byte) error {
+	// Only the server announces its keys
+	if s.isServer {
+		return fmt.Errorf("unexpected server keys frame")
+	}
+
+	if len(frame) < 1 || len(frame) < 1+int(frame[0])*announcedKeyLength {
+		return fmt.Errorf("invalid server keys frame")
+	}
+
+	keys := make([]AnnouncedServerKey, frame[0])
+	for i := range keys {
+		offset := 1 + i*announcedKeyLength
+		keys[i].PublicKey = append(ed25519.PublicKey(nil), frame[offset:offset+ed25519.PublicKeySize]...)
+		if notAfter := int64(binary.BigEndian.Uint64(frame[offset+ed25519.PublicKeySize:])); notAfter != 0 {
+			keys[i].NotAfter = time.Unix(notAfter, 0)
+		}
+	}
+
+	if s.OnServerKeys != nil {
+		s.OnServerKeys(keys)
+	}
+
+	return nil
+}
+
+// encodeServerKeyIds encodes the ids of the pinned server keys, so the server signs with one of them
+func encodeServerKeyIds(ids [][]byte) ([]byte, error) {
+	if len(ids) > 255 {
+		return nil, fmt.Errorf("too many pinned server keys: %d", len(ids))
+	}
+
+	arr := make([]byte, 1, 1+len(ids)*serverKeyIdLength)
+	arr[0] = uint8(len(ids))
+	for _, id := range ids {
+		if len(id) != serverKeyIdLength {
+			return nil, fmt.Errorf("invalid server key id")
+		}
+		arr = append(arr, id...)
+	}
+
+	return arr, nil
+}
+
+// decodeServerKeyIds decodes the optional trailing server key ids, empty for clients pinning a single key,
+// and returns how many bytes they take
+func decodeServerKeyIds(data []byte) ([][]byte, int, error) {
+	if len(data) == 0 {
+		return nil, 0, nil
+	}
+
+	count := int(data[0])
+	if len(data) < 1+count*serverKeyIdLength {
+		return nil, 0, fmt.Errorf("invalid server key ids length")
+	}
+
+	ids := make([][]byte, count)
+	for i := range ids {
+		ids[i] = data[1+i*serverKeyIdLength : 1+(i+1)*serverKeyIdLength]
+	}
+
+	return ids, 1 + count*serverKeyIdLength, nil
+}
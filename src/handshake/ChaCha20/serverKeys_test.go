@@ -0,0 +1,66 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestSession_ServerKeysFrame(t *testing.T) {
+	client, server := newSessionPair(t)
+	current, _, _ := ed25519.GenerateKey(rand.Reader)
+	next, _, _ := ed25519.GenerateKey(rand.Reader)
+	notAfter := time.Unix(1900000000, 0)
+
+	frame, err := WriteServerKeysFrame([]AnnouncedServerKey{{PublicKey: current, NotAfter: notAfter}, {PublicKey: next}})
+	if err != nil {
+		t.Fatalf("failed to write server keys frame: %s", err)
+	}
+
+	var announced []AnnouncedServerKey
+	client.OnServerKeys = func(keys []AnnouncedServerKey) {
+		announced = keys
+	}
+	if _, err = client.HandleControlFrame(frame); err != nil {
+		t.Fatalf("failed to handle server keys frame: %s", err)
+	}
+	if len(announced) != 2 || !announced[0].PublicKey.Equal(current) || !announced[0].NotAfter.Equal(notAfter) {
+		t.Fatalf("unexpected announced keys: %v", announced)
+	}
+	if !announced[1].PublicKey.Equal(next) || !announced[1].NotAfter.IsZero() {
+		t.Errorf("expected key without expiry, got %v", announced[1])
+	}
+
+	if _, err = server.HandleControlFrame(frame); err == nil {
+		t.Errorf("expected server to reject announced keys")
+	}
+}
+
+func TestClientHello_ServerKeyIdsRoundTrip(t *testing.T) {
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	pinned, _, _ := ed25519.GenerateKey(rand.Reader)
+	curvePublic := make([]byte, 32)
+	nonce := make([]byte, 32)
+
+	data, err := (&ClientHello{
+		EdPublicKey:    edPublic,
+		CurvePublicKey: curvePublic,
+		ClientNonce:    nonce,
+		Capabilities:   SupportedCapabilities,
+		CipherSuites:   SupportedCipherSuites,
+		ServerKeyIds:   ServerKeyIds([]ed25519.PublicKey{pinned}),
+	}).Write()
+	if err != nil {
+		t.Fatalf("failed to write client hello: %s", err)
+	}
+
+	clientHello, err := (&ClientHello{}).Read(*data)
+	if err != nil {
+		t.Fatalf("failed to read client hello: %s", err)
+	}
+	if len(clientHello.ServerKeyIds) != 1 || !bytes.Equal(clientHello.ServerKeyIds[0], ServerKeyId(pinned)) {
+		t.Errorf("expected pinned key id to survive the round trip, got %v", clientHello.ServerKeyIds)
+	}
+}
@@ -2,9 +2,11 @@ package ChaCha20
 
 import (
 	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
-	"golang.org/x/crypto/chacha20poly1305"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Session struct {
@@ -13,43 +15,143 @@ type Session struct {
 	SendNonce      [12]byte // Used for encryption
 	RecvNonce      [12]byte // Used for decryption
 	isServer       bool
+	suite          CipherSuite // AEAD negotiated in the handshake, rekeys keep it
+	wireGuard      bool        // the WireGuard transport format, see NewWireGuardSession
 	SessionId      [32]byte
+	receiverIndex  uint32 // derived from SessionId, see SetSessionId
 	sendNonceMutex sync.Mutex
 	recvNonceMutex sync.Mutex
+	replayWindow   ReplayWindow // Used for decryption of datagrams, which may arrive out of order
+	// RekeyAfterBytes and RekeyAfterTime trigger an in-band rekey once exceeded, zero disables the threshold
+	RekeyAfterBytes uint64
+	RekeyAfterTime  time.Duration
+	keyCreatedAt    atomic.Int64     // unix nanoseconds the current send key was installed at
+	trafficBytes    atomic.Uint64    // plaintext bytes encrypted and decrypted under the current keys
+	previousRecv    *previousRecvKey // guarded by the receive mutex, as is pendingSend
+	pendingSend     cipher.AEAD      // responder side send key, installed once the initiator confirms the rekey
+	rekeyMutex      sync.Mutex
+	rekey           rekeyState
+	resumption      resumptionState
+	// OnServerKeys is called on the client with the signing keys the server announces, so they can be pinned
+	OnServerKeys func(keys []AnnouncedServerKey)
+	// OnEnrollment is called on the client with the configuration the server returns when it enrolls the client
+	OnEnrollment func(conf []byte)
 }
 
-func NewSession(sendKey, recvKey []byte, isServer bool) (*Session, error) {
-	sendCipher, err := chacha20poly1305.New(sendKey)
-	if err != nil {
-		return nil, err
-	}
+// previousRecvKey is the receive key replaced by a rekey, it is kept for a short overlap
+// so packets encrypted under the old key that are still in flight can be decrypted
+type previousRecvKey struct {
+	cipher       cipher.AEAD
+	nonce        [12]byte
+	replayWindow ReplayWindow
+	expiresAt    time.Time // zero until the peer confirms the new key
+}
 
-	recvCipher, err := chacha20poly1305.New(recvKey)
+const (
+	// DatagramReceiverIndexLength is the size of the receiver index prepended to every encrypted datagram,
+	// the WireGuard format carries it in the transport header instead
+	DatagramReceiverIndexLength = 4
+	// DatagramCounterLength is the size of the explicit counter that follows the receiver index
+	DatagramCounterLength = 8
+)
+
+func NewSession(suite CipherSuite, sendKey, recvKey []byte, isServer bool) (*Session, error) {
+	sendCipher, recvCipher, err := newCiphers(suite, sendKey, recvKey)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Session{
+	session := &Session{
 		sendCipher: sendCipher,
 		recvCipher: recvCipher,
 		SendNonce:  [12]byte{},
 		RecvNonce:  [12]byte{},
 		isServer:   isServer,
-	}, nil
+		suite:      suite,
+	}
+	session.keyCreatedAt.Store(time.Now().UnixNano())
+
+	return session, nil
+}
+
+// NewWireGuardSession creates a session in the transport format of WireGuard: ChaCha20-Poly1305 with Noise nonces,
+// a little-endian datagram counter and no additional data. Rekeys are not supported, WireGuard peers handshake again instead.
+func NewWireGuardSession(sendKey, recvKey []byte, isServer bool) (*Session, error) {
+	session, err := NewSession(CipherSuiteChaCha20Poly1305, sendKey, recvKey, isServer)
+	if err != nil {
+		return nil, err
+	}
+	session.wireGuard = true
+
+	return session, nil
+}
+
+// SetSessionId sets the id the handshake derived for the session and the receiver index derived from it
+func (s *Session) SetSessionId(sessionId [32]byte) {
+	s.SessionId = sessionId
+	s.receiverIndex = DeriveReceiverIndex(sessionId)
+}
+
+// ReceiverIndex returns the index sent in front of every datagram of the session
+func (s *Session) ReceiverIndex() uint32 {
+	return s.receiverIndex
+}
+
+// DatagramReceiverIndex returns the receiver index of a datagram produced by EncryptDatagram,
+// so the receiver is able to find its session before decrypting anything
+func DatagramReceiverIndex(datagram []byte) (uint32, bool) {
+	if len(datagram) < DatagramReceiverIndexLength+DatagramCounterLength {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(datagram), true
+}
+
+func newCiphers(suite CipherSuite, sendKey, recvKey []byte) (cipher.AEAD, cipher.AEAD, error) {
+	sendCipher, err := suite.NewAEAD(sendKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recvCipher, err := suite.NewAEAD(recvKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sendCipher, recvCipher, nil
 }
 
 func (s *Session) Encrypt(plaintext []byte) ([]byte, error) {
 	s.sendNonceMutex.Lock()
 	defer s.sendNonceMutex.Unlock()
 
+	return s.encrypt(plaintext)
+}
+
+// EncryptAndWrite encrypts plaintext and passes the ciphertext to write while still holding the send lock,
+// so several goroutines writing to the same stream cannot reorder ciphertexts against their nonces
+func (s *Session) EncryptAndWrite(plaintext []byte, write func(ciphertext []byte) error) error {
+	s.sendNonceMutex.Lock()
+	defer s.sendNonceMutex.Unlock()
+
+	ciphertext, err := s.encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+
+	return write(ciphertext)
+}
+
+func (s *Session) encrypt(plaintext []byte) ([]byte, error) {
 	aad := s.CreateAAD(s.isServer, s.SendNonce)
 
-	ciphertext := s.sendCipher.Seal(nil, s.SendNonce[:], plaintext, aad)
+	ciphertext := s.sendCipher.Seal(nil, s.nonce(s.sendCipher, &s.SendNonce), plaintext, aad)
 
 	err := incrementNonce(&s.SendNonce)
 	if err != nil {
 		return nil, err
 	}
+	s.trafficBytes.Add(uint64(len(plaintext)))
 
 	return ciphertext, nil
 }
@@ -60,20 +162,131 @@ func (s *Session) Decrypt(ciphertext []byte) ([]byte, error) {
 
 	aad := s.CreateAAD(!s.isServer, s.RecvNonce)
 
-	plaintext, err := s.recvCipher.Open(nil, s.RecvNonce[:], ciphertext, aad)
+	plaintext, err := s.recvCipher.Open(nil, s.nonce(s.recvCipher, &s.RecvNonce), ciphertext, aad)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt: %w", err)
+		// The peer may still be sending under the key replaced by the last rekey
+		previous := s.activePreviousRecv()
+		if previous == nil {
+			return nil, fmt.Errorf("failed to decrypt: %w", err)
+		}
+
+		aad = s.CreateAAD(!s.isServer, previous.nonce)
+		plaintext, err = previous.cipher.Open(nil, s.nonce(previous.cipher, &previous.nonce), ciphertext, aad)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt: %w", err)
+		}
+
+		err = incrementNonce(&previous.nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		return plaintext, nil
 	}
 
 	err = incrementNonce(&s.RecvNonce)
 	if err != nil {
 		return nil, err
 	}
+	s.onCurrentKeyUsed(len(plaintext))
 
 	return plaintext, nil
 }
 
+// EncryptDatagram encrypts plaintext and prepends the receiver index of the session and the counter it was encrypted with,
+// so the peer is able to find the session and decrypt the datagram regardless of the order it arrives in
+func (s *Session) EncryptDatagram(plaintext []byte) ([]byte, error) {
+	s.sendNonceMutex.Lock()
+	defer s.sendNonceMutex.Unlock()
+
+	// Only the last 8 bytes of the nonce are transmitted
+	if binary.BigEndian.Uint32(s.SendNonce[:4]) != 0 {
+		return nil, fmt.Errorf("nonce overflow")
+	}
+
+	aad := s.CreateAAD(s.isServer, s.SendNonce)
+
+	headerLength := s.datagramHeaderLength()
+	datagram := make([]byte, headerLength, headerLength+len(plaintext)+s.sendCipher.Overhead())
+	s.putDatagramHeader(datagram, s.SendNonce)
+	datagram = s.sendCipher.Seal(datagram, s.nonce(s.sendCipher, &s.SendNonce), plaintext, aad)
+
+	err := incrementNonce(&s.SendNonce)
+	if err != nil {
+		return nil, err
+	}
+	s.trafficBytes.Add(uint64(len(plaintext)))
+
+	return datagram, nil
+}
+
+// DecryptDatagram decrypts a datagram produced by EncryptDatagram.
+// Datagrams may be reordered, but each counter is accepted only once.
+func (s *Session) DecryptDatagram(datagram []byte) ([]byte, error) {
+	counter, err := s.datagramCounter(datagram)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := datagram[s.datagramHeaderLength():]
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[12-DatagramCounterLength:], counter)
+
+	s.recvNonceMutex.Lock()
+	defer s.recvNonceMutex.Unlock()
+
+	aad := s.CreateAAD(!s.isServer, nonce)
+
+	if s.replayWindow.Check(counter) {
+		plaintext, err := s.recvCipher.Open(nil, s.nonce(s.recvCipher, &nonce), ciphertext, aad)
+		if err == nil {
+			s.replayWindow.Accept(counter)
+			s.onCurrentKeyUsed(len(plaintext))
+			return plaintext, nil
+		}
+	}
+
+	// Datagrams encrypted under the key replaced by the last rekey may still be in flight
+	previous := s.activePreviousRecv()
+	if previous == nil || !previous.replayWindow.Check(counter) {
+		return nil, fmt.Errorf("replayed, too old or forged datagram: %d", counter)
+	}
+
+	plaintext, err := previous.cipher.Open(nil, s.nonce(previous.cipher, &nonce), ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	previous.replayWindow.Accept(counter)
+
+	return plaintext, nil
+}
+
+// Authenticates reports whether a datagram is a fresh one of this session, without accepting its counter,
+// so the datagram still decrypts afterwards. A client whose address has changed is recognized by it.
+func (s *Session) Authenticates(datagram []byte) bool {
+	counter, err := s.datagramCounter(datagram)
+	if err != nil {
+		return false
+	}
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[12-DatagramCounterLength:], counter)
+
+	s.recvNonceMutex.Lock()
+	defer s.recvNonceMutex.Unlock()
+
+	if !s.replayWindow.Check(counter) {
+		return false
+	}
+	_, err = s.recvCipher.Open(nil, s.nonce(s.recvCipher, &nonce), datagram[s.datagramHeaderLength():], s.CreateAAD(!s.isServer, nonce))
+
+	return err == nil
+}
+
 func (s *Session) CreateAAD(isServerToClient bool, nonce [12]byte) []byte {
+	if s.wireGuard {
+		return nil
+	}
+
 	direction := []byte("client-to-server")
 	if isServerToClient {
 		direction = []byte("server-to-client")
@@ -84,6 +297,54 @@ func (s *Session) CreateAAD(isServerToClient bool, nonce [12]byte) []byte {
 	return aad
 }
 
+// nonce returns the AEAD nonce of a counter nonce, in the Noise layout for the WireGuard format
+func (s *Session) nonce(aead cipher.AEAD, nonce *[12]byte) []byte {
+	if s.wireGuard {
+		return noiseNonce(binary.BigEndian.Uint64(nonce[12-DatagramCounterLength:]))
+	}
+
+	return aeadNonce(aead, nonce)
+}
+
+// datagramHeaderLength is the size of the header in front of the ciphertext of a datagram
+func (s *Session) datagramHeaderLength() int {
+	if s.wireGuard {
+		return DatagramCounterLength
+	}
+
+	return DatagramReceiverIndexLength + DatagramCounterLength
+}
+
+// putDatagramHeader writes the receiver index and the counter of nonce in front of a datagram,
+// only the counter in the WireGuard format, little-endian
+func (s *Session) putDatagramHeader(datagram []byte, nonce [12]byte) {
+	if s.wireGuard {
+		binary.LittleEndian.PutUint64(datagram, binary.BigEndian.Uint64(nonce[12-DatagramCounterLength:]))
+		return
+	}
+
+	binary.BigEndian.PutUint32(datagram, s.receiverIndex)
+	copy(datagram[DatagramReceiverIndexLength:], nonce[12-DatagramCounterLength:])
+}
+
+// datagramCounter reads the counter in front of a datagram, after checking it is addressed to this session
+func (s *Session) datagramCounter(datagram []byte) (uint64, error) {
+	if len(datagram) < s.datagramHeaderLength() {
+		return 0, fmt.Errorf("datagram is too short")
+	}
+
+	if s.wireGuard {
+		return binary.LittleEndian.Uint64(datagram[:DatagramCounterLength]), nil
+	}
+
+	index := binary.BigEndian.Uint32(datagram)
+	if index != s.receiverIndex {
+		return 0, fmt.Errorf("datagram of another session: receiver index %d", index)
+	}
+
+	return binary.BigEndian.Uint64(datagram[DatagramReceiverIndexLength:s.datagramHeaderLength()]), nil
+}
+
 func incrementNonce(b *[12]byte) error {
 	for i := len(b) - 1; i >= 0; i-- {
 		b[i]++
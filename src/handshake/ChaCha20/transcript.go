@@ -0,0 +1,51 @@
+package ChaCha20
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+)
+
+// Transcript is a running hash of the handshake messages both sides sent and received, in the order they were on the wire.
+// The signatures, the key derivation and the session id are bound to it, so tampering with any field aborts the session.
+type Transcript struct {
+	hash hash.Hash
+}
+
+func NewTranscript() *Transcript {
+	return &Transcript{hash: sha256.New()}
+}
+
+// Add hashes a handshake message the way it is framed on the wire
+func (t *Transcript) Add(messageType byte, body []byte) {
+	t.hash.Write(handshakeHeader(messageType, len(body)))
+	t.hash.Write(body)
+}
+
+// Sum returns the hash of the messages added so far, more messages can be added afterwards
+func (t *Transcript) Sum() []byte {
+	return t.hash.Sum(nil)
+}
+
+// HandshakeSalt is the HKDF salt of the pre-shared key binders, bound to the transcript up to the client hello
+// the server answers and to the server nonce
+func HandshakeSalt(transcriptHash []byte, serverNonce []byte) []byte {
+	salt := sha256.Sum256(append(append([]byte("handshake-salt"), transcriptHash...), serverNonce...))
+	return salt[:]
+}
+
+// ClientSignatureData returns the data covered by the client signature, the transcript up to the server hello
+func ClientSignatureData(transcriptHash []byte) []byte {
+	return append([]byte("client-signature"), transcriptHash...)
+}
+
+// DeriveSessionId derives the session id from the shared secret and the complete transcript
+func DeriveSessionId(sharedSecret []byte, transcriptHash []byte) [32]byte {
+	return sha256.Sum256(append(append([]byte("session-id"), sharedSecret...), transcriptHash...))
+}
+
+// DeriveReceiverIndex derives the receiver index of a session from its id, so both peers know it without sending it
+func DeriveReceiverIndex(sessionId [32]byte) uint32 {
+	sum := sha256.Sum256(append([]byte("receiver-index"), sessionId[:]...))
+	return binary.BigEndian.Uint32(sum[:4])
+}
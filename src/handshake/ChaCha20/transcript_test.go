@@ -0,0 +1,45 @@
+package ChaCha20
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestTranscript_HashesWireMessages(t *testing.T) {
+	var wire bytes.Buffer
+	_ = WriteHandshakeMessage(&wire, ClientHelloMessage, []byte("client hello"))
+	_ = WriteHandshakeMessage(&wire, ServerHelloMessage, []byte("server hello"))
+
+	transcript := NewTranscript()
+	transcript.Add(ClientHelloMessage, []byte("client hello"))
+	transcript.Add(ServerHelloMessage, []byte("server hello"))
+
+	expected := sha256.Sum256(wire.Bytes())
+	if !bytes.Equal(transcript.Sum(), expected[:]) {
+		t.Errorf("expected the transcript to hash the messages as framed on the wire")
+	}
+}
+
+func TestTranscript_BindsEveryField(t *testing.T) {
+	original := NewTranscript()
+	original.Add(ClientHelloMessage, []byte("client hello"))
+
+	tampered := NewTranscript()
+	tampered.Add(ClientHelloMessage, []byte("client hellO"))
+
+	if bytes.Equal(HandshakeSalt(original.Sum(), nil), HandshakeSalt(tampered.Sum(), nil)) {
+		t.Errorf("expected a tampered message to change the salt")
+	}
+	if DeriveSessionId([]byte("secret"), original.Sum()) == DeriveSessionId([]byte("secret"), tampered.Sum()) {
+		t.Errorf("expected a tampered message to change the session id")
+	}
+
+	// A message moved into another one changes the transcript, as the framing is hashed too
+	split := NewTranscript()
+	split.Add(ClientHelloMessage, []byte("client"))
+	split.Add(ClientHelloMessage, []byte(" hello"))
+	if bytes.Equal(split.Sum(), original.Sum()) {
+		t.Errorf("expected the framing to be bound")
+	}
+}
@@ -5,63 +5,132 @@ import (
 	"fmt"
 )
 
+const clientHelloLength = 32 + 32 + 32
+
 type ClientHello struct {
-	IpVersion       uint8
-	IpAddressLength uint8
-	IpAddress       string
-	EdPublicKey     ed25519.PublicKey
-	CurvePublicKey  []byte
-	ClientNonce     []byte
+	EdPublicKey    ed25519.PublicKey
+	CurvePublicKey []byte
+	ClientNonce    []byte
+	Capabilities   []Capability // capabilities offered by the client
+	Cookie         []byte       // cookie echoed back to a server under load, empty otherwise
+	// KEMEncapsulationKey is the ML-KEM-768 key of a hybrid handshake, empty if the client does not offer one
+	KEMEncapsulationKey []byte
+	CipherSuites        []CipherSuite // cipher suites offered by the client
+	// ServerKeyIds identify the server keys the client pins, empty if the client pins a single key
+	ServerKeyIds [][]byte
+	// InviteId and InviteBinder are sent by a client enrolling with an invite, empty otherwise
+	InviteId     []byte
+	InviteBinder []byte
 }
 
+const maxCookieLength = 32
+
 func (m *ClientHello) Read(data []byte) (*ClientHello, error) {
-	if len(data) < 4 {
+	if len(data) < clientHelloLength {
 		return nil, fmt.Errorf("invalid message")
 	}
 
-	m.IpVersion = data[0]
+	m.EdPublicKey = data[:32]
 
-	if m.IpVersion != 4 && m.IpVersion != 6 {
-		return nil, fmt.Errorf("invalid IP version")
-	}
+	m.CurvePublicKey = data[32 : 32+32]
 
-	m.IpAddressLength = data[1]
+	m.ClientNonce = data[32+32 : 32+32+32]
 
-	if int(2+m.IpAddressLength) > len(data) {
-		return nil, fmt.Errorf("invalid IP address length")
+	capabilities, capabilitiesLength, err := decodeCapabilities(data[clientHelloLength:])
+	if err != nil {
+		return nil, err
 	}
+	m.Capabilities = capabilities
 
-	m.IpAddress = string(data[2 : 2+m.IpAddressLength])
+	cookieOffset := clientHelloLength + capabilitiesLength
+	if len(data) < cookieOffset+1 || len(data) < cookieOffset+1+int(data[cookieOffset]) {
+		return nil, fmt.Errorf("invalid cookie length")
+	}
+	m.Cookie = data[cookieOffset+1 : cookieOffset+1+int(data[cookieOffset])]
 
-	m.EdPublicKey = data[2+m.IpAddressLength : 2+m.IpAddressLength+32]
+	kemOffset := cookieOffset + 1 + len(m.Cookie)
+	kemEncapsulationKey, kemLength, err := decodeKEMField(data[kemOffset:])
+	if err != nil {
+		return nil, err
+	}
+	m.KEMEncapsulationKey = kemEncapsulationKey
 
-	m.CurvePublicKey = data[2+m.IpAddressLength+32 : 2+m.IpAddressLength+32+32]
+	suitesOffset := kemOffset + kemLength
+	cipherSuites, suitesLength, err := decodeCipherSuites(data[suitesOffset:])
+	if err != nil {
+		return nil, err
+	}
+	m.CipherSuites = cipherSuites
 
-	m.ClientNonce = data[2+m.IpAddressLength+32+32 : 2+m.IpAddressLength+32+32+32]
+	serverKeyIdsOffset := suitesOffset + suitesLength
+	serverKeyIds, serverKeyIdsLength, err := decodeServerKeyIds(data[serverKeyIdsOffset:])
+	if err != nil {
+		return nil, err
+	}
+	m.ServerKeyIds = serverKeyIds
+
+	inviteId, inviteBinder, err := decodeInvite(data[serverKeyIdsOffset+serverKeyIdsLength:])
+	if err != nil {
+		return nil, err
+	}
+	m.InviteId, m.InviteBinder = inviteId, inviteBinder
 
 	return m, nil
 }
 
-func (m *ClientHello) Write(ipVersion uint8, ip string, EdPublicKey ed25519.PublicKey, curvePublic *[]byte, nonce *[]byte) (*[]byte, error) {
-	if ipVersion != 4 && ipVersion != 6 {
-		return nil, fmt.Errorf("invalid ip version")
+// Write encodes the client hello from its fields
+func (m *ClientHello) Write() (*[]byte, error) {
+	if len(m.EdPublicKey) != 32 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+
+	if len(m.CurvePublicKey) != 32 {
+		return nil, fmt.Errorf("invalid curve public key")
+	}
+
+	if len(m.ClientNonce) != 32 {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+
+	encodedCapabilities, err := encodeCapabilities(m.Capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Cookie) > maxCookieLength {
+		return nil, fmt.Errorf("invalid cookie")
+	}
+
+	if len(m.KEMEncapsulationKey) != 0 && len(m.KEMEncapsulationKey) != KEMEncapsulationKeyLength {
+		return nil, fmt.Errorf("invalid KEM encapsulation key")
+	}
+
+	encodedCipherSuites, err := encodeCipherSuites(m.CipherSuites)
+	if err != nil {
+		return nil, err
 	}
 
-	if ipVersion == 4 && len(ip) < 7 { //min IPv4 address length is 7 characters
-		return nil, fmt.Errorf("invalid ip address")
+	encodedServerKeyIds, err := encodeServerKeyIds(m.ServerKeyIds)
+	if err != nil {
+		return nil, err
 	}
 
-	if ipVersion == 6 && len(ip) < 2 { //min IPv6 address length is 2 characters
-		return nil, fmt.Errorf("invalid ip address")
+	encodedInvite, err := encodeInvite(m.InviteId, m.InviteBinder)
+	if err != nil {
+		return nil, err
 	}
 
-	arr := make([]byte, 2+len(ip)+32+32+32)
-	arr[0] = ipVersion
-	arr[1] = uint8(len(ip))
-	copy(arr[2:], ip)
-	copy(arr[2+len(ip):], EdPublicKey)
-	copy(arr[2+len(ip)+32:], *curvePublic)
-	copy(arr[2+len(ip)+32+32:], *nonce)
+	arr := make([]byte, clientHelloLength+len(encodedCapabilities)+1+len(m.Cookie))
+	copy(arr, m.EdPublicKey)
+	copy(arr[32:], m.CurvePublicKey)
+	copy(arr[32+32:], m.ClientNonce)
+	copy(arr[clientHelloLength:], encodedCapabilities)
+	arr[clientHelloLength+len(encodedCapabilities)] = uint8(len(m.Cookie))
+	copy(arr[clientHelloLength+len(encodedCapabilities)+1:], m.Cookie)
+	arr = append(arr, encodeKEMField(m.KEMEncapsulationKey)...)
+	arr = append(arr, encodedCipherSuites...)
+	arr = append(arr, encodedServerKeyIds...)
+	arr = append(arr, encodedInvite...)
 
 	return &arr, nil
 }
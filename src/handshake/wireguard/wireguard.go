@@ -0,0 +1,242 @@
+package wireguard
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"etha-tunnel/handshake/ChaCha20"
+	"fmt"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"hash"
+	"io"
+	"time"
+)
+
+// The WireGuard wire protocol (https://www.wireguard.com/protocol/), as spoken by the server to stock WireGuard clients.
+// The server is always the responder, WireGuard clients initiate every handshake.
+const (
+	InitiationMessage  byte = 1
+	ResponseMessage    byte = 2
+	CookieReplyMessage byte = 3
+	TransportMessage   byte = 4
+)
+
+const (
+	InitiationLength  = 148
+	ResponseLength    = 92
+	CookieReplyLength = 64
+	// TransportHeaderLength is 1 (type) + 3 (reserved) + 4 (receiver index), the counter and ciphertext follow
+	TransportHeaderLength = 8
+	// MinTransportLength is a transport message carrying a keepalive, the counter and tag of an empty plaintext
+	MinTransportLength = TransportHeaderLength + ChaCha20.DatagramCounterLength + chacha20poly1305.Overhead
+
+	macLength       = 16
+	timestampLength = 12
+)
+
+// Timers of the WireGuard protocol the responder follows
+const (
+	// RejectAfterTime is how long the keys of a handshake are used, clients handshake again every two minutes
+	RejectAfterTime = 180 * time.Second
+	// KeepaliveTimeout is how long after receiving data a keepalive is sent, if nothing else was sent in the meantime
+	KeepaliveTimeout = 10 * time.Second
+)
+
+// Protocol is the Noise protocol of WireGuard, its prologue is the WireGuard identifier
+var Protocol = ChaCha20.NoiseProtocol{
+	Name:             "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s",
+	Prologue:         []byte("WireGuard v1 zx2c4 Jason@zx2c4.com"),
+	Hash:             newBLAKE2s,
+	WithPresharedKey: true,
+}
+
+var (
+	labelMAC1   = []byte("mac1----")
+	labelCookie = []byte("cookie--")
+)
+
+func newBLAKE2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+// Responder answers the handshakes of WireGuard peers addressing its static key
+type Responder struct {
+	staticPrivate []byte
+	staticPublic  []byte
+	mac1Key       []byte
+	cookieKey     []byte
+}
+
+func NewResponder(staticPrivate []byte) (*Responder, error) {
+	staticPublic, err := curve25519.X25519(staticPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wireguard static key: %w", err)
+	}
+
+	return &Responder{
+		staticPrivate: staticPrivate,
+		staticPublic:  staticPublic,
+		mac1Key:       labelHash(labelMAC1, staticPublic),
+		cookieKey:     labelHash(labelCookie, staticPublic),
+	}, nil
+}
+
+// PublicKey returns the static public key of the responder, the PublicKey of the server in the [Peer] section of clients
+func (r *Responder) PublicKey() []byte {
+	return r.staticPublic
+}
+
+// Initiation is a handshake initiation the responder decrypted
+type Initiation struct {
+	SenderIndex uint32
+	// RemoteStatic is the static public key of the peer
+	RemoteStatic []byte
+	// Timestamp is the TAI64N timestamp of the initiation, a peer's timestamps only grow
+	Timestamp []byte
+	// MAC1 is the mac1 of the initiation, a cookie reply to it is bound to it
+	MAC1      []byte
+	handshake *ChaCha20.NoiseHandshake
+}
+
+// CheckMAC1 reports whether a handshake message carries a valid mac1, so it is addressed to the responder key.
+// It is checked before any public key operation is done for the message.
+func (r *Responder) CheckMAC1(message []byte) bool {
+	if len(message) < 2*macLength {
+		return false
+	}
+
+	mac1Offset := len(message) - 2*macLength
+	return hmac.Equal(message[mac1Offset:mac1Offset+macLength], mac(r.mac1Key, message[:mac1Offset]))
+}
+
+// CheckMAC2 reports whether a handshake message carries a mac2 made with the cookie, so the sender receives at its address
+func CheckMAC2(message []byte, cookie []byte) bool {
+	if len(message) < 2*macLength {
+		return false
+	}
+
+	mac2Offset := len(message) - macLength
+	return hmac.Equal(message[mac2Offset:], mac(cookie, message[:mac2Offset]))
+}
+
+// ConsumeInitiation decrypts a handshake initiation, the peer is not authorized yet
+func (r *Responder) ConsumeInitiation(message []byte) (*Initiation, error) {
+	if len(message) != InitiationLength || message[0] != InitiationMessage {
+		return nil, fmt.Errorf("invalid handshake initiation")
+	}
+
+	handshake, err := Protocol.NewResponder(r.staticPrivate)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Noise message is the ephemeral key, the encrypted static key and the encrypted timestamp
+	timestamp, err := handshake.ReadInitiation(message[8 : InitiationLength-2*macLength])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt handshake initiation: %w", err)
+	}
+	if len(timestamp) != timestampLength {
+		return nil, fmt.Errorf("invalid handshake initiation timestamp")
+	}
+
+	return &Initiation{
+		SenderIndex:  binary.LittleEndian.Uint32(message[4:8]),
+		RemoteStatic: handshake.RemoteStatic(),
+		Timestamp:    timestamp,
+		MAC1:         message[InitiationLength-2*macLength : InitiationLength-macLength],
+		handshake:    handshake,
+	}, nil
+}
+
+// CreateResponse answers an initiation, and returns the response along with the transport keys of the responder
+func (r *Responder) CreateResponse(initiation *Initiation, senderIndex uint32, presharedKey []byte) (response []byte, sendKey []byte, recvKey []byte, err error) {
+	initiation.handshake.SetPresharedKey(presharedKey)
+	noiseMessage, err := initiation.handshake.WriteResponse(nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to write handshake response: %w", err)
+	}
+
+	response = make([]byte, 0, ResponseLength)
+	response = append(response, ResponseMessage, 0, 0, 0)
+	response = binary.LittleEndian.AppendUint32(response, senderIndex)
+	response = binary.LittleEndian.AppendUint32(response, initiation.SenderIndex)
+	response = append(response, noiseMessage...)
+	response = append(response, mac(labelHash(labelMAC1, initiation.RemoteStatic), response)...)
+	// The responder holds no cookie of the initiator, so mac2 is zero
+	response = append(response, make([]byte, macLength)...)
+
+	recvKey, sendKey = initiation.handshake.Split()
+	return response, sendKey, recvKey, nil
+}
+
+// CreateCookieReply answers a handshake message while under load with the cookie the sender must make its mac2 with
+func (r *Responder) CreateCookieReply(message []byte, cookie []byte) ([]byte, error) {
+	if len(message) < 8+2*macLength {
+		return nil, fmt.Errorf("invalid handshake message")
+	}
+	mac1Offset := len(message) - 2*macLength
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(r.cookieKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 0, CookieReplyLength)
+	reply = append(reply, CookieReplyMessage, 0, 0, 0)
+	reply = append(reply, message[4:8]...) // sender index of the message
+	reply = append(reply, nonce...)
+	reply = aead.Seal(reply, nonce, cookie, message[mac1Offset:mac1Offset+macLength])
+
+	return reply, nil
+}
+
+// TransportHeader returns the header of a transport message to the peer, the session datagram follows it
+func TransportHeader(receiverIndex uint32) []byte {
+	header := make([]byte, 0, TransportHeaderLength)
+	header = append(header, TransportMessage, 0, 0, 0)
+	return binary.LittleEndian.AppendUint32(header, receiverIndex)
+}
+
+// ReceiverIndex returns the receiver index of a response, cookie reply or transport message
+func ReceiverIndex(message []byte) uint32 {
+	if message[0] == ResponseMessage {
+		return binary.LittleEndian.Uint32(message[8:12])
+	}
+
+	return binary.LittleEndian.Uint32(message[4:8])
+}
+
+// TAI64N returns the timestamp format of handshake initiations: seconds since 1970 offset by 2^62, then nanoseconds
+func TAI64N(t time.Time) []byte {
+	timestamp := make([]byte, 0, timestampLength)
+	timestamp = binary.BigEndian.AppendUint64(timestamp, uint64(1)<<62+uint64(t.Unix()))
+	return binary.BigEndian.AppendUint32(timestamp, uint32(t.Nanosecond()))
+}
+
+// IsNewerTimestamp reports whether a TAI64N timestamp is after the previous one, which may be nil
+func IsNewerTimestamp(timestamp []byte, previous []byte) bool {
+	return previous == nil || bytes.Compare(timestamp, previous) > 0
+}
+
+func labelHash(label []byte, publicKey []byte) []byte {
+	h := newBLAKE2s()
+	h.Write(label)
+	h.Write(publicKey)
+	return h.Sum(nil)
+}
+
+// mac is the keyed BLAKE2s-128 of WireGuard
+func mac(key []byte, data []byte) []byte {
+	h, _ := blake2s.New128(key)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,170 @@
+package wireguard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"etha-tunnel/handshake/ChaCha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"testing"
+	"time"
+)
+
+func newKeyPair(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	private := make([]byte, 32)
+	_, _ = rand.Read(private)
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("failed to generate key pair: %s", err)
+	}
+	return private, public
+}
+
+// initiate builds a handshake initiation the way a WireGuard client does
+func initiate(t *testing.T, initiatorPrivate []byte, responderPublic []byte, senderIndex uint32, cookie []byte) (*ChaCha20.NoiseHandshake, []byte) {
+	t.Helper()
+	handshake, err := Protocol.NewInitiator(initiatorPrivate, responderPublic)
+	if err != nil {
+		t.Fatalf("failed to create initiator: %s", err)
+	}
+
+	noiseMessage, err := handshake.WriteInitiation(TAI64N(time.Now()))
+	if err != nil {
+		t.Fatalf("failed to write initiation: %s", err)
+	}
+
+	message := []byte{InitiationMessage, 0, 0, 0}
+	message = binary.LittleEndian.AppendUint32(message, senderIndex)
+	message = append(message, noiseMessage...)
+	message = append(message, mac(labelHash(labelMAC1, responderPublic), message)...)
+	if cookie != nil {
+		message = append(message, mac(cookie, message)...)
+	} else {
+		message = append(message, make([]byte, macLength)...)
+	}
+
+	return handshake, message
+}
+
+func TestResponder_Handshake(t *testing.T) {
+	serverPrivate, serverPublic := newKeyPair(t)
+	clientPrivate, clientPublic := newKeyPair(t)
+	presharedKey := bytes.Repeat([]byte{7}, 32)
+
+	responder, err := NewResponder(serverPrivate)
+	if err != nil {
+		t.Fatalf("failed to create responder: %s", err)
+	}
+
+	initiator, message := initiate(t, clientPrivate, serverPublic, 17, nil)
+	if len(message) != InitiationLength {
+		t.Fatalf("unexpected initiation length: %d", len(message))
+	}
+	if !responder.CheckMAC1(message) {
+		t.Fatalf("expected mac1 to be valid")
+	}
+
+	initiation, err := responder.ConsumeInitiation(message)
+	if err != nil {
+		t.Fatalf("failed to consume initiation: %s", err)
+	}
+	if initiation.SenderIndex != 17 || !bytes.Equal(initiation.RemoteStatic, clientPublic) {
+		t.Errorf("unexpected initiation: %+v", initiation)
+	}
+
+	response, sendKey, recvKey, err := responder.CreateResponse(initiation, 42, presharedKey)
+	if err != nil {
+		t.Fatalf("failed to create response: %s", err)
+	}
+	if len(response) != ResponseLength || ReceiverIndex(response) != 17 || binary.LittleEndian.Uint32(response[4:8]) != 42 {
+		t.Fatalf("unexpected response header: %x", response[:12])
+	}
+	if !bytes.Equal(response[60:76], mac(labelHash(labelMAC1, clientPublic), response[:60])) {
+		t.Errorf("expected the response mac1 to be keyed with the client key")
+	}
+
+	initiator.SetPresharedKey(presharedKey)
+	if _, err = initiator.ReadResponse(response[12:60]); err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+
+	// Transport messages of the client are decrypted by the server session and the other way around
+	clientSendKey, clientRecvKey := initiator.Split()
+	client, _ := ChaCha20.NewWireGuardSession(clientSendKey, clientRecvKey, false)
+	server, _ := ChaCha20.NewWireGuardSession(sendKey, recvKey, true)
+
+	datagram, _ := client.EncryptDatagram([]byte("packet"))
+	packet, err := server.DecryptDatagram(datagram)
+	if err != nil || string(packet) != "packet" {
+		t.Errorf("failed to decrypt client datagram: %v", err)
+	}
+	datagram, _ = server.EncryptDatagram(nil)
+	if len(TransportHeader(17))+len(datagram) != MinTransportLength {
+		t.Errorf("unexpected keepalive length: %d", len(datagram))
+	}
+	if _, err = client.DecryptDatagram(datagram); err != nil {
+		t.Errorf("failed to decrypt server keepalive: %s", err)
+	}
+}
+
+func TestResponder_RejectsInitiationToOtherKey(t *testing.T) {
+	serverPrivate, _ := newKeyPair(t)
+	_, otherPublic := newKeyPair(t)
+	clientPrivate, _ := newKeyPair(t)
+
+	responder, _ := NewResponder(serverPrivate)
+	_, message := initiate(t, clientPrivate, otherPublic, 1, nil)
+
+	if responder.CheckMAC1(message) {
+		t.Errorf("expected mac1 of another responder key to be invalid")
+	}
+	if _, err := responder.ConsumeInitiation(message); err == nil {
+		t.Errorf("expected initiation to another key to fail")
+	}
+}
+
+func TestResponder_CookieReply(t *testing.T) {
+	serverPrivate, serverPublic := newKeyPair(t)
+	clientPrivate, _ := newKeyPair(t)
+	cookie := bytes.Repeat([]byte{3}, 16)
+
+	responder, _ := NewResponder(serverPrivate)
+	_, message := initiate(t, clientPrivate, serverPublic, 5, nil)
+	if CheckMAC2(message, cookie) {
+		t.Fatalf("expected an initiation without cookie to fail mac2")
+	}
+
+	reply, err := responder.CreateCookieReply(message, cookie)
+	if err != nil {
+		t.Fatalf("failed to create cookie reply: %s", err)
+	}
+	if len(reply) != CookieReplyLength || ReceiverIndex(reply) != 5 {
+		t.Fatalf("unexpected cookie reply: %x", reply)
+	}
+
+	// The client decrypts the cookie with a key derived from the server key, bound to the mac1 of its message
+	aead, _ := chacha20poly1305.NewX(labelHash(labelCookie, serverPublic))
+	decrypted, err := aead.Open(nil, reply[8:32], reply[32:], message[InitiationLength-32:InitiationLength-16])
+	if err != nil || !bytes.Equal(decrypted, cookie) {
+		t.Fatalf("failed to decrypt cookie: %v", err)
+	}
+
+	_, message = initiate(t, clientPrivate, serverPublic, 6, decrypted)
+	if !responder.CheckMAC1(message) || !CheckMAC2(message, cookie) {
+		t.Errorf("expected an initiation with the cookie to pass both macs")
+	}
+}
+
+func TestTAI64N_Ordering(t *testing.T) {
+	earlier := TAI64N(time.Unix(1000, 999))
+	later := TAI64N(time.Unix(1001, 0))
+
+	if !IsNewerTimestamp(later, earlier) || IsNewerTimestamp(earlier, later) || IsNewerTimestamp(later, later) {
+		t.Errorf("expected timestamps to order by time")
+	}
+	if !IsNewerTimestamp(earlier, nil) {
+		t.Errorf("expected the first timestamp to be accepted")
+	}
+}
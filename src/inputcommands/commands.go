@@ -3,17 +3,24 @@ package inputcommands
 import (
 	"bufio"
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"etha-tunnel/server/confgen"
+	"etha-tunnel/settings/server"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
 	shutdown           = "exit"
 	generateClientConf = "gen"
+	createInvite       = "invite"
+	listInvites        = "invites"
+	revoke             = "revoke"
 )
 
 func ListenForCommand(cancelFunc context.CancelFunc) {
@@ -30,6 +37,23 @@ func ListenForCommand(cancelFunc context.CancelFunc) {
 			if err != nil {
 				log.Printf("failed to generate new client conf: %s", err)
 			}
+		} else if strings.EqualFold(text, createInvite) {
+			err := printNewInvite()
+			if err != nil {
+				log.Printf("failed to create invite: %s", err)
+			}
+		} else if strings.EqualFold(text, listInvites) {
+			err := printInvites()
+			if err != nil {
+				log.Printf("failed to list invites: %s", err)
+			}
+		} else if fields := strings.Fields(text); len(fields) == 2 && strings.EqualFold(fields[0], revoke) {
+			err := revokeInviteOrClient(fields[1])
+			if err != nil {
+				log.Printf("failed to revoke %s: %s", fields[1], err)
+				continue
+			}
+			log.Printf("%s is revoked", fields[1])
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -51,3 +75,40 @@ func printNewClientConf() error {
 	fmt.Println(string(marshalled))
 	return nil
 }
+
+func printNewInvite() error {
+	code, invite, err := confgen.NewInvite()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("invite %s, valid until %s:\n%s\n", invite.Id, invite.ExpiresAt.Format(time.RFC3339), code)
+	return nil
+}
+
+func printInvites() error {
+	invites, err := server.PendingInvites(time.Now())
+	if err != nil {
+		return err
+	}
+
+	if len(invites) == 0 {
+		fmt.Println("no pending invites")
+		return nil
+	}
+
+	for _, invite := range invites {
+		fmt.Printf("%s  created %s  expires %s\n", invite.Id, invite.CreatedAt.Format(time.RFC3339), invite.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// revokeInviteOrClient revokes a pending invite by its id, or a client by its public key
+func revokeInviteOrClient(target string) error {
+	publicKey, err := base64.StdEncoding.DecodeString(target)
+	if err == nil && len(publicKey) == ed25519.PublicKeySize {
+		return server.RevokePeer(publicKey)
+	}
+
+	return server.RevokeInvite(target)
+}
@@ -52,6 +52,17 @@ func LinkAddrAdd(devName string, ip string) (string, error) {
 	return devName, nil
 }
 
+// LinkAddrFlush Removes all IP addresses from a network device
+func LinkAddrFlush(devName string) (string, error) {
+	cmd := exec.Command("ip", "addr", "flush", "dev", devName)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to flush IP addresses of %v: %v, output: %s", devName, err, output)
+	}
+
+	return devName, nil
+}
+
 // RouteDefault Gets a default network device name
 func RouteDefault() (string, error) {
 	out, err := exec.Command("ip", "route").Output()
@@ -0,0 +1,329 @@
+package obfuscation
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The obfuscation layer turns the byte stream of a connection into records that look like random bytes.
+// The client opens the connection with a seed of random bytes and their HMAC under the obfuscation key shared by
+// the server and its clients, bound to the current minute. The server refuses seeds it has seen before, so a replayed
+// connection start is told apart. Both directions are then encrypted with AES-256-CTR under keys derived from the seed.
+// Every Write is sent as one record: an encrypted header with the payload and padding lengths, the payload,
+// and padding of a length picked by the padding policy. The stream is not authenticated, the tunnel protocol
+// inside is, so a tampered record makes the handshake or the session fail.
+
+const (
+	// SeedLength is the length of the seed the client opens the connection with
+	SeedLength = 32
+	// seedRandomLength is the random part of the seed, the truncated HMAC makes up the rest
+	seedRandomLength = 16
+	// seedSlot is the granularity of the time bound into the seed, the server accepts maxSeedSkew slots either side of its clock
+	seedSlot    = time.Minute
+	maxSeedSkew = 2
+	// KeyLength is the length of the obfuscation key
+	KeyLength = 32
+	// recordHeaderLength is 4 (payload length) + 2 (padding length)
+	recordHeaderLength = 4 + 2
+	// maxRecordPayload bounds the records of the peer, a tunnel frame is at most 4 + 65535 bytes
+	maxRecordPayload = 1 << 20
+	maxPadding       = 0xffff
+)
+
+// PaddingPolicy picks the padding of every record. Records are padded to a multiple of BlockSize,
+// then up to MaxRandomPadding random bytes are added, so larger values hide the lengths of packets
+// and handshake messages better, at the cost of bandwidth.
+type PaddingPolicy struct {
+	BlockSize        int
+	MaxRandomPadding int
+}
+
+// PaddingPolicies are the padding policies by name, from no overhead to the strongest length hiding
+var PaddingPolicies = map[string]PaddingPolicy{
+	"none":   {BlockSize: 1, MaxRandomPadding: 0},
+	"low":    {BlockSize: 64, MaxRandomPadding: 0},
+	"medium": {BlockSize: 128, MaxRandomPadding: 256},
+	"high":   {BlockSize: 512, MaxRandomPadding: 1024},
+}
+
+// DefaultPaddingPolicy is the padding policy used if none is configured
+const DefaultPaddingPolicy = "medium"
+
+// ParsePaddingPolicy returns the padding policy of a name, the default one for an empty name
+func ParsePaddingPolicy(name string) (PaddingPolicy, error) {
+	if name == "" {
+		name = DefaultPaddingPolicy
+	}
+
+	policy, ok := PaddingPolicies[name]
+	if !ok {
+		names := make([]string, 0, len(PaddingPolicies))
+		for known := range PaddingPolicies {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return PaddingPolicy{}, fmt.Errorf("unknown padding policy %s, expected one of %v", name, names)
+	}
+
+	return policy, nil
+}
+
+// paddingLength returns the padding of a record carrying payloadLength bytes
+func (p PaddingPolicy) paddingLength(payloadLength int) (int, error) {
+	padding := 0
+	if p.BlockSize > 1 {
+		recordLength := recordHeaderLength + payloadLength
+		padding = (p.BlockSize - recordLength%p.BlockSize) % p.BlockSize
+	}
+
+	if p.MaxRandomPadding > 0 {
+		random, err := rand.Int(rand.Reader, big.NewInt(int64(p.MaxRandomPadding)+1))
+		if err != nil {
+			return 0, err
+		}
+		padding += int(random.Int64())
+	}
+
+	return min(padding, maxPadding), nil
+}
+
+// Conn is a net.Conn whose byte stream is obfuscated, see Client and Server
+type Conn struct {
+	net.Conn
+	policy    PaddingPolicy
+	writeLock sync.Mutex
+	encrypt   cipher.Stream
+	decrypt   cipher.Stream
+	pending   []byte // payload of the current record not read yet
+}
+
+// Client opens the obfuscation layer on a connection to the server by sending a fresh seed
+func Client(conn net.Conn, key []byte, policy PaddingPolicy) (*Conn, error) {
+	random := make([]byte, seedRandomLength)
+	for {
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, err
+		}
+		// The server tells transports apart by the first bytes, so a seed looking like another one is not used
+		if !looksLikeOtherTransport(random) {
+			break
+		}
+	}
+	seed := append(random, seedMAC(key, random, seedSlotOf(time.Now()))...)
+
+	_, err := conn.Write(seed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send obfuscation seed: %w", err)
+	}
+
+	return newConn(conn, key, seed, policy, true)
+}
+
+// Server opens the obfuscation layer on a connection of a client by reading its seed.
+// A seed which is not authenticated by the key, or which has been seen already, is refused.
+func Server(conn net.Conn, key []byte, policy PaddingPolicy) (*Conn, error) {
+	seed := make([]byte, SeedLength)
+	_, err := io.ReadFull(conn, seed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read obfuscation seed: %w", err)
+	}
+
+	err = seenSeeds.accept(key, seed, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, key, seed, policy, false)
+}
+
+// seedSlotOf returns the time slot of a seed created at now
+func seedSlotOf(now time.Time) int64 {
+	return now.Unix() / int64(seedSlot/time.Second)
+}
+
+// seedMAC authenticates the random part of a seed and the time slot it was created in
+func seedMAC(key []byte, random []byte, slot int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("TunGo obfuscation seed"))
+	mac.Write(random)
+	_ = binary.Write(mac, binary.BigEndian, slot)
+	return mac.Sum(nil)[:SeedLength-seedRandomLength]
+}
+
+// seedFilter remembers the seeds the server accepted for as long as their time slot is accepted
+type seedFilter struct {
+	mutex      sync.Mutex
+	seen       map[[SeedLength]byte]time.Time // seed to the time it stops being accepted
+	lastPruned time.Time
+}
+
+var seenSeeds = &seedFilter{seen: make(map[[SeedLength]byte]time.Time)}
+
+// accept checks that a seed is authenticated by the key for a time slot close to now and was not accepted before
+func (f *seedFilter) accept(key []byte, seed []byte, now time.Time) error {
+	random, mac := seed[:seedRandomLength], seed[seedRandomLength:]
+	slot := seedSlotOf(now)
+	authenticated := false
+	for skew := int64(-maxSeedSkew); skew <= maxSeedSkew && !authenticated; skew++ {
+		if hmac.Equal(mac, seedMAC(key, random, slot+skew)) {
+			authenticated = true
+			slot += skew
+		}
+	}
+	if !authenticated {
+		return fmt.Errorf("obfuscation seed is not authenticated by the key or is too old")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if now.Sub(f.lastPruned) >= seedSlot {
+		for seen, expiresAt := range f.seen {
+			if !now.Before(expiresAt) {
+				delete(f.seen, seen)
+			}
+		}
+		f.lastPruned = now
+	}
+
+	id := [SeedLength]byte(seed)
+	if expiresAt, ok := f.seen[id]; ok && now.Before(expiresAt) {
+		return fmt.Errorf("obfuscation seed is replayed")
+	}
+	f.seen[id] = time.Unix((slot+maxSeedSkew+1)*int64(seedSlot/time.Second), 0)
+
+	return nil
+}
+
+func newConn(conn net.Conn, key []byte, seed []byte, policy PaddingPolicy, isClient bool) (*Conn, error) {
+	if len(key) != KeyLength {
+		return nil, fmt.Errorf("invalid obfuscation key length: %d, expected %d", len(key), KeyLength)
+	}
+
+	clientToServer, err := newStream(key, seed, "TunGo obfuscation client to server")
+	if err != nil {
+		return nil, err
+	}
+	serverToClient, err := newStream(key, seed, "TunGo obfuscation server to client")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: conn, policy: policy, encrypt: serverToClient, decrypt: clientToServer}
+	if isClient {
+		c.encrypt, c.decrypt = clientToServer, serverToClient
+	}
+
+	return c, nil
+}
+
+// newStream derives the key and the initial counter of one direction, AES-CTR has a 128-bit counter which never wraps in practice
+func newStream(key []byte, seed []byte, info string) (cipher.Stream, error) {
+	material := make([]byte, 32+aes.BlockSize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, seed, []byte(info)), material)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(material[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewCTR(block, material[32:]), nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		payload, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = payload
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends b as one record, or as several if it is longer than a record
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		chunk := b[written:min(len(b), written+maxRecordPayload)]
+		err := c.writeRecord(chunk)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		if written == len(b) {
+			return written, nil
+		}
+	}
+}
+
+func (c *Conn) readRecord() ([]byte, error) {
+	header := make([]byte, recordHeaderLength)
+	_, err := io.ReadFull(c.Conn, header)
+	if err != nil {
+		return nil, err
+	}
+	c.decrypt.XORKeyStream(header, header)
+
+	payloadLength := binary.BigEndian.Uint32(header[:4])
+	paddingLength := binary.BigEndian.Uint16(header[4:])
+	if payloadLength > maxRecordPayload {
+		return nil, fmt.Errorf("obfuscated record is too large: %d", payloadLength)
+	}
+
+	record := make([]byte, int(payloadLength)+int(paddingLength))
+	_, err = io.ReadFull(c.Conn, record)
+	if err != nil {
+		return nil, err
+	}
+	c.decrypt.XORKeyStream(record, record)
+
+	return record[:payloadLength], nil
+}
+
+// writeRecord encrypts and sends a record in a single write, records of concurrent writers are not interleaved
+func (c *Conn) writeRecord(payload []byte) error {
+	paddingLength, err := c.policy.paddingLength(len(payload))
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, recordHeaderLength, recordHeaderLength+len(payload)+paddingLength)
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint16(record[4:], uint16(paddingLength))
+	record = append(record, payload...)
+	record = append(record, make([]byte, paddingLength)...)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	// Padding is zeros before encryption, the key stream makes it random
+	c.encrypt.XORKeyStream(record, record)
+	_, err = c.Conn.Write(record)
+	return err
+}
+
+// looksLikeOtherTransport reports whether the first bytes of a seed could be taken for a tunnel handshake message,
+// an HTTP request or a TLS handshake record by the server
+func looksLikeOtherTransport(seed []byte) bool {
+	return seed[0] <= 0x0f || bytes.HasPrefix(seed, []byte("GET ")) || seed[0] == 0x16
+}
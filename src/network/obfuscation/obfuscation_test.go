@@ -0,0 +1,162 @@
+package obfuscation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe opens the obfuscation layer on both ends of a pipe, and returns the raw client end
+// tapped so the bytes on the wire can be inspected
+func pipe(t *testing.T, clientKey []byte, serverKey []byte, policy PaddingPolicy) (*Conn, *Conn, *bytes.Buffer) {
+	t.Helper()
+	clientSide, serverSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+		_ = serverSide.Close()
+	})
+
+	wire := &bytes.Buffer{}
+	tapped := &tapConn{Conn: clientSide, wire: wire}
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := Server(serverSide, serverKey, policy)
+		if err != nil {
+			t.Errorf("failed to open server side: %s", err)
+		}
+		accepted <- conn
+	}()
+
+	client, err := Client(tapped, clientKey, policy)
+	if err != nil {
+		t.Fatalf("failed to open client side: %s", err)
+	}
+	return client, <-accepted, wire
+}
+
+type tapConn struct {
+	net.Conn
+	wire *bytes.Buffer
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	c.wire.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestConn_RoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeyLength)
+	client, server, wire := pipe(t, key, key, PaddingPolicies["high"])
+
+	message := []byte{0x01, 0x03, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	go func() {
+		_, _ = client.Write(message)
+	}()
+
+	received := make([]byte, len(message))
+	if _, err := io.ReadFull(server, received); err != nil || !bytes.Equal(received, message) {
+		t.Fatalf("failed to read record: %v", err)
+	}
+
+	// The seed and the encrypted record are on the wire, the message is not
+	recordLength := wire.Len() - SeedLength
+	if bytes.Contains(wire.Bytes(), message[4:]) || looksLikeOtherTransport(wire.Bytes()) {
+		t.Errorf("expected the message to be obfuscated on the wire")
+	}
+	if recordLength < 512 || recordLength > 512+1024 {
+		t.Errorf("expected the record to be padded to the block size and at most 1024 random bytes, got %d bytes", recordLength)
+	}
+
+	go func() {
+		_, _ = server.Write([]byte("reply"))
+	}()
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+}
+
+// openServer sends the bytes a client starts its stream with to the server side of a pipe
+func openServer(t *testing.T, start []byte, key []byte) error {
+	t.Helper()
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	go func() {
+		_, _ = clientSide.Write(start)
+	}()
+	_, err := Server(serverSide, key, PaddingPolicies["none"])
+	return err
+}
+
+func TestServer_WrongKey(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	go func() {
+		_, _ = Client(clientSide, bytes.Repeat([]byte{1}, KeyLength), PaddingPolicies["none"])
+	}()
+	if _, err := Server(serverSide, bytes.Repeat([]byte{2}, KeyLength), PaddingPolicies["none"]); err == nil {
+		t.Errorf("expected a server holding another key to refuse the seed")
+	}
+}
+
+func TestServer_RefusesReplayedSeed(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeyLength)
+	client, server, wire := pipe(t, key, key, PaddingPolicies["none"])
+
+	message := []byte{0x01, 0x03, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	go func() {
+		_, _ = client.Write(message)
+	}()
+	if _, err := io.ReadFull(server, make([]byte, len(message))); err != nil {
+		t.Fatalf("failed to read record: %v", err)
+	}
+
+	// A prober replaying the recorded start of the stream is refused at the seed
+	if err := openServer(t, wire.Bytes(), key); err == nil {
+		t.Errorf("expected a replayed seed to be refused")
+	}
+}
+
+func TestServer_RefusesStaleSeed(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeyLength)
+	random := make([]byte, seedRandomLength)
+	_, _ = rand.Read(random)
+
+	stale := append(bytes.Clone(random), seedMAC(key, random, seedSlotOf(time.Now())-maxSeedSkew-1)...)
+	if err := openServer(t, stale, key); err == nil {
+		t.Errorf("expected a seed from too long ago to be refused")
+	}
+
+	skewed := append(bytes.Clone(random), seedMAC(key, random, seedSlotOf(time.Now())+1)...)
+	if err := openServer(t, skewed, key); err != nil {
+		t.Errorf("expected a seed from a slightly skewed clock to be accepted, got %v", err)
+	}
+}
+
+func TestPaddingPolicy_PaddingLength(t *testing.T) {
+	policy := PaddingPolicy{BlockSize: 128}
+	for _, payloadLength := range []int{0, 1, 122, 123, 1000} {
+		padding, err := policy.paddingLength(payloadLength)
+		if err != nil {
+			t.Fatalf("failed to pick padding: %s", err)
+		}
+		if (recordHeaderLength+payloadLength+padding)%128 != 0 || padding >= 128 {
+			t.Errorf("expected %d bytes to be padded to the block size, got %d bytes of padding", payloadLength, padding)
+		}
+	}
+
+	if _, err := ParsePaddingPolicy("extreme"); err == nil {
+		t.Errorf("expected an unknown padding policy to be refused")
+	}
+	if policy, err := ParsePaddingPolicy(""); err != nil || policy != PaddingPolicies[DefaultPaddingPolicy] {
+		t.Errorf("expected the default padding policy, got %+v, %v", policy, err)
+	}
+}
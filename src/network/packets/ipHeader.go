@@ -6,6 +6,7 @@ import (
 )
 
 type IPHeader interface {
+	GetSourceIP() net.IP
 	GetDestinationIP() net.IP
 }
 
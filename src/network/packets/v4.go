@@ -23,6 +23,10 @@ type IPv4Header struct {
 	DestinationIP  net.IP
 }
 
+func (h *IPv4Header) GetSourceIP() net.IP {
+	return h.SourceIP
+}
+
 func (h *IPv4Header) GetDestinationIP() net.IP {
 	return h.DestinationIP
 }
@@ -19,6 +19,10 @@ type IPv6Header struct {
 	DestinationIP net.IP
 }
 
+func (h *IPv6Header) GetSourceIP() net.IP {
+	return h.SourceIP
+}
+
 func (h *IPv6Header) GetDestinationIP() net.IP {
 	return h.DestinationIP
 }
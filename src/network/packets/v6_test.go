@@ -0,0 +1,38 @@
+package packets
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseIPv6Header(t *testing.T) {
+	packet := []byte{
+		0x60, 0x00, 0x00, 0x00, 0x00, 0x08, 0x3a, 0x40,
+		0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	}
+
+	header, err := Parse(packet)
+	if err != nil {
+		t.Fatalf("failed to parse IPv6 header: %v", err)
+	}
+
+	expectedSourceIP := net.ParseIP("fd00::2")
+	if !header.GetSourceIP().Equal(expectedSourceIP) {
+		t.Errorf("expected SourceIP %s, got %s", expectedSourceIP, header.GetSourceIP())
+	}
+
+	expectedDestinationIP := net.ParseIP("fd00::1")
+	if !header.GetDestinationIP().Equal(expectedDestinationIP) {
+		t.Errorf("expected DestinationIP %s, got %s", expectedDestinationIP, header.GetDestinationIP())
+	}
+}
+
+func TestParseIPv6Header_InvalidLength(t *testing.T) {
+	packet := []byte{0x60, 0x00, 0x00, 0x00}
+
+	_, err := ParseIPv6Header(packet)
+	if err == nil {
+		t.Errorf("expected error for invalid packet length, but got none")
+	}
+}
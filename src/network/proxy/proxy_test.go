@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serveProxy accepts one connection, runs the proxy side of the negotiation on it and then echoes the stream
+func serveProxy(t *testing.T, negotiate func(conn net.Conn, reader *bufio.Reader) bool) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if negotiate(conn, reader) {
+			_, _ = io.Copy(conn, reader)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func dialAndEcho(t *testing.T, rawURL string) error {
+	t.Helper()
+	proxyURL, err := Parse(rawURL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy url: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, proxyURL, "192.0.2.1:8080")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	_, err = io.ReadFull(conn, echo)
+	if err != nil || string(echo) != "ping" {
+		t.Errorf("expected the stream to pass the proxy, got %q, %v", echo, err)
+	}
+	return nil
+}
+
+func TestDial_HTTPConnect(t *testing.T) {
+	address := serveProxy(t, func(conn net.Conn, reader *bufio.Reader) bool {
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return false
+		}
+		authorization := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+		if request.Method != http.MethodConnect || request.Host != "192.0.2.1:8080" || request.Header.Get("Proxy-Authorization") != authorization {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return false
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return true
+	})
+
+	err := dialAndEcho(t, "http://user:secret@"+address)
+	if err != nil {
+		t.Errorf("expected the proxy to connect, got %v", err)
+	}
+}
+
+func TestDial_SOCKS5(t *testing.T) {
+	address := serveProxy(t, func(conn net.Conn, reader *bufio.Reader) bool {
+		greeting := make([]byte, 3)
+		_, _ = io.ReadFull(reader, greeting)
+		if !bytes.Equal(greeting, []byte{socksVersion, 1, socksUsernamePassword}) {
+			return false
+		}
+		_, _ = conn.Write([]byte{socksVersion, socksUsernamePassword})
+
+		credentials := make([]byte, 2+len("user")+1+len("secret"))
+		_, _ = io.ReadFull(reader, credentials)
+		if string(credentials[2:6]) != "user" || string(credentials[7:]) != "secret" {
+			_, _ = conn.Write([]byte{socksUsernamePasswordVersion, 1})
+			return false
+		}
+		_, _ = conn.Write([]byte{socksUsernamePasswordVersion, socksSucceeded})
+
+		request := make([]byte, 10)
+		_, _ = io.ReadFull(reader, request)
+		if !bytes.Equal(request, []byte{socksVersion, socksConnect, 0, socksIPv4, 192, 0, 2, 1, 0x1f, 0x90}) {
+			return false
+		}
+		_, _ = conn.Write([]byte{socksVersion, socksSucceeded, 0, socksIPv4, 127, 0, 0, 1, 0x30, 0x39})
+		return true
+	})
+
+	err := dialAndEcho(t, "socks5://user:secret@"+address)
+	if err != nil {
+		t.Errorf("expected the proxy to connect, got %v", err)
+	}
+}
+
+func TestDial_Refused(t *testing.T) {
+	address := serveProxy(t, func(conn net.Conn, reader *bufio.Reader) bool {
+		_, _ = http.ReadRequest(reader)
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return false
+	})
+
+	err := dialAndEcho(t, "http://"+address)
+	if err == nil {
+		t.Errorf("expected a refused proxy request to fail")
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, rawURL := range []string{"ftp://proxy:21", "http://proxy", "socks5://:1080"} {
+		_, err := Parse(rawURL)
+		if err == nil {
+			t.Errorf("expected %s to be rejected", rawURL)
+		}
+	}
+}
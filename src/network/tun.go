@@ -91,7 +91,15 @@ func CreateNewTun(conf *server.Conf) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("assigned IP %s to interface %s\n", conf.TCPPort, conf.IfName)
+	fmt.Printf("assigned IP %s to interface %s\n", conf.IfIP, conf.IfName)
+
+	if conf.IfIPv6 != "" {
+		_, err = ip.LinkAddrAdd(conf.IfName, conf.IfIPv6)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("assigned IP %s to interface %s\n", conf.IfIPv6, conf.IfName)
+	}
 
 	return nil
 }
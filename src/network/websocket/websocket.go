@@ -0,0 +1,329 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc6455
+
+const (
+	opContinuation byte = 0x0
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xa
+
+	finBit  byte = 0x80
+	maskBit byte = 0x80
+
+	// maxMessageLength bounds the messages of the peer, a tunnel frame is at most 4 + 65535 bytes
+	maxMessageLength = 1 << 20
+	// maxControlLength is the largest payload of a close, ping or pong frame
+	maxControlLength = 125
+
+	// closeTimeout bounds sending the close frame, so closing never hangs on a peer which stopped reading
+	closeTimeout = time.Second
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// Conn is a net.Conn carrying a byte stream in WebSocket binary messages. Every Write is sent as one message,
+// so a tunnel frame is never split across messages, and Read returns the payloads of the messages in order.
+type Conn struct {
+	net.Conn
+	reader    *bufio.Reader // reads the underlying connection, it may hold bytes read along with the HTTP upgrade
+	isClient  bool          // clients mask the frames they send
+	writeLock sync.Mutex
+	pending   []byte // payload of the current message not read yet
+	closed    bool   // the peer has sent a close frame
+}
+
+// IsUpgradeRequest reports whether the first bytes of a connection start an HTTP request rather than a tunnel handshake
+func IsUpgradeRequest(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte("GET "))
+}
+
+// Dial upgrades a connection to the server to a WebSocket on path, host is sent as the Host header
+func Dial(conn net.Conn, host string, path string) (*Conn, error) {
+	keyBuf := make([]byte, 16)
+	_, err := rand.Read(keyBuf)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBuf)
+
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	_, err = conn.Write([]byte(request))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send websocket upgrade: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read websocket upgrade response: %w", err)
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("server refused websocket upgrade: %s", response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("invalid websocket upgrade response")
+	}
+
+	return &Conn{Conn: conn, reader: reader, isClient: true}, nil
+}
+
+// ErrNotUpgrade is returned by Accept for an HTTP request which is not a WebSocket upgrade on the path
+var ErrNotUpgrade = errors.New("not a websocket upgrade request")
+
+// Accept reads the HTTP upgrade request of a client and completes the upgrade if it asks for a WebSocket on path.
+// Any other request, a malformed one included, fails with ErrNotUpgrade and is left unanswered, see RefuseUpgrade.
+func Accept(conn net.Conn, path string) (*Conn, error) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read request: %s", ErrNotUpgrade, err)
+	}
+	_ = request.Body.Close()
+
+	if request.URL.Path != path {
+		return nil, fmt.Errorf("%w: unknown path %s", ErrNotUpgrade, request.URL.Path)
+	}
+
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if request.Method != http.MethodGet || !headerContains(request.Header, "Connection", "upgrade") ||
+		!headerContains(request.Header, "Upgrade", "websocket") || request.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		return nil, fmt.Errorf("%w: missing upgrade headers", ErrNotUpgrade)
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(response))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send websocket upgrade response: %w", err)
+	}
+
+	return &Conn{Conn: conn, reader: reader}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+
+		payload, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = payload
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	err := c.writeFrame(opBinary, b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close sends a close frame before closing the underlying connection
+func (c *Conn) Close() error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	_ = c.writeFrame(opClose, nil)
+	return c.Conn.Close()
+}
+
+// readMessage reads the frames of the next data message, answering the control frames in between
+func (c *Conn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			err = c.writeFrame(opPong, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.closed = true
+			_ = c.writeFrame(opClose, nil)
+			return nil, nil
+		}
+
+		message = append(message, payload...)
+		if len(message) > maxMessageLength {
+			return nil, fmt.Errorf("websocket message is too large")
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&finBit != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&maskBit != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch opcode {
+	case opContinuation, opBinary:
+	case opClose, opPing, opPong:
+		if !fin || length > maxControlLength {
+			return false, 0, nil, fmt.Errorf("invalid websocket control frame")
+		}
+	default:
+		return false, 0, nil, fmt.Errorf("unsupported websocket opcode: %d", opcode)
+	}
+
+	// Clients must mask their frames and servers must not
+	if masked == c.isClient {
+		return false, 0, nil, fmt.Errorf("invalid websocket frame masking")
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if length > maxMessageLength {
+		return false, 0, nil, fmt.Errorf("websocket frame is too large")
+	}
+
+	var maskKey [4]byte
+	if masked {
+		_, err = io.ReadFull(c.reader, maskKey[:])
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		mask(payload, maskKey)
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends a single frame, frames of concurrent writers are not interleaved
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, finBit|opcode)
+
+	var maskFlag byte
+	if c.isClient {
+		maskFlag = maskBit
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskFlag|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if c.isClient {
+		var maskKey [4]byte
+		_, err := rand.Read(maskKey[:])
+		if err != nil {
+			return err
+		}
+		frame = append(frame, maskKey[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		mask(frame[start:], maskKey)
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func mask(payload []byte, maskKey [4]byte) {
+	for i := range payload {
+		payload[i] ^= maskKey[i%4]
+	}
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RefuseUpgrade answers a request Accept failed for with 404 Not Found
+func RefuseUpgrade(conn net.Conn) {
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", http.StatusNotFound, http.StatusText(http.StatusNotFound))
+}
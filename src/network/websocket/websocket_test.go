@@ -0,0 +1,119 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// The example of RFC 6455 section 1.3
+	if key := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept key: %s", key)
+	}
+}
+
+func upgrade(t *testing.T, clientPath string, serverPath string) (*Conn, *Conn, error, error) {
+	t.Helper()
+	clientSide, serverSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+		_ = serverSide.Close()
+	})
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := Accept(serverSide, serverPath)
+		if err != nil {
+			RefuseUpgrade(serverSide)
+			_ = serverSide.Close()
+		}
+		accepted <- result{conn, err}
+	}()
+
+	client, clientErr := Dial(clientSide, "example.com", clientPath)
+	server := <-accepted
+	return client, server.conn, clientErr, server.err
+}
+
+func TestConn_RoundTrip(t *testing.T) {
+	client, server, clientErr, serverErr := upgrade(t, "/tunnel", "/tunnel")
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("failed to upgrade: %v, %v", clientErr, serverErr)
+	}
+
+	large := bytes.Repeat([]byte{0xab}, 70000)
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+		_, _ = client.Write(large)
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	received := make([]byte, len(large))
+	if _, err := io.ReadFull(server, received); err != nil || !bytes.Equal(received, large) {
+		t.Fatalf("failed to read large message: %v", err)
+	}
+
+	go func() {
+		_, _ = server.Write([]byte("world"))
+	}()
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "world" {
+		t.Fatalf("failed to read message of the server: %v", err)
+	}
+}
+
+func TestConn_AnswersPing(t *testing.T) {
+	client, server, clientErr, serverErr := upgrade(t, "/", "/")
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("failed to upgrade: %v, %v", clientErr, serverErr)
+	}
+
+	go func() {
+		_ = server.writeFrame(opPing, []byte("ping"))
+		_, _ = server.Write([]byte("data"))
+	}()
+	go func() {
+		// The pong is read by the server before the data of the client
+		_, _ = io.ReadFull(server, make([]byte, 4))
+	}()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("expected the ping to be skipped, got %q, %v", buf, err)
+	}
+}
+
+func TestAccept_RefusesOtherPath(t *testing.T) {
+	_, _, clientErr, serverErr := upgrade(t, "/other", "/tunnel")
+	if clientErr == nil || !errors.Is(serverErr, ErrNotUpgrade) {
+		t.Errorf("expected the upgrade to another path to fail, got %v, %v", clientErr, serverErr)
+	}
+}
+
+func TestAccept_RefusesMalformedRequest(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	go func() {
+		_, _ = clientSide.Write([]byte("GET / HTTP/1.1\r\nHost example.com\r\n\r\n"))
+	}()
+	if _, err := Accept(serverSide, "/"); !errors.Is(err, ErrNotUpgrade) {
+		t.Errorf("expected a malformed request to be no upgrade, got %v", err)
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	if !IsUpgradeRequest([]byte("GET / HTTP/1.1")) || IsUpgradeRequest([]byte{0x01, 0x03, 0x00, 0x20}) {
+		t.Errorf("expected only an HTTP request to be an upgrade")
+	}
+}
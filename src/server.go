@@ -3,10 +3,15 @@ package main
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"etha-tunnel/handshake/ChaCha20"
 	"etha-tunnel/network"
 	"etha-tunnel/server/forwarding/routing"
+	"etha-tunnel/server/sshagent"
 	"etha-tunnel/settings/server"
+	"fmt"
 	"log"
+	"slices"
+	"time"
 )
 
 func main() {
@@ -15,10 +20,16 @@ func main() {
 		log.Fatalf("failed to read configuration: %v", err)
 	}
 
+	err = registerSSHAgentSigners(conf)
+	if err != nil {
+		log.Fatalf("failed to use ssh-agent: %s", err)
+	}
+
 	err = ensureEd25519KeyPairCreated(conf)
 	if err != nil {
 		log.Fatalf("failed to generate ed25519 keys: %s", err)
 	}
+	logServerKeyFingerprints(conf)
 
 	err = startServer(conf)
 	if err != nil {
@@ -27,8 +38,31 @@ func main() {
 }
 
 func ensureEd25519KeyPairCreated(conf *server.Conf) error {
+	// Rotation keys added to the conf without a key pair get one, so the next key can be announced before it is used
+	if slices.ContainsFunc(conf.SigningKeys, func(key server.SigningKey) bool { return len(key.Ed25519PublicKey) == 0 }) {
+		updated, err := server.UpdateConf(func(current *server.Conf) error {
+			for i := range current.SigningKeys {
+				key := &current.SigningKeys[i]
+				if len(key.Ed25519PublicKey) > 0 {
+					continue
+				}
+
+				edPub, ed, keyGenerationErr := ed25519.GenerateKey(rand.Reader)
+				if keyGenerationErr != nil {
+					return fmt.Errorf("failed to generate ed25519 key pair: %s", keyGenerationErr)
+				}
+				key.Ed25519PublicKey, key.Ed25519PrivateKey = edPub, ed
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("failed to insert ed25519 keys to server conf: %s", err)
+		}
+		*conf = *updated
+	}
+
 	// if keys are generated
-	if len(conf.Ed25519PublicKey) > 0 && len(conf.Ed25519PrivateKey) > 0 {
+	if len(conf.AllSigningKeys()) > 0 {
 		return nil
 	}
 
@@ -44,6 +78,66 @@ func ensureEd25519KeyPairCreated(conf *server.Conf) error {
 	return nil
 }
 
+// logServerKeyFingerprints prints the fingerprints of the server keys, so an operator can compare them out of band
+// with the one a client trusting on first use shows
+func logServerKeyFingerprints(conf *server.Conf) {
+	for _, key := range conf.AllSigningKeys() {
+		if key.NotAfter.IsZero() {
+			log.Printf("server key fingerprint: %s", ChaCha20.Fingerprint(key.Ed25519PublicKey))
+			continue
+		}
+		log.Printf("server key fingerprint: %s, valid until %s", ChaCha20.Fingerprint(key.Ed25519PublicKey), key.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// registerSSHAgentSigners makes the ssh-agent sign with the server keys whose private keys are not in the keystore.
+// A server without any key adopts the first Ed25519 key of the agent.
+func registerSSHAgentSigners(conf *server.Conf) error {
+	if conf.SSHAgentSocket == "" {
+		return nil
+	}
+
+	if len(conf.Ed25519PublicKey) == 0 && len(conf.SigningKeys) == 0 {
+		agentKeys, err := sshagent.Ed25519Keys(conf.SSHAgentSocket)
+		if err != nil {
+			return err
+		}
+		if len(agentKeys) == 0 {
+			return fmt.Errorf("ssh-agent holds no ed25519 key")
+		}
+		updated, err := server.UpdateConf(func(current *server.Conf) error {
+			current.Ed25519PublicKey = agentKeys[0]
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		*conf = *updated
+	}
+
+	keys := append([]server.SigningKey{{
+		Ed25519PublicKey:  conf.Ed25519PublicKey,
+		Ed25519PrivateKey: conf.Ed25519PrivateKey,
+	}}, conf.SigningKeys...)
+	for _, key := range keys {
+		if len(key.Ed25519PublicKey) == 0 || len(key.Ed25519PrivateKey) > 0 {
+			continue
+		}
+
+		signer := sshagent.NewSigner(conf.SSHAgentSocket, key.Ed25519PublicKey)
+		err := signer.CheckKey()
+		if err != nil {
+			return err
+		}
+		err = server.RegisterSigner(signer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func startServer(conf *server.Conf) error {
 	err := network.CreateNewTun(conf)
 	tunFile, err := network.OpenTunByName(conf.IfName)
@@ -52,7 +146,7 @@ func startServer(conf *server.Conf) error {
 	}
 	defer tunFile.Close()
 
-	err = routing.Start(tunFile, conf.TCPPort)
+	err = routing.Start(tunFile, conf)
 	if err != nil {
 		return err
 	}
@@ -1,54 +1,207 @@
 package confgen
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"etha-tunnel/handshake/ChaCha20"
 	"etha-tunnel/settings/client"
 	"etha-tunnel/settings/server"
 	"fmt"
 	"net"
 	"os/exec"
+	"slices"
 	"strings"
+	"time"
 )
 
 // Generate generates new client configuration
 func Generate() (*client.Conf, error) {
-	serverConf, err := (&server.Conf{}).Read()
+	clientEdPub, clientEd, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read server configuration: %s", err)
+		return nil, fmt.Errorf("failed to generate client ed25519 key pair: %s", err)
 	}
 
-	serverIpAddr, addressResolutionError := getServerIpString()
-	if addressResolutionError != nil {
-		if serverConf.FallbackServerAddress == "" {
-			return nil, fmt.Errorf("failed to resolve server IP and no fallback address provided in server configuration: %s", addressResolutionError)
+	var conf *client.Conf
+	_, err = server.UpdateConf(func(serverConf *server.Conf) error {
+		var addErr error
+		conf, addErr = addPeer(serverConf, clientEdPub)
+		return addErr
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add peer to server configuration: %s", err)
+	}
+	conf.ClientEd25519PrivateKey = clientEd
+
+	return conf, nil
+}
+
+// Enroll registers the key a new client generated itself and returns its configuration, without the client private key.
+// The invite is redeemed once the client is a peer, and the peer is removed again if the invite was redeemed in the
+// meantime by a concurrent enrollment, so an invite enrolls a single client and a failed enrollment does not burn it.
+func Enroll(clientEdPub ed25519.PublicKey, inviteId string) (*client.Conf, error) {
+	var conf *client.Conf
+	_, err := server.UpdateConf(func(serverConf *server.Conf) error {
+		if _, found := serverConf.FindPeer(clientEdPub); found {
+			return fmt.Errorf("client is already enrolled")
 		}
-		serverIpAddr = serverConf.FallbackServerAddress
+
+		var addErr error
+		conf, addErr = addPeer(serverConf, clientEdPub)
+		return addErr
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	var serverTCPAddress string
-	// for IPv6, port must be handled in different way
-	if strings.Contains(serverIpAddr, ":") {
-		serverTCPAddress = fmt.Sprintf("[%s]%s", serverIpAddr, serverConf.TCPPort)
-	} else {
-		serverTCPAddress = fmt.Sprintf("%s%s", serverIpAddr, serverConf.TCPPort)
+	err = server.RedeemInvite(inviteId, time.Now())
+	if err != nil {
+		_, removeErr := server.UpdateConf(func(serverConf *server.Conf) error {
+			serverConf.Peers = slices.DeleteFunc(serverConf.Peers, func(peer server.Peer) bool {
+				return peer.Ed25519PublicKey.Equal(clientEdPub)
+			})
+			return nil
+		})
+		if removeErr != nil {
+			return nil, fmt.Errorf("failed to redeem invite %s: %s, and to remove the peer again: %s", inviteId, err, removeErr)
+		}
+		return nil, fmt.Errorf("failed to redeem invite %s: %s", inviteId, err)
+	}
+
+	return conf, nil
+}
+
+// NewInvite mints a single-use invite, the returned code is what the new client puts into its configuration
+func NewInvite() (string, *server.Invite, error) {
+	serverConf, err := (&server.Conf{}).Read()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read server configuration: %s", err)
+	}
+
+	serverTCPAddress, serverUDPAddress, err := serverAddresses(serverConf)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := make([]byte, ChaCha20.InviteIdLength)
+	secret := make([]byte, ChaCha20.InviteSecretLength)
+	_, err = rand.Read(id)
+	if err == nil {
+		_, err = rand.Read(secret)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate invite: %s", err)
+	}
+
+	now := time.Now().UTC()
+	invite := server.Invite{
+		Id:        hex.EncodeToString(id),
+		Secret:    secret,
+		CreatedAt: now,
+		ExpiresAt: now.Add(serverConf.InviteLifetime()),
+	}
+	code, err := (&client.Invite{
+		ServerTCPAddress: serverTCPAddress,
+		ServerUDPAddress: serverUDPAddress,
+		Ed25519PublicKey: serverConf.Ed25519PublicKey,
+		Id:               id,
+		Secret:           secret,
+	}).Encode()
+	if err != nil {
+		return "", nil, err
 	}
 
-	serverConf.ClientCounter += 1
-	clientIfIp := fmt.Sprintf("10.0.0.%d/24", serverConf.ClientCounter+1)
-	err = serverConf.RewriteConf()
+	err = server.AddInvite(invite)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return code, &invite, nil
+}
+
+// addPeer adds the client key to server peers and returns the client configuration without the client private key,
+// the server conf is written by the caller
+func addPeer(serverConf *server.Conf, clientEdPub ed25519.PublicKey) (*client.Conf, error) {
+	serverTCPAddress, serverUDPAddress, err := serverAddresses(serverConf)
 	if err != nil {
 		return nil, err
 	}
 
+	// Pre-shared key protects the session keys even if the curve is broken some day
+	presharedKey := make([]byte, 32)
+	_, err = rand.Read(presharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate pre-shared key: %s", err)
+	}
+
+	// Client access ends after the configured lifetime, if there is one
+	var notAfter time.Time
+	if serverConf.ClientLifetimeSeconds > 0 {
+		notAfter = time.Now().UTC().Add(time.Duration(serverConf.ClientLifetimeSeconds) * time.Second).Truncate(time.Second)
+	}
+
+	// Tunnel address is assigned by the server during the handshake
+	serverConf.Peers = append(serverConf.Peers, server.Peer{
+		Ed25519PublicKey: clientEdPub,
+		PresharedKey:     presharedKey,
+		NotAfter:         notAfter,
+	})
+
+	// All keys the server signs with now or will sign with are pinned, so a key rotation does not break the client
+	var serverKeys []client.ServerKey
+	for _, key := range serverConf.UpcomingSigningKeys(time.Now()) {
+		if key.Ed25519PublicKey.Equal(serverConf.Ed25519PublicKey) {
+			continue
+		}
+		serverKeys = append(serverKeys, client.ServerKey{Ed25519PublicKey: key.Ed25519PublicKey, NotAfter: key.NotAfter})
+	}
+
 	conf := client.Conf{
 		IfName:           "ethatun0",
-		IfIP:             clientIfIp,
 		ServerTCPAddress: serverTCPAddress,
+		ServerUDPAddress: serverUDPAddress,
+		Transport:        client.TCPTransport,
 		Ed25519PublicKey: serverConf.Ed25519PublicKey,
+		PresharedKey:     presharedKey,
+		ServerKeys:       serverKeys,
+		NotAfter:         notAfter,
+		// The client pads by the policy of the server, the one who picked how much length hiding is worth
+		ObfuscationKey:     serverConf.ObfuscationKey,
+		ObfuscationPadding: serverConf.ObfuscationPadding,
 	}
 
 	return &conf, nil
 }
 
+// serverAddresses returns the addresses clients reach the server at
+func serverAddresses(serverConf *server.Conf) (string, string, error) {
+	serverIpAddr, addressResolutionError := getServerIpString()
+	if addressResolutionError != nil {
+		if serverConf.FallbackServerAddress == "" {
+			return "", "", fmt.Errorf("failed to resolve server IP and no fallback address provided in server configuration: %s", addressResolutionError)
+		}
+		serverIpAddr = serverConf.FallbackServerAddress
+	}
+
+	serverTCPAddress := joinHostPort(serverIpAddr, serverConf.TCPPort)
+	var serverUDPAddress string
+	if serverConf.UDPPort != "" {
+		serverUDPAddress = joinHostPort(serverIpAddr, serverConf.UDPPort)
+	}
+
+	return serverTCPAddress, serverUDPAddress, nil
+}
+
+// joinHostPort joins server ip with a port in ':port' notation
+func joinHostPort(serverIpAddr string, port string) string {
+	// for IPv6, port must be handled in different way
+	if strings.Contains(serverIpAddr, ":") {
+		return fmt.Sprintf("[%s]%s", serverIpAddr, port)
+	}
+
+	return fmt.Sprintf("%s%s", serverIpAddr, port)
+}
+
 func getServerIpString() (string, error) {
 	v4Addr, err := getV4Addr()
 	if err == nil {
@@ -0,0 +1,57 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"etha-tunnel/server/forwarding/servertcptunforward"
+	"etha-tunnel/server/ipam"
+	"etha-tunnel/settings/server"
+	"log"
+	"sync"
+	"time"
+)
+
+// revocationCheckInterval is how often active sessions are checked against the server conf,
+// so sessions of expired clients and of clients revoked by editing the conf end as well
+const revocationCheckInterval = 30 * time.Second
+
+// enforceRevocations tears down the sessions of revoked clients at once, and the ones of expired clients periodically
+func enforceRevocations(ctx context.Context, pool *ipam.Pool, localIpToConn *sync.Map, localIpToSession *sync.Map) {
+	server.OnPeerRevoked(func(publicKey ed25519.PublicKey) {
+		for _, peer := range pool.ActivePeers() {
+			if peer.Ed25519PublicKey.Equal(publicKey) {
+				log.Printf("client %s is revoked", base64.StdEncoding.EncodeToString(publicKey))
+				servertcptunforward.Disconnect(peer.Addresses, localIpToConn, localIpToSession)
+			}
+		}
+
+		// The addresses of a revoked client are free for others, rather than held until its lease expires
+		if err := pool.Forget(publicKey); err != nil {
+			log.Printf("failed to forget the lease of a revoked client: %s", err)
+		}
+	})
+
+	ticker := time.NewTicker(revocationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			conf, err := (&server.Conf{}).Read()
+			if err != nil {
+				log.Printf("failed to read server conf: %s", err)
+				continue
+			}
+
+			now := time.Now()
+			for _, peer := range pool.ActivePeers() {
+				if _, err = conf.AuthorizePeer(peer.Ed25519PublicKey, now); err != nil {
+					log.Printf("%s, closing its sessions", err)
+					servertcptunforward.Disconnect(peer.Addresses, localIpToConn, localIpToSession)
+				}
+			}
+		}
+	}
+}
@@ -2,15 +2,25 @@ package routing
 
 import (
 	"context"
+	"crypto/tls"
+	"etha-tunnel/handshake/ChaCha20"
 	"etha-tunnel/inputcommands"
+	"etha-tunnel/network/obfuscation"
 	"etha-tunnel/server/forwarding/serveripconfiguration"
 	"etha-tunnel/server/forwarding/servertcptunforward"
+	"etha-tunnel/server/forwarding/serverudptunforward"
+	"etha-tunnel/server/forwarding/serverwireguardforward"
+	"etha-tunnel/server/handshakeguard"
+	"etha-tunnel/server/ipam"
+	"etha-tunnel/server/resumption"
+	"etha-tunnel/settings/server"
 	"fmt"
+	"log"
 	"os"
 	"sync"
 )
 
-func Start(tunFile *os.File, listenPort string) error {
+func Start(tunFile *os.File, conf *server.Conf) error {
 	// Create a context that can be canceled
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -25,10 +35,73 @@ func Start(tunFile *os.File, listenPort string) error {
 	}
 	defer serveripconfiguration.Unconfigure(tunFile)
 
+	// Cipher suites are checked once on startup, rather than failing every handshake
+	_, err = ChaCha20.ParseCipherSuites(conf.CipherSuites)
+	if err != nil {
+		return fmt.Errorf("invalid cipher suites: %s", err)
+	}
+
+	// Address pool to assign tunnel addresses to clients
+	pool, err := ipam.NewPool(conf)
+	if err != nil {
+		return fmt.Errorf("failed to create address pool: %s", err)
+	}
+
+	// Rate limits and cookies protecting the handshake from floods
+	guard := handshakeguard.NewGuard(conf)
+	tickets := resumption.NewTickets(conf)
+
+	// Clients may wrap the tunnel in TLS, so it looks like HTTPS on the wire
+	var tlsConfig *tls.Config
+	var tlsServerNames []string
+	if conf.TLS {
+		certificate, err := conf.TLSCertificate()
+		if err != nil {
+			return fmt.Errorf("failed to load tls certificate: %s", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+		log.Printf("tls certificate SHA-256: %s", server.CertificateFingerprint(certificate))
+
+		// ClientHellos for other names are spliced to the TLS decoy, so a probe does not see the tunnel certificate
+		if conf.TLSDecoyAddress != "" {
+			tlsServerNames, err = conf.TLSNames(certificate)
+			if err != nil {
+				return fmt.Errorf("failed to read tls certificate names: %s", err)
+			}
+			if len(tlsServerNames) == 0 {
+				return fmt.Errorf("TLSDecoyAddress needs TLSServerNames or a certificate with DNS names")
+			}
+		}
+	}
+
+	listenerOptions := servertcptunforward.ListenerOptions{
+		WebSocketPath:   conf.WebSocketPath,
+		TLSConfig:       tlsConfig,
+		DecoyAddress:    conf.DecoyAddress,
+		TLSDecoyAddress: conf.TLSDecoyAddress,
+		TLSServerNames:  tlsServerNames,
+	}
+
+	// Clients may obfuscate their stream, so it carries no recognizable framing or packet lengths
+	if conf.ObfuscationKey != nil {
+		if len(conf.ObfuscationKey) != obfuscation.KeyLength {
+			return fmt.Errorf("invalid obfuscation key length: %d, expected %d", len(conf.ObfuscationKey), obfuscation.KeyLength)
+		}
+		padding, err := obfuscation.ParsePaddingPolicy(conf.ObfuscationPadding)
+		if err != nil {
+			return fmt.Errorf("invalid obfuscation padding: %s", err)
+		}
+		listenerOptions.ObfuscationKey = conf.ObfuscationKey
+		listenerOptions.ObfuscationPadding = padding
+	}
+
 	// Map to keep track of connected clients
 	var extToLocalIp sync.Map   // external ip to local ip map
 	var extIpToSession sync.Map // external ip to session map
 
+	// Sessions of revoked and expired clients are torn down
+	go enforceRevocations(ctx, pool, &extToLocalIp, &extIpToSession)
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -41,9 +114,27 @@ func Start(tunFile *os.File, listenPort string) error {
 	// TCP -> TUN
 	go func() {
 		defer wg.Done()
-		servertcptunforward.ToTun(listenPort, tunFile, &extToLocalIp, &extIpToSession, ctx)
+		servertcptunforward.ToTun(conf.TCPPort, listenerOptions, tunFile, &extToLocalIp, &extIpToSession, pool, guard, tickets, ctx)
 	}()
 
+	// UDP -> TUN
+	if conf.UDPPort != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serverudptunforward.ToTun(conf.UDPPort, tunFile, &extToLocalIp, &extIpToSession, pool, guard, tickets, ctx)
+		}()
+	}
+
+	// WireGuard -> TUN
+	if conf.WireGuardUDPPort != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serverwireguardforward.ToTun(conf.WireGuardUDPPort, tunFile, &extToLocalIp, &extIpToSession, conf, pool, guard, ctx)
+		}()
+	}
+
 	wg.Wait()
 	return nil
 }
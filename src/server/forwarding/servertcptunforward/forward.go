@@ -3,9 +3,13 @@ package servertcptunforward
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"etha-tunnel/handshake/ChaCha20"
 	"etha-tunnel/handshake/ChaCha20/handshakeHandlers"
 	"etha-tunnel/network/packets"
+	"etha-tunnel/server/handshakeguard"
+	"etha-tunnel/server/ipam"
+	"etha-tunnel/server/resumption"
 	"io"
 	"log"
 	"net"
@@ -17,6 +21,7 @@ const (
 	maxPacketLengthBytes = 65535
 )
 
+// ToTCP forwards packets from TUN to the connected clients
 func ToTCP(tunFile *os.File, localIpMap *sync.Map, localIpToSessionMap *sync.Map, ctx context.Context) {
 	buf := make([]byte, maxPacketLengthBytes)
 	for {
@@ -51,16 +56,23 @@ func ToTCP(tunFile *os.File, localIpMap *sync.Map, localIpToSessionMap *sync.Map
 					continue
 				}
 				session := sessionValue.(*ChaCha20.Session)
-				encryptedPacket, err := session.Encrypt(packet)
-				if err != nil {
-					log.Printf("failder to encrypt a package")
+
+				// Clients connected over UDP receive each packet as a standalone datagram
+				if conn.RemoteAddr().Network() == "udp" {
+					datagram, err := session.EncryptDatagram(packet)
+					if err != nil {
+						log.Printf("failed to encrypt a datagram")
+						continue
+					}
+
+					_, err = conn.Write(datagram)
+					if err != nil {
+						log.Printf("failed to send datagram to client: %v", err)
+					}
 					continue
 				}
 
-				length := uint32(len(encryptedPacket))
-				lengthBuf := make([]byte, 4)
-				binary.BigEndian.PutUint32(lengthBuf, length)
-				_, err = conn.Write(append(lengthBuf, encryptedPacket...))
+				err = writeFrame(conn, session, packet)
 				if err != nil {
 					log.Printf("failed to send packet to client: %v", err)
 					localIpMap.Delete(destinationIP)
@@ -71,7 +83,9 @@ func ToTCP(tunFile *os.File, localIpMap *sync.Map, localIpToSessionMap *sync.Map
 	}
 }
 
-func ToTun(listenPort string, tunFile *os.File, localIpMap *sync.Map, localIpToSessionMap *sync.Map, ctx context.Context) {
+// ToTun accepts clients on the TCP port, connecting with the raw tunnel protocol or over a WebSocket,
+// either of them wrapped in TLS if it is enabled. Other connections are spliced to the decoy if there is one.
+func ToTun(listenPort string, options ListenerOptions, tunFile *os.File, localIpMap *sync.Map, localIpToSessionMap *sync.Map, pool *ipam.Pool, guard *handshakeguard.Guard, tickets *resumption.Tickets, ctx context.Context) {
 	listener, err := net.Listen("tcp", listenPort)
 	if err != nil {
 		log.Printf("failed to listen on port %s: %v", listenPort, err)
@@ -96,39 +110,97 @@ func ToTun(listenPort string, tunFile *os.File, localIpMap *sync.Map, localIpToS
 				log.Printf("failed to accept connection: %v", err)
 				continue
 			}
-			go registerClient(conn, tunFile, localIpMap, localIpToSessionMap)
+			// Connections over the handshake rate limit are closed before any work is done for them
+			if !guard.Allow(handshakeguard.SourceIP(conn.RemoteAddr())) {
+				_ = conn.Close()
+				continue
+			}
+			go registerClient(conn, options, tunFile, localIpMap, localIpToSessionMap, pool, guard, tickets)
 		}
 	}
 }
 
-func registerClient(conn net.Conn, tunFile *os.File, localIpToConn *sync.Map, localIpToServerSessionMap *sync.Map) {
-	log.Printf("connected: %s", conn.RemoteAddr())
+func registerClient(rawConn net.Conn, options ListenerOptions, tunFile *os.File, localIpToConn *sync.Map, localIpToServerSessionMap *sync.Map, pool *ipam.Pool, guard *handshakeguard.Guard, tickets *resumption.Tickets) {
+	log.Printf("connected: %s", rawConn.RemoteAddr())
+
+	// The handshake is in progress from the transport handshake on, so a TLS handshake flood counts as load as well
+	finishHandshake := guard.Begin()
 
-	serverSession, internalIpAddr, err := handshakeHandlers.OnClientConnected(conn)
+	// The handshake runs inside TLS or the WebSocket for clients behind HTTP-only networks
+	conn, transport, err := acceptTransport(rawConn, options)
+	// Probes of the port see the decoy service rather than a closed connection
+	if errors.Is(err, errForeignServerName) {
+		finishHandshake()
+		log.Printf("spliced to tls decoy: %s (%s)", rawConn.RemoteAddr(), err)
+		spliceToDecoy(conn, options.TLSDecoyAddress)
+		return
+	}
+	if errors.Is(err, errNotTunnel) && options.DecoyAddress != "" {
+		finishHandshake()
+		log.Printf("spliced to decoy: %s", rawConn.RemoteAddr())
+		spliceToDecoy(conn, options.DecoyAddress)
+		return
+	}
+	if err != nil {
+		finishHandshake()
+		_ = rawConn.Close()
+		log.Printf("conn closed: %s (regfail: %s)\n", rawConn.RemoteAddr(), err)
+		return
+	}
+	if transport != "tcp" {
+		log.Printf("transport of %s: %s", conn.RemoteAddr(), transport)
+	}
+
+	serverSession, assignment, controlFrames, err := handshakeHandlers.OnClientConnected(conn, pool, guard, tickets)
+	finishHandshake()
+	// A probe starting like a handshake is handed to the decoy as well, unless the server has already answered it
+	if recording, ok := conn.(*recordingConn); ok {
+		if err != nil && !recording.answered {
+			log.Printf("spliced to decoy: %s (regfail: %s)", conn.RemoteAddr(), err)
+			spliceToDecoy(recording.replay(), options.DecoyAddress)
+			return
+		}
+		recording.stopRecording()
+	}
 	if err != nil {
 		conn.Close()
 		log.Printf("conn closed: %s (regfail: %s)\n", conn.RemoteAddr(), err)
 		return
 	}
-	log.Printf("registered: %s", conn.RemoteAddr())
+	defer pool.Release(assignment)
+	log.Printf("registered: %s as %v", conn.RemoteAddr(), assignment.Addresses())
 
-	// Prevent IP spoofing
-	_, ipCollision := localIpToConn.Load(*internalIpAddr)
-	if ipCollision {
-		log.Printf("conn closed: %s (internal ip %s already in use)\n", conn.RemoteAddr(), *internalIpAddr)
-		_ = conn.Close()
+	for _, internalIpAddr := range assignment.Addresses() {
+		// Addresses are bound to the client identity, so a collision means the same client has reconnected
+		previous, ipCollision := localIpToConn.Swap(internalIpAddr, conn)
+		if ipCollision {
+			log.Printf("conn closed: %s (internal ip %s is taken over by %s)\n", previous.(net.Conn).RemoteAddr(), internalIpAddr, conn.RemoteAddr())
+			_ = previous.(net.Conn).Close()
+		}
+		localIpToServerSessionMap.Store(internalIpAddr, serverSession)
 	}
 
-	localIpToConn.Store(*internalIpAddr, conn)
-	localIpToServerSessionMap.Store(*internalIpAddr, serverSession)
+	// Resumption ticket and server keys are the first frames of the session
+	for _, frame := range controlFrames {
+		err = writeFrame(conn, serverSession, frame)
+		if err != nil {
+			log.Printf("failed to send control frame to client: %v", err)
+		}
+	}
 
-	handleClient(conn, tunFile, localIpToConn, localIpToServerSessionMap, internalIpAddr)
+	handleClient(conn, tunFile, localIpToConn, localIpToServerSessionMap, assignment, serverSession)
 }
 
-func handleClient(conn net.Conn, tunFile *os.File, localIpToConn *sync.Map, localIpToSession *sync.Map, extIpAddr *string) {
+func handleClient(conn net.Conn, tunFile *os.File, localIpToConn *sync.Map, localIpToSession *sync.Map, assignment *ipam.Assignment, session *ChaCha20.Session) {
+	var spoofedPackets uint64
 	defer func() {
-		localIpToConn.Delete(*extIpAddr)
-		localIpToSession.Delete(*extIpAddr)
+		for _, internalIpAddr := range assignment.Addresses() {
+			localIpToConn.CompareAndDelete(internalIpAddr, conn)
+			localIpToSession.CompareAndDelete(internalIpAddr, session)
+		}
+		if spoofedPackets > 0 {
+			log.Printf("dropped %d packets with spoofed source address from %s", spoofedPackets, conn.RemoteAddr())
+		}
 		conn.Close()
 		log.Printf("disconnected: %s", conn.RemoteAddr())
 	}()
@@ -158,15 +230,6 @@ func handleClient(conn net.Conn, tunFile *os.File, localIpToConn *sync.Map, loca
 			return
 		}
 
-		// Retrieve the session for this client
-		sessionValue, sessionExists := localIpToSession.Load(*extIpAddr)
-		if !sessionExists {
-			log.Printf("failed to load session for IP %s", *extIpAddr)
-			continue
-		}
-
-		session := sessionValue.(*ChaCha20.Session)
-
 		// Decrypt the data
 		packet, err := session.Decrypt(buf[:length])
 		if err != nil {
@@ -174,12 +237,39 @@ func handleClient(conn net.Conn, tunFile *os.File, localIpToConn *sync.Map, loca
 			return
 		}
 
+		// Rekey frames are answered on the same connection
+		if ChaCha20.IsControlFrame(packet) {
+			reply, err := session.HandleControlFrame(packet)
+			if err != nil {
+				log.Printf("failed to handle control frame: %v", err)
+				return
+			}
+			if reply != nil {
+				err = writeFrame(conn, session, reply)
+				if err != nil {
+					log.Printf("failed to send control frame to client: %v", err)
+					return
+				}
+			}
+			continue
+		}
+
 		// Validate the packet (optional but recommended)
-		if _, err := packets.Parse(packet); err != nil {
+		header, err := packets.Parse(packet)
+		if err != nil {
 			log.Printf("invalid IP packet structure: %v", err)
 			continue
 		}
 
+		// Prevent IP spoofing: a client is only allowed to send packets from the addresses it owns
+		if !assignment.Owns(header.GetSourceIP()) {
+			spoofedPackets++
+			if spoofedPackets == 1 {
+				log.Printf("dropped packet from %s: source address %s is not owned by the client", conn.RemoteAddr(), header.GetSourceIP())
+			}
+			continue
+		}
+
 		// Write the decrypted packet to the TUN interface
 		_, err = tunFile.Write(packet)
 		if err != nil {
@@ -188,3 +278,29 @@ func handleClient(conn net.Conn, tunFile *os.File, localIpToConn *sync.Map, loca
 		}
 	}
 }
+
+// Disconnect tears down the sessions holding the tunnel addresses at once, by removing them from the connection
+// and session maps and closing their sockets. It works for clients connected over UDP as well, as they share the maps.
+func Disconnect(addresses []string, localIpToConn *sync.Map, localIpToSession *sync.Map) {
+	for _, internalIpAddr := range addresses {
+		localIpToSession.Delete(internalIpAddr)
+		v, ok := localIpToConn.LoadAndDelete(internalIpAddr)
+		if !ok {
+			continue
+		}
+		conn := v.(net.Conn)
+		log.Printf("conn closed: %s (access of %s is withdrawn)", conn.RemoteAddr(), internalIpAddr)
+		_ = conn.Close()
+	}
+}
+
+// writeFrame encrypts a frame and writes it with a length prefix, so frames from the TUN reader and
+// the replies to client control frames are serialized by the session
+func writeFrame(conn net.Conn, session *ChaCha20.Session, plaintext []byte) error {
+	return session.EncryptAndWrite(plaintext, func(ciphertext []byte) error {
+		lengthBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(lengthBuf, uint32(len(ciphertext)))
+		_, err := conn.Write(append(lengthBuf, ciphertext...))
+		return err
+	})
+}
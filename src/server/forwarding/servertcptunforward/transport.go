@@ -0,0 +1,298 @@
+package servertcptunforward
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"etha-tunnel/handshake/ChaCha20"
+	"etha-tunnel/network/obfuscation"
+	"etha-tunnel/network/websocket"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// firstByteTimeout bounds waiting for the first bytes of a connection, a tunnel client sends them right away
+	firstByteTimeout = time.Second
+	// upgradeTimeout bounds reading the TLS handshake and the WebSocket upgrade request once the first bytes arrived
+	upgradeTimeout = 10 * time.Second
+	// defaultWebSocketPath is the path WebSocket upgrades are accepted on if the server conf sets none
+	defaultWebSocketPath = "/"
+	// decoyDialTimeout bounds connecting to the decoy
+	decoyDialTimeout = 5 * time.Second
+	// decoyIdleTimeout is how long either side of a connection spliced to the decoy may stay silent
+	decoyIdleTimeout = 2 * time.Minute
+)
+
+// errNotTunnel is returned for a connection which neither starts a tunnel handshake nor upgrades to a WebSocket on the tunnel path
+var errNotTunnel = errors.New("not a tunnel connection")
+
+// errForeignServerName is returned for a TLS ClientHello naming a server other than the tunnel one
+var errForeignServerName = errors.New("tls client hello for another server name")
+
+// ListenerOptions are the transports the TCP listener accepts next to raw TCP, and what it does with other connections
+type ListenerOptions struct {
+	// WebSocketPath is the path WebSocket upgrades are accepted on, "/" if empty
+	WebSocketPath string
+	// TLSConfig accepts clients wrapping the tunnel in TLS if set
+	TLSConfig *tls.Config
+	// DecoyAddress is the address connections which are not tunnel ones are spliced to, they are closed if empty
+	DecoyAddress string
+	// TLSDecoyAddress is the address TLS connections whose ClientHello names none of TLSServerNames are spliced to,
+	// before the ClientHello is answered, so a probe sees the certificate of that TLS service rather than the tunnel one
+	TLSDecoyAddress string
+	TLSServerNames  []string
+	// ObfuscationKey accepts clients obfuscating their stream with it if set, padded by ObfuscationPadding
+	ObfuscationKey     []byte
+	ObfuscationPadding obfuscation.PaddingPolicy
+}
+
+// peekedConn is a connection whose first bytes were read ahead to tell the transport of the client apart
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// recordingConn records what is read from a connection until the transport is known, or until the handshake is done,
+// so a connection which turns out not to be a tunnel one can be handed to the decoy from its first byte on
+type recordingConn struct {
+	net.Conn
+	recorded  bytes.Buffer
+	recording bool
+	answered  bool // something was written to the connection while recording
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.recording {
+		c.recorded.Write(b[:n])
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	if c.recording {
+		c.answered = true
+	}
+	return c.Conn.Write(b)
+}
+
+// stopRecording forgets what was recorded, the connection is known to be a tunnel one
+func (c *recordingConn) stopRecording() {
+	c.recording = false
+	c.recorded = bytes.Buffer{}
+}
+
+// replay returns the connection with everything read from it so far to be read again
+func (c *recordingConn) replay() net.Conn {
+	return &peekedConn{Conn: c.Conn, reader: io.MultiReader(bytes.NewReader(c.recorded.Bytes()), c.Conn)}
+}
+
+// acceptTransport tells a TLS connection, a WebSocket upgrade and a raw or obfuscated tunnel handshake apart by the
+// first bytes of the connection. A tunnel handshake starts with a message type byte, an HTTP request with its method,
+// TLS with a handshake record, and an obfuscated stream with a random seed. Inside TLS the client may upgrade to
+// a WebSocket again, and inside either of them it may obfuscate its stream.
+// The name of the transport is returned along with the connection the handshake runs on. A connection which is
+// not a tunnel one fails with errNotTunnel, and is returned with what was read from it to be read again.
+// With a decoy, a raw handshake is returned as a recordingConn, so it is handed to the decoy if the handshake fails.
+// A TLS ClientHello for another server name fails with errForeignServerName, and is returned to be read again as well.
+func acceptTransport(conn net.Conn, options ListenerOptions) (net.Conn, string, error) {
+	_ = conn.SetDeadline(time.Now().Add(firstByteTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	prefix, err := reader.Peek(4)
+	peeked := &peekedConn{Conn: conn, reader: reader}
+	// A client of the tunnel speaks first, a probe waiting for a banner is handed to the decoy about as soon as
+	// a server speaking first would have sent it
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return peeked, "", errNotTunnel
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	_ = conn.SetDeadline(time.Now().Add(upgradeTimeout))
+
+	if options.TLSConfig != nil && isTLSHandshake(prefix) {
+		var tlsClient net.Conn = peeked
+		if options.TLSDecoyAddress != "" {
+			serverName, replayed := clientHelloServerName(peeked)
+			if !isServerName(serverName, options.TLSServerNames) {
+				return replayed, "", fmt.Errorf("%w: %q", errForeignServerName, serverName)
+			}
+			tlsClient = replayed
+		}
+
+		tlsConn := tls.Server(tlsClient, options.TLSConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			return nil, "", fmt.Errorf("tls handshake failed: %w", err)
+		}
+		options.TLSConfig = nil
+		innerConn, transport, err := acceptTransport(tlsConn, options)
+		return innerConn, "tls+" + transport, err
+	}
+
+	if !websocket.IsUpgradeRequest(prefix) {
+		innerConn, transport, err := acceptStream(peeked, options)
+		return innerConn, "tcp" + transport, err
+	}
+
+	webSocketPath := options.WebSocketPath
+	if webSocketPath == "" {
+		webSocketPath = defaultWebSocketPath
+	}
+	recording := &recordingConn{Conn: peeked, recording: true}
+	wsConn, err := websocket.Accept(recording, webSocketPath)
+	if errors.Is(err, websocket.ErrNotUpgrade) {
+		if options.DecoyAddress == "" {
+			websocket.RefuseUpgrade(recording)
+		}
+		return recording.replay(), "", fmt.Errorf("%w: %s", errNotTunnel, err)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	recording.stopRecording()
+
+	// The WebSocket was upgraded on the tunnel path, so a client failing to start a handshake in it is not handed to the decoy
+	options.DecoyAddress = ""
+	innerConn, transport, err := acceptStream(wsConn, options)
+	if errors.Is(err, errNotTunnel) {
+		return nil, "", fmt.Errorf("no tunnel handshake in websocket")
+	}
+	return innerConn, "websocket" + transport, err
+}
+
+// acceptStream tells a raw tunnel handshake from an obfuscated one by the first bytes of the stream of a client.
+// An obfuscated stream is taken for a tunnel one only if it starts a handshake under the obfuscation key.
+func acceptStream(conn net.Conn, options ListenerOptions) (net.Conn, string, error) {
+	reader := bufio.NewReader(conn)
+	prefix, err := reader.Peek(4)
+	peeked := &peekedConn{Conn: conn, reader: reader}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return peeked, "", errNotTunnel
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if ChaCha20.IsClientHandshakeStart(prefix) {
+		// A probe may start like a handshake just as well, it is told apart once the handshake fails
+		if options.DecoyAddress != "" {
+			return &recordingConn{Conn: peeked, recording: true}, "", nil
+		}
+		return peeked, "", nil
+	}
+	if options.ObfuscationKey == nil {
+		return peeked, "", errNotTunnel
+	}
+
+	recording := &recordingConn{Conn: peeked, recording: true}
+	obfuscated, err := obfuscation.Server(recording, options.ObfuscationKey, options.ObfuscationPadding)
+	if err != nil {
+		return recording.replay(), "", fmt.Errorf("%w: %s", errNotTunnel, err)
+	}
+
+	obfuscatedReader := bufio.NewReader(obfuscated)
+	prefix, err = obfuscatedReader.Peek(4)
+	if err != nil || !ChaCha20.IsClientHandshakeStart(prefix) {
+		return recording.replay(), "", errNotTunnel
+	}
+	recording.stopRecording()
+
+	return &peekedConn{Conn: obfuscated, reader: obfuscatedReader}, "+obfuscated", nil
+}
+
+// spliceToDecoy hands a connection which is not a tunnel one to the decoy, so a probe of the port sees the decoy service
+func spliceToDecoy(conn net.Conn, decoyAddress string) {
+	defer conn.Close()
+
+	decoy, err := net.DialTimeout("tcp", decoyAddress, decoyDialTimeout)
+	if err != nil {
+		log.Printf("failed to connect to decoy %s: %v", decoyAddress, err)
+		return
+	}
+	defer decoy.Close()
+
+	go func() {
+		copyUntilIdle(decoy, conn)
+		// The decoy still answers a probe which has finished sending
+		if tcpConn, ok := decoy.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	}()
+	copyUntilIdle(conn, decoy)
+}
+
+// copyUntilIdle copies from src to dst until either fails or src has been silent for decoyIdleTimeout,
+// so neither a probe nor the decoy holds a spliced connection open forever
+func copyUntilIdle(dst net.Conn, src net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(decoyIdleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			_ = dst.SetWriteDeadline(time.Now().Add(decoyIdleTimeout))
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// clientHelloServerName reads the TLS ClientHello of a connection without answering it, and returns the server name
+// it asks for, empty if it names none or is malformed, along with the connection to be read again from its first byte on
+func clientHelloServerName(conn net.Conn) (string, net.Conn) {
+	recording := &recordingConn{Conn: conn, recording: true}
+	serverName := ""
+	helloRead := errors.New("client hello read")
+	sniffer := tls.Server(&silentConn{Conn: recording}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, helloRead
+		},
+	})
+	// The handshake is given up right after the ClientHello, the alert it sends is swallowed
+	_ = sniffer.Handshake()
+
+	return serverName, recording.replay()
+}
+
+// isServerName reports whether a server name is one of names, server names are case-insensitive
+func isServerName(serverName string, names []string) bool {
+	for _, name := range names {
+		if strings.EqualFold(serverName, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// silentConn is a connection whose writes are dropped, nothing is sent on it
+type silentConn struct {
+	net.Conn
+}
+
+func (c *silentConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// isTLSHandshake reports whether the first bytes of a connection are a TLS handshake record, the ClientHello
+func isTLSHandshake(prefix []byte) bool {
+	return len(prefix) >= 3 && prefix[0] == 0x16 && prefix[1] == 0x03 && prefix[2] <= 0x04
+}
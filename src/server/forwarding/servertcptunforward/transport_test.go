@@ -0,0 +1,208 @@
+package servertcptunforward
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"etha-tunnel/network/obfuscation"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// accept runs acceptTransport on a connection the client sends first to, and returns what the server side reads next
+func accept(t *testing.T, first []byte, options ListenerOptions) (string, []byte, error) {
+	t.Helper()
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	go func() {
+		_, _ = clientSide.Write(first)
+		// The refusal of the server, if any, is drained so its write does not block
+		_, _ = io.Copy(io.Discard, clientSide)
+	}()
+
+	conn, transport, err := acceptTransport(serverSide, options)
+	if conn == nil {
+		return transport, nil, err
+	}
+	read := make([]byte, len(first))
+	_, _ = io.ReadFull(conn, read)
+	return transport, read, err
+}
+
+func TestAcceptTransport_RawHandshake(t *testing.T) {
+	first := []byte{0x01, 0x03, 0x00, 0x10}
+	transport, read, err := accept(t, first, ListenerOptions{})
+	if err != nil || transport != "tcp" || string(read) != string(first) {
+		t.Errorf("expected a raw tunnel handshake with its header kept, got %q, %v, %x", transport, err, read)
+	}
+}
+
+func TestAcceptTransport_RecordsHandshakeForDecoy(t *testing.T) {
+	first := []byte{0x01, 0x03, 0x00, 0x10}
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	go func() {
+		_, _ = clientSide.Write(first)
+	}()
+
+	conn, _, err := acceptTransport(serverSide, ListenerOptions{DecoyAddress: "127.0.0.1:1"})
+	recording, ok := conn.(*recordingConn)
+	if err != nil || !ok {
+		t.Fatalf("expected a raw tunnel handshake to be recorded, got %T, %v", conn, err)
+	}
+
+	// What the failed handshake has read is read again by the decoy
+	_, _ = io.ReadFull(conn, make([]byte, len(first)))
+	read := make([]byte, len(first))
+	_, _ = io.ReadFull(recording.replay(), read)
+	if !bytes.Equal(read, first) || recording.answered {
+		t.Errorf("expected the handshake to be replayed to the decoy, got %x", read)
+	}
+}
+
+func TestAcceptTransport_ReplaysProbes(t *testing.T) {
+	for _, first := range [][]byte{
+		[]byte("SSH-2.0-probe\r\n"),
+		[]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+	} {
+		_, read, err := accept(t, first, ListenerOptions{DecoyAddress: "127.0.0.1:1"})
+		if !errors.Is(err, errNotTunnel) {
+			t.Errorf("expected %q to be no tunnel connection, got %v", first, err)
+		}
+		if string(read) != string(first) {
+			t.Errorf("expected the probe to be replayed to the decoy, got %q", read)
+		}
+	}
+}
+
+func TestAcceptTransport_Obfuscated(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, obfuscation.KeyLength)
+	options := ListenerOptions{ObfuscationKey: key, ObfuscationPadding: obfuscation.PaddingPolicies["medium"]}
+	first := []byte{0x01, 0x03, 0x00, 0x10}
+
+	for _, clientKey := range [][]byte{key, bytes.Repeat([]byte{0x24}, obfuscation.KeyLength)} {
+		clientSide, serverSide := net.Pipe()
+		seed := make(chan []byte, 1)
+		go func() {
+			recorder := &writeRecorder{Conn: clientSide}
+			obfuscatedConn, err := obfuscation.Client(recorder, clientKey, options.ObfuscationPadding)
+			seed <- bytes.Clone(recorder.written.Bytes())
+			if err != nil {
+				return
+			}
+			_, _ = obfuscatedConn.Write(first)
+		}()
+
+		conn, transport, err := acceptTransport(serverSide, options)
+		expectedSeed := <-seed
+		if bytes.Equal(clientKey, key) {
+			read := make([]byte, len(first))
+			_, _ = io.ReadFull(conn, read)
+			if err != nil || transport != "tcp+obfuscated" || !bytes.Equal(read, first) {
+				t.Errorf("expected an obfuscated tunnel handshake, got %q, %v, %x", transport, err, read)
+			}
+		} else {
+			read := make([]byte, len(expectedSeed))
+			_, _ = io.ReadFull(conn, read)
+			if !errors.Is(err, errNotTunnel) || !bytes.Equal(read, expectedSeed) {
+				t.Errorf("expected a stream under another key to be replayed to the decoy, got %v, %x", err, read)
+			}
+		}
+
+		_ = clientSide.Close()
+		_ = serverSide.Close()
+	}
+}
+
+// writeRecorder records what is written to a connection, the seed leading the obfuscated stream of the client
+type writeRecorder struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *writeRecorder) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestAcceptTransport_SplicesForeignServerNameUnanswered(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"vpn.example.com"}, NotAfter: time.Now().Add(time.Hour)}
+	certificateDER, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	options := ListenerOptions{
+		TLSConfig:       &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{certificateDER}, PrivateKey: key}}},
+		TLSDecoyAddress: "127.0.0.1:1",
+		TLSServerNames:  []string{"vpn.example.com"},
+	}
+	first := []byte{0x01, 0x03, 0x00, 0x10}
+
+	for _, serverName := range []string{"VPN.example.com", "www.example.org"} {
+		clientSide, serverSide := net.Pipe()
+		recorder := &writeRecorder{Conn: clientSide}
+		go func() {
+			tlsConn := tls.Client(recorder, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+			if tlsConn.Handshake() == nil {
+				_, _ = tlsConn.Write(first)
+			}
+		}()
+
+		conn, transport, err := acceptTransport(serverSide, options)
+		if serverName == "VPN.example.com" {
+			read := make([]byte, len(first))
+			_, _ = io.ReadFull(conn, read)
+			if err != nil || transport != "tls+tcp" || !bytes.Equal(read, first) {
+				t.Errorf("expected a tunnel handshake inside tls, got %q, %v, %x", transport, err, read)
+			}
+		} else {
+			// The ClientHello is read again by the TLS decoy, nothing has been sent back to the client
+			hello := recorder.written.Bytes()
+			read := make([]byte, len(hello))
+			_, _ = io.ReadFull(conn, read)
+			if !errors.Is(err, errForeignServerName) || !bytes.Equal(read, hello) {
+				t.Errorf("expected the client hello to be handed to the tls decoy, got %v, %x", err, read)
+			}
+		}
+
+		_ = clientSide.Close()
+		_ = serverSide.Close()
+	}
+}
+
+func TestSpliceToDecoy(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer decoy.Close()
+	go func() {
+		conn, err := decoy.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, len("probe"))
+		_, _ = io.ReadFull(conn, request)
+		_, _ = conn.Write(append([]byte("decoy: "), request...))
+	}()
+
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	go spliceToDecoy(serverSide, decoy.Addr().String())
+
+	_, _ = clientSide.Write([]byte("probe"))
+	reply := make([]byte, len("decoy: probe"))
+	_, err = io.ReadFull(clientSide, reply)
+	if err != nil || string(reply) != "decoy: probe" {
+		t.Errorf("expected the decoy to answer the probe, got %q, %v", reply, err)
+	}
+}
@@ -0,0 +1,127 @@
+package serverudptunforward
+
+import (
+	"etha-tunnel/handshake/ChaCha20"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	inboundQueueLength = 256
+)
+
+// clientConn is a net.Conn over datagrams of a single client of a shared UDP listener.
+// Every Read returns exactly one datagram and every Write sends exactly one datagram,
+// so the handshake handlers are able to use it the same way as a TCP connection.
+// The address changes when the client roams, e.g. once a NAT in between rebinds its port.
+type clientConn struct {
+	listener     *net.UDPConn
+	addr         atomic.Pointer[net.UDPAddr]
+	session      atomic.Pointer[ChaCha20.Session] // set once the handshake succeeded
+	inbound      chan []byte
+	closed       chan struct{}
+	closeOnce    sync.Once
+	onClose      func(c *clientConn)
+	deadlineLock sync.Mutex
+	readDeadline time.Time
+}
+
+func newClientConn(listener *net.UDPConn, addr *net.UDPAddr, onClose func(c *clientConn)) *clientConn {
+	c := &clientConn{
+		listener: listener,
+		inbound:  make(chan []byte, inboundQueueLength),
+		closed:   make(chan struct{}),
+		onClose:  onClose,
+	}
+	c.addr.Store(addr)
+	return c
+}
+
+// roam moves the client to the address its datagrams come from now
+func (c *clientConn) roam(addr *net.UDPAddr) {
+	c.addr.Store(addr)
+}
+
+// isClosed reports whether the connection has been closed
+func (c *clientConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver queues a datagram received from the client, dropping it if the client is not keeping up
+func (c *clientConn) deliver(datagram []byte) {
+	select {
+	case c.inbound <- datagram:
+	default:
+	}
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	c.deadlineLock.Lock()
+	deadline := c.readDeadline
+	c.deadlineLock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-c.inbound:
+		return copy(b, datagram), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+		return c.listener.WriteToUDP(b, c.addr.Load())
+	}
+}
+
+func (c *clientConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.onClose(c)
+	})
+	return nil
+}
+
+func (c *clientConn) LocalAddr() net.Addr {
+	return c.listener.LocalAddr()
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	return c.addr.Load()
+}
+
+func (c *clientConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *clientConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline is a no-op, as writes to the shared listener never block for long
+func (c *clientConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
@@ -0,0 +1,234 @@
+package serverudptunforward
+
+import (
+	"context"
+	"errors"
+	"etha-tunnel/handshake/ChaCha20"
+	"etha-tunnel/handshake/ChaCha20/handshakeHandlers"
+	"etha-tunnel/network/packets"
+	"etha-tunnel/server/handshakeguard"
+	"etha-tunnel/server/ipam"
+	"etha-tunnel/server/resumption"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxPacketLengthBytes = 65535
+	// UDP has no notion of a closed connection, so clients that went silent are forgotten after this timeout
+	clientIdleTimeout = 3 * time.Minute
+)
+
+// ToTun listens for UDP datagrams, registers new clients and forwards their decrypted packets to TUN
+func ToTun(listenPort string, tunFile *os.File, localIpMap *sync.Map, localIpToSessionMap *sync.Map, pool *ipam.Pool, guard *handshakeguard.Guard, tickets *resumption.Tickets, ctx context.Context) {
+	listenAddr, err := net.ResolveUDPAddr("udp", listenPort)
+	if err != nil {
+		log.Printf("failed to resolve udp address %s: %v", listenPort, err)
+		return
+	}
+
+	listener, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		log.Printf("failed to listen on udp port %s: %v", listenPort, err)
+		return
+	}
+	defer listener.Close()
+	log.Printf("server listening on udp port %s", listenPort)
+
+	//using this goroutine to 'unblock' ReadFromUDP blocking-call
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var clients sync.Map // client address to *clientConn map
+	sessions := newSessionIndex()
+	onClose := func(c *clientConn) {
+		clients.CompareAndDelete(c.RemoteAddr().String(), c)
+	}
+	buf := make([]byte, maxPacketLengthBytes)
+	for {
+		n, addr, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("UDP server is shutting down.")
+				return
+			}
+			log.Printf("failed to read from udp: %v", err)
+			continue
+		}
+
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+
+		key := addr.String()
+		v, ok := clients.Load(key)
+		if ok && v.(*clientConn).isClosed() {
+			clients.CompareAndDelete(key, v)
+			ok = false
+		}
+		if !ok {
+			// Datagrams of new clients over the handshake rate limit are dropped before any work is done for them
+			if !guard.Allow(addr.IP) {
+				continue
+			}
+
+			// Clients are known by their session rather than their address, so one that roamed keeps its session
+			if roamed := findRoamedClient(sessions, datagram); roamed != nil {
+				previousKey := roamed.RemoteAddr().String()
+				roamed.roam(addr)
+				clients.Store(key, roamed)
+				clients.CompareAndDelete(previousKey, roamed)
+				log.Printf("roamed: %s to %s", previousKey, key)
+				roamed.deliver(datagram)
+				continue
+			}
+
+			conn := newClientConn(listener, addr, onClose)
+			clients.Store(key, conn)
+			go registerClient(conn, sessions, tunFile, localIpMap, localIpToSessionMap, pool, guard, tickets)
+			v = conn
+		}
+		v.(*clientConn).deliver(datagram)
+	}
+}
+
+// findRoamedClient returns the client whose session authenticates a datagram that came from an unknown address.
+// Only the sessions under the receiver index of the datagram are tried, so a forged datagram costs a single decryption.
+func findRoamedClient(sessions *sessionIndex, datagram []byte) *clientConn {
+	index, ok := ChaCha20.DatagramReceiverIndex(datagram)
+	if !ok {
+		return nil
+	}
+
+	for _, conn := range sessions.lookup(index) {
+		session := conn.session.Load()
+		if session != nil && !conn.isClosed() && session.Authenticates(datagram) {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+func registerClient(conn *clientConn, sessions *sessionIndex, tunFile *os.File, localIpToConn *sync.Map, localIpToServerSessionMap *sync.Map, pool *ipam.Pool, guard *handshakeguard.Guard, tickets *resumption.Tickets) {
+	log.Printf("connected: %s", conn.RemoteAddr())
+
+	finishHandshake := guard.Begin()
+	serverSession, assignment, controlFrames, err := handshakeHandlers.OnClientConnected(conn, pool, guard, tickets)
+	finishHandshake()
+	if err != nil {
+		_ = conn.Close()
+		log.Printf("conn closed: %s (regfail: %s)\n", conn.RemoteAddr(), err)
+		return
+	}
+	defer pool.Release(assignment)
+	conn.session.Store(serverSession)
+	sessions.add(serverSession.ReceiverIndex(), conn)
+	defer sessions.remove(serverSession.ReceiverIndex(), conn)
+	log.Printf("registered: %s as %v", conn.RemoteAddr(), assignment.Addresses())
+
+	for _, internalIpAddr := range assignment.Addresses() {
+		// UDP clients cannot close their previous session, so a reconnected client takes over its addresses
+		previous, ipCollision := localIpToConn.Swap(internalIpAddr, conn)
+		if ipCollision {
+			log.Printf("conn closed: %s (internal ip %s is taken over by %s)\n", previous.(net.Conn).RemoteAddr(), internalIpAddr, conn.RemoteAddr())
+			_ = previous.(net.Conn).Close()
+		}
+		localIpToServerSessionMap.Store(internalIpAddr, serverSession)
+	}
+
+	// Resumption ticket and server keys are the first datagrams of the session, a lost one is sent again on the next connect
+	for _, frame := range controlFrames {
+		datagram, err := serverSession.EncryptDatagram(frame)
+		if err == nil {
+			_, err = conn.Write(datagram)
+		}
+		if err != nil {
+			log.Printf("failed to send control frame to client: %v", err)
+		}
+	}
+
+	handleClient(conn, tunFile, localIpToConn, localIpToServerSessionMap, assignment, serverSession)
+}
+
+func handleClient(conn *clientConn, tunFile *os.File, localIpToConn *sync.Map, localIpToSession *sync.Map, assignment *ipam.Assignment, session *ChaCha20.Session) {
+	var spoofedPackets uint64
+	defer func() {
+		for _, internalIpAddr := range assignment.Addresses() {
+			localIpToConn.CompareAndDelete(internalIpAddr, conn)
+			localIpToSession.CompareAndDelete(internalIpAddr, session)
+		}
+		if spoofedPackets > 0 {
+			log.Printf("dropped %d packets with spoofed source address from %s", spoofedPackets, conn.RemoteAddr())
+		}
+		_ = conn.Close()
+		log.Printf("disconnected: %s", conn.RemoteAddr())
+	}()
+
+	buf := make([]byte, maxPacketLengthBytes)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(clientIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("client %s is idle", conn.RemoteAddr())
+			}
+			return
+		}
+
+		// Datagrams may be forged, so the ones failing authentication are dropped without closing the session
+		packet, err := session.DecryptDatagram(buf[:n])
+		if err != nil {
+			log.Printf("failed to decrypt datagram: %v", err)
+			continue
+		}
+
+		// Rekey frames are answered with a datagram
+		if ChaCha20.IsControlFrame(packet) {
+			reply, err := session.HandleControlFrame(packet)
+			if err != nil {
+				log.Printf("failed to handle control frame: %v", err)
+				continue
+			}
+			if reply != nil {
+				datagram, err := session.EncryptDatagram(reply)
+				if err != nil {
+					log.Printf("failed to encrypt a datagram")
+					continue
+				}
+				_, err = conn.Write(datagram)
+				if err != nil {
+					log.Printf("failed to send datagram to client: %v", err)
+				}
+			}
+			continue
+		}
+
+		// Validate the packet (optional but recommended)
+		header, err := packets.Parse(packet)
+		if err != nil {
+			log.Printf("invalid IP packet structure: %v", err)
+			continue
+		}
+
+		// Prevent IP spoofing: a client is only allowed to send packets from the addresses it owns
+		if !assignment.Owns(header.GetSourceIP()) {
+			spoofedPackets++
+			if spoofedPackets == 1 {
+				log.Printf("dropped packet from %s: source address %s is not owned by the client", conn.RemoteAddr(), header.GetSourceIP())
+			}
+			continue
+		}
+
+		// Write the decrypted packet to the TUN interface
+		_, err = tunFile.Write(packet)
+		if err != nil {
+			log.Printf("failed to write to TUN: %v", err)
+			return
+		}
+	}
+}
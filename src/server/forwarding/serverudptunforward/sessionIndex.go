@@ -0,0 +1,55 @@
+package serverudptunforward
+
+import (
+	"sync"
+)
+
+// sessionIndex finds clients by the receiver index in front of their datagrams,
+// so a datagram from an unknown address is checked against its own session only.
+// Indexes are derived from the session ids and may collide, so an index holds every client using it, usually one.
+type sessionIndex struct {
+	mutex   sync.Mutex
+	clients map[uint32][]*clientConn
+}
+
+func newSessionIndex() *sessionIndex {
+	return &sessionIndex{
+		clients: make(map[uint32][]*clientConn),
+	}
+}
+
+// add indexes a client once its handshake succeeded
+func (i *sessionIndex) add(index uint32, conn *clientConn) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.clients[index] = append(i.clients[index], conn)
+}
+
+// remove forgets a client whose session ended
+func (i *sessionIndex) remove(index uint32, conn *clientConn) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	clients := i.clients[index]
+	for j, c := range clients {
+		if c == conn {
+			clients = append(clients[:j:j], clients[j+1:]...)
+			break
+		}
+	}
+
+	if len(clients) == 0 {
+		delete(i.clients, index)
+		return
+	}
+	i.clients[index] = clients
+}
+
+// lookup returns the clients using an index
+func (i *sessionIndex) lookup(index uint32) []*clientConn {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	return append([]*clientConn(nil), i.clients[index]...)
+}
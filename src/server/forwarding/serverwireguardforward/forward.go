@@ -0,0 +1,465 @@
+package serverwireguardforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"etha-tunnel/handshake/ChaCha20"
+	"etha-tunnel/handshake/wireguard"
+	"etha-tunnel/network/packets"
+	"etha-tunnel/server/handshakeguard"
+	"etha-tunnel/server/ipam"
+	"etha-tunnel/settings/server"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxPacketLengthBytes = 65535
+	// timerInterval is how often sessions are checked for expiry and keepalives
+	timerInterval = time.Second
+	// authorizationCheckInterval is how often active sessions are checked against the server conf,
+	// so sessions of peers expired or removed by editing the conf end as well
+	authorizationCheckInterval = 30 * time.Second
+)
+
+// peerSession is the session established by a handshake of a WireGuard peer, under the index the server picked for it.
+// It is confirmed by the first transport message of the peer, and only then takes over the tunnel addresses.
+type peerSession struct {
+	localIndex     uint32
+	publicKey      []byte
+	session        *ChaCha20.Session
+	assignment     *ipam.Assignment
+	conn           *peerConn
+	createdAt      time.Time
+	confirmed      atomic.Bool
+	lastReceived   atomic.Int64 // unix nanoseconds of the last transport message received from the peer
+	spoofedPackets atomic.Uint64
+}
+
+// forwarder speaks the WireGuard protocol on a UDP port, and forwards the packets of WireGuard peers to TUN.
+// Sessions are put into the same connection and session maps as the ones of TunGo clients, so packets
+// from TUN reach WireGuard peers through the TUN forwarder.
+type forwarder struct {
+	listener         *net.UDPConn
+	responder        *wireguard.Responder
+	tunFile          *os.File
+	localIpToConn    *sync.Map
+	localIpToSession *sync.Map
+	pool             *ipam.Pool
+	guard            *handshakeguard.Guard
+
+	mu         sync.Mutex
+	sessions   map[uint32]*peerSession // local index to session map, nil for an index reserved by a handshake in progress
+	timestamps map[string][]byte       // string(peer public key) to timestamp of its last accepted initiation map
+}
+
+// ToTun listens for WireGuard messages, answers the handshakes of WireGuard peers and forwards their packets to TUN
+func ToTun(listenPort string, tunFile *os.File, localIpMap *sync.Map, localIpToSessionMap *sync.Map, conf *server.Conf, pool *ipam.Pool, guard *handshakeguard.Guard, ctx context.Context) {
+	// The WireGuard key of the server is derived from its ed25519 key, so it stays the same across restarts
+	if len(conf.Ed25519PrivateKey) != ed25519.PrivateKeySize {
+		log.Printf("wireguard mode needs the server private key, it is not available to sign with an external agent")
+		return
+	}
+	responder, err := wireguard.NewResponder(ChaCha20.X25519PrivateKey(conf.Ed25519PrivateKey))
+	if err != nil {
+		log.Printf("failed to create wireguard responder: %v", err)
+		return
+	}
+
+	listenAddr, err := net.ResolveUDPAddr("udp", listenPort)
+	if err != nil {
+		log.Printf("failed to resolve udp address %s: %v", listenPort, err)
+		return
+	}
+
+	listener, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		log.Printf("failed to listen on udp port %s: %v", listenPort, err)
+		return
+	}
+	defer listener.Close()
+	log.Printf("server listening for wireguard peers on udp port %s, server public key %s", listenPort, base64.StdEncoding.EncodeToString(responder.PublicKey()))
+
+	f := &forwarder{
+		listener:         listener,
+		responder:        responder,
+		tunFile:          tunFile,
+		localIpToConn:    localIpMap,
+		localIpToSession: localIpToSessionMap,
+		pool:             pool,
+		guard:            guard,
+		sessions:         make(map[uint32]*peerSession),
+		timestamps:       make(map[string][]byte),
+	}
+
+	// Sessions of revoked peers are torn down at once
+	server.OnPeerRevoked(func(publicKey ed25519.PublicKey) {
+		for _, peerSession := range f.activeSessions() {
+			if bytes.Equal(peerSession.publicKey, publicKey) {
+				log.Printf("wireguard peer %s is revoked", base64.StdEncoding.EncodeToString(publicKey))
+				_ = peerSession.conn.Close()
+			}
+		}
+	})
+
+	go f.runTimers(ctx)
+
+	//using this goroutine to 'unblock' ReadFromUDP blocking-call
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	buf := make([]byte, maxPacketLengthBytes)
+	for {
+		n, addr, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("WireGuard server is shutting down.")
+				return
+			}
+			log.Printf("failed to read from udp: %v", err)
+			continue
+		}
+		if n < wireguard.TransportHeaderLength {
+			continue
+		}
+
+		switch buf[0] {
+		case wireguard.InitiationMessage:
+			if n != wireguard.InitiationLength || !responder.CheckMAC1(buf[:n]) {
+				continue
+			}
+
+			// Under load the peer must prove it receives at its address, it is answered with a cookie otherwise
+			if guard.UnderLoad() {
+				cookie := guard.Cookie(addr.IP)
+				if !wireguard.CheckMAC2(buf[:n], cookie) {
+					reply, err := responder.CreateCookieReply(buf[:n], cookie)
+					if err == nil {
+						_, err = listener.WriteToUDP(reply, addr)
+					}
+					if err != nil {
+						log.Printf("failed to send cookie reply: %v", err)
+					}
+					continue
+				}
+			}
+
+			if !guard.Allow(addr.IP) {
+				continue
+			}
+
+			message := make([]byte, n)
+			copy(message, buf[:n])
+			go f.handshake(message, addr)
+		case wireguard.TransportMessage:
+			if n < wireguard.MinTransportLength {
+				continue
+			}
+
+			f.mu.Lock()
+			peerSession := f.sessions[wireguard.ReceiverIndex(buf[:n])]
+			f.mu.Unlock()
+			if peerSession == nil {
+				continue
+			}
+
+			f.receive(peerSession, buf[wireguard.TransportHeaderLength:n], addr)
+		}
+	}
+}
+
+// handshake answers a handshake initiation of a WireGuard peer, the new session waits for its first transport message
+func (f *forwarder) handshake(message []byte, addr *net.UDPAddr) {
+	finish := f.guard.Begin()
+	defer finish()
+
+	initiation, err := f.responder.ConsumeInitiation(message)
+	if err != nil {
+		log.Printf("wireguard handshake from %s failed: %s", addr, err)
+		return
+	}
+
+	conf, err := (&server.Conf{}).Read()
+	if err != nil {
+		log.Printf("failed to read server conf: %s", err)
+		return
+	}
+	peer, err := conf.AuthorizeWireGuardPeer(initiation.RemoteStatic, time.Now())
+	if err != nil {
+		log.Printf("wireguard handshake from %s failed: %s", addr, err)
+		return
+	}
+
+	if !f.acceptTimestamp(peer.PublicKey, initiation.Timestamp) {
+		log.Printf("wireguard handshake from %s failed: replayed initiation", addr)
+		return
+	}
+
+	assignment, err := f.pool.StaticAssignment(peer.PublicKey, peer.StaticIPv4, peer.StaticIPv6)
+	if err != nil {
+		log.Printf("wireguard handshake from %s failed: %s", addr, err)
+		return
+	}
+
+	peerSession := &peerSession{
+		publicKey:  peer.PublicKey,
+		assignment: assignment,
+		createdAt:  time.Now(),
+	}
+	peerSession.conn = newPeerConn(f.listener, addr, initiation.SenderIndex, func() {
+		f.forget(peerSession)
+	})
+
+	localIndex, err := f.register(peerSession)
+	if err != nil {
+		log.Printf("wireguard handshake from %s failed: %s", addr, err)
+		return
+	}
+
+	response, sendKey, recvKey, err := f.responder.CreateResponse(initiation, localIndex, peer.PresharedKey)
+	if err == nil {
+		peerSession.session, err = ChaCha20.NewWireGuardSession(sendKey, recvKey, true)
+	}
+	if err != nil {
+		_ = peerSession.conn.Close()
+		log.Printf("wireguard handshake from %s failed: %s", addr, err)
+		return
+	}
+
+	// The session is looked up by its index only once its keys are in place
+	f.mu.Lock()
+	f.sessions[localIndex] = peerSession
+	f.mu.Unlock()
+
+	_, err = f.listener.WriteToUDP(response, addr)
+	if err != nil {
+		_ = peerSession.conn.Close()
+		log.Printf("failed to send wireguard handshake response to %s: %v", addr, err)
+		return
+	}
+}
+
+// receive decrypts a transport message of the session and forwards the packet it carries to TUN
+func (f *forwarder) receive(peerSession *peerSession, datagram []byte, addr *net.UDPAddr) {
+	if time.Since(peerSession.createdAt) > wireguard.RejectAfterTime || peerSession.conn.isClosed() {
+		return
+	}
+
+	// Datagrams may be forged, so the ones failing authentication are dropped without closing the session
+	packet, err := peerSession.session.DecryptDatagram(datagram)
+	if err != nil {
+		return
+	}
+	peerSession.conn.roam(addr)
+	peerSession.lastReceived.Store(time.Now().UnixNano())
+
+	if !peerSession.confirmed.Load() {
+		f.confirm(peerSession)
+	}
+
+	// An empty packet is a keepalive
+	if len(packet) == 0 {
+		return
+	}
+
+	// WireGuard pads packets to a multiple of 16 bytes, the padding is cut off by the length in the IP header
+	packet, err = trimPadding(packet)
+	if err != nil {
+		log.Printf("invalid IP packet structure: %v", err)
+		return
+	}
+	header, err := packets.Parse(packet)
+	if err != nil {
+		log.Printf("invalid IP packet structure: %v", err)
+		return
+	}
+
+	// Prevent IP spoofing: a peer is only allowed to send packets from the addresses it owns
+	if !peerSession.assignment.Owns(header.GetSourceIP()) {
+		if peerSession.spoofedPackets.Add(1) == 1 {
+			log.Printf("dropped packet from %s: source address %s is not owned by the wireguard peer", addr, header.GetSourceIP())
+		}
+		return
+	}
+
+	_, err = f.tunFile.Write(packet)
+	if err != nil {
+		log.Printf("failed to write to TUN: %v", err)
+	}
+}
+
+// confirm makes the session the one packets to the addresses of the peer are sent with, the previous session ends
+func (f *forwarder) confirm(peerSession *peerSession) {
+	if peerSession.confirmed.Swap(true) {
+		return
+	}
+
+	for _, internalIpAddr := range peerSession.assignment.Addresses() {
+		previous, ipCollision := f.localIpToConn.Swap(internalIpAddr, peerSession.conn)
+		f.localIpToSession.Store(internalIpAddr, peerSession.session)
+		if ipCollision && previous != peerSession.conn {
+			_ = previous.(net.Conn).Close()
+		}
+	}
+	log.Printf("registered: wireguard peer %s at %s as %v", base64.StdEncoding.EncodeToString(peerSession.publicKey), peerSession.conn.RemoteAddr(), peerSession.assignment.Addresses())
+}
+
+// register reserves a random unused index for the session, the peer addresses its transport messages with it
+func (f *forwarder) register(peerSession *peerSession) (uint32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	indexBuf := make([]byte, 4)
+	for range 16 {
+		_, err := rand.Read(indexBuf)
+		if err != nil {
+			return 0, err
+		}
+		index := binary.LittleEndian.Uint32(indexBuf)
+		if _, taken := f.sessions[index]; !taken {
+			f.sessions[index] = nil
+			peerSession.localIndex = index
+			return index, nil
+		}
+	}
+
+	return 0, fmt.Errorf("failed to pick a session index")
+}
+
+// forget removes a closed session from the index and from the connection and session maps
+func (f *forwarder) forget(peerSession *peerSession) {
+	f.mu.Lock()
+	if current, ok := f.sessions[peerSession.localIndex]; ok && (current == nil || current == peerSession) {
+		delete(f.sessions, peerSession.localIndex)
+	}
+	f.mu.Unlock()
+
+	removed := false
+	for _, internalIpAddr := range peerSession.assignment.Addresses() {
+		if f.localIpToConn.CompareAndDelete(internalIpAddr, peerSession.conn) {
+			removed = true
+		}
+		f.localIpToSession.CompareAndDelete(internalIpAddr, peerSession.session)
+	}
+	if removed {
+		log.Printf("disconnected: wireguard peer %s", base64.StdEncoding.EncodeToString(peerSession.publicKey))
+	}
+}
+
+// acceptTimestamp reports whether the initiation is newer than the last accepted one of the peer
+func (f *forwarder) acceptTimestamp(publicKey []byte, timestamp []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !wireguard.IsNewerTimestamp(timestamp, f.timestamps[string(publicKey)]) {
+		return false
+	}
+	f.timestamps[string(publicKey)] = timestamp
+
+	return true
+}
+
+func (f *forwarder) activeSessions() []*peerSession {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	peerSessions := make([]*peerSession, 0, len(f.sessions))
+	for _, peerSession := range f.sessions {
+		if peerSession == nil {
+			continue
+		}
+		peerSessions = append(peerSessions, peerSession)
+	}
+	return peerSessions
+}
+
+// runTimers ends sessions once their keys are too old, sends keepalives to peers which are not sent any data,
+// and ends the sessions of peers which are no longer allowed to connect
+func (f *forwarder) runTimers(ctx context.Context) {
+	ticker := time.NewTicker(timerInterval)
+	defer ticker.Stop()
+	lastAuthorizationCheck := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, peerSession := range f.activeSessions() {
+				if now.Sub(peerSession.createdAt) > wireguard.RejectAfterTime {
+					_ = peerSession.conn.Close()
+					continue
+				}
+
+				// A peer is sent a keepalive if it has sent data which was not answered, so it knows the session is alive
+				lastReceived := peerSession.lastReceived.Load()
+				if peerSession.confirmed.Load() && lastReceived > peerSession.conn.lastSent.Load() &&
+					now.Sub(time.Unix(0, lastReceived)) >= wireguard.KeepaliveTimeout {
+					datagram, err := peerSession.session.EncryptDatagram(nil)
+					if err == nil {
+						_, err = peerSession.conn.Write(datagram)
+					}
+					if err != nil {
+						log.Printf("failed to send keepalive to wireguard peer: %v", err)
+					}
+				}
+			}
+
+			if now.Sub(lastAuthorizationCheck) >= authorizationCheckInterval {
+				lastAuthorizationCheck = now
+				f.checkAuthorizations(now)
+			}
+		}
+	}
+}
+
+func (f *forwarder) checkAuthorizations(now time.Time) {
+	conf, err := (&server.Conf{}).Read()
+	if err != nil {
+		log.Printf("failed to read server conf: %s", err)
+		return
+	}
+
+	for _, peerSession := range f.activeSessions() {
+		if _, err = conf.AuthorizeWireGuardPeer(peerSession.publicKey, now); err != nil {
+			log.Printf("%s, closing its sessions", err)
+			_ = peerSession.conn.Close()
+		}
+	}
+}
+
+// trimPadding cuts a decrypted packet to the length in its IP header
+func trimPadding(packet []byte) ([]byte, error) {
+	var length int
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, fmt.Errorf("invalid packet length")
+		}
+		length = int(binary.BigEndian.Uint16(packet[2:4]))
+	case 6:
+		if len(packet) < 40 {
+			return nil, fmt.Errorf("invalid packet length for IPv6")
+		}
+		length = 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+	default:
+		return nil, fmt.Errorf("unsupported packet version")
+	}
+
+	if length > len(packet) {
+		return nil, fmt.Errorf("packet is shorter than its header length")
+	}
+
+	return packet[:length], nil
+}
@@ -0,0 +1,103 @@
+package serverwireguardforward
+
+import (
+	"etha-tunnel/handshake/wireguard"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// peerConn is the net.Conn of a WireGuard session in the connection map. Every Write sends one session datagram
+// as a transport message, so the TUN forwarder treats WireGuard peers the same way as clients connected over UDP.
+// Datagrams of the peer are read by the shared listener, so Read only blocks until the session is closed.
+type peerConn struct {
+	listener *net.UDPConn
+	addr     atomic.Pointer[net.UDPAddr] // the peer may roam, its last authenticated address is used
+	header   []byte
+	lastSent atomic.Int64 // unix nanoseconds of the last transport message sent to the peer
+	closed   chan struct{}
+	once     sync.Once
+	onClose  func()
+}
+
+func newPeerConn(listener *net.UDPConn, addr *net.UDPAddr, receiverIndex uint32, onClose func()) *peerConn {
+	conn := &peerConn{
+		listener: listener,
+		header:   wireguard.TransportHeader(receiverIndex),
+		closed:   make(chan struct{}),
+		onClose:  onClose,
+	}
+	conn.addr.Store(addr)
+
+	return conn
+}
+
+func (c *peerConn) Read(_ []byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	message := make([]byte, 0, len(c.header)+len(b))
+	message = append(message, c.header...)
+	message = append(message, b...)
+	_, err := c.listener.WriteToUDP(message, c.addr.Load())
+	if err != nil {
+		return 0, err
+	}
+	c.lastSent.Store(time.Now().UnixNano())
+
+	return len(b), nil
+}
+
+func (c *peerConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.onClose()
+	})
+	return nil
+}
+
+func (c *peerConn) LocalAddr() net.Addr {
+	return c.listener.LocalAddr()
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.addr.Load()
+}
+
+func (c *peerConn) SetDeadline(_ time.Time) error {
+	return nil
+}
+
+func (c *peerConn) SetReadDeadline(_ time.Time) error {
+	return nil
+}
+
+func (c *peerConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// isClosed reports whether the session of the connection has ended
+func (c *peerConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// roam moves the session to the address an authenticated transport message came from
+func (c *peerConn) roam(addr *net.UDPAddr) {
+	if current := c.addr.Load(); !current.IP.Equal(addr.IP) || current.Port != addr.Port {
+		c.addr.Store(addr)
+	}
+}
@@ -0,0 +1,205 @@
+package handshakeguard
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"etha-tunnel/settings/server"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRatePerIP     = 5   // handshakes per second a single source address may start
+	defaultBurstPerIP    = 10  // handshakes a single source address may start at once
+	defaultRate          = 100 // handshakes per second all clients together may start
+	defaultBurst         = 200
+	defaultLoadThreshold = 32 // handshakes in progress at once before cookies are required
+
+	// CookieLength is the length of the cookie a client must echo back under load
+	CookieLength = 16
+	// cookieSecretLifetime is how often the cookie secret rotates, cookies of the previous secret stay valid
+	cookieSecretLifetime = 2 * time.Minute
+	// bucketIdleTime is how long the bucket of a silent source address is kept
+	bucketIdleTime = time.Minute
+)
+
+// Guard protects the server from handshake floods. It limits the rate handshakes are started at,
+// per source address and globally, and asks clients to prove they can receive at their address
+// with a stateless cookie once too many handshakes are in progress.
+type Guard struct {
+	mu            sync.Mutex
+	buckets       map[string]*bucket // source address to bucket map
+	global        bucket
+	ratePerIP     float64
+	burstPerIP    float64
+	loadThreshold int64
+	inProgress    atomic.Int64
+	secret        [32]byte
+	prevSecret    [32]byte
+	secretAt      time.Time
+	lastPrune     time.Time
+	now           func() time.Time
+}
+
+func NewGuard(conf *server.Conf) *Guard {
+	ratePerIP, burstPerIP := float64(defaultRatePerIP), float64(defaultBurstPerIP)
+	if conf.HandshakeRateLimitPerIP > 0 {
+		ratePerIP, burstPerIP = conf.HandshakeRateLimitPerIP, 2*conf.HandshakeRateLimitPerIP
+	}
+
+	rate, burst := float64(defaultRate), float64(defaultBurst)
+	if conf.HandshakeRateLimit > 0 {
+		rate, burst = conf.HandshakeRateLimit, 2*conf.HandshakeRateLimit
+	}
+
+	loadThreshold := int64(defaultLoadThreshold)
+	if conf.HandshakeLoadThreshold > 0 {
+		loadThreshold = int64(conf.HandshakeLoadThreshold)
+	}
+
+	return newGuard(ratePerIP, burstPerIP, rate, burst, loadThreshold, time.Now)
+}
+
+func newGuard(ratePerIP, burstPerIP, rate, burst float64, loadThreshold int64, now func() time.Time) *Guard {
+	g := &Guard{
+		buckets:       make(map[string]*bucket),
+		global:        bucket{rate: rate, burst: burst, tokens: burst, updatedAt: now()},
+		ratePerIP:     ratePerIP,
+		burstPerIP:    burstPerIP,
+		loadThreshold: loadThreshold,
+		secretAt:      now(),
+		lastPrune:     now(),
+		now:           now,
+	}
+	_, _ = rand.Read(g.secret[:])
+	_, _ = rand.Read(g.prevSecret[:])
+
+	return g
+}
+
+// Allow reports whether a handshake from ip may be started, consuming a token of both its own and the global bucket.
+// A client whose source address is unknown is refused, rather than sharing a bucket with all the others.
+func (g *Guard) Allow(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	g.prune(now)
+
+	key := ip.String()
+	b, ok := g.buckets[key]
+	if !ok {
+		b = &bucket{rate: g.ratePerIP, burst: g.burstPerIP, tokens: g.burstPerIP, updatedAt: now}
+		g.buckets[key] = b
+	}
+
+	// A flooding source must not drain the global bucket for everyone else
+	if !b.take(now) {
+		return false
+	}
+
+	return g.global.take(now)
+}
+
+// Begin marks a handshake as in progress, the returned function marks it as finished
+func (g *Guard) Begin() func() {
+	g.inProgress.Add(1)
+	return func() {
+		g.inProgress.Add(-1)
+	}
+}
+
+// UnderLoad reports whether new handshakes must present a cookie
+func (g *Guard) UnderLoad() bool {
+	return g.inProgress.Load() > g.loadThreshold
+}
+
+// Cookie returns the cookie a client at ip has to echo back
+func (g *Guard) Cookie(ip net.IP) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rotateSecret(g.now())
+	return cookie(g.secret[:], ip)
+}
+
+// VerifyCookie reports whether c was issued to ip by the current or the previous secret
+func (g *Guard) VerifyCookie(ip net.IP, c []byte) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rotateSecret(g.now())
+	return hmac.Equal(c, cookie(g.secret[:], ip)) || hmac.Equal(c, cookie(g.prevSecret[:], ip))
+}
+
+func (g *Guard) rotateSecret(now time.Time) {
+	if now.Sub(g.secretAt) < cookieSecretLifetime {
+		return
+	}
+
+	g.prevSecret = g.secret
+	_, _ = rand.Read(g.secret[:])
+	g.secretAt = now
+}
+
+// prune forgets buckets of source addresses that have been silent long enough to have refilled
+func (g *Guard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < bucketIdleTime {
+		return
+	}
+
+	for key, b := range g.buckets {
+		if now.Sub(b.updatedAt) >= bucketIdleTime {
+			delete(g.buckets, key)
+		}
+	}
+	g.lastPrune = now
+}
+
+func cookie(secret []byte, ip net.IP) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(ip.To16())
+	return mac.Sum(nil)[:CookieLength]
+}
+
+// bucket is a token bucket refilling at rate tokens per second up to burst tokens
+type bucket struct {
+	rate      float64
+	burst     float64
+	tokens    float64
+	updatedAt time.Time
+}
+
+func (b *bucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.updatedAt).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.updatedAt = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// SourceIP returns the IP address of a TCP or UDP remote address, or nil for any other address
+func SourceIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package handshakeguard
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestGuard_LimitsRatePerIP(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	guard := newGuard(1, 2, 100, 100, 1, clock.Now)
+	flooder := net.ParseIP("192.0.2.1")
+
+	if !guard.Allow(flooder) || !guard.Allow(flooder) {
+		t.Fatalf("expected the burst to be allowed")
+	}
+	if guard.Allow(flooder) {
+		t.Errorf("expected handshake over the burst to be rejected")
+	}
+	if !guard.Allow(net.ParseIP("192.0.2.2")) {
+		t.Errorf("expected other source address to be allowed")
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if !guard.Allow(flooder) {
+		t.Errorf("expected handshake to be allowed once the bucket refilled")
+	}
+}
+
+func TestGuard_LimitsGlobalRate(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	guard := newGuard(10, 10, 1, 2, 1, clock.Now)
+
+	if !guard.Allow(net.ParseIP("192.0.2.1")) || !guard.Allow(net.ParseIP("192.0.2.2")) {
+		t.Fatalf("expected the global burst to be allowed")
+	}
+	if guard.Allow(net.ParseIP("192.0.2.3")) {
+		t.Errorf("expected handshake over the global burst to be rejected")
+	}
+}
+
+func TestGuard_RejectsUnknownSource(t *testing.T) {
+	guard := newGuard(10, 10, 10, 10, 1, time.Now)
+
+	if guard.Allow(SourceIP(&net.UnixAddr{Name: "@tunnel", Net: "unix"})) {
+		t.Errorf("expected handshake from an unknown source address to be rejected")
+	}
+}
+
+func TestGuard_UnderLoad(t *testing.T) {
+	guard := newGuard(1, 1, 1, 1, 1, time.Now)
+
+	first := guard.Begin()
+	if guard.UnderLoad() {
+		t.Errorf("expected no load at the threshold")
+	}
+	second := guard.Begin()
+	if !guard.UnderLoad() {
+		t.Errorf("expected load over the threshold")
+	}
+	second()
+	first()
+	if guard.UnderLoad() {
+		t.Errorf("expected no load once handshakes finished")
+	}
+}
+
+func TestGuard_Cookie(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	guard := newGuard(1, 1, 1, 1, 1, clock.Now)
+	ip := net.ParseIP("2001:db8::1")
+
+	cookie := guard.Cookie(ip)
+	if !guard.VerifyCookie(ip, cookie) {
+		t.Errorf("expected cookie to be valid")
+	}
+	if guard.VerifyCookie(net.ParseIP("2001:db8::2"), cookie) {
+		t.Errorf("expected cookie to be bound to the source address")
+	}
+
+	// A cookie survives one secret rotation, but not two
+	clock.now = clock.now.Add(cookieSecretLifetime)
+	if !guard.VerifyCookie(ip, cookie) {
+		t.Errorf("expected cookie of the previous secret to be valid")
+	}
+	clock.now = clock.now.Add(cookieSecretLifetime)
+	if guard.VerifyCookie(ip, cookie) {
+		t.Errorf("expected cookie of an expired secret to be rejected")
+	}
+}
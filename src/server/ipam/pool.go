@@ -0,0 +1,448 @@
+package ipam
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"etha-tunnel/settings/server"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// leaseTime is how long an address stays bound to a peer after its last session has ended
+	leaseTime = 30 * 24 * time.Hour
+)
+
+// Assignment is a set of tunnel addresses handed to a connected peer, in CIDR notation.
+// Prefixes are the host prefixes the peer owns, packets from any other source must not be accepted from it.
+type Assignment struct {
+	Ed25519PublicKey ed25519.PublicKey
+	IPv4             string
+	IPv6             string
+	Prefixes         []*net.IPNet
+}
+
+// Owns reports whether the peer is allowed to send packets from ip
+func (a *Assignment) Owns(ip net.IP) bool {
+	for _, prefix := range a.Prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Addresses returns the assigned addresses without prefix lengths
+func (a *Assignment) Addresses() []string {
+	var addresses []string
+	for _, cidr := range []string{a.IPv4, a.IPv6} {
+		if cidr != "" {
+			addresses = append(addresses, strings.Split(cidr, "/")[0])
+		}
+	}
+	return addresses
+}
+
+// Pool assigns tunnel addresses to peers from the configured IPv4 and IPv6 ranges.
+// Addresses are sticky: a peer gets the same address back for as long as its lease is not reclaimed.
+type Pool struct {
+	mu        sync.Mutex
+	v4        *net.IPNet
+	v6        *net.IPNet
+	excluded  []net.IP // addresses of the server itself
+	reserved  []net.IP // addresses of WireGuard peers, which are never assigned from the pool
+	leases    *server.Leases
+	active    map[string]int  // public key to active sessions count map
+	forgotten map[string]bool // public keys whose lease is dropped once their last session ends
+	persist   func() error
+	now       func() time.Time
+}
+
+func NewPool(conf *server.Conf) (*Pool, error) {
+	leases, err := (&server.Leases{}).Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease database: %s", err)
+	}
+
+	pool, err := newPool(conf, leases)
+	if err != nil {
+		return nil, err
+	}
+	pool.persist = leases.Rewrite
+
+	return pool, nil
+}
+
+func newPool(conf *server.Conf, leases *server.Leases) (*Pool, error) {
+	pool := &Pool{
+		leases:    leases,
+		active:    make(map[string]int),
+		forgotten: make(map[string]bool),
+		persist:   func() error { return nil },
+		now:       time.Now,
+	}
+
+	if conf.IPv4Pool != "" {
+		_, v4, err := net.ParseCIDR(conf.IPv4Pool)
+		if err != nil || v4.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 pool: %s", conf.IPv4Pool)
+		}
+		pool.v4 = v4
+	}
+
+	if conf.IPv6Pool != "" {
+		_, v6, err := net.ParseCIDR(conf.IPv6Pool)
+		if err != nil || v6.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 pool: %s", conf.IPv6Pool)
+		}
+		pool.v6 = v6
+	}
+
+	if pool.v4 == nil && pool.v6 == nil {
+		return nil, fmt.Errorf("no address pool configured")
+	}
+
+	for _, serverAddress := range []string{conf.IfIP, conf.IfIPv6} {
+		if serverAddress == "" {
+			continue
+		}
+		ip := net.ParseIP(strings.Split(serverAddress, "/")[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid server address: %s", serverAddress)
+		}
+		pool.excluded = append(pool.excluded, ip)
+	}
+
+	for _, peer := range conf.WireGuardPeers {
+		for _, address := range []string{peer.StaticIPv4, peer.StaticIPv6} {
+			if ip := net.ParseIP(address); ip != nil {
+				pool.reserved = append(pool.reserved, ip)
+			}
+		}
+	}
+
+	return pool, nil
+}
+
+// Acquire returns the addresses of the peer, allocating them if the peer has none.
+// Every successful Acquire must be followed by a Release once the session has ended.
+func (p *Pool) Acquire(publicKey ed25519.PublicKey, peers []server.Peer) (*Assignment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var peer server.Peer
+	found := false
+	for _, candidate := range peers {
+		if candidate.Ed25519PublicKey.Equal(publicKey) {
+			peer, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown peer")
+	}
+
+	delete(p.forgotten, keyOf(publicKey))
+
+	lease := p.findLease(publicKey)
+	if lease == nil {
+		p.leases.Leases = append(p.leases.Leases, server.Lease{Ed25519PublicKey: publicKey})
+		lease = &p.leases.Leases[len(p.leases.Leases)-1]
+	}
+
+	assignment := &Assignment{Ed25519PublicKey: publicKey}
+
+	if p.v4 != nil {
+		ip, err := p.pick(p.v4, peer.StaticIPv4, lease.IPv4, publicKey, peers, func(l *server.Lease) *string { return &l.IPv4 })
+		if err != nil {
+			return nil, err
+		}
+		lease.IPv4 = ip.String()
+		assignment.IPv4 = toCIDR(ip, p.v4)
+		assignment.Prefixes = append(assignment.Prefixes, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)})
+	}
+
+	if p.v6 != nil {
+		ip, err := p.pick(p.v6, peer.StaticIPv6, lease.IPv6, publicKey, peers, func(l *server.Lease) *string { return &l.IPv6 })
+		if err != nil {
+			return nil, err
+		}
+		lease.IPv6 = ip.String()
+		assignment.IPv6 = toCIDR(ip, p.v6)
+		assignment.Prefixes = append(assignment.Prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+	}
+
+	lease.Expires = p.now().Add(leaseTime)
+	p.active[keyOf(publicKey)]++
+
+	if err := p.persist(); err != nil {
+		return nil, fmt.Errorf("failed to write lease database: %s", err)
+	}
+
+	return assignment, nil
+}
+
+// StaticAssignment returns the assignment of a WireGuard peer, whose addresses are configured rather than leased.
+// The addresses are reserved when the pool is created, so no other peer is assigned them.
+func (p *Pool) StaticAssignment(publicKey []byte, ipv4 string, ipv6 string) (*Assignment, error) {
+	assignment := &Assignment{Ed25519PublicKey: publicKey}
+
+	if ipv4 != "" {
+		ip := net.ParseIP(ipv4)
+		if p.v4 == nil || ip == nil || ip.To4() == nil || !p.v4.Contains(ip) || p.isServerAddress(ip) {
+			return nil, fmt.Errorf("static address %s is not usable in the IPv4 pool", ipv4)
+		}
+		assignment.IPv4 = toCIDR(ip, p.v4)
+		assignment.Prefixes = append(assignment.Prefixes, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)})
+	}
+
+	if ipv6 != "" {
+		ip := net.ParseIP(ipv6)
+		if p.v6 == nil || ip == nil || ip.To4() != nil || !p.v6.Contains(ip) || p.isServerAddress(ip) {
+			return nil, fmt.Errorf("static address %s is not usable in the IPv6 pool", ipv6)
+		}
+		assignment.IPv6 = toCIDR(ip, p.v6)
+		assignment.Prefixes = append(assignment.Prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+	}
+
+	if len(assignment.Prefixes) == 0 {
+		return nil, fmt.Errorf("no static address configured")
+	}
+
+	return assignment, nil
+}
+
+// Release marks a session of the peer as ended, the lease then expires after leaseTime
+func (p *Pool) Release(assignment *Assignment) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := keyOf(assignment.Ed25519PublicKey)
+	if p.active[key] > 0 {
+		p.active[key]--
+	}
+	if p.active[key] == 0 {
+		delete(p.active, key)
+		if p.forgotten[key] {
+			delete(p.forgotten, key)
+			p.dropLease(assignment.Ed25519PublicKey)
+			_ = p.persist()
+			return
+		}
+	}
+
+	if lease := p.findLease(assignment.Ed25519PublicKey); lease != nil {
+		lease.Expires = p.now().Add(leaseTime)
+		_ = p.persist()
+	}
+}
+
+// Forget drops the lease of a revoked peer, so its addresses are free for other peers right away.
+// The lease of a peer with active sessions is dropped once the last of them is released.
+func (p *Pool) Forget(publicKey ed25519.PublicKey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := keyOf(publicKey)
+	if p.active[key] > 0 {
+		p.forgotten[key] = true
+		return nil
+	}
+
+	p.dropLease(publicKey)
+	if err := p.persist(); err != nil {
+		return fmt.Errorf("failed to write lease database: %s", err)
+	}
+
+	return nil
+}
+
+// ActivePeer is a peer with an active session, along with the tunnel addresses it holds
+type ActivePeer struct {
+	Ed25519PublicKey ed25519.PublicKey
+	Addresses        []string
+}
+
+// ActivePeers returns the peers with an active session
+func (p *Pool) ActivePeers() []ActivePeer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var peers []ActivePeer
+	for _, lease := range p.leases.Leases {
+		if p.active[keyOf(lease.Ed25519PublicKey)] == 0 {
+			continue
+		}
+
+		peer := ActivePeer{Ed25519PublicKey: lease.Ed25519PublicKey}
+		for _, address := range []string{lease.IPv4, lease.IPv6} {
+			if address != "" {
+				peer.Addresses = append(peer.Addresses, address)
+			}
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// pick selects an address for the peer: the static reservation if any, then its current lease, then the first free address
+func (p *Pool) pick(network *net.IPNet, static string, current string, publicKey ed25519.PublicKey, peers []server.Peer, field func(*server.Lease) *string) (net.IP, error) {
+	if static != "" {
+		ip := net.ParseIP(static)
+		if ip == nil || !network.Contains(ip) || p.isExcluded(ip) {
+			return nil, fmt.Errorf("static address %s is not usable in pool %s", static, network)
+		}
+		// A reservation added while another peer is connected with the address takes effect once that peer disconnects
+		if p.isHeldByActivePeer(ip, publicKey, field) {
+			return nil, fmt.Errorf("static address %s is in use by a connected peer", static)
+		}
+		p.evict(ip, publicKey, field)
+		return ip, nil
+	}
+
+	taken := make(map[string]bool)
+	for _, other := range peers {
+		if other.Ed25519PublicKey.Equal(publicKey) {
+			continue
+		}
+		for _, reserved := range []string{other.StaticIPv4, other.StaticIPv6} {
+			if ip := net.ParseIP(reserved); ip != nil {
+				taken[ip.String()] = true
+			}
+		}
+	}
+	for i := range p.leases.Leases {
+		lease := &p.leases.Leases[i]
+		if lease.Ed25519PublicKey.Equal(publicKey) || p.isReclaimable(lease) {
+			continue
+		}
+		if address := *field(lease); address != "" {
+			taken[address] = true
+		}
+	}
+
+	isFree := func(ip net.IP) bool {
+		return network.Contains(ip) && !taken[ip.String()] && !p.isExcluded(ip) && !isNetworkSpecial(ip, network)
+	}
+
+	if ip := net.ParseIP(current); ip != nil && isFree(ip) {
+		return ip, nil
+	}
+
+	for ip := nextIP(network.IP); network.Contains(ip); ip = nextIP(ip) {
+		if isFree(ip) {
+			p.evict(ip, publicKey, field)
+			return ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("address pool %s is exhausted", network)
+}
+
+// isHeldByActivePeer reports whether another peer with an active session holds the address
+func (p *Pool) isHeldByActivePeer(ip net.IP, publicKey ed25519.PublicKey, field func(*server.Lease) *string) bool {
+	for i := range p.leases.Leases {
+		lease := &p.leases.Leases[i]
+		if !lease.Ed25519PublicKey.Equal(publicKey) && *field(lease) == ip.String() && p.active[keyOf(lease.Ed25519PublicKey)] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// evict takes the address away from the reclaimable lease of another peer
+func (p *Pool) evict(ip net.IP, publicKey ed25519.PublicKey, field func(*server.Lease) *string) {
+	for i := range p.leases.Leases {
+		lease := &p.leases.Leases[i]
+		if !lease.Ed25519PublicKey.Equal(publicKey) && *field(lease) == ip.String() {
+			*field(lease) = ""
+		}
+	}
+}
+
+// dropLease removes the lease of a peer
+func (p *Pool) dropLease(publicKey ed25519.PublicKey) {
+	p.leases.Leases = slices.DeleteFunc(p.leases.Leases, func(lease server.Lease) bool {
+		return lease.Ed25519PublicKey.Equal(publicKey)
+	})
+}
+
+func (p *Pool) isReclaimable(lease *server.Lease) bool {
+	return p.active[keyOf(lease.Ed25519PublicKey)] == 0 && p.now().After(lease.Expires)
+}
+
+func (p *Pool) isExcluded(ip net.IP) bool {
+	if p.isServerAddress(ip) {
+		return true
+	}
+	for _, reserved := range p.reserved {
+		if reserved.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) isServerAddress(ip net.IP) bool {
+	for _, excluded := range p.excluded {
+		if excluded.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) findLease(publicKey ed25519.PublicKey) *server.Lease {
+	for i := range p.leases.Leases {
+		if p.leases.Leases[i].Ed25519PublicKey.Equal(publicKey) {
+			return &p.leases.Leases[i]
+		}
+	}
+	return nil
+}
+
+// isNetworkSpecial reports whether ip is the network address, or the broadcast address of an IPv4 network
+func isNetworkSpecial(ip net.IP, network *net.IPNet) bool {
+	if ip.Equal(network.IP) {
+		return true
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits == 32 && ones < 31 {
+		v4 := ip.To4()
+		for i := range v4 {
+			if v4[i]|network.Mask[i] != 0xff {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func toCIDR(ip net.IP, network *net.IPNet) string {
+	ones, _ := network.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+func keyOf(publicKey ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey)
+}
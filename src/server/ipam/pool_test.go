@@ -0,0 +1,245 @@
+package ipam
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"etha-tunnel/settings/server"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestPeer(t *testing.T) server.Peer {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return server.Peer{Ed25519PublicKey: publicKey}
+}
+
+func newTestPool(t *testing.T, conf *server.Conf) *Pool {
+	pool, err := newPool(conf, &server.Leases{})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	return pool
+}
+
+func TestPool_SkipsServerAndNetworkAddresses(t *testing.T) {
+	pool := newTestPool(t, &server.Conf{IfIP: "10.0.0.1/24", IPv4Pool: "10.0.0.0/24"})
+	peer := newTestPeer(t)
+
+	assignment, err := pool.Acquire(peer.Ed25519PublicKey, []server.Peer{peer})
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+
+	if assignment.IPv4 != "10.0.0.2/24" {
+		t.Errorf("expected 10.0.0.2/24, got %s", assignment.IPv4)
+	}
+}
+
+func TestPool_IsSticky(t *testing.T) {
+	pool := newTestPool(t, &server.Conf{IfIP: "10.0.0.1/24", IPv4Pool: "10.0.0.0/24", IPv6Pool: "fd00::/64"})
+	first, second := newTestPeer(t), newTestPeer(t)
+	peers := []server.Peer{first, second}
+
+	firstAssignment, _ := pool.Acquire(first.Ed25519PublicKey, peers)
+	pool.Release(firstAssignment)
+	secondAssignment, _ := pool.Acquire(second.Ed25519PublicKey, peers)
+	again, err := pool.Acquire(first.Ed25519PublicKey, peers)
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+
+	if again.IPv4 != firstAssignment.IPv4 || again.IPv6 != firstAssignment.IPv6 {
+		t.Errorf("expected %s %s, got %s %s", firstAssignment.IPv4, firstAssignment.IPv6, again.IPv4, again.IPv6)
+	}
+
+	if secondAssignment.IPv4 == firstAssignment.IPv4 || secondAssignment.IPv6 == firstAssignment.IPv6 {
+		t.Errorf("expected different addresses for different peers")
+	}
+}
+
+func TestPool_StaticReservation(t *testing.T) {
+	pool := newTestPool(t, &server.Conf{IfIP: "10.0.0.1/24", IPv4Pool: "10.0.0.0/24"})
+	reserved, dynamic := newTestPeer(t), newTestPeer(t)
+	reserved.StaticIPv4 = "10.0.0.2"
+	peers := []server.Peer{reserved, dynamic}
+
+	dynamicAssignment, _ := pool.Acquire(dynamic.Ed25519PublicKey, peers)
+	if dynamicAssignment.IPv4 == "10.0.0.2/24" {
+		t.Errorf("reserved address must not be assigned to another peer")
+	}
+
+	reservedAssignment, _ := pool.Acquire(reserved.Ed25519PublicKey, peers)
+	if reservedAssignment.IPv4 != "10.0.0.2/24" {
+		t.Errorf("expected reserved address 10.0.0.2/24, got %s", reservedAssignment.IPv4)
+	}
+}
+
+func TestPool_StaticReservationWaitsForConnectedPeer(t *testing.T) {
+	pool := newTestPool(t, &server.Conf{IfIP: "10.0.0.1/24", IPv4Pool: "10.0.0.0/24"})
+	connected, reserved := newTestPeer(t), newTestPeer(t)
+
+	connectedAssignment, _ := pool.Acquire(connected.Ed25519PublicKey, []server.Peer{connected, reserved})
+	if connectedAssignment.IPv4 != "10.0.0.2/24" {
+		t.Fatalf("expected 10.0.0.2/24, got %s", connectedAssignment.IPv4)
+	}
+
+	// The address is reserved for another peer while the first one is still connected with it
+	reserved.StaticIPv4 = "10.0.0.2"
+	peers := []server.Peer{connected, reserved}
+	if _, err := pool.Acquire(reserved.Ed25519PublicKey, peers); err == nil {
+		t.Fatalf("expected the address of a connected peer not to be taken away")
+	}
+
+	pool.Release(connectedAssignment)
+	reservedAssignment, err := pool.Acquire(reserved.Ed25519PublicKey, peers)
+	if err != nil || reservedAssignment.IPv4 != "10.0.0.2/24" {
+		t.Fatalf("expected reserved address once the peer disconnected, got %v, %v", reservedAssignment, err)
+	}
+
+	reconnectedAssignment, _ := pool.Acquire(connected.Ed25519PublicKey, peers)
+	if reconnectedAssignment.IPv4 == "10.0.0.2/24" {
+		t.Errorf("expected the peer to get another address after the reservation")
+	}
+}
+
+func TestPool_ReclaimsExpiredAndRevokedLeases(t *testing.T) {
+	// The pool holds only 10.0.0.1 and 10.0.0.2, the first one is used by the server
+	pool := newTestPool(t, &server.Conf{IfIP: "10.0.0.1/30", IPv4Pool: "10.0.0.0/30"})
+	first, second := newTestPeer(t), newTestPeer(t)
+
+	firstAssignment, _ := pool.Acquire(first.Ed25519PublicKey, []server.Peer{first, second})
+	if _, err := pool.Acquire(second.Ed25519PublicKey, []server.Peer{first, second}); err == nil {
+		t.Fatalf("expected pool to be exhausted")
+	}
+
+	pool.Release(firstAssignment)
+	if _, err := pool.Acquire(second.Ed25519PublicKey, []server.Peer{first, second}); err == nil {
+		t.Fatalf("expected lease to be kept until it expires")
+	}
+
+	pool.now = func() time.Time { return time.Now().Add(leaseTime + time.Hour) }
+	if _, err := pool.Acquire(second.Ed25519PublicKey, []server.Peer{first, second}); err != nil {
+		t.Fatalf("expected expired lease to be reclaimed: %v", err)
+	}
+
+	// The lease of a revoked peer is dropped once its last session has ended
+	third := newTestPeer(t)
+	pool.now = time.Now
+	secondAssignment, _ := pool.Acquire(second.Ed25519PublicKey, []server.Peer{first, second})
+	if err := pool.Forget(second.Ed25519PublicKey); err != nil {
+		t.Fatalf("failed to forget lease: %v", err)
+	}
+	if _, err := pool.Acquire(third.Ed25519PublicKey, []server.Peer{third}); err == nil {
+		t.Fatalf("expected lease of revoked peer to be kept while it is connected")
+	}
+	pool.Release(secondAssignment)
+	pool.Release(secondAssignment)
+	if _, err := pool.Acquire(third.Ed25519PublicKey, []server.Peer{third}); err != nil {
+		t.Fatalf("expected lease of revoked peer to be reclaimed: %v", err)
+	}
+}
+
+func TestPool_KeepsLeasesOfPeersMissingFromAcquire(t *testing.T) {
+	pool := newTestPool(t, &server.Conf{IfIP: "10.0.0.1/30", IPv4Pool: "10.0.0.0/30"})
+	first, second := newTestPeer(t), newTestPeer(t)
+
+	firstAssignment, _ := pool.Acquire(first.Ed25519PublicKey, []server.Peer{first})
+	pool.Release(firstAssignment)
+
+	// Acquiring for a peer known only to the caller, such as one redeeming an invite, leaves other leases alone
+	if _, err := pool.Acquire(second.Ed25519PublicKey, []server.Peer{second}); err == nil {
+		t.Fatalf("expected the lease of the other peer to be kept")
+	}
+	if assignment, err := pool.Acquire(first.Ed25519PublicKey, []server.Peer{first}); err != nil || assignment.IPv4 != firstAssignment.IPv4 {
+		t.Errorf("expected the peer to get its address back, got %v, %v", assignment, err)
+	}
+}
+
+func TestPool_RejectsUnknownPeer(t *testing.T) {
+	pool := newTestPool(t, &server.Conf{IPv4Pool: "10.0.0.0/24"})
+	peer := newTestPeer(t)
+
+	if _, err := pool.Acquire(peer.Ed25519PublicKey, nil); err == nil {
+		t.Errorf("expected unknown peer to be rejected")
+	}
+}
+
+func TestAssignment_OwnsOnlyAssignedAddresses(t *testing.T) {
+	pool := newTestPool(t, &server.Conf{IfIP: "10.0.0.1/24", IPv4Pool: "10.0.0.0/24", IPv6Pool: "fd00::/64"})
+	peer := newTestPeer(t)
+
+	assignment, err := pool.Acquire(peer.Ed25519PublicKey, []server.Peer{peer})
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+
+	for _, owned := range assignment.Addresses() {
+		if !assignment.Owns(net.ParseIP(owned)) {
+			t.Errorf("expected %s to be owned", owned)
+		}
+	}
+
+	for _, foreign := range []string{"10.0.0.1", "10.0.0.3", "fd00::2", "192.168.0.1"} {
+		if assignment.Owns(net.ParseIP(foreign)) {
+			t.Errorf("expected %s not to be owned", foreign)
+		}
+	}
+}
+
+func TestPool_ActivePeers(t *testing.T) {
+	pool := newTestPool(t, &server.Conf{IfIP: "10.0.0.1/24", IPv4Pool: "10.0.0.0/24"})
+	peer := newTestPeer(t)
+
+	assignment, err := pool.Acquire(peer.Ed25519PublicKey, []server.Peer{peer})
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+
+	active := pool.ActivePeers()
+	if len(active) != 1 || !active[0].Ed25519PublicKey.Equal(peer.Ed25519PublicKey) || len(active[0].Addresses) != 1 || active[0].Addresses[0] != "10.0.0.2" {
+		t.Errorf("expected the peer to be active at 10.0.0.2, got %v", active)
+	}
+
+	pool.Release(assignment)
+	if active = pool.ActivePeers(); len(active) != 0 {
+		t.Errorf("expected no active peers after release, got %v", active)
+	}
+}
+
+func TestPool_WireGuardStaticAssignment(t *testing.T) {
+	wireGuardKey := make([]byte, 32)
+	pool := newTestPool(t, &server.Conf{
+		IfIP:           "10.0.0.1/24",
+		IPv4Pool:       "10.0.0.0/24",
+		WireGuardPeers: []server.WireGuardPeer{{PublicKey: wireGuardKey, StaticIPv4: "10.0.0.2"}},
+	})
+
+	assignment, err := pool.StaticAssignment(wireGuardKey, "10.0.0.2", "")
+	if err != nil {
+		t.Fatalf("failed to assign static address: %v", err)
+	}
+	if assignment.IPv4 != "10.0.0.2/24" || !assignment.Owns(net.ParseIP("10.0.0.2")) {
+		t.Errorf("unexpected assignment: %+v", assignment)
+	}
+
+	// The address of the WireGuard peer is never leased to a client
+	peer := newTestPeer(t)
+	leased, err := pool.Acquire(peer.Ed25519PublicKey, []server.Peer{peer})
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	if leased.IPv4 != "10.0.0.3/24" {
+		t.Errorf("expected 10.0.0.3/24, got %s", leased.IPv4)
+	}
+
+	if _, err = pool.StaticAssignment(wireGuardKey, "10.0.0.1", ""); err == nil {
+		t.Errorf("expected the server address to be refused")
+	}
+	if _, err = pool.StaticAssignment(wireGuardKey, "10.1.0.2", ""); err == nil {
+		t.Errorf("expected an address outside of the pool to be refused")
+	}
+}
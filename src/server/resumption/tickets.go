@@ -0,0 +1,209 @@
+package resumption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"etha-tunnel/handshake/ChaCha20"
+	"etha-tunnel/settings/server"
+	"golang.org/x/crypto/chacha20poly1305"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLifetime is how long a ticket is valid unless configured otherwise
+	defaultLifetime = 12 * time.Hour
+	// keyIdLength is the length of the ticket key id a ticket starts with
+	keyIdLength = 4
+)
+
+var (
+	ErrResumptionDisabled = errors.New("session resumption is disabled")
+	ErrInvalidTicket      = errors.New("invalid resumption ticket")
+	ErrTicketExpired      = errors.New("resumption ticket expired")
+	ErrTicketRedeemed     = errors.New("resumption ticket already redeemed")
+)
+
+// State is what a ticket carries, the server keeps only the ids of redeemed tickets until they expire
+type State struct {
+	Ed25519PublicKey ed25519.PublicKey     `json:"k"`
+	Secret           []byte                `json:"s"`
+	CipherSuite      ChaCha20.CipherSuite  `json:"c"`
+	Capabilities     []ChaCha20.Capability `json:"f"`
+	ExpiresAt        int64                 `json:"e"`
+}
+
+// Tickets seals session state into tickets the clients keep. The ticket key rotates every ticket lifetime,
+// tickets sealed with the previous key are still opened, so no ticket is cut short by a rotation.
+// A ticket resumes a single session, so a captured resume hello cannot be replayed to take over the session.
+type Tickets struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	key      ticketKey
+	prevKey  ticketKey
+	keyAt    time.Time
+	redeemed map[string]int64 // nonce of a redeemed ticket to its expiry
+	now      func() time.Time
+}
+
+type ticketKey struct {
+	id   [keyIdLength]byte
+	aead cipher.AEAD
+}
+
+func NewTickets(conf *server.Conf) *Tickets {
+	lifetime := defaultLifetime
+	if conf.ResumptionTicketLifetimeSeconds > 0 {
+		lifetime = time.Duration(conf.ResumptionTicketLifetimeSeconds) * time.Second
+	} else if conf.ResumptionTicketLifetimeSeconds < 0 {
+		lifetime = 0
+	}
+
+	return newTickets(lifetime, time.Now)
+}
+
+func newTickets(lifetime time.Duration, now func() time.Time) *Tickets {
+	t := &Tickets{
+		lifetime: lifetime,
+		key:      newTicketKey(),
+		prevKey:  newTicketKey(),
+		keyAt:    now(),
+		redeemed: make(map[string]int64),
+		now:      now,
+	}
+
+	return t
+}
+
+// Enabled reports whether tickets are issued at all
+func (t *Tickets) Enabled() bool {
+	return t != nil && t.lifetime > 0
+}
+
+// Lifetime is how long an issued ticket is valid
+func (t *Tickets) Lifetime() time.Duration {
+	return t.lifetime
+}
+
+// Issue seals the state into a ticket valid for the ticket lifetime
+func (t *Tickets) Issue(state State) ([]byte, error) {
+	if !t.Enabled() {
+		return nil, ErrResumptionDisabled
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.rotateKey(now)
+	state.ExpiresAt = now.Add(t.lifetime).Unix()
+
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket := make([]byte, 0, keyIdLength+len(nonce)+len(plaintext)+chacha20poly1305.Overhead)
+	ticket = append(ticket, t.key.id[:]...)
+	ticket = append(ticket, nonce...)
+	return t.key.aead.Seal(ticket, nonce, plaintext, t.key.id[:]), nil
+}
+
+// Open returns the state sealed into a ticket by the current or the previous ticket key
+func (t *Tickets) Open(ticket []byte) (*State, error) {
+	if !t.Enabled() {
+		return nil, ErrResumptionDisabled
+	}
+
+	if len(ticket) < keyIdLength+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return nil, ErrInvalidTicket
+	}
+
+	t.mu.Lock()
+	now := t.now()
+	t.rotateKey(now)
+	var key *ticketKey
+	switch id := ticket[:keyIdLength]; {
+	case bytes.Equal(id, t.key.id[:]):
+		key = &t.key
+	case bytes.Equal(id, t.prevKey.id[:]):
+		key = &t.prevKey
+	}
+	t.mu.Unlock()
+
+	if key == nil {
+		return nil, ErrInvalidTicket
+	}
+
+	nonce := ticket[keyIdLength : keyIdLength+chacha20poly1305.NonceSizeX]
+	plaintext, err := key.aead.Open(nil, nonce, ticket[keyIdLength+chacha20poly1305.NonceSizeX:], ticket[:keyIdLength])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+
+	var state State
+	err = json.Unmarshal(plaintext, &state)
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+
+	if now.Unix() >= state.ExpiresAt {
+		return nil, ErrTicketExpired
+	}
+
+	return &state, nil
+}
+
+// Redeem marks an opened ticket as used, it fails if the ticket was redeemed before.
+// Redeemed tickets are remembered until they expire, after that Open rejects them anyway.
+func (t *Tickets) Redeem(ticket []byte, state *State) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now().Unix()
+	for id, expiresAt := range t.redeemed {
+		if now >= expiresAt {
+			delete(t.redeemed, id)
+		}
+	}
+
+	// The nonce is random for every ticket, so it identifies the ticket
+	id := string(ticket[keyIdLength : keyIdLength+chacha20poly1305.NonceSizeX])
+	if _, ok := t.redeemed[id]; ok {
+		return ErrTicketRedeemed
+	}
+	t.redeemed[id] = state.ExpiresAt
+
+	return nil
+}
+
+func (t *Tickets) rotateKey(now time.Time) {
+	if now.Sub(t.keyAt) < t.lifetime {
+		return
+	}
+
+	t.prevKey = t.key
+	t.key = newTicketKey()
+	t.keyAt = now
+}
+
+func newTicketKey() ticketKey {
+	var k ticketKey
+	_, _ = rand.Read(k.id[:])
+
+	secret := make([]byte, chacha20poly1305.KeySize)
+	_, _ = rand.Read(secret)
+	k.aead, _ = chacha20poly1305.NewX(secret)
+
+	return k
+}
@@ -0,0 +1,97 @@
+package resumption
+
+import (
+	"bytes"
+	"errors"
+	"etha-tunnel/handshake/ChaCha20"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestTickets_RoundTrip(t *testing.T) {
+	tickets := newTickets(time.Hour, time.Now)
+	secret := bytes.Repeat([]byte{7}, 32)
+
+	ticket, err := tickets.Issue(State{Secret: secret, CipherSuite: ChaCha20.CipherSuiteAES256GCM})
+	if err != nil {
+		t.Fatalf("failed to issue ticket: %s", err)
+	}
+
+	state, err := tickets.Open(ticket)
+	if err != nil {
+		t.Fatalf("failed to open ticket: %s", err)
+	}
+	if !bytes.Equal(state.Secret, secret) || state.CipherSuite != ChaCha20.CipherSuiteAES256GCM {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	ticket[len(ticket)-1] ^= 1
+	if _, err = tickets.Open(ticket); !errors.Is(err, ErrInvalidTicket) {
+		t.Errorf("expected tampered ticket to be rejected, got %v", err)
+	}
+}
+
+func TestTickets_RedeemOnce(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tickets := newTickets(time.Hour, clock.Now)
+
+	ticket, _ := tickets.Issue(State{Secret: bytes.Repeat([]byte{7}, 32)})
+	state, err := tickets.Open(ticket)
+	if err != nil {
+		t.Fatalf("failed to open ticket: %s", err)
+	}
+	if err = tickets.Redeem(ticket, state); err != nil {
+		t.Fatalf("failed to redeem ticket: %s", err)
+	}
+	if err = tickets.Redeem(ticket, state); !errors.Is(err, ErrTicketRedeemed) {
+		t.Errorf("expected a ticket to be redeemed only once, got %v", err)
+	}
+
+	// Redeemed tickets are forgotten once they expire
+	clock.now = clock.now.Add(time.Hour)
+	_ = tickets.Redeem([]byte("another ticket id and nonce which is long enough"), &State{ExpiresAt: clock.now.Add(time.Hour).Unix()})
+	if len(tickets.redeemed) != 1 {
+		t.Errorf("expected the expired ticket to be forgotten, got %d redeemed tickets", len(tickets.redeemed))
+	}
+}
+
+func TestTickets_KeyRotation(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tickets := newTickets(time.Hour, clock.Now)
+
+	clock.now = clock.now.Add(30 * time.Minute)
+	ticket, _ := tickets.Issue(State{Secret: []byte{1}})
+
+	// The ticket key rotated, but the ticket is still within its lifetime
+	clock.now = clock.now.Add(time.Hour - time.Second)
+	_, _ = tickets.Issue(State{Secret: []byte{2}})
+	if _, err := tickets.Open(ticket); err != nil {
+		t.Errorf("expected ticket of the previous key to be accepted, got %v", err)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if _, err := tickets.Open(ticket); !errors.Is(err, ErrTicketExpired) {
+		t.Errorf("expected expired ticket to be rejected, got %v", err)
+	}
+
+	// Two rotations later the key is gone
+	clock.now = clock.now.Add(2 * time.Hour)
+	if _, err := tickets.Open(ticket); !errors.Is(err, ErrInvalidTicket) {
+		t.Errorf("expected ticket of a dropped key to be rejected, got %v", err)
+	}
+}
+
+func TestTickets_Disabled(t *testing.T) {
+	tickets := newTickets(0, time.Now)
+	if _, err := tickets.Issue(State{}); !errors.Is(err, ErrResumptionDisabled) {
+		t.Errorf("expected no tickets to be issued, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package sshagent
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"time"
+)
+
+// dialTimeout bounds connecting to the agent, so a stuck agent fails the handshake rather than hanging it
+const dialTimeout = 2 * time.Second
+
+// Signer signs with an Ed25519 key held by an ssh-agent, so the private key never enters the server process.
+// Every signature is made over a fresh connection to the agent socket, so a restarted agent is picked up.
+type Signer struct {
+	socketPath string
+	publicKey  ed25519.PublicKey
+}
+
+func NewSigner(socketPath string, publicKey ed25519.PublicKey) *Signer {
+	return &Signer{
+		socketPath: socketPath,
+		publicKey:  publicKey,
+	}
+}
+
+func (s *Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs the message itself, as Ed25519 does not sign digests
+func (s *Signer) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("ed25519 cannot sign hashed messages")
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(s.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("unix", s.socketPath, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	signature, err := agent.NewClient(conn).Sign(sshPublicKey, message)
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent failed to sign: %w", err)
+	}
+
+	if signature.Format != ssh.KeyAlgoED25519 || len(signature.Blob) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("unexpected ssh-agent signature format: %s", signature.Format)
+	}
+
+	return signature.Blob, nil
+}
+
+// CheckKey reports an error unless the agent holds the key of the signer
+func (s *Signer) CheckKey() error {
+	keys, err := Ed25519Keys(s.socketPath)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if key.Equal(s.publicKey) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("ssh-agent does not hold the server key")
+}
+
+// Ed25519Keys lists the Ed25519 keys held by the agent
+func Ed25519Keys(socketPath string) ([]ed25519.PublicKey, error) {
+	conn, err := net.DialTimeout("unix", socketPath, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	agentKeys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ssh-agent keys: %w", err)
+	}
+
+	var keys []ed25519.PublicKey
+	for _, agentKey := range agentKeys {
+		if agentKey.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+
+		publicKey, err := ssh.ParsePublicKey(agentKey.Marshal())
+		if err != nil {
+			continue
+		}
+		if cryptoKey, ok := publicKey.(ssh.CryptoPublicKey); ok {
+			if edKey, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey); ok {
+				keys = append(keys, edKey)
+			}
+		}
+	}
+
+	return keys, nil
+}
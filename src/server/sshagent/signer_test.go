@@ -0,0 +1,83 @@
+package sshagent
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// serveKeyring serves an in-memory agent on a unix socket, standing in for a local ssh-agent
+func serveKeyring(t *testing.T, keys ...ed25519.PrivateKey) string {
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatalf("failed to add key to agent: %s", err)
+		}
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on agent socket: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return socketPath
+}
+
+func TestSigner_SignsWithAgentKey(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	socketPath := serveKeyring(t, privateKey)
+
+	var signer crypto.Signer = NewSigner(socketPath, publicKey)
+	message := []byte("server hello")
+	signature, err := signer.Sign(rand.Reader, message, crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	if !ed25519.Verify(publicKey, message, signature) {
+		t.Errorf("expected signature to verify with the agent key")
+	}
+
+	if err = NewSigner(socketPath, publicKey).CheckKey(); err != nil {
+		t.Errorf("expected agent to hold the key: %s", err)
+	}
+}
+
+func TestSigner_UnknownKey(t *testing.T) {
+	_, agentKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherPublicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	socketPath := serveKeyring(t, agentKey)
+
+	signer := NewSigner(socketPath, otherPublicKey)
+	if err := signer.CheckKey(); err == nil {
+		t.Errorf("expected missing key to be reported")
+	}
+	if _, err := signer.Sign(rand.Reader, []byte("server hello"), crypto.Hash(0)); err == nil {
+		t.Errorf("expected signing with a missing key to fail")
+	}
+
+	keys, err := Ed25519Keys(socketPath)
+	if err != nil || len(keys) != 1 || !keys[0].Equal(agentKey.Public()) {
+		t.Errorf("expected the agent key to be listed, got %v (%v)", keys, err)
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// invitePrefix marks an invite code, so it is not mistaken for another base64 string
+const invitePrefix = "tungo-invite:"
+
+// Invite is what a new client needs for its first handshake: where the server is, its key and the invite token
+type Invite struct {
+	ServerTCPAddress string            `json:"ServerTCPAddress"`
+	ServerUDPAddress string            `json:"ServerUDPAddress,omitempty"`
+	Ed25519PublicKey ed25519.PublicKey `json:"Ed25519PublicKey"`
+	Id               []byte            `json:"Id"`
+	Secret           []byte            `json:"Secret"`
+}
+
+// Encode returns the invite code handed to the new client
+func (i *Invite) Encode() (string, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+
+	return invitePrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeInvite parses an invite code
+func DecodeInvite(code string) (*Invite, error) {
+	encoded, found := strings.CutPrefix(strings.TrimSpace(code), invitePrefix)
+	if !found {
+		return nil, fmt.Errorf("not an invite code")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite code: %s", err)
+	}
+
+	var invite Invite
+	err = json.Unmarshal(data, &invite)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite code: %s", err)
+	}
+
+	if invite.ServerTCPAddress == "" || len(invite.Ed25519PublicKey) != ed25519.PublicKeySize || len(invite.Id) == 0 || len(invite.Secret) == 0 {
+		return nil, fmt.Errorf("invalid invite code: incomplete")
+	}
+
+	return &invite, nil
+}
+
+// PrepareEnrollment fills in the server the invite code points at and generates the client key pair,
+// the server registers the key and returns the rest of the configuration in the first handshake
+func (s *Conf) PrepareEnrollment() error {
+	invite, err := DecodeInvite(s.InviteCode)
+	if err != nil {
+		return err
+	}
+
+	s.ServerTCPAddress = invite.ServerTCPAddress
+	s.ServerUDPAddress = invite.ServerUDPAddress
+	s.Ed25519PublicKey = invite.Ed25519PublicKey
+	if s.IfName == "" {
+		s.IfName = "ethatun0"
+	}
+	if s.Transport == UDPTransport && s.ServerUDPAddress == "" {
+		s.Transport = TCPTransport
+	}
+
+	// Every attempt enrolls a fresh key, as the key of an interrupted earlier attempt may be registered without the client knowing its pre-shared key
+	_, s.ClientEd25519PrivateKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate client ed25519 key pair: %s", err)
+	}
+
+	return s.RewriteConf()
+}
+
+// CompleteEnrollment takes over the configuration returned by the server, the client keeps its key and local settings
+func (s *Conf) CompleteEnrollment(enrolled *Conf) {
+	s.ServerTCPAddress = enrolled.ServerTCPAddress
+	s.ServerUDPAddress = enrolled.ServerUDPAddress
+	s.Ed25519PublicKey = enrolled.Ed25519PublicKey
+	s.ServerKeys = enrolled.ServerKeys
+	s.PresharedKey = enrolled.PresharedKey
+	s.ObfuscationKey = enrolled.ObfuscationKey
+	s.NotAfter = enrolled.NotAfter
+	s.InviteCode = ""
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestInvite_EncodeDecode(t *testing.T) {
+	serverKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	invite := &Invite{
+		ServerTCPAddress: "192.0.2.1:8080",
+		Ed25519PublicKey: serverKey,
+		Id:               []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Secret:           bytes.Repeat([]byte{9}, 32),
+	}
+
+	code, err := invite.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode invite: %s", err)
+	}
+
+	decoded, err := DecodeInvite(" " + code + "\n")
+	if err != nil {
+		t.Fatalf("failed to decode invite: %s", err)
+	}
+	if decoded.ServerTCPAddress != invite.ServerTCPAddress || !decoded.Ed25519PublicKey.Equal(serverKey) || !bytes.Equal(decoded.Secret, invite.Secret) {
+		t.Errorf("expected the invite to round trip, got %+v", decoded)
+	}
+
+	if _, err = DecodeInvite(code[len(invitePrefix):]); err == nil {
+		t.Errorf("expected a code without prefix to be rejected")
+	}
+}
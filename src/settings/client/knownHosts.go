@@ -0,0 +1,87 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// KnownHost is a server key trusted on first use
+type KnownHost struct {
+	Host             string            `json:"Host"`
+	Ed25519PublicKey ed25519.PublicKey `json:"Ed25519PublicKey"`
+	FirstSeen        time.Time         `json:"FirstSeen"`
+}
+
+// KnownHosts records the server keys trusted on first use, like the known_hosts file of SSH
+type KnownHosts struct {
+	Hosts []KnownHost `json:"Hosts"`
+}
+
+// Read reads the known hosts, a missing file is treated as an empty one
+func (k *KnownHosts) Read() (*KnownHosts, error) {
+	knownHostsPath, err := getKnownHostsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(knownHostsPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return k, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, k)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (k *KnownHosts) Rewrite() error {
+	knownHostsPath, err := getKnownHostsPath()
+	if err != nil {
+		return err
+	}
+
+	jsonContent, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(knownHostsPath, jsonContent, 0600)
+}
+
+// Find returns the key trusted for the host
+func (k *KnownHosts) Find(host string) (ed25519.PublicKey, bool) {
+	for _, knownHost := range k.Hosts {
+		if knownHost.Host == host {
+			return knownHost.Ed25519PublicKey, true
+		}
+	}
+
+	return nil, false
+}
+
+// Trust records the key of a host seen for the first time
+func (k *KnownHosts) Trust(host string, publicKey ed25519.PublicKey) {
+	k.Hosts = append(k.Hosts, KnownHost{
+		Host:             host,
+		Ed25519PublicKey: publicKey,
+		FirstSeen:        time.Now().UTC(),
+	})
+}
+
+func getKnownHostsPath() (string, error) {
+	confPath, err := getServerConfPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(confPath), "known_hosts.json"), nil
+}
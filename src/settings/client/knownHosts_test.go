@@ -0,0 +1,49 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownHosts_RoundTrip(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "src", "settings", "client"), 0700)
+	if err != nil {
+		t.Fatalf("failed to create settings directory: %s", err)
+	}
+	t.Chdir(filepath.Join(root, "src"))
+
+	knownHosts, err := (&KnownHosts{}).Read()
+	if err != nil {
+		t.Fatalf("expected missing known hosts to read as empty, got %s", err)
+	}
+	if _, ok := knownHosts.Find("192.0.2.1"); ok {
+		t.Fatalf("expected no known host")
+	}
+
+	serverKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	knownHosts.Trust("192.0.2.1", serverKey)
+	err = knownHosts.Rewrite()
+	if err != nil {
+		t.Fatalf("failed to write known hosts: %s", err)
+	}
+
+	reread, err := (&KnownHosts{}).Read()
+	if err != nil {
+		t.Fatalf("failed to read known hosts: %s", err)
+	}
+	key, ok := reread.Find("192.0.2.1")
+	if !ok || !key.Equal(serverKey) {
+		t.Errorf("expected the trusted key to be recorded, got %v", key)
+	}
+}
+
+func TestConf_ServerHost(t *testing.T) {
+	conf := &Conf{ServerTCPAddress: "192.0.2.1:8080", ServerUDPAddress: "192.0.2.1:9090", Transport: UDPTransport}
+	if host := conf.ServerHost(); host != "192.0.2.1" {
+		t.Errorf("expected the host without port, got %q", host)
+	}
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TLSConfig returns the configuration the client wraps its connection in TLS with. The server name is sent as SNI.
+// A pinned certificate fingerprint replaces the verification against the system roots, so a self-signed server
+// certificate is accepted, but no other certificate is.
+func (s *Conf) TLSConfig() (*tls.Config, error) {
+	serverName := s.TLSServerName
+	if serverName == "" {
+		serverName = s.ServerHost()
+	}
+
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if s.TLSCertificateSHA256 == "" {
+		return config, nil
+	}
+
+	pinned, err := hex.DecodeString(strings.ReplaceAll(s.TLSCertificateSHA256, ":", ""))
+	if err != nil || len(pinned) != sha256.Size {
+		return nil, fmt.Errorf("invalid tls certificate fingerprint: %s", s.TLSCertificateSHA256)
+	}
+
+	// The chain is not verified, the leaf certificate is compared to the pinned one instead
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server presented no tls certificate")
+		}
+		fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+		if !bytes.Equal(fingerprint[:], pinned) {
+			return fmt.Errorf("server tls certificate %s does not match the pinned one", hex.EncodeToString(fingerprint[:]))
+		}
+		return nil
+	}
+
+	return config, nil
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func newSelfSignedCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func handshakeWith(t *testing.T, certificate tls.Certificate, conf *Conf) error {
+	t.Helper()
+	clientConfig, err := conf.TLSConfig()
+	if err != nil {
+		t.Fatalf("failed to create tls config: %s", err)
+	}
+
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	go func() {
+		_ = tls.Server(serverSide, &tls.Config{Certificates: []tls.Certificate{certificate}}).Handshake()
+		_ = serverSide.Close()
+	}()
+
+	return tls.Client(clientSide, clientConfig).Handshake()
+}
+
+func TestConf_TLSConfigPinsCertificate(t *testing.T) {
+	certificate := newSelfSignedCertificate(t)
+	fingerprint := sha256.Sum256(certificate.Certificate[0])
+
+	pinned := &Conf{ServerTCPAddress: "192.0.2.1:443", TLSCertificateSHA256: hex.EncodeToString(fingerprint[:])}
+	if err := handshakeWith(t, certificate, pinned); err != nil {
+		t.Errorf("expected the pinned self-signed certificate to be accepted, got %s", err)
+	}
+
+	other := newSelfSignedCertificate(t)
+	if err := handshakeWith(t, other, pinned); err == nil {
+		t.Errorf("expected another certificate to be refused")
+	}
+
+	unpinned := &Conf{ServerTCPAddress: "192.0.2.1:443"}
+	if err := handshakeWith(t, certificate, unpinned); err == nil {
+		t.Errorf("expected an unpinned self-signed certificate to be refused")
+	}
+}
+
+func TestConf_TLSConfigServerName(t *testing.T) {
+	conf := &Conf{ServerTCPAddress: "vpn.example.com:443", Transport: TCPTransport}
+	if config, _ := conf.TLSConfig(); config.ServerName != "vpn.example.com" {
+		t.Errorf("expected the server host as SNI, got %q", config.ServerName)
+	}
+
+	conf.TLSServerName = "www.example.org"
+	if config, _ := conf.TLSConfig(); config.ServerName != "www.example.org" {
+		t.Errorf("expected the configured SNI, got %q", config.ServerName)
+	}
+
+	conf.TLSCertificateSHA256 = "not hex"
+	if _, err := conf.TLSConfig(); err == nil {
+		t.Errorf("expected an invalid fingerprint to be refused")
+	}
+}
@@ -5,31 +5,107 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 type Conf struct {
-	IfName                string             `json:"IfName"`
-	IfIP                  string             `json:"IfIP"`
-	TCPPort               string             `json:"TCPPort"`
+	IfName   string `json:"IfName"`
+	IfIP     string `json:"IfIP"`
+	IfIPv6   string `json:"IfIPv6"`
+	IPv4Pool string `json:"IPv4Pool"`
+	IPv6Pool string `json:"IPv6Pool"`
+	TCPPort  string `json:"TCPPort"`
+	UDPPort  string `json:"UDPPort"`
+	// WebSocketPath is the path clients upgrade to a WebSocket on, at TCPPort next to raw TCP clients, "/" if empty
+	WebSocketPath         string             `json:"WebSocketPath,omitempty"`
 	FallbackServerAddress string             `json:"FallbackServerAddress"`
 	Ed25519PublicKey      ed25519.PublicKey  `json:"Ed25519PublicKey"`
-	Ed25519PrivateKey     ed25519.PrivateKey `json:"Ed25519PrivateKey"`
-	ClientCounter         uint8              `json:"ClientCounter"`
+	Ed25519PrivateKey     ed25519.PrivateKey `json:"Ed25519PrivateKey,omitempty"` // kept in the keystore, see EncryptKeystore
+	Peers                 []Peer             `json:"Peers"`
+	// RevokedPeers are refused in the handshake and their active sessions are torn down
+	RevokedPeers []RevokedPeer `json:"RevokedPeers,omitempty"`
+	// SigningKeys are additional server keys with a validity period, used to rotate the key without breaking clients
+	SigningKeys []SigningKey `json:"SigningKeys,omitempty"`
+	// CipherSuites lists the allowed cipher suites in the order of preference, empty allows all of them
+	CipherSuites []string `json:"CipherSuites,omitempty"`
+	// Handshake flood protection, zero values pick the defaults
+	HandshakeRateLimitPerIP float64 `json:"HandshakeRateLimitPerIP,omitempty"` // handshakes per second per source address
+	HandshakeRateLimit      float64 `json:"HandshakeRateLimit,omitempty"`      // handshakes per second in total
+	HandshakeLoadThreshold  int     `json:"HandshakeLoadThreshold,omitempty"`  // handshakes in progress before cookies are required
+	// ResumptionTicketLifetimeSeconds is how long a session resumption ticket is valid, zero picks the default and -1 disables resumption
+	ResumptionTicketLifetimeSeconds int64 `json:"ResumptionTicketLifetimeSeconds,omitempty"`
+	// EncryptKeystore encrypts the keystore holding the server private keys with a passphrase asked for at startup
+	EncryptKeystore bool `json:"EncryptKeystore,omitempty"`
+	// SSHAgentSocket is the socket of a local ssh-agent signing with the server keys whose private keys are not in the keystore
+	SSHAgentSocket string `json:"SSHAgentSocket,omitempty"`
+	// InviteLifetimeSeconds is how long an enrollment invite can be redeemed, zero picks the default
+	InviteLifetimeSeconds int64 `json:"InviteLifetimeSeconds,omitempty"`
+	// ClientLifetimeSeconds limits how long generated and enrolled clients are allowed to connect, zero for no limit
+	ClientLifetimeSeconds int64 `json:"ClientLifetimeSeconds,omitempty"`
+	// TLS accepts clients wrapping the tunnel in TLS at TCPPort, next to the raw TCP and WebSocket ones
+	TLS bool `json:"TLS,omitempty"`
+	// TLSCertificateFile and TLSKeyFile are the PEM certificate chain and key of TLS, a self-signed certificate is generated without them
+	TLSCertificateFile string `json:"TLSCertificateFile,omitempty"`
+	TLSKeyFile         string `json:"TLSKeyFile,omitempty"`
+	// DecoyAddress is a service, such as a local web server, that connections to TCPPort which are not tunnel ones are spliced to
+	DecoyAddress string `json:"DecoyAddress,omitempty"`
+	// TLSDecoyAddress is a TLS service, such as the HTTPS port of a local web server, that TLS connections to TCPPort are
+	// spliced to before their ClientHello is answered, if it names none of TLSServerNames. These default to the DNS names
+	// of the certificate, a self-signed certificate has none.
+	TLSDecoyAddress string   `json:"TLSDecoyAddress,omitempty"`
+	TLSServerNames  []string `json:"TLSServerNames,omitempty"`
+	// ObfuscationKey accepts clients obfuscating their stream with it at TCPPort, clients without obfuscation are still accepted.
+	// ObfuscationPadding is the padding policy of the records the server sends, see obfuscation.PaddingPolicies
+	ObfuscationKey     []byte `json:"ObfuscationKey,omitempty"`
+	ObfuscationPadding string `json:"ObfuscationPadding,omitempty"`
+	// WireGuardUDPPort enables the WireGuard compatibility mode, stock WireGuard clients connect to it
+	WireGuardUDPPort string `json:"WireGuardUDPPort,omitempty"`
+	// WireGuardPeers are the WireGuard clients allowed to connect to WireGuardUDPPort
+	WireGuardPeers []WireGuardPeer `json:"WireGuardPeers,omitempty"`
 }
 
-func (s *Conf) InsertEdKeys(public ed25519.PublicKey, private ed25519.PrivateKey) error {
-	currentConf, err := s.Read()
-	currentConf.Ed25519PublicKey = public
-	currentConf.Ed25519PrivateKey = private
+// confMutex serializes the updates of conf.json, so enrollments and revocations running at the same time
+// do not write back a conf missing the changes of each other
+var confMutex sync.Mutex
 
-	err = s.RewriteConf()
+func (s *Conf) InsertEdKeys(public ed25519.PublicKey, private ed25519.PrivateKey) error {
+	updated, err := UpdateConf(func(conf *Conf) error {
+		conf.Ed25519PublicKey = public
+		conf.Ed25519PrivateKey = private
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	*s = *updated
 
 	return nil
 }
 
+// UpdateConf reads the conf, updates it and writes it back, nothing is written if the update fails.
+// Every update of conf.json goes through it, so no update is lost to a concurrent one.
+func UpdateConf(update func(conf *Conf) error) (*Conf, error) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+
+	conf, err := (&Conf{}).Read()
+	if err != nil {
+		return nil, err
+	}
+
+	err = update(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conf.RewriteConf()
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
 func (s *Conf) Read() (*Conf, error) {
 	confPath, err := getServerConfPath()
 	if err != nil {
@@ -41,7 +117,15 @@ func (s *Conf) Read() (*Conf, error) {
 		return nil, err
 	}
 
-	err = json.Unmarshal(data, s)
+	// Decoded into a fresh conf, so private keys held in memory are not taken for ones found in conf.json
+	var fromFile Conf
+	err = json.Unmarshal(data, &fromFile)
+	if err != nil {
+		return nil, err
+	}
+	*s = fromFile
+
+	err = s.attachPrivateKeys()
 	if err != nil {
 		return nil, err
 	}
@@ -49,29 +133,61 @@ func (s *Conf) Read() (*Conf, error) {
 	return s, nil
 }
 
+// RewriteConf writes the private keys to the keystore and the rest of the conf to conf.json
 func (s *Conf) RewriteConf() error {
+	err := s.storePrivateKeys()
+	if err != nil {
+		return err
+	}
+
+	return s.writeConf()
+}
+
+// writeConf writes conf.json without the private keys
+func (s *Conf) writeConf() error {
 	confPath, err := getServerConfPath()
 	if err != nil {
 		return err
 	}
 
-	jsonContent, err := json.MarshalIndent(s, "", "  ")
+	stripped := *s
+	stripped.Ed25519PrivateKey = nil
+	stripped.SigningKeys = make([]SigningKey, len(s.SigningKeys))
+	for i, key := range s.SigningKeys {
+		key.Ed25519PrivateKey = nil
+		stripped.SigningKeys[i] = key
+	}
+
+	jsonContent, err := json.MarshalIndent(&stripped, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	file, err := os.Create(confPath)
+	// Handshakes read conf.json concurrently, so it is written next to it and renamed over it rather than
+	// truncated in place, a reader then sees either the old or the new conf but never a partial one
+	file, err := os.CreateTemp(filepath.Dir(confPath), "conf.json.*.tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
 
 	_, err = file.Write(jsonContent)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
 	if err != nil {
 		return err
 	}
+	if closeErr != nil {
+		return closeErr
+	}
 
-	return nil
+	return os.Rename(tmpPath, confPath)
 }
 
 func getServerConfPath() (string, error) {
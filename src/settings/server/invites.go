@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultInviteLifetime is how long an invite can be redeemed if InviteLifetimeSeconds is not set
+const defaultInviteLifetime = time.Hour
+
+// ErrInviteNotFound is returned for an invite that does not exist, has expired, was revoked or was already redeemed
+var ErrInviteNotFound = errors.New("invite not found")
+
+// Invite is a single-use token a new client enrolls with, the client proves it holds the secret in its first handshake
+type Invite struct {
+	Id        string    `json:"Id"`
+	Secret    []byte    `json:"Secret"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	ExpiresAt time.Time `json:"ExpiresAt"`
+}
+
+// Invites is the database of pending invites
+type Invites struct {
+	Invites []Invite `json:"Invites"`
+}
+
+// invitesMutex serializes the updates of the invites database, so an invite is redeemed only once
+var invitesMutex sync.Mutex
+
+// InviteLifetime returns how long a new invite can be redeemed
+func (s *Conf) InviteLifetime() time.Duration {
+	if s.InviteLifetimeSeconds <= 0 {
+		return defaultInviteLifetime
+	}
+
+	return time.Duration(s.InviteLifetimeSeconds) * time.Second
+}
+
+// AddInvite stores a new invite
+func AddInvite(invite Invite) error {
+	return updateInvites(time.Now(), func(invites *Invites) error {
+		if slices.ContainsFunc(invites.Invites, func(i Invite) bool { return i.Id == invite.Id }) {
+			return fmt.Errorf("duplicate invite id: %s", invite.Id)
+		}
+		invites.Invites = append(invites.Invites, invite)
+		return nil
+	})
+}
+
+// PendingInvites returns the invites which can still be redeemed
+func PendingInvites(now time.Time) ([]Invite, error) {
+	invitesMutex.Lock()
+	defer invitesMutex.Unlock()
+
+	invites, err := readPendingInvites(now)
+	if err != nil {
+		return nil, err
+	}
+
+	return invites.Invites, nil
+}
+
+// FindInvite returns a pending invite without redeeming it
+func FindInvite(id string, now time.Time) (*Invite, error) {
+	pending, err := PendingInvites(now)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pending {
+		if pending[i].Id == id {
+			return &pending[i], nil
+		}
+	}
+
+	return nil, ErrInviteNotFound
+}
+
+// RedeemInvite removes a pending invite, it fails if the invite was redeemed in the meantime
+func RedeemInvite(id string, now time.Time) error {
+	return removeInvite(id, now)
+}
+
+// RevokeInvite removes a pending invite, so it can no longer be redeemed
+func RevokeInvite(id string) error {
+	return removeInvite(id, time.Now())
+}
+
+func removeInvite(id string, now time.Time) error {
+	return updateInvites(now, func(invites *Invites) error {
+		index := slices.IndexFunc(invites.Invites, func(i Invite) bool { return i.Id == id })
+		if index < 0 {
+			return ErrInviteNotFound
+		}
+		invites.Invites = slices.Delete(invites.Invites, index, index+1)
+		return nil
+	})
+}
+
+// updateInvites updates the pending invites and writes them back, the expired ones are forgotten on the way
+func updateInvites(now time.Time, update func(invites *Invites) error) error {
+	invitesMutex.Lock()
+	defer invitesMutex.Unlock()
+
+	invites, err := readPendingInvites(now)
+	if err != nil {
+		return err
+	}
+
+	err = update(invites)
+	if err != nil {
+		return err
+	}
+
+	return invites.Rewrite()
+}
+
+// readPendingInvites reads the invites without the expired ones, the mutex must be held
+func readPendingInvites(now time.Time) (*Invites, error) {
+	invites, err := (&Invites{}).Read()
+	if err != nil {
+		return nil, err
+	}
+
+	invites.Invites = slices.DeleteFunc(invites.Invites, func(i Invite) bool {
+		return !now.Before(i.ExpiresAt)
+	})
+
+	return invites, nil
+}
+
+// Read reads the invites database, a missing database is treated as an empty one
+func (i *Invites) Read() (*Invites, error) {
+	invitesPath, err := getInvitesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(invitesPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return i, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, i)
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func (i *Invites) Rewrite() error {
+	invitesPath, err := getInvitesPath()
+	if err != nil {
+		return err
+	}
+
+	jsonContent, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(invitesPath, jsonContent, 0600)
+}
+
+func getInvitesPath() (string, error) {
+	confPath, err := getServerConfPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(confPath), "invites.json"), nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInvites_RedeemOnce(t *testing.T) {
+	useTempConfDir(t)
+	now := time.Now()
+
+	err := AddInvite(Invite{Id: "a1", Secret: []byte("secret"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("failed to add invite: %s", err)
+	}
+
+	if _, err = FindInvite("a1", now); err != nil {
+		t.Fatalf("expected the invite to be pending, got %s", err)
+	}
+	if err = RedeemInvite("a1", now); err != nil {
+		t.Fatalf("failed to redeem invite: %s", err)
+	}
+	if err = RedeemInvite("a1", now); !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("expected the invite to be redeemed only once, got %v", err)
+	}
+}
+
+func TestInvites_ExpireAndRevoke(t *testing.T) {
+	useTempConfDir(t)
+	now := time.Now()
+
+	_ = AddInvite(Invite{Id: "short", ExpiresAt: now.Add(time.Minute)})
+	_ = AddInvite(Invite{Id: "long", ExpiresAt: now.Add(time.Hour)})
+
+	pending, err := PendingInvites(now.Add(2 * time.Minute))
+	if err != nil {
+		t.Fatalf("failed to list invites: %s", err)
+	}
+	if len(pending) != 1 || pending[0].Id != "long" {
+		t.Errorf("expected only the long invite to be pending, got %v", pending)
+	}
+
+	if err = RevokeInvite("long"); err != nil {
+		t.Fatalf("failed to revoke invite: %s", err)
+	}
+	if _, err = FindInvite("long", now); !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("expected the revoked invite to be gone, got %v", err)
+	}
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const (
+	// KeystorePassphraseEnv holds the keystore passphrase
+	KeystorePassphraseEnv = "TUNGO_KEYSTORE_PASSPHRASE"
+	// KeystorePassphraseFdEnv holds the number of an inherited file descriptor the keystore passphrase is read from
+	KeystorePassphraseFdEnv = "TUNGO_KEYSTORE_PASSPHRASE_FD"
+
+	keystoreVersion = 1
+	keystoreKDF     = "argon2id"
+	// argon2id parameters of newly encrypted keystores, the ones a keystore was encrypted with are stored in it
+	keystoreKDFTime     = 3
+	keystoreKDFMemory   = 64 * 1024 // KiB
+	keystoreKDFThreads  = 4
+	maxPassphraseLength = 1024
+)
+
+// ErrKeystoreLocked is returned when the keystore is encrypted and no passphrase is given
+var ErrKeystoreLocked = errors.New("server keystore is encrypted, but no passphrase is given")
+
+// keystoreFile is the file the server private keys are kept in, apart from conf.json.
+// An encrypted keystore holds the keys sealed with a key derived from the passphrase, a plaintext one holds them as is.
+type keystoreFile struct {
+	Version    int                  `json:"Version"`
+	Keys       []ed25519.PrivateKey `json:"Keys,omitempty"`
+	KDF        string               `json:"KDF,omitempty"`
+	Salt       []byte               `json:"Salt,omitempty"`
+	Time       uint32               `json:"Time,omitempty"`
+	Memory     uint32               `json:"Memory,omitempty"`
+	Threads    uint8                `json:"Threads,omitempty"`
+	Nonce      []byte               `json:"Nonce,omitempty"`
+	Ciphertext []byte               `json:"Ciphertext,omitempty"`
+}
+
+// keystore caches the unlocked keystore, so the passphrase is asked for once per process
+var keystore struct {
+	mu         sync.Mutex
+	loaded     bool
+	keys       []ed25519.PrivateKey
+	passphrase []byte // nil while the keystore is kept in plaintext
+}
+
+// attachPrivateKeys fills in the private keys of the conf from the keystore.
+// Private keys still found in conf.json are moved to the keystore, and the conf is rewritten without them.
+func (s *Conf) attachPrivateKeys() error {
+	keystore.mu.Lock()
+	defer keystore.mu.Unlock()
+
+	err := loadKeystore()
+	if err != nil {
+		return err
+	}
+
+	plaintextKeys := s.privateKeys()
+	if len(plaintextKeys) > 0 {
+		for _, key := range plaintextKeys {
+			if findPrivateKey(keystore.keys, key.Public().(ed25519.PublicKey)) == nil {
+				keystore.keys = append(keystore.keys, key)
+			}
+		}
+		err = saveKeystore(keystore.keys, s.EncryptKeystore)
+		if err != nil {
+			return fmt.Errorf("failed to move private keys to the keystore: %w", err)
+		}
+		err = s.writeConf()
+		if err != nil {
+			return err
+		}
+		log.Printf("server private keys are moved from conf.json to the keystore")
+	} else if keystore.passphrase == nil && s.EncryptKeystore && len(keystore.keys) > 0 {
+		// A plaintext keystore is encrypted once encryption is turned on
+		err = saveKeystore(keystore.keys, true)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt the keystore: %w", err)
+		}
+	}
+
+	s.Ed25519PrivateKey = findPrivateKey(keystore.keys, s.Ed25519PublicKey)
+	for i := range s.SigningKeys {
+		s.SigningKeys[i].Ed25519PrivateKey = findPrivateKey(keystore.keys, s.SigningKeys[i].Ed25519PublicKey)
+	}
+
+	return nil
+}
+
+// storePrivateKeys writes the private keys of the conf to the keystore, unless it already holds exactly these keys
+func (s *Conf) storePrivateKeys() error {
+	keystore.mu.Lock()
+	defer keystore.mu.Unlock()
+
+	err := loadKeystore()
+	if err != nil {
+		return err
+	}
+
+	keys := s.privateKeys()
+	if slices.EqualFunc(keys, keystore.keys, func(a, b ed25519.PrivateKey) bool { return a.Equal(b) }) {
+		return nil
+	}
+
+	return saveKeystore(keys, s.EncryptKeystore)
+}
+
+// privateKeys returns the private keys held by the conf
+func (s *Conf) privateKeys() []ed25519.PrivateKey {
+	var keys []ed25519.PrivateKey
+	if len(s.Ed25519PrivateKey) == ed25519.PrivateKeySize {
+		keys = append(keys, s.Ed25519PrivateKey)
+	}
+
+	for _, key := range s.SigningKeys {
+		if len(key.Ed25519PrivateKey) == ed25519.PrivateKeySize {
+			keys = append(keys, key.Ed25519PrivateKey)
+		}
+	}
+
+	return keys
+}
+
+func findPrivateKey(keys []ed25519.PrivateKey, publicKey ed25519.PublicKey) ed25519.PrivateKey {
+	if len(publicKey) == 0 {
+		return nil
+	}
+
+	for _, key := range keys {
+		if publicKey.Equal(key.Public()) {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// loadKeystore reads and unlocks the keystore once, a missing keystore is treated as an empty one.
+// The keystore lock must be held.
+func loadKeystore() error {
+	if keystore.loaded {
+		return nil
+	}
+
+	keystorePath, err := getKeystorePath()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(keystorePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			keystore.loaded = true
+			return nil
+		}
+		return err
+	}
+
+	var file keystoreFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return fmt.Errorf("invalid keystore: %w", err)
+	}
+
+	if file.Version != keystoreVersion {
+		return fmt.Errorf("unsupported keystore version: %d", file.Version)
+	}
+
+	if file.KDF == "" {
+		keystore.keys = file.Keys
+		keystore.loaded = true
+		return nil
+	}
+
+	passphrase, err := keystorePassphrase(true)
+	if err != nil {
+		return err
+	}
+
+	keys, err := openKeystore(&file, passphrase)
+	if err != nil {
+		return err
+	}
+
+	keystore.keys = keys
+	keystore.passphrase = passphrase
+	keystore.loaded = true
+	return nil
+}
+
+// saveKeystore writes the keys to the keystore, encrypted if it was encrypted before,
+// if encryption is turned on in the conf or if a passphrase is given in the environment.
+// The keystore lock must be held.
+func saveKeystore(keys []ed25519.PrivateKey, encrypt bool) error {
+	passphrase := keystore.passphrase
+	if passphrase == nil {
+		var err error
+		passphrase, err = keystorePassphrase(encrypt)
+		if err != nil && !(errors.Is(err, ErrKeystoreLocked) && !encrypt) {
+			return err
+		}
+	}
+
+	file := keystoreFile{Version: keystoreVersion, Keys: keys}
+	if passphrase != nil {
+		sealed, err := sealKeystore(keys, passphrase)
+		if err != nil {
+			return err
+		}
+		file = *sealed
+	}
+
+	jsonContent, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	keystorePath, err := getKeystorePath()
+	if err != nil {
+		return err
+	}
+
+	// Written next to the keystore and renamed over it, so a crash never leaves a truncated keystore behind
+	tmpPath := keystorePath + ".tmp"
+	err = os.WriteFile(tmpPath, jsonContent, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, keystorePath)
+	if err != nil {
+		return err
+	}
+
+	keystore.keys = keys
+	keystore.passphrase = passphrase
+	keystore.loaded = true
+	return nil
+}
+
+func sealKeystore(keys []ed25519.PrivateKey, passphrase []byte) (*keystoreFile, error) {
+	file := &keystoreFile{
+		Version: keystoreVersion,
+		KDF:     keystoreKDF,
+		Salt:    make([]byte, 16),
+		Time:    keystoreKDFTime,
+		Memory:  keystoreKDFMemory,
+		Threads: keystoreKDFThreads,
+		Nonce:   make([]byte, chacha20poly1305.NonceSizeX),
+	}
+	_, err := rand.Read(file.Salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(file.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(file.deriveKey(passphrase))
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, file.additionalData())
+	return file, nil
+}
+
+func openKeystore(file *keystoreFile, passphrase []byte) ([]ed25519.PrivateKey, error) {
+	if file.KDF != keystoreKDF {
+		return nil, fmt.Errorf("unsupported keystore KDF: %s", file.KDF)
+	}
+
+	aead, err := chacha20poly1305.NewX(file.deriveKey(passphrase))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid keystore nonce")
+	}
+
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, file.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock the keystore: wrong passphrase or corrupted keystore")
+	}
+
+	var keys []ed25519.PrivateKey
+	err = json.Unmarshal(plaintext, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keystore: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (f *keystoreFile) deriveKey(passphrase []byte) []byte {
+	return argon2.IDKey(passphrase, f.Salt, f.Time, f.Memory, f.Threads, chacha20poly1305.KeySize)
+}
+
+// additionalData binds the KDF parameters to the ciphertext, so they cannot be weakened unnoticed
+func (f *keystoreFile) additionalData() []byte {
+	return fmt.Appendf(nil, "%d|%s|%x|%d|%d|%d", f.Version, f.KDF, f.Salt, f.Time, f.Memory, f.Threads)
+}
+
+// keystorePassphrase reads the passphrase from the environment or an inherited file descriptor,
+// and from the terminal if prompt is set. ErrKeystoreLocked is returned if none is given.
+func keystorePassphrase(prompt bool) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(KeystorePassphraseEnv); ok && passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if fdValue, ok := os.LookupEnv(KeystorePassphraseFdEnv); ok {
+		fd, err := strconv.Atoi(fdValue)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", KeystorePassphraseFdEnv, fdValue)
+		}
+		file := os.NewFile(uintptr(fd), "passphrase")
+		defer file.Close()
+		return readPassphraseLine(file)
+	}
+
+	if prompt {
+		passphrase, err := readPassphraseFromTerminal()
+		if err == nil {
+			return passphrase, nil
+		}
+	}
+
+	return nil, ErrKeystoreLocked
+}
+
+// readPassphraseFromTerminal reads the passphrase from stdin with echo turned off
+func readPassphraseFromTerminal() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("stdin is not a terminal")
+	}
+
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	err = unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+		_, _ = fmt.Fprintln(os.Stderr)
+	}()
+
+	_, _ = fmt.Fprint(os.Stderr, "Server keystore passphrase: ")
+	return readPassphraseLine(os.Stdin)
+}
+
+// readPassphraseLine reads up to the end of the first line one byte at a time,
+// so nothing after the passphrase is consumed from a shared input
+func readPassphraseLine(file *os.File) ([]byte, error) {
+	var passphrase []byte
+	b := make([]byte, 1)
+	for {
+		n, err := file.Read(b)
+		if n == 0 || b[0] == '\n' {
+			if err != nil && len(passphrase) == 0 {
+				return nil, fmt.Errorf("failed to read keystore passphrase: %w", err)
+			}
+			break
+		}
+		// A longer passphrase is refused rather than cut short, one byte more is read for a trailing carriage return
+		if len(passphrase) > maxPassphraseLength {
+			return nil, fmt.Errorf("keystore passphrase is longer than %d bytes", maxPassphraseLength)
+		}
+		passphrase = append(passphrase, b[0])
+	}
+
+	passphrase = bytes.TrimSuffix(passphrase, []byte("\r"))
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty keystore passphrase")
+	}
+	if len(passphrase) > maxPassphraseLength {
+		return nil, fmt.Errorf("keystore passphrase is longer than %d bytes", maxPassphraseLength)
+	}
+
+	return passphrase, nil
+}
+
+func getKeystorePath() (string, error) {
+	confPath, err := getServerConfPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(confPath), "keystore.json"), nil
+}
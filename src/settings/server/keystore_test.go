@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempConfDir points the conf path to a temporary directory and forgets the cached keystore
+func useTempConfDir(t *testing.T) string {
+	root := t.TempDir()
+	confDir := filepath.Join(root, "src", "settings", "server")
+	if err := os.MkdirAll(confDir, 0700); err != nil {
+		t.Fatalf("failed to create conf dir: %s", err)
+	}
+	workDir := filepath.Join(root, "bin")
+	if err := os.Mkdir(workDir, 0700); err != nil {
+		t.Fatalf("failed to create work dir: %s", err)
+	}
+	t.Chdir(workDir)
+
+	keystore.loaded, keystore.keys, keystore.passphrase = false, nil, nil
+	return confDir
+}
+
+func TestKeystore_SealAndOpen(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+
+	file, err := sealKeystore([]ed25519.PrivateKey{private}, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("failed to seal keystore: %s", err)
+	}
+
+	keys, err := openKeystore(file, []byte("passphrase"))
+	if err != nil || len(keys) != 1 || !keys[0].Equal(private) {
+		t.Fatalf("failed to open keystore: %v", err)
+	}
+
+	if _, err = openKeystore(file, []byte("wrong")); err == nil {
+		t.Errorf("expected wrong passphrase to be rejected")
+	}
+
+	// Weakening the KDF parameters is noticed
+	file.Time = 1
+	if _, err = openKeystore(file, []byte("passphrase")); err == nil {
+		t.Errorf("expected altered KDF parameters to be rejected")
+	}
+}
+
+func TestConf_MigratesPrivateKeyToEncryptedKeystore(t *testing.T) {
+	confDir := useTempConfDir(t)
+	t.Setenv(KeystorePassphraseEnv, "passphrase")
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	plaintextConf, _ := json.Marshal(map[string]any{"Ed25519PublicKey": public, "Ed25519PrivateKey": private})
+	if err := os.WriteFile(filepath.Join(confDir, "conf.json"), plaintextConf, 0600); err != nil {
+		t.Fatalf("failed to write conf: %s", err)
+	}
+
+	conf, err := (&Conf{}).Read()
+	if err != nil {
+		t.Fatalf("failed to read conf: %s", err)
+	}
+	if !conf.Ed25519PrivateKey.Equal(private) {
+		t.Fatalf("expected private key to be attached")
+	}
+
+	confData, _ := os.ReadFile(filepath.Join(confDir, "conf.json"))
+	if bytes.Contains(confData, []byte("Ed25519PrivateKey")) {
+		t.Errorf("expected private key to be removed from conf.json")
+	}
+
+	info, err := os.Stat(filepath.Join(confDir, "keystore.json"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected keystore with 0600 permissions, got %v (%v)", info, err)
+	}
+	keystoreData, _ := os.ReadFile(filepath.Join(confDir, "keystore.json"))
+	var file keystoreFile
+	_ = json.Unmarshal(keystoreData, &file)
+	if file.KDF != keystoreKDF || len(file.Keys) != 0 {
+		t.Errorf("expected keystore to be encrypted")
+	}
+
+	// A restarted server unlocks the keystore with the passphrase
+	keystore.loaded, keystore.keys, keystore.passphrase = false, nil, nil
+	conf, err = (&Conf{}).Read()
+	if err != nil || !conf.Ed25519PrivateKey.Equal(private) {
+		t.Fatalf("failed to unlock keystore: %v", err)
+	}
+
+	keystore.loaded, keystore.keys, keystore.passphrase = false, nil, nil
+	t.Setenv(KeystorePassphraseEnv, "wrong")
+	if _, err = (&Conf{}).Read(); err == nil {
+		t.Errorf("expected wrong passphrase to be rejected")
+	}
+}
+
+func TestReadPassphraseLine_RefusesTooLong(t *testing.T) {
+	passphrasePath := filepath.Join(t.TempDir(), "passphrase")
+	for length, refused := range map[int]bool{maxPassphraseLength: false, maxPassphraseLength + 1: true} {
+		line := append(bytes.Repeat([]byte("a"), length), "\r\n"...)
+		if err := os.WriteFile(passphrasePath, line, 0600); err != nil {
+			t.Fatalf("failed to write passphrase: %s", err)
+		}
+		file, err := os.Open(passphrasePath)
+		if err != nil {
+			t.Fatalf("failed to open passphrase: %s", err)
+		}
+
+		passphrase, err := readPassphraseLine(file)
+		_ = file.Close()
+		if refused && err == nil {
+			t.Errorf("expected a passphrase of %d bytes to be refused", length)
+		}
+		if !refused && len(passphrase) != length {
+			t.Errorf("expected a passphrase of %d bytes to be read, got %d bytes, %v", length, len(passphrase), err)
+		}
+	}
+}
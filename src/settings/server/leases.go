@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Lease is a tunnel address assignment of a peer, kept between server restarts
+type Lease struct {
+	Ed25519PublicKey ed25519.PublicKey `json:"Ed25519PublicKey"`
+	IPv4             string            `json:"IPv4,omitempty"`
+	IPv6             string            `json:"IPv6,omitempty"`
+	Expires          time.Time         `json:"Expires"`
+}
+
+// Leases is the lease database of the server
+type Leases struct {
+	Leases []Lease `json:"Leases"`
+}
+
+// Read reads the lease database, a missing database is treated as an empty one
+func (l *Leases) Read() (*Leases, error) {
+	leasesPath, err := getLeasesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(leasesPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return l, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Leases) Rewrite() error {
+	leasesPath, err := getLeasesPath()
+	if err != nil {
+		return err
+	}
+
+	jsonContent, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(leasesPath, jsonContent, 0600)
+}
+
+func getLeasesPath() (string, error) {
+	confPath, err := getServerConfPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(confPath), "leases.json"), nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Peer is a client which is allowed to connect to the server.
+// To revoke the access of a client, add it to RevokedPeers, or remove its entry from the server configuration.
+// StaticIPv4 and StaticIPv6 optionally reserve tunnel addresses for the client.
+// PresharedKey is optional and must match the one in the client configuration.
+// NotAfter optionally limits how long the client is allowed to connect.
+type Peer struct {
+	Ed25519PublicKey ed25519.PublicKey `json:"Ed25519PublicKey"`
+	StaticIPv4       string            `json:"StaticIPv4,omitempty"`
+	StaticIPv6       string            `json:"StaticIPv6,omitempty"`
+	PresharedKey     []byte            `json:"PresharedKey,omitempty"`
+	NotAfter         time.Time         `json:"NotAfter,omitzero"`
+}
+
+// RevokedPeer is a client key which is refused even if it is listed in the peers again
+type RevokedPeer struct {
+	Ed25519PublicKey ed25519.PublicKey `json:"Ed25519PublicKey"`
+	RevokedAt        time.Time         `json:"RevokedAt"`
+}
+
+var (
+	// ErrUnknownPeer is returned for a client key which is not listed in the server peers
+	ErrUnknownPeer = errors.New("client public key is not allowed")
+	// ErrPeerRevoked is returned for a client key on the revocation list
+	ErrPeerRevoked = errors.New("client public key is revoked")
+	// ErrPeerExpired is returned for a client whose access has expired
+	ErrPeerExpired = errors.New("client access has expired")
+)
+
+// revocationListeners are told about revoked clients, so their active sessions are torn down at once
+var revocationListeners struct {
+	sync.Mutex
+	listeners []func(publicKey ed25519.PublicKey)
+}
+
+// FindPeer looks up an allowed peer by its ed25519 public key
+func (s *Conf) FindPeer(publicKey ed25519.PublicKey) (*Peer, bool) {
+	for i := range s.Peers {
+		if s.Peers[i].Ed25519PublicKey.Equal(publicKey) {
+			return &s.Peers[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// AuthorizePeer looks up the peer of a client key and checks it is neither revoked nor expired
+func (s *Conf) AuthorizePeer(publicKey ed25519.PublicKey, now time.Time) (*Peer, error) {
+	if s.IsRevoked(publicKey) {
+		return nil, fmt.Errorf("%w: %s", ErrPeerRevoked, base64.StdEncoding.EncodeToString(publicKey))
+	}
+
+	peer, found := s.FindPeer(publicKey)
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, base64.StdEncoding.EncodeToString(publicKey))
+	}
+
+	if !peer.NotAfter.IsZero() && !now.Before(peer.NotAfter) {
+		return nil, fmt.Errorf("%w: %s at %s", ErrPeerExpired, base64.StdEncoding.EncodeToString(publicKey), peer.NotAfter.Format(time.RFC3339))
+	}
+
+	return peer, nil
+}
+
+// IsRevoked reports whether the client key is on the revocation list
+func (s *Conf) IsRevoked(publicKey ed25519.PublicKey) bool {
+	return slices.ContainsFunc(s.RevokedPeers, func(revoked RevokedPeer) bool {
+		return revoked.Ed25519PublicKey.Equal(publicKey)
+	})
+}
+
+// RevokePeer puts the client key on the revocation list and tells the listeners, so active sessions of the client end
+func RevokePeer(publicKey ed25519.PublicKey) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid client public key")
+	}
+
+	_, err := UpdateConf(func(conf *Conf) error {
+		if !conf.IsRevoked(publicKey) {
+			conf.RevokedPeers = append(conf.RevokedPeers, RevokedPeer{Ed25519PublicKey: publicKey, RevokedAt: time.Now().UTC()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	revocationListeners.Lock()
+	listeners := slices.Clone(revocationListeners.listeners)
+	revocationListeners.Unlock()
+	for _, listener := range listeners {
+		listener(publicKey)
+	}
+
+	return nil
+}
+
+// OnPeerRevoked registers a listener called with every client key revoked through RevokePeer
+func OnPeerRevoked(listener func(publicKey ed25519.PublicKey)) {
+	revocationListeners.Lock()
+	defer revocationListeners.Unlock()
+	revocationListeners.listeners = append(revocationListeners.listeners, listener)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConf_AuthorizePeer(t *testing.T) {
+	allowed, _, _ := ed25519.GenerateKey(rand.Reader)
+	expiring, _, _ := ed25519.GenerateKey(rand.Reader)
+	revoked, _, _ := ed25519.GenerateKey(rand.Reader)
+	unknown, _, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Unix(1000, 0)
+	conf := &Conf{
+		Peers: []Peer{
+			{Ed25519PublicKey: allowed},
+			{Ed25519PublicKey: expiring, NotAfter: time.Unix(2000, 0)},
+			{Ed25519PublicKey: revoked},
+		},
+		RevokedPeers: []RevokedPeer{{Ed25519PublicKey: revoked}},
+	}
+
+	if _, err := conf.AuthorizePeer(allowed, now); err != nil {
+		t.Errorf("expected the peer to be allowed, got %s", err)
+	}
+	if _, err := conf.AuthorizePeer(expiring, now); err != nil {
+		t.Errorf("expected the peer to be allowed before it expires, got %s", err)
+	}
+	if _, err := conf.AuthorizePeer(expiring, time.Unix(2000, 0)); !errors.Is(err, ErrPeerExpired) {
+		t.Errorf("expected the peer to be expired, got %v", err)
+	}
+	if _, err := conf.AuthorizePeer(revoked, now); !errors.Is(err, ErrPeerRevoked) {
+		t.Errorf("expected the listed peer to stay revoked, got %v", err)
+	}
+	if _, err := conf.AuthorizePeer(unknown, now); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("expected the peer to be unknown, got %v", err)
+	}
+}
+
+func TestRevokePeer_TellsListeners(t *testing.T) {
+	confDir := useTempConfDir(t)
+	if err := os.WriteFile(filepath.Join(confDir, "conf.json"), []byte(`{"Peers": []}`), 0600); err != nil {
+		t.Fatalf("failed to write conf: %s", err)
+	}
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	var told ed25519.PublicKey
+	OnPeerRevoked(func(revoked ed25519.PublicKey) {
+		told = revoked
+	})
+	if err := RevokePeer(publicKey); err != nil {
+		t.Fatalf("failed to revoke peer: %s", err)
+	}
+	if !told.Equal(publicKey) {
+		t.Errorf("expected the listener to be told about the revoked key")
+	}
+
+	conf, err := (&Conf{}).Read()
+	if err != nil {
+		t.Fatalf("failed to read conf: %s", err)
+	}
+	if !conf.IsRevoked(publicKey) {
+		t.Errorf("expected the key to be on the revocation list")
+	}
+}
+
+func TestUpdateConf_KeepsConcurrentUpdates(t *testing.T) {
+	confDir := useTempConfDir(t)
+	if err := os.WriteFile(filepath.Join(confDir, "conf.json"), []byte(`{"Peers": []}`), 0600); err != nil {
+		t.Fatalf("failed to write conf: %s", err)
+	}
+	revoked, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+			_, err := UpdateConf(func(conf *Conf) error {
+				conf.Peers = append(conf.Peers, Peer{Ed25519PublicKey: publicKey})
+				return nil
+			})
+			if err != nil {
+				t.Errorf("failed to add peer: %s", err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := RevokePeer(revoked); err != nil {
+			t.Errorf("failed to revoke peer: %s", err)
+		}
+	}()
+	wg.Wait()
+
+	conf, err := (&Conf{}).Read()
+	if err != nil {
+		t.Fatalf("failed to read conf: %s", err)
+	}
+	if len(conf.Peers) != 8 || !conf.IsRevoked(revoked) {
+		t.Errorf("expected every peer and the revocation to be kept, got %d peers, revoked %v", len(conf.Peers), conf.IsRevoked(revoked))
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SigningKey is a server Ed25519 key pair valid from NotBefore until NotAfter, a zero time leaves that end open.
+// Keys are rotated by adding the next key before the current one expires, so clients learn it in time.
+// An entry without a key pair gets one generated on the next server startup,
+// an entry with a public key only is signed with by an external signer, see RegisterSigner.
+type SigningKey struct {
+	Ed25519PublicKey  ed25519.PublicKey  `json:"Ed25519PublicKey"`
+	Ed25519PrivateKey ed25519.PrivateKey `json:"Ed25519PrivateKey,omitempty"`
+	NotBefore         time.Time          `json:"NotBefore,omitzero"`
+	NotAfter          time.Time          `json:"NotAfter,omitzero"`
+}
+
+// externalSigners are the signers registered for keys whose private key is held outside the server process
+var externalSigners sync.Map // string(public key) to crypto.Signer map
+
+// RegisterSigner makes handshakes signed with the key of the signer go through it,
+// so the private key of that key need not be in the conf or the keystore
+func RegisterSigner(signer crypto.Signer) error {
+	publicKey, ok := signer.Public().(ed25519.PublicKey)
+	if !ok || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("signer does not hold an ed25519 key")
+	}
+
+	externalSigners.Store(string(publicKey), signer)
+	return nil
+}
+
+// Signer returns what signs with the key: its private key, or the signer registered for it
+func (k *SigningKey) Signer() (crypto.Signer, error) {
+	if len(k.Ed25519PrivateKey) == ed25519.PrivateKeySize {
+		return k.Ed25519PrivateKey, nil
+	}
+
+	if signer, ok := externalSigners.Load(string(k.Ed25519PublicKey)); ok {
+		return signer.(crypto.Signer), nil
+	}
+
+	return nil, fmt.Errorf("no private key or signer for the server key")
+}
+
+func (k *SigningKey) hasSigner() bool {
+	_, err := k.Signer()
+	return err == nil
+}
+
+// ValidAt reports whether the key may sign handshakes at the given time
+func (k *SigningKey) ValidAt(now time.Time) bool {
+	if !k.NotBefore.IsZero() && now.Before(k.NotBefore) {
+		return false
+	}
+
+	return k.NotAfter.IsZero() || now.Before(k.NotAfter)
+}
+
+// AllSigningKeys returns the signing keys of the server which can sign, the Ed25519 key pair of the conf root first
+func (s *Conf) AllSigningKeys() []SigningKey {
+	keys := make([]SigningKey, 0, 1+len(s.SigningKeys))
+	rootKey := SigningKey{
+		Ed25519PublicKey:  s.Ed25519PublicKey,
+		Ed25519PrivateKey: s.Ed25519PrivateKey,
+	}
+	if len(rootKey.Ed25519PublicKey) > 0 && rootKey.hasSigner() {
+		keys = append(keys, rootKey)
+	}
+
+	for _, key := range s.SigningKeys {
+		if len(key.Ed25519PublicKey) > 0 && key.hasSigner() {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// SelectSigningKey picks the key a handshake is signed with: the newest valid key the client pins,
+// or the longest valid one for clients that do not tell which keys they pin, as those pin the oldest key
+func (s *Conf) SelectSigningKey(now time.Time, isPinned func(ed25519.PublicKey) bool) (*SigningKey, error) {
+	var oldest, newestPinned *SigningKey
+	keys := s.AllSigningKeys()
+	for i := range keys {
+		key := &keys[i]
+		if !key.ValidAt(now) {
+			continue
+		}
+
+		if oldest == nil || key.NotBefore.Before(oldest.NotBefore) {
+			oldest = key
+		}
+
+		if isPinned != nil && isPinned(key.Ed25519PublicKey) && (newestPinned == nil || key.NotBefore.After(newestPinned.NotBefore)) {
+			newestPinned = key
+		}
+	}
+
+	if newestPinned != nil {
+		return newestPinned, nil
+	}
+
+	if oldest == nil {
+		return nil, fmt.Errorf("no valid signing key")
+	}
+
+	return oldest, nil
+}
+
+// UpcomingSigningKeys returns the keys which are valid or will become valid, the ones clients should pin
+func (s *Conf) UpcomingSigningKeys(now time.Time) []SigningKey {
+	var upcoming []SigningKey
+	for _, key := range s.AllSigningKeys() {
+		if key.NotAfter.IsZero() || now.Before(key.NotAfter) {
+			upcoming = append(upcoming, key)
+		}
+	}
+
+	return upcoming
+}
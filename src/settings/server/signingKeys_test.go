@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func newSigningKey(t *testing.T, notBefore, notAfter time.Time) SigningKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	return SigningKey{Ed25519PublicKey: public, Ed25519PrivateKey: private, NotBefore: notBefore, NotAfter: notAfter}
+}
+
+func TestConf_SelectSigningKey(t *testing.T) {
+	now := time.Unix(1000, 0)
+	current := newSigningKey(t, time.Unix(0, 0), time.Unix(2000, 0))
+	next := newSigningKey(t, time.Unix(500, 0), time.Time{})
+	future := newSigningKey(t, time.Unix(1500, 0), time.Time{})
+	conf := &Conf{SigningKeys: []SigningKey{current, next, future}}
+
+	pinsAll := func(ed25519.PublicKey) bool { return true }
+	key, err := conf.SelectSigningKey(now, pinsAll)
+	if err != nil || !key.Ed25519PublicKey.Equal(next.Ed25519PublicKey) {
+		t.Errorf("expected the newest valid pinned key, got %v (%v)", key, err)
+	}
+
+	// A client pinning only the old key keeps working during the overlap
+	key, err = conf.SelectSigningKey(now, nil)
+	if err != nil || !key.Ed25519PublicKey.Equal(current.Ed25519PublicKey) {
+		t.Errorf("expected the longest valid key, got %v (%v)", key, err)
+	}
+
+	if upcoming := conf.UpcomingSigningKeys(time.Unix(2500, 0)); len(upcoming) != 2 {
+		t.Errorf("expected the expired key not to be announced, got %d keys", len(upcoming))
+	}
+
+	if _, err = (&Conf{SigningKeys: []SigningKey{current}}).SelectSigningKey(time.Unix(2500, 0), pinsAll); err == nil {
+		t.Errorf("expected no valid signing key")
+	}
+}
+
+func TestConf_ExternalSigner(t *testing.T) {
+	external := newSigningKey(t, time.Time{}, time.Time{})
+	conf := &Conf{SigningKeys: []SigningKey{{Ed25519PublicKey: external.Ed25519PublicKey}}}
+
+	if len(conf.AllSigningKeys()) != 0 {
+		t.Fatalf("expected key without a signer to be skipped")
+	}
+
+	if err := RegisterSigner(external.Ed25519PrivateKey); err != nil {
+		t.Fatalf("failed to register signer: %s", err)
+	}
+	keys := conf.AllSigningKeys()
+	if len(keys) != 1 {
+		t.Fatalf("expected key with a registered signer, got %d keys", len(keys))
+	}
+
+	signer, err := keys[0].Signer()
+	if err != nil {
+		t.Fatalf("failed to get signer: %s", err)
+	}
+	signature, _ := signer.Sign(rand.Reader, []byte("hello"), crypto.Hash(0))
+	if !ed25519.Verify(external.Ed25519PublicKey, []byte("hello"), signature) {
+		t.Errorf("expected signature of the registered signer")
+	}
+}
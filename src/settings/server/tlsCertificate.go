@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// selfSignedLifetime is how long a generated certificate is valid, clients pin it rather than checking its dates
+	selfSignedLifetime = 10 * 365 * 24 * time.Hour
+	selfSignedName     = "TunGo"
+)
+
+// TLSCertificate returns the certificate the server presents to clients connecting over TLS. Without TLSCertificateFile
+// and TLSKeyFile a self-signed certificate is generated on the first start and kept next to conf.json.
+func (s *Conf) TLSCertificate() (tls.Certificate, error) {
+	if s.TLSCertificateFile != "" || s.TLSKeyFile != "" {
+		return tls.LoadX509KeyPair(s.TLSCertificateFile, s.TLSKeyFile)
+	}
+
+	certificatePath, keyPath, err := getSelfSignedPaths()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certificatePath, keyPath)
+	if err == nil {
+		return certificate, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return tls.Certificate{}, err
+	}
+
+	certificatePEM, keyPEM, err := generateSelfSigned(time.Now())
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate self-signed certificate: %s", err)
+	}
+	err = os.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = os.WriteFile(certificatePath, certificatePEM, 0644)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certificatePEM, keyPEM)
+}
+
+// TLSNames returns the names clients send as SNI, TLSServerNames if set and the DNS names of the certificate otherwise
+func (s *Conf) TLSNames(certificate tls.Certificate) ([]string, error) {
+	if len(s.TLSServerNames) > 0 {
+		return s.TLSServerNames, nil
+	}
+
+	if len(certificate.Certificate) == 0 {
+		return nil, nil
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return leaf.DNSNames, nil
+}
+
+// CertificateFingerprint returns the SHA-256 of the leaf certificate in hex, the value clients pin the certificate with
+func CertificateFingerprint(certificate tls.Certificate) string {
+	if len(certificate.Certificate) == 0 {
+		return ""
+	}
+
+	fingerprint := sha256.Sum256(certificate.Certificate[0])
+	return hex.EncodeToString(fingerprint[:])
+}
+
+func generateSelfSigned(now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: selfSignedName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certificatePEM, keyPEM, nil
+}
+
+func getSelfSignedPaths() (string, string, error) {
+	confPath, err := getServerConfPath()
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Dir(confPath)
+	return filepath.Join(dir, "tls_certificate.pem"), filepath.Join(dir, "tls_key.pem"), nil
+}
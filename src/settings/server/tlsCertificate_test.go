@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestGenerateSelfSigned(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	certificatePEM, keyPEM, err := generateSelfSigned(now)
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %s", err)
+	}
+
+	certificate, err := tls.X509KeyPair(certificatePEM, keyPEM)
+	if err != nil {
+		t.Fatalf("failed to load generated certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse generated certificate: %s", err)
+	}
+	if leaf.NotAfter.Before(now.Add(365*24*time.Hour)) || leaf.NotBefore.After(now) {
+		t.Errorf("unexpected validity: %s to %s", leaf.NotBefore, leaf.NotAfter)
+	}
+
+	if fingerprint := CertificateFingerprint(certificate); len(fingerprint) != 64 {
+		t.Errorf("expected a hex SHA-256 fingerprint, got %q", fingerprint)
+	}
+}
+
+func TestConf_TLSNames(t *testing.T) {
+	certificatePEM, keyPEM, _ := generateSelfSigned(time.Now())
+	certificate, _ := tls.X509KeyPair(certificatePEM, keyPEM)
+
+	conf := &Conf{}
+	if names, err := conf.TLSNames(certificate); err != nil || len(names) != 0 {
+		t.Errorf("expected a self-signed certificate to have no names, got %v, %v", names, err)
+	}
+
+	conf.TLSServerNames = []string{"vpn.example.com"}
+	if names, err := conf.TLSNames(certificate); err != nil || len(names) != 1 || names[0] != "vpn.example.com" {
+		t.Errorf("expected the configured names, got %v, %v", names, err)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// WireGuardPeer is a stock WireGuard client which is allowed to connect to the WireGuard port of the server.
+// PublicKey is the Curve25519 public key from the [Interface] of the client, and StaticIPv4 and StaticIPv6 are the
+// tunnel addresses set as its Address, as WireGuard has no way to hand out addresses. At least one of them is required.
+// To revoke the access of a client, revoke its WireGuard public key, or remove its entry from the server configuration.
+type WireGuardPeer struct {
+	PublicKey    []byte    `json:"PublicKey"`
+	StaticIPv4   string    `json:"StaticIPv4,omitempty"`
+	StaticIPv6   string    `json:"StaticIPv6,omitempty"`
+	PresharedKey []byte    `json:"PresharedKey,omitempty"`
+	NotAfter     time.Time `json:"NotAfter,omitzero"`
+}
+
+// FindWireGuardPeer looks up an allowed WireGuard peer by its public key
+func (s *Conf) FindWireGuardPeer(publicKey []byte) (*WireGuardPeer, bool) {
+	for i := range s.WireGuardPeers {
+		if bytes.Equal(s.WireGuardPeers[i].PublicKey, publicKey) {
+			return &s.WireGuardPeers[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// AuthorizeWireGuardPeer looks up the WireGuard peer of a public key and checks it is neither revoked nor expired.
+// WireGuard keys share the revocation list with client keys, both are 32 bytes.
+func (s *Conf) AuthorizeWireGuardPeer(publicKey []byte, now time.Time) (*WireGuardPeer, error) {
+	if s.IsRevoked(ed25519.PublicKey(publicKey)) {
+		return nil, fmt.Errorf("%w: %s", ErrPeerRevoked, base64.StdEncoding.EncodeToString(publicKey))
+	}
+
+	peer, found := s.FindWireGuardPeer(publicKey)
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, base64.StdEncoding.EncodeToString(publicKey))
+	}
+
+	if !peer.NotAfter.IsZero() && !now.Before(peer.NotAfter) {
+		return nil, fmt.Errorf("%w: %s at %s", ErrPeerExpired, base64.StdEncoding.EncodeToString(publicKey), peer.NotAfter.Format(time.RFC3339))
+	}
+
+	return peer, nil
+}
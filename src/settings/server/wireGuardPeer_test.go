@@ -0,0 +1,36 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConf_AuthorizeWireGuardPeer(t *testing.T) {
+	allowed := bytes.Repeat([]byte{1}, 32)
+	expiring := bytes.Repeat([]byte{2}, 32)
+	revoked := bytes.Repeat([]byte{3}, 32)
+	now := time.Unix(1000, 0)
+	conf := &Conf{
+		WireGuardPeers: []WireGuardPeer{
+			{PublicKey: allowed, StaticIPv4: "10.0.0.2"},
+			{PublicKey: expiring, StaticIPv4: "10.0.0.3", NotAfter: time.Unix(2000, 0)},
+			{PublicKey: revoked, StaticIPv4: "10.0.0.4"},
+		},
+		RevokedPeers: []RevokedPeer{{Ed25519PublicKey: revoked}},
+	}
+
+	if peer, err := conf.AuthorizeWireGuardPeer(allowed, now); err != nil || peer.StaticIPv4 != "10.0.0.2" {
+		t.Errorf("expected the peer to be allowed, got %v", err)
+	}
+	if _, err := conf.AuthorizeWireGuardPeer(expiring, time.Unix(2000, 0)); !errors.Is(err, ErrPeerExpired) {
+		t.Errorf("expected the peer to be expired, got %v", err)
+	}
+	if _, err := conf.AuthorizeWireGuardPeer(revoked, now); !errors.Is(err, ErrPeerRevoked) {
+		t.Errorf("expected the peer to be revoked, got %v", err)
+	}
+	if _, err := conf.AuthorizeWireGuardPeer(bytes.Repeat([]byte{4}, 32), now); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("expected the peer to be unknown, got %v", err)
+	}
+}